@@ -1,20 +1,117 @@
 import { BackendProfile } from "./config";
 
 export type TrafficEntry = {
+  target?: string;
+  source?: "proxy" | "grpc-web" | "connect" | "http";
+  correlationId?: string;
   service: string;
   method: string;
   metadata: Record<string, string[]>;
+  httpHeaders?: Record<string, string[]>;
   request: any;
   response: any;
   error?: string;
+  errorKind?: "transport" | "protocol_mismatch" | "descriptor" | "payload" | "application";
+  errorDetails?: ErrorDetail[];
   startedAt: string;
   duration: number;
+  messages?: StreamLogEntry[];
+};
+
+export type ErrorDetail = {
+  type: string;
+  value?: any;
+  raw?: string;
+};
+
+export type StreamLogEntry = {
+  direction: "send" | "recv";
+  elapsedMs: number;
+  message: any;
 };
 
 export type InvokeRequest = {
+  target?: string;
   fullMethod: string;
   metadata?: Record<string, string>;
   payload: any;
+  timeoutMs?: number;
+  callId?: string;
+  env?: string;
+  variables?: Record<string, string>;
+};
+
+export type VariableSets = {
+  active?: string;
+  sets: Record<string, Record<string, string>>;
+};
+
+export type SavedRequest = {
+  id: string;
+  name: string;
+  description?: string;
+  target?: string;
+  fullMethod: string;
+  env?: string;
+  metadata?: Record<string, string>;
+  payload?: any;
+  timeoutMs?: number;
+  assertions?: Assertion[];
+};
+
+export type Assertion = {
+  status?: string;
+  maxLatencyMs?: number;
+  path?: string;
+  header?: string;
+  trailer?: string;
+  equals?: any;
+  contains?: string;
+  matches?: string;
+  exists?: boolean;
+};
+
+export type CollectionEntry = {
+  id: string;
+  name: string;
+  fullMethod?: string;
+  folder?: string;
+  file: string;
+  modTime: string;
+  error?: string;
+};
+
+export type Collection = {
+  name: string;
+  requests: CollectionEntry[];
+};
+
+export type CollectionEvent = {
+  type: "created" | "updated" | "removed";
+  id: string;
+  file: string;
+  at: string;
+};
+
+export type ServiceHealth = {
+  service: string;
+  status: "SERVING" | "NOT_SERVING" | "SERVICE_UNKNOWN" | "UNKNOWN" | "UNIMPLEMENTED" | "UNREACHABLE";
+  error?: string;
+  at?: string;
+};
+
+export type HealthReport = {
+  live: boolean;
+  ready: boolean;
+  backend: {
+    target: string;
+    addr: string;
+    state: string;
+    status: ServiceHealth["status"];
+    error?: string;
+    services?: ServiceHealth[];
+  };
+  checkedAt: string;
 };
 
 function baseUrl(profile: BackendProfile): string {
@@ -63,3 +160,13 @@ export async function invokeMethod(
   }
   return res.json();
 }
+
+export async function fetchHealth(
+  profile: BackendProfile,
+  healthEndpoint: string
+): Promise<HealthReport> {
+  const res = await fetch(`${baseUrl(profile)}${normalizePath(healthEndpoint || "/healthz")}`);
+  // 503 still carries the report: the inspector is up, the backend is not ready.
+  if (!res.ok && res.status !== 503) throw new Error("Failed to load health");
+  return res.json();
+}
@@ -44,6 +44,41 @@ export async function restartBackend(config: EnvSettings): Promise<void> {
   await invoke("restart_backend", { config: backendConfig });
 }
 
+/**
+ * Apply backend settings to the running Inspector without restarting it.
+ * Returns false if the settings can only take effect after a restart
+ * (the HTTP listen address changed) or the Inspector is not reachable.
+ */
+export async function applyBackendConfig(config: EnvSettings): Promise<boolean> {
+  const endpoint = `${getInspectorBackendAddress()}/inspector/config`;
+  let current: { httpAddr: string };
+  try {
+    const res = await fetch(endpoint);
+    if (!res.ok) return false;
+    current = await res.json();
+  } catch {
+    return false;
+  }
+  if (current.httpAddr !== config.httpAddr) return false;
+
+  const res = await fetch(endpoint, {
+    method: "PUT",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({
+      backendAddr: config.backendAddr.trim().replace(/^https?:\/\//, "").toLowerCase(),
+      useTLS: config.useTLS ?? false,
+      allowOrigins: config.allowOrigins
+        .split(",")
+        .map(o => o.trim())
+        .filter(Boolean),
+    }),
+  });
+  if (!res.ok) {
+    throw new Error((await res.text()) || "Failed to apply settings");
+  }
+  return true;
+}
+
 /**
  * Get the Inspector backend address (where the proxy is running)
  * This is typically http://localhost:8081
@@ -28,6 +28,9 @@ export type MethodDescriptor = {
   displayName: string;
   protocol: string;
   path: string;
+  httpMethod?: string; // REST routes only
+  httpBody?: string; // request field bound to the body of a REST route, or "*"
+  rpc?: string; // method a REST route calls
   requestType?: string;
   responseType?: string;
   schema?: Record<string, unknown>;
@@ -55,6 +58,7 @@ export type InspectorDescriptor = {
   capabilitiesEndpoint: string;
   invokeEndpoint: string;
   healthEndpoint: string;
+  healthWatchEndpoint?: string;
 };
 
 export async function fetchCapabilities(address: string): Promise<CapabilityManifest> {
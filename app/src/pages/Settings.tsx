@@ -7,7 +7,7 @@ import {
   loadEnvSettings,
   saveEnvSettings
 } from "../lib/config";
-import { restartBackend } from "../lib/backend";
+import { applyBackendConfig, restartBackend } from "../lib/backend";
 
 export function Settings({
   profiles,
@@ -55,10 +55,14 @@ export function Settings({
 
   const handleRestartBackend = async () => {
     try {
+      if (await applyBackendConfig(envSettings)) {
+        alert("Settings applied to the running backend");
+        return;
+      }
       await restartBackend(envSettings);
       alert("Backend restarted with new settings");
     } catch (err: any) {
-      alert(`Failed to restart backend: ${err.message}`);
+      alert(`Failed to apply settings: ${err.message}`);
     }
   };
 
@@ -117,10 +121,10 @@ export function Settings({
           <div className="settings__section-heading">
             <div>
               <div className="settings__label">Backend Environment</div>
-              <p>Passed as env vars whenever the Go proxy restarts.</p>
+              <p>Applied to the running Go proxy; changing GRPS_HTTP_ADDR restarts it.</p>
             </div>
             <button className="settings__btn settings__btn--primary" onClick={handleRestartBackend}>
-              Restart backend
+              Apply settings
             </button>
           </div>
 
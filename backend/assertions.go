@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Assertion is one expectation on the outcome of a saved request. It checks
+// exactly one subject: the status code, the latency, or a value selected by
+// Path ("$.user.id", see extractValue), Header or Trailer. A value is compared
+// with Equals, Contains and Matches; without any of them it only has to exist.
+//
+//	assertions:
+//	  - status: NOT_FOUND
+//	  - maxLatencyMs: 250
+//	  - path: $.user.email
+//	    matches: "@example\\.com$"
+//	  - trailer: x-request-id
+//	    exists: true
+type Assertion struct {
+	Status       string  `json:"status,omitempty" yaml:"status,omitempty"` // a gRPC code: OK, NOT_FOUND, NotFound or 5
+	MaxLatencyMs float64 `json:"maxLatencyMs,omitempty" yaml:"maxLatencyMs,omitempty"`
+	Path         string  `json:"path,omitempty" yaml:"path,omitempty"`
+	Header       string  `json:"header,omitempty" yaml:"header,omitempty"`
+	Trailer      string  `json:"trailer,omitempty" yaml:"trailer,omitempty"`
+	Equals       any     `json:"equals,omitempty" yaml:"equals,omitempty"`
+	Contains     string  `json:"contains,omitempty" yaml:"contains,omitempty"`
+	Matches      string  `json:"matches,omitempty" yaml:"matches,omitempty"` // a Go regular expression
+	Exists       *bool   `json:"exists,omitempty" yaml:"exists,omitempty"`
+}
+
+// AssertionResult is the outcome of one Assertion.
+type AssertionResult struct {
+	Assertion string `json:"assertion"` // readable form, e.g. `$.user.id equals "42"`
+	Passed    bool   `json:"passed"`
+	Actual    string `json:"actual,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// validate reports assertions that cannot be evaluated, so that a typo fails
+// when the request is saved rather than when the test runs.
+func (a Assertion) validate() error {
+	subjects := 0
+	for _, set := range []bool{a.Status != "", a.MaxLatencyMs != 0, a.Path != "", a.Header != "", a.Trailer != ""} {
+		if set {
+			subjects++
+		}
+	}
+	if subjects != 1 {
+		return errors.New("an assertion needs exactly one of status, maxLatencyMs, path, header or trailer")
+	}
+	hasMatcher := a.Equals != nil || a.Contains != "" || a.Matches != "" || a.Exists != nil
+	switch {
+	case a.Status != "":
+		if _, ok := parseStatusCode(a.Status); !ok {
+			return fmt.Errorf("unknown status code %q", a.Status)
+		}
+		if hasMatcher {
+			return errors.New("status assertions take no matchers")
+		}
+	case a.MaxLatencyMs != 0:
+		if a.MaxLatencyMs < 0 {
+			return errors.New("maxLatencyMs must not be negative")
+		}
+		if hasMatcher {
+			return errors.New("maxLatencyMs assertions take no matchers")
+		}
+	case a.Path != "":
+		if _, err := parseResponsePath(a.Path); err != nil {
+			return err
+		}
+	}
+	if a.Matches != "" {
+		if _, err := regexp.Compile(a.Matches); err != nil {
+			return fmt.Errorf("matches: %w", err)
+		}
+	}
+	if a.Exists != nil && !*a.Exists && (a.Equals != nil || a.Contains != "" || a.Matches != "") {
+		return errors.New("exists: false cannot be combined with other matchers")
+	}
+	return nil
+}
+
+// String describes the assertion for reports.
+func (a Assertion) String() string {
+	switch {
+	case a.Status != "":
+		return "status is " + a.Status
+	case a.MaxLatencyMs != 0:
+		return fmt.Sprintf("latency <= %gms", a.MaxLatencyMs)
+	}
+	subject := a.subject()
+	var parts []string
+	if a.Exists != nil && !*a.Exists {
+		parts = append(parts, "does not exist")
+	}
+	if a.Equals != nil {
+		want, _ := json.Marshal(a.Equals)
+		parts = append(parts, "equals "+string(want))
+	}
+	if a.Contains != "" {
+		parts = append(parts, "contains "+strconv.Quote(a.Contains))
+	}
+	if a.Matches != "" {
+		parts = append(parts, "matches /"+a.Matches+"/")
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "exists")
+	}
+	return subject + " " + strings.Join(parts, " and ")
+}
+
+// subject is the extractValue path of a value assertion.
+func (a Assertion) subject() string {
+	switch {
+	case a.Header != "":
+		return "$headers." + a.Header
+	case a.Trailer != "":
+		return "$trailers." + a.Trailer
+	}
+	return a.Path
+}
+
+// check evaluates the assertion against a finished call.
+func (a Assertion) check(resp InvokeResponse, latencyMs float64) AssertionResult {
+	res := AssertionResult{Assertion: a.String()}
+	if err := a.validate(); err != nil {
+		res.Message = err.Error()
+		return res
+	}
+
+	switch {
+	case a.Status != "":
+		want, _ := parseStatusCode(a.Status)
+		got := responseCode(resp)
+		res.Actual = got.String()
+		res.Passed = got == want
+		if !res.Passed && resp.Error != nil {
+			res.Message = resp.Error.Message
+		}
+		return res
+	case a.MaxLatencyMs != 0:
+		res.Actual = strconv.FormatFloat(latencyMs, 'f', 3, 64) + "ms"
+		res.Passed = latencyMs <= a.MaxLatencyMs
+		return res
+	}
+
+	got, err := extractValue(resp, a.subject())
+	if a.Exists != nil && !*a.Exists {
+		res.Passed = err != nil
+		if !res.Passed {
+			res.Actual = got
+		}
+		return res
+	}
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	res.Actual = got
+	res.Passed = true
+	if a.Equals != nil && got != expectedString(a.Equals) {
+		res.Passed = false
+	}
+	if a.Contains != "" && !strings.Contains(got, a.Contains) {
+		res.Passed = false
+	}
+	if a.Matches != "" && !regexp.MustCompile(a.Matches).MatchString(got) {
+		res.Passed = false
+	}
+	return res
+}
+
+// expectedString renders an expected value the way extractValue renders the
+// actual one: strings as they are, anything else as JSON. This lets
+// `equals: 42` match both the number 42 and the string "42" that protojson
+// produces for 64-bit integers.
+func expectedString(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// responseCode is the gRPC code of a call, OK if it succeeded.
+func responseCode(resp InvokeResponse) codes.Code {
+	if resp.Error == nil {
+		return codes.OK
+	}
+	if code, ok := parseStatusCode(resp.Error.Code); ok {
+		return code
+	}
+	return codes.Unknown
+}
+
+// parseStatusCode accepts a code as the proto enum name (NOT_FOUND), the Go
+// name (NotFound) or the number (5).
+func parseStatusCode(s string) (codes.Code, bool) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 || n > int(codes.Unauthenticated) {
+			return 0, false
+		}
+		return codes.Code(n), true
+	}
+	want := strings.ToLower(strings.ReplaceAll(s, "_", ""))
+	if want == "cancelled" { // the proto spelling
+		want = "canceled"
+	}
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.ToLower(c.String()) == want {
+			return c, true
+		}
+	}
+	return 0, false
+}
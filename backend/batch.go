@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultBatchConcurrency = 4
+	maxBatchConcurrency     = 64
+	maxBatchSize            = 10000
+)
+
+// BatchResult is one line of the /invoke/batch response, for the input at Index.
+type BatchResult struct {
+	Index int `json:"index"`
+	InvokeResponse
+}
+
+// BatchSummary is the last line of the /invoke/batch response.
+type BatchSummary struct {
+	Total       int            `json:"total"`
+	Succeeded   int            `json:"succeeded"`
+	Failed      int            `json:"failed"`
+	ByCode      map[string]int `json:"byCode"`
+	DurationMs  float64        `json:"durationMs"`
+	Concurrency int            `json:"concurrency"`
+	Rate        float64        `json:"rate,omitempty"`
+	Cancelled   bool           `json:"cancelled,omitempty"` // the client went away before every input ran
+}
+
+// batchOptions are the query parameters of /invoke/batch. target, fullMethod
+// and timeoutMs are defaults for inputs that do not set them.
+type batchOptions struct {
+	Concurrency int
+	Rate        float64 // requests per second; unlimited if zero
+	Target      string
+	FullMethod  string
+	TimeoutMs   int64
+}
+
+func parseBatchOptions(r *http.Request) (batchOptions, error) {
+	q := r.URL.Query()
+	opts := batchOptions{
+		Concurrency: defaultBatchConcurrency,
+		Target:      targetParam(r),
+		FullMethod:  strings.TrimSpace(q.Get("fullMethod")),
+	}
+	if v := q.Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxBatchConcurrency {
+			return opts, fmt.Errorf("concurrency must be between 1 and %d", maxBatchConcurrency)
+		}
+		opts.Concurrency = n
+	}
+	if v := q.Get("rate"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(rate == 0 || rateInterval(rate) > 0) {
+			return opts, fmt.Errorf("rate must be 0 (unlimited) or between %g and %g requests per second", minRate, maxRate)
+		}
+		opts.Rate = rate
+	}
+	if v := q.Get("timeoutMs"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || ms < 0 {
+			return opts, errors.New("timeoutMs must be a non-negative integer")
+		}
+		opts.TimeoutMs = ms
+	}
+	return opts, nil
+}
+
+// readBatchInputs decodes the request body, either a JSON array of
+// InvokeRequest or one InvokeRequest per line (NDJSON).
+func readBatchInputs(body io.Reader) ([]InvokeRequest, error) {
+	br := bufio.NewReader(body)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("the body contains no requests")
+		}
+		return nil, err
+	}
+
+	var inputs []InvokeRequest
+	dec := json.NewDecoder(br)
+	if first == '[' {
+		if err := dec.Decode(&inputs); err != nil {
+			return nil, fmt.Errorf("invalid json array: %w", err)
+		}
+	} else {
+		for {
+			var in InvokeRequest
+			err := dec.Decode(&in)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid ndjson at request %d: %w", len(inputs), err)
+			}
+			inputs = append(inputs, in)
+			if len(inputs) > maxBatchSize {
+				break
+			}
+		}
+	}
+	if len(inputs) > maxBatchSize {
+		return nil, fmt.Errorf("a batch holds at most %d requests", maxBatchSize)
+	}
+	return inputs, nil
+}
+
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
+
+// invokeBatchHandler runs many unary requests and streams the results back
+// as NDJSON in completion order, followed by a summary line.
+func (s *Server) invokeBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	opts, err := parseBatchOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inputs, err := readBatchInputs(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported by this connection", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := r.Context()
+	start := time.Now()
+	results := make(chan BatchResult)
+	go func() {
+		s.runBatch(ctx, inputs, opts, results)
+		close(results)
+	}()
+
+	summary := BatchSummary{Total: len(inputs), ByCode: map[string]int{}, Concurrency: opts.Concurrency, Rate: opts.Rate}
+	enc := json.NewEncoder(w)
+	ran := 0
+	for res := range results {
+		ran++
+		code := codes.OK.String()
+		if res.Error != nil {
+			code = res.Error.Code
+			summary.Failed++
+		} else {
+			summary.Succeeded++
+		}
+		summary.ByCode[code]++
+		_ = enc.Encode(res)
+		flusher.Flush()
+	}
+	summary.DurationMs = durationMs(time.Since(start))
+	summary.Cancelled = ran < len(inputs)
+	_ = enc.Encode(map[string]any{"summary": summary})
+	flusher.Flush()
+}
+
+// Paces in calls per second that a ticker can keep. maxRate is one call per
+// nanosecond; at minRate the interval, about 32 years, still fits a
+// time.Duration.
+const (
+	minRate = 1e-9
+	maxRate = float64(time.Second)
+)
+
+// rateInterval returns the time between calls started at rate calls per
+// second, or zero if rate is not a number between minRate and maxRate.
+func rateInterval(rate float64) time.Duration {
+	if !(rate >= minRate && rate <= maxRate) {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// runBatch sends every input through invokeCall, with at most
+// opts.Concurrency calls in flight and at most opts.Rate calls started per
+// second. It returns once every started call has reported its result.
+func (s *Server) runBatch(ctx context.Context, inputs []InvokeRequest, opts batchOptions, results chan<- BatchResult) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range opts.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results <- BatchResult{Index: i, InvokeResponse: s.batchCall(ctx, inputs[i], opts)}
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(rateInterval(opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+dispatch:
+	for i := range inputs {
+		if tick != nil && i > 0 {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (s *Server) batchCall(ctx context.Context, in InvokeRequest, opts batchOptions) InvokeResponse {
+	if in.Target == "" {
+		in.Target = opts.Target
+	}
+	if in.FullMethod == "" {
+		in.FullMethod = opts.FullMethod
+	}
+	if in.TimeoutMs == 0 {
+		in.TimeoutMs = opts.TimeoutMs
+	}
+	var err error
+	switch {
+	case in.FullMethod == "":
+		err = errors.New("fullMethod is required")
+	case in.TimeoutMs < 0:
+		err = errors.New("timeoutMs must not be negative")
+	}
+	if err != nil {
+		return InvokeResponse{Error: &InvokeError{Kind: errKindPayload, Message: err.Error(), Code: codes.InvalidArgument.String()}}
+	}
+
+	conn, target, err := s.backend(in.Target)
+	if err != nil {
+		ie, _ := newInvokeError(ctx, err, target, nil, false)
+		if errors.Is(err, errUnknownTarget) {
+			ie.Kind, ie.Code = errKindPayload, codes.InvalidArgument.String()
+		}
+		return InvokeResponse{Error: ie}
+	}
+	resp, _, _, err := s.invokeCall(ctx, conn, target, in, "batch")
+	if err != nil {
+		return InvokeResponse{Error: &InvokeError{Kind: errKindPayload, Message: err.Error(), Code: codes.AlreadyExists.String()}}
+	}
+	return resp
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseBatchOptionsRate(t *testing.T) {
+	tests := []struct {
+		rate     string
+		wantErr  bool
+		interval time.Duration
+	}{
+		{"0", false, 0},
+		{"2", false, 500 * time.Millisecond},
+		{"1e9", false, time.Nanosecond},
+		{"1.5e9", true, 0},
+		{"1e-9", false, time.Duration(1e18)},
+		{"1e-12", true, 0},
+		{"1e300", true, 0},
+		{"Inf", true, 0},
+		{"NaN", true, 0},
+		{"-1", true, 0},
+		{"fast", true, 0},
+	}
+	for _, tt := range tests {
+		opts, err := parseBatchOptions(httptest.NewRequest("POST", "/invoke/batch?rate="+tt.rate, nil))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("rate=%s: error = %v, want error %v", tt.rate, err, tt.wantErr)
+			continue
+		}
+		if err == nil && rateInterval(opts.Rate) != tt.interval {
+			t.Errorf("rate=%s: interval = %v, want %v", tt.rate, rateInterval(opts.Rate), tt.interval)
+		}
+	}
+}
@@ -7,10 +7,10 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/types/descriptorpb"
 )
 
@@ -23,6 +23,7 @@ type CapabilityManifest struct {
 	Actions   []ActionDescriptor  `json:"actions,omitempty"`
 	Telemetry TelemetryDescriptor `json:"telemetry"`
 	Inspector InspectorDescriptor `json:"inspector"`
+	Schema    SchemaInfo          `json:"schema"`
 }
 
 type ServiceDescriptor struct {
@@ -37,6 +38,7 @@ type FeatureDescriptor struct {
 	Protocols          []string `json:"protocols"`
 	TrafficFeed        bool     `json:"trafficFeed"`
 	MetadataHeaders    []string `json:"metadataHeaders,omitempty"`
+	Reflection         string   `json:"reflection,omitempty"` // reflection version used: v1 or v1alpha
 }
 
 type MethodDescriptor struct {
@@ -44,6 +46,9 @@ type MethodDescriptor struct {
 	DisplayName       string           `json:"displayName"`
 	Protocol          string           `json:"protocol"`
 	Path              string           `json:"path"`
+	HTTPMethod        string           `json:"httpMethod,omitempty"` // REST routes only
+	HTTPBody          string           `json:"httpBody,omitempty"`   // request field bound to the body of a REST route, or "*"
+	RPC               string           `json:"rpc,omitempty"`        // method a REST route calls
 	RequestType       string           `json:"requestType,omitempty"`
 	ResponseType      string           `json:"responseType,omitempty"`
 	Schema            map[string]any   `json:"schema,omitempty"`
@@ -70,14 +75,23 @@ type TelemetryDescriptor struct {
 type InspectorDescriptor struct {
 	CapabilitiesEndpoint string `json:"capabilitiesEndpoint"`
 	InvokeEndpoint       string `json:"invokeEndpoint"`
+	StreamEndpoint       string `json:"streamEndpoint"`
+	WebSocketEndpoint    string `json:"webSocketEndpoint"`
 	HealthEndpoint       string `json:"healthEndpoint"`
+	HealthWatchEndpoint  string `json:"healthWatchEndpoint"`
+	TargetsEndpoint      string `json:"targetsEndpoint"`
+	DescriptorsEndpoint  string `json:"descriptorsEndpoint"`
+	ConfigEndpoint       string `json:"configEndpoint"`
+	DiagnoseEndpoint     string `json:"diagnoseEndpoint"`
+	SchemaInvalidate     string `json:"schemaInvalidateEndpoint"`
+	Target               string `json:"target"`
 }
 
 func (s *Server) capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
-	// Ensure connection exists and is healthy
 	ctx := r.Context()
-	if err := s.ensureConnection(ctx); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to connect to backend: %v. Please check GRPS_BACKEND_ADDR in Settings.", err), http.StatusServiceUnavailable)
+	conn, target, err := s.backend(targetParam(r))
+	if err != nil {
+		writeBackendError(w, err)
 		return
 	}
 
@@ -89,26 +103,18 @@ func (s *Server) capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	manifest, err := s.buildCapabilityManifest(ctx)
+	manifest, snap, err := s.buildCapabilityManifest(ctx, conn, target)
 	if err != nil {
 		log.Printf("ERROR: failed to collect capabilities: %v", err)
 
-		// Provide helpful error messages for common connection issues
-		errMsg := err.Error()
-		if strings.Contains(errMsg, "connection refused") {
-			errMsg = fmt.Sprintf("Connection refused: The gRPC backend at %s is not running or not accessible. Please:\n1. Ensure your gRPC backend is running\n2. Check that GRPS_BACKEND_ADDR in Settings is correct (currently: %s)\n3. Verify GRPS_BACKEND_USE_TLS matches your backend's TLS configuration\n4. Restart the ServiceLens backend", s.cfg.BackendAddr, s.cfg.BackendAddr)
-		} else if strings.Contains(errMsg, "no such host") {
-			errMsg = fmt.Sprintf("Host not found: The gRPC backend address '%s' is invalid. Please check GRPS_BACKEND_ADDR in Settings.", s.cfg.BackendAddr)
-		} else if strings.Contains(errMsg, "TLS") || strings.Contains(errMsg, "tls") {
-			errMsg = fmt.Sprintf("TLS error: There's a TLS configuration mismatch. Please check GRPS_BACKEND_USE_TLS in Settings (currently: %v) and ensure it matches your gRPC backend's TLS configuration.", s.cfg.UseTLS)
-		} else if strings.Contains(errMsg, "http2") || strings.Contains(errMsg, "HTTP/1.1") || strings.Contains(errMsg, "frame too large") {
-			errMsg = fmt.Sprintf("Protocol mismatch: The address %s appears to be running an HTTP server, not a gRPC server. gRPC requires HTTP/2, but received HTTP/1.1 responses.\n\nPlease verify:\n1. GRPS_BACKEND_ADDR is pointing to a gRPC server (currently: %s)\n2. The server on port 9090 is actually a gRPC server, not an HTTP server\n3. If your gRPC server uses a different port, update GRPS_BACKEND_ADDR in Settings", s.cfg.BackendAddr, s.cfg.BackendAddr)
-		}
-
-		http.Error(w, "failed to collect capabilities: "+errMsg, http.StatusServiceUnavailable)
+		err = schemaError(err)
+		errMsg := errorMessage(classifyError(err, false), err, target)
+		errMsg += fmt.Sprintf("\n\nFor a step-by-step report, open /inspector/diagnose?target=%s.", target.Name)
+		writeClassifiedError(w, "failed to collect capabilities: "+errMsg, err)
 		return
 	}
 
+	snap.setHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(manifest); err != nil {
 		log.Printf("ERROR: failed to encode capabilities manifest: %v", err)
@@ -116,14 +122,14 @@ func (s *Server) capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) buildCapabilityManifest(ctx context.Context) (*CapabilityManifest, error) {
-	methods, err := collectMethods(ctx, s.backendConn, s.cfg.DefaultMD)
+func (s *Server) buildCapabilityManifest(ctx context.Context, conn grpc.ClientConnInterface, target Target) (*CapabilityManifest, *schemaSnapshot, error) {
+	snap, err := s.schema(ctx, conn, target, false)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	methodDescriptors := make([]MethodDescriptor, 0, len(methods))
-	for _, m := range methods {
+	methodDescriptors := make([]MethodDescriptor, 0, len(snap.Methods))
+	for _, m := range snap.Methods {
 		if m.FullName == "" {
 			continue
 		}
@@ -149,6 +155,12 @@ func (s *Server) buildCapabilityManifest(ctx context.Context) (*CapabilityManife
 		})
 	}
 
+	protocols := []string{"grpc"}
+	if s.config().Gateway && len(snap.Routes) > 0 {
+		methodDescriptors = append(methodDescriptors, gatewayMethods(snap)...)
+		protocols = append(protocols, "http")
+	}
+
 	serviceName := os.Getenv("SERVICE_NAME")
 	if serviceName == "" {
 		serviceName = "console"
@@ -168,8 +180,9 @@ func (s *Server) buildCapabilityManifest(ctx context.Context) (*CapabilityManife
 		},
 		Features: FeatureDescriptor{
 			SupportsInvocation: true,
-			Protocols:          []string{"grpc"},
+			Protocols:          protocols,
 			TrafficFeed:        true,
+			Reflection:         snap.Reflection,
 		},
 		Methods: methodDescriptors,
 		Telemetry: TelemetryDescriptor{
@@ -180,11 +193,21 @@ func (s *Server) buildCapabilityManifest(ctx context.Context) (*CapabilityManife
 		Inspector: InspectorDescriptor{
 			CapabilitiesEndpoint: "/inspector/capabilities",
 			InvokeEndpoint:       "/invoke",
+			StreamEndpoint:       "/invoke/stream",
+			WebSocketEndpoint:    "/invoke/ws",
 			HealthEndpoint:       "/healthz",
+			HealthWatchEndpoint:  "/healthz/watch",
+			TargetsEndpoint:      "/targets",
+			DescriptorsEndpoint:  "/schema/descriptors",
+			ConfigEndpoint:       "/inspector/config",
+			DiagnoseEndpoint:     "/inspector/diagnose",
+			SchemaInvalidate:     "/schema/invalidate",
+			Target:               target.Name,
 		},
+		Schema: snap.info(),
 	}
 
-	return manifest, nil
+	return manifest, snap, nil
 }
 
 // findBinaryFields recursively finds all fields of type BYTES in a message descriptor
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runCommand runs a subcommand given on the command line. It reports false if
+// args do not name one, in which case the server starts as usual.
+func runCommand(args []string) (int, bool) {
+	switch args[0] {
+	case "loadtest":
+		return runLoadTestCommand(args[1:], os.Stdout, os.Stderr), true
+	case "test":
+		return runTestCommand(args[1:], os.Stdout, os.Stderr), true
+	case "help", "-h", "-help", "--help":
+		fmt.Fprintln(os.Stdout, "usage: backend [loadtest [flags] | test [flags] <collection>]\n\nWithout a subcommand the inspector server starts. Run `backend loadtest -h` or `backend test -h` for their flags.")
+		return 0, true
+	}
+	return 0, false
+}
+
+// runLoadTestCommand is the command-line equivalent of POST /loadtest. The
+// backend is configured through the usual GRPS_* variables, or -addr.
+func runLoadTestCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		addr        = fs.String("addr", "", "backend address (default GRPS_BACKEND_ADDR)")
+		useTLS      = fs.Bool("tls", false, "connect with TLS")
+		target      = fs.String("target", "", "named target from GRPS_TARGETS")
+		method      = fs.String("method", "", "full method name, e.g. pkg.Service/Method (required)")
+		data        = fs.String("data", "{}", "request payload as JSON")
+		tmpl        = fs.String("template", "", "payload template; {{requestNumber}} and {{workerId}} are filled in per call")
+		mdJSON      = fs.String("metadata", "", `request metadata as a JSON object, e.g. {"authorization":"Bearer ..."}`)
+		requests    = fs.Int("n", defaultLoadTestRequests, "total number of calls")
+		duration    = fs.Duration("duration", 0, "run for this long instead of -n calls")
+		concurrency = fs.Int("c", defaultLoadTestConcurrency, "concurrent workers")
+		rps         = fs.Float64("rps", 0, "calls started per second; unlimited if 0")
+		timeout     = fs.Duration("timeout", 0, "deadline of each call")
+		asJSON      = fs.Bool("json", false, "print the report as JSON")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *method == "" {
+		fmt.Fprintln(stderr, "loadtest: -method is required")
+		fs.Usage()
+		return 2
+	}
+
+	req := LoadTestRequest{
+		Target:          *target,
+		FullMethod:      *method,
+		PayloadTemplate: *tmpl,
+		Requests:        *requests,
+		DurationMs:      duration.Milliseconds(),
+		Concurrency:     *concurrency,
+		RPS:             *rps,
+		TimeoutMs:       timeout.Milliseconds(),
+	}
+	if *tmpl == "" {
+		if err := json.Unmarshal([]byte(*data), &req.Payload); err != nil {
+			fmt.Fprintf(stderr, "loadtest: invalid -data: %v\n", err)
+			return 2
+		}
+	}
+	if *mdJSON != "" {
+		if err := json.Unmarshal([]byte(*mdJSON), &req.Metadata); err != nil {
+			fmt.Fprintf(stderr, "loadtest: invalid -metadata: %v\n", err)
+			return 2
+		}
+	}
+
+	cfg := loadConfig()
+	cfg.SchemaCacheDir = "" // a one-off run should not replace the server's cached schemas
+	if *addr != "" {
+		cfg.BackendAddr = *addr
+	}
+	if *useTLS {
+		cfg.UseTLS = true
+	}
+	if err := validateTarget(cfg.defaultTarget()); err != nil {
+		fmt.Fprintf(stderr, "loadtest: invalid backend settings: %v\n", err)
+		return 2
+	}
+	srv := newServer(cfg)
+	defer srv.conns.closeAll()
+	t, ok := srv.targets.get(*target)
+	if !ok {
+		fmt.Fprintf(stderr, "loadtest: %v %q\n", errUnknownTarget, *target)
+		return 2
+	}
+	if err := srv.loadTargetDescriptors(t); err != nil {
+		fmt.Fprintf(stderr, "loadtest: load descriptors: %v\n", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	lt, _, _, err := srv.prepareLoadTest(ctx, req)
+	if err != nil {
+		fmt.Fprintf(stderr, "loadtest: %s\n", errorMessage(classifyError(err, false), err, t))
+		return 1
+	}
+	fmt.Fprintf(stderr, "Load testing %s on %s with %d workers...\n", lt.fullMethod, t.Addr, lt.req.Concurrency)
+	report := lt.run(ctx, func(p LoadTestProgress) {
+		fmt.Fprintf(stderr, "  %6.1fs  %d done, %d failed, %.0f/s, p99 %.2fms\n", p.ElapsedMs/1000, p.Completed, p.Failed, p.Throughput, p.Latency.P99Ms)
+	})
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		printLoadTestReport(stdout, report)
+	}
+	if report.Cancelled {
+		return 130
+	}
+	return 0
+}
+
+// runTestCommand runs the saved requests of a collection and checks their
+// assertions, for CI. It exits with 1 if any test failed.
+func runTestCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: backend test [flags] <collection>[/folder]")
+		fs.PrintDefaults()
+	}
+	var (
+		addr      = fs.String("addr", "", "backend address (default GRPS_BACKEND_ADDR)")
+		useTLS    = fs.Bool("tls", false, "connect with TLS")
+		target    = fs.String("target", "", "run every request against this named target instead of its own")
+		env       = fs.String("env", "", "variable set to use instead of each request's own")
+		workspace = fs.String("workspace", "", "collections workspace (default GRPS_WORKSPACE_DIR)")
+		junitFile = fs.String("junit", "", "write a JUnit XML report to this file")
+		jsonFile  = fs.String("json", "", "write a JSON report to this file, or - for stdout")
+	)
+	// Flags may follow the collection name, as in `test payments -junit out.xml`.
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg := loadConfig()
+	cfg.SchemaCacheDir = ""
+	if *addr != "" {
+		cfg.BackendAddr = *addr
+	}
+	if *useTLS {
+		cfg.UseTLS = true
+	}
+	if *workspace != "" {
+		cfg.WorkspaceDir = *workspace
+	}
+	if cfg.WorkspaceDir == "" {
+		fmt.Fprintln(stderr, "test: no collections workspace is configured (GRPS_WORKSPACE_DIR or -workspace)")
+		return 2
+	}
+	if err := validateTarget(cfg.defaultTarget()); err != nil {
+		fmt.Fprintf(stderr, "test: invalid backend settings: %v\n", err)
+		return 2
+	}
+	srv := newServer(cfg)
+	defer srv.conns.closeAll()
+	for _, t := range srv.targets.list() {
+		if err := srv.loadTargetDescriptors(t); err != nil {
+			fmt.Fprintf(stderr, "test: load descriptors of %s: %v\n", t.Name, err)
+			return 1
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := srv.runCollectionTests(ctx, TestOptions{Collection: positional[0], Target: *target, Env: *env})
+	if err != nil {
+		fmt.Fprintf(stderr, "test: %v\n", err)
+		return 2
+	}
+
+	if *junitFile != "" {
+		var buf strings.Builder
+		err := writeJUnit(&buf, report)
+		if err == nil {
+			err = os.WriteFile(*junitFile, []byte(buf.String()), 0o644)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "test: write JUnit report: %v\n", err)
+			return 1
+		}
+	}
+	switch *jsonFile {
+	case "":
+	case "-":
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	default:
+		data, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(*jsonFile, append(data, '\n'), 0o644); err != nil {
+			fmt.Fprintf(stderr, "test: write JSON report: %v\n", err)
+			return 1
+		}
+	}
+	if *jsonFile != "-" {
+		printTestReport(stdout, report)
+	}
+
+	if ctx.Err() != nil {
+		return 130
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printTestReport(w io.Writer, r TestReport) {
+	for _, tc := range r.Cases {
+		mark := "PASS"
+		if !tc.Passed {
+			mark = "FAIL"
+		}
+		fmt.Fprintf(w, "%s  %s (%.1fms)\n", mark, tc.ID, tc.DurationMs)
+		if tc.Error != "" {
+			fmt.Fprintf(w, "      %s\n", tc.Error)
+		}
+		for _, a := range tc.Assertions {
+			if a.Passed {
+				continue
+			}
+			fmt.Fprintf(w, "      ✗ %s", a.Assertion)
+			if a.Actual != "" {
+				fmt.Fprintf(w, ", got %s", a.Actual)
+			}
+			if a.Message != "" {
+				fmt.Fprintf(w, ": %s", a.Message)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	fmt.Fprintf(w, "\n%d tests, %d passed, %d failed in %s\n", r.Total, r.Passed, r.Failed, time.Duration(r.DurationMs*float64(time.Millisecond)).Round(time.Millisecond))
+}
+
+func printLoadTestReport(w io.Writer, r LoadTestReport) {
+	fmt.Fprintf(w, "\nSummary:\n")
+	fmt.Fprintf(w, "  Method:      %s (%s)\n", r.FullMethod, r.Target)
+	fmt.Fprintf(w, "  Calls:       %d (%d ok, %d failed)\n", r.Total, r.Succeeded, r.Failed)
+	fmt.Fprintf(w, "  Duration:    %s\n", time.Duration(r.DurationMs*float64(time.Millisecond)).Round(time.Millisecond))
+	fmt.Fprintf(w, "  Throughput:  %.2f calls/s\n", r.Throughput)
+
+	fmt.Fprintf(w, "\nLatency (ms):\n")
+	fmt.Fprintf(w, "  min %.3f  mean %.3f  max %.3f\n", r.Latency.MinMs, r.Latency.MeanMs, r.Latency.MaxMs)
+	fmt.Fprintf(w, "  p50 %.3f  p90 %.3f  p95 %.3f  p99 %.3f\n", r.Latency.P50Ms, r.Latency.P90Ms, r.Latency.P95Ms, r.Latency.P99Ms)
+
+	if len(r.Histogram) > 0 {
+		fmt.Fprintf(w, "\nHistogram:\n")
+		for _, b := range r.Histogram {
+			fmt.Fprintf(w, "  %10.3f [%d]\t|%s\n", b.UpToMs, b.Count, strings.Repeat("■", int(b.Fraction*40+0.5)))
+		}
+	}
+
+	fmt.Fprintf(w, "\nStatus codes:\n")
+	codes := make([]string, 0, len(r.StatusCodes))
+	for code := range r.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  [%s] %d\n", code, r.StatusCodes[code])
+	}
+	if len(r.Errors) > 0 {
+		fmt.Fprintf(w, "\nErrors:\n")
+		for msg, n := range r.Errors {
+			fmt.Fprintf(w, "  [%d] %s\n", n, msg)
+		}
+	}
+}
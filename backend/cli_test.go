@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunTestCommandReportsJUnitWriteFailure(t *testing.T) {
+	workspace := t.TempDir()
+	if err := os.Mkdir(filepath.Join(workspace, "payments"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var stderr strings.Builder
+	junit := filepath.Join(t.TempDir(), "missing", "report.xml")
+	code := runTestCommand([]string{"-addr", closedAddr(t), "-workspace", workspace, "-junit", junit, "payments"}, io.Discard, &stderr)
+	if code != 1 || !strings.Contains(stderr.String(), "write JUnit report") {
+		t.Errorf("runTestCommand() = %d (%q), want 1 with the JUnit write error", code, stderr.String())
+	}
+}
+
+func TestCommandsRejectInvalidBackendTransport(t *testing.T) {
+	t.Setenv("GRPS_BACKEND_TRANSPORT", "h2")
+	var stderr strings.Builder
+	code := runLoadTestCommand([]string{"-addr", closedAddr(t), "-method", "/grpc.health.v1.Health/Check"}, io.Discard, &stderr)
+	if code != 2 || !strings.Contains(stderr.String(), `invalid transport "h2"`) {
+		t.Errorf("loadtest = %d (%q), want 2 with the invalid transport", code, stderr.String())
+	}
+	stderr.Reset()
+	code = runTestCommand([]string{"-addr", closedAddr(t), "-workspace", t.TempDir(), "payments"}, io.Discard, &stderr)
+	if code != 2 || !strings.Contains(stderr.String(), `invalid transport "h2"`) {
+		t.Errorf("test = %d (%q), want 2 with the invalid transport", code, stderr.String())
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// Collections live in a workspace directory: every top-level directory is a
+// collection, nested directories are folders and every .yaml, .yml or .json
+// file is one saved request. A request is identified by its path relative to
+// the workspace without the extension, e.g. "users/admin/get-user".
+
+var (
+	errCollectionNotFound = errors.New("not found")
+	errCollectionConflict = errors.New("conflict")
+
+	collectionSegment = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_. -]*$`)
+	requestExts       = []string{".yaml", ".yml", ".json"}
+)
+
+// SavedRequest is the content of a request file.
+type SavedRequest struct {
+	ID          string            `json:"id" yaml:"-"`
+	Name        string            `json:"name" yaml:"name"`
+	Description string            `json:"description,omitempty" yaml:"description,omitempty"`
+	Target      string            `json:"target,omitempty" yaml:"target,omitempty"`
+	FullMethod  string            `json:"fullMethod" yaml:"fullMethod"`
+	Env         string            `json:"env,omitempty" yaml:"env,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	Payload     map[string]any    `json:"payload,omitempty" yaml:"payload,omitempty"`
+	TimeoutMs   int64             `json:"timeoutMs,omitempty" yaml:"timeoutMs,omitempty"`
+	Assertions  []Assertion       `json:"assertions,omitempty" yaml:"assertions,omitempty"`
+}
+
+// CollectionEntry is a saved request as listed by GET /collections.
+type CollectionEntry struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	FullMethod string    `json:"fullMethod,omitempty"`
+	Folder     string    `json:"folder,omitempty"` // path below the collection
+	File       string    `json:"file"`             // path relative to the workspace
+	ModTime    time.Time `json:"modTime"`
+	Error      string    `json:"error,omitempty"` // the file could not be parsed
+}
+
+// Collection is a top-level directory of the workspace.
+type Collection struct {
+	Name     string            `json:"name"`
+	Requests []CollectionEntry `json:"requests"`
+}
+
+// CollectionEvent reports a change to a request file, whether made through
+// the API or directly on disk (an editor, git checkout, ...).
+type CollectionEvent struct {
+	Type string    `json:"type"` // created, updated or removed
+	ID   string    `json:"id"`
+	File string    `json:"file"`
+	At   time.Time `json:"at"`
+}
+
+// collectionStore reads and writes the request files of a workspace and
+// reports changes to subscribers.
+type collectionStore struct {
+	dir string
+
+	mu   sync.Mutex
+	subs map[chan CollectionEvent]struct{}
+}
+
+func newCollectionStore(dir string) *collectionStore {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			log.Printf("WARNING: collections workspace %s unavailable: %v", dir, err)
+			dir = ""
+		}
+	}
+	return &collectionStore{dir: dir, subs: make(map[chan CollectionEvent]struct{})}
+}
+
+// cleanRequestID validates a request or folder path from a URL.
+func cleanRequestID(id string) (string, error) {
+	id = strings.Trim(id, "/")
+	if id == "" {
+		return "", errors.New("empty path")
+	}
+	for _, seg := range strings.Split(id, "/") {
+		if !collectionSegment.MatchString(seg) {
+			return "", fmt.Errorf("invalid path segment %q", seg)
+		}
+	}
+	return id, nil
+}
+
+func isRequestFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range requestExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// requestFile returns the existing file of a request.
+func (cs *collectionStore) requestFile(id string) (string, bool) {
+	base := filepath.Join(cs.dir, filepath.FromSlash(id))
+	for _, ext := range requestExts {
+		if st, err := os.Stat(base + ext); err == nil && st.Mode().IsRegular() {
+			return base + ext, true
+		}
+	}
+	return "", false
+}
+
+// idOf returns the request ID of a file in the workspace.
+func (cs *collectionStore) idOf(file string) string {
+	rel, err := filepath.Rel(cs.dir, file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(filepath.ToSlash(rel), filepath.Ext(rel))
+}
+
+func readSavedRequest(file string) (SavedRequest, error) {
+	var req SavedRequest
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return req, err
+	}
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		err = json.Unmarshal(data, &req)
+	} else {
+		err = yaml.Unmarshal(data, &req)
+	}
+	if err != nil {
+		return req, fmt.Errorf("parse %s: %w", filepath.Base(file), err)
+	}
+	return req, nil
+}
+
+// list walks the workspace and returns every collection with its requests.
+func (cs *collectionStore) list() ([]Collection, error) {
+	entries, err := os.ReadDir(cs.dir)
+	if err != nil {
+		return nil, err
+	}
+	out := []Collection{}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		c, err := cs.collection(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// collection lists the requests below a collection or folder path.
+func (cs *collectionStore) collection(id string) (Collection, error) {
+	root := filepath.Join(cs.dir, filepath.FromSlash(id))
+	name, _, _ := strings.Cut(id, "/")
+	c := Collection{Name: name, Requests: []CollectionEntry{}}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !isRequestFile(d.Name()) {
+			return nil
+		}
+		entry := CollectionEntry{ID: cs.idOf(p)}
+		entry.File = filepath.ToSlash(strings.TrimPrefix(p, cs.dir+string(filepath.Separator)))
+		if dir := path.Dir(entry.ID); dir != name {
+			entry.Folder = strings.TrimPrefix(dir, name+"/")
+		}
+		if info, err := d.Info(); err == nil {
+			entry.ModTime = info.ModTime()
+		}
+		if req, err := readSavedRequest(p); err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.Name, entry.FullMethod = req.Name, req.FullMethod
+		}
+		if entry.Name == "" {
+			entry.Name = path.Base(entry.ID)
+		}
+		c.Requests = append(c.Requests, entry)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, fmt.Errorf("collection %q: %w", id, errCollectionNotFound)
+	}
+	sort.Slice(c.Requests, func(i, j int) bool { return c.Requests[i].ID < c.Requests[j].ID })
+	return c, err
+}
+
+func (cs *collectionStore) get(id string) (SavedRequest, error) {
+	file, ok := cs.requestFile(id)
+	if !ok {
+		return SavedRequest{}, fmt.Errorf("request %q: %w", id, errCollectionNotFound)
+	}
+	req, err := readSavedRequest(file)
+	req.ID = id
+	return req, err
+}
+
+// put writes a request, keeping the format of an existing file. New files
+// are written as YAML unless format is "json".
+func (cs *collectionStore) put(id string, req SavedRequest, format string) (SavedRequest, error) {
+	if !strings.Contains(id, "/") {
+		return req, errors.New("requests are saved inside a collection: use <collection>/<request>")
+	}
+	if req.FullMethod == "" {
+		return req, errors.New("fullMethod is required")
+	}
+	for i, a := range req.Assertions {
+		if err := a.validate(); err != nil {
+			return req, fmt.Errorf("assertion %d: %w", i, err)
+		}
+	}
+	if req.Name == "" {
+		req.Name = path.Base(id)
+	}
+	file, exists := cs.requestFile(id)
+	if !exists {
+		ext := ".yaml"
+		if format == "json" {
+			ext = ".json"
+		}
+		file = filepath.Join(cs.dir, filepath.FromSlash(id)) + ext
+		if st, err := os.Stat(strings.TrimSuffix(file, ext)); err == nil && st.IsDir() {
+			return req, fmt.Errorf("%q is a folder: %w", id, errCollectionConflict)
+		}
+	}
+
+	var data []byte
+	var err error
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		data, err = json.MarshalIndent(req, "", "  ")
+		data = append(data, '\n')
+	} else {
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		err = enc.Encode(req)
+		data = buf.Bytes()
+	}
+	if err != nil {
+		return req, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return req, err
+	}
+	if err := writeFileAtomic(file, data, 0o644); err != nil {
+		return req, err
+	}
+	req.ID = id
+	return req, nil
+}
+
+// remove deletes a request, or a folder or collection. Folders that are not
+// empty are only removed if recursive is set.
+func (cs *collectionStore) remove(id string, recursive bool) error {
+	if file, ok := cs.requestFile(id); ok {
+		return os.Remove(file)
+	}
+	dir := filepath.Join(cs.dir, filepath.FromSlash(id))
+	st, err := os.Stat(dir)
+	if err != nil || !st.IsDir() {
+		return fmt.Errorf("%q: %w", id, errCollectionNotFound)
+	}
+	if recursive {
+		return os.RemoveAll(dir)
+	}
+	if err := os.Remove(dir); err != nil {
+		return fmt.Errorf("folder %q is not empty; pass recursive=true: %w", id, errCollectionConflict)
+	}
+	return nil
+}
+
+func (cs *collectionStore) subscribe() (<-chan CollectionEvent, func()) {
+	ch := make(chan CollectionEvent, 64)
+	cs.mu.Lock()
+	cs.subs[ch] = struct{}{}
+	cs.mu.Unlock()
+	return ch, func() {
+		cs.mu.Lock()
+		delete(cs.subs, ch)
+		cs.mu.Unlock()
+	}
+}
+
+func (cs *collectionStore) publish(ev CollectionEvent) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for ch := range cs.subs {
+		select {
+		case ch <- ev:
+		default: // a slow subscriber misses events rather than blocking the watcher
+		}
+	}
+}
+
+// watchDebounce coalesces the burst of events an editor or git produces for
+// one file (create, write, chmod, rename) into one CollectionEvent.
+const watchDebounce = 100 * time.Millisecond
+
+// watch reports changes to request files until done is closed. fsnotify
+// watches single directories, so every directory of the workspace is added,
+// including ones created later.
+func (cs *collectionStore) watch(done <-chan struct{}) error {
+	if cs.dir == "" {
+		return nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	cw := &collectionWatcher{store: cs, fs: w, known: map[string]bool{}, pending: map[string]string{}}
+	cw.addTree(cs.dir, false)
+	go cw.run(done)
+	return nil
+}
+
+type collectionWatcher struct {
+	store   *collectionStore
+	fs      *fsnotify.Watcher
+	known   map[string]bool   // request files seen so far, to tell created from updated
+	pending map[string]string // file -> event type, waiting for the debounce
+}
+
+// addTree watches root and its directories. Request files found in a
+// directory that appeared after startup are reported as created, since their
+// own events happened before the directory was watched.
+func (cw *collectionWatcher) addTree(root string, report bool) {
+	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != cw.store.dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			if isRequestFile(p) {
+				if report && !cw.known[p] {
+					cw.pending[p] = "created"
+				}
+				cw.known[p] = true
+			}
+			return nil
+		}
+		if err := cw.fs.Add(p); err != nil {
+			log.Printf("WARNING: cannot watch %s: %v", p, err)
+		}
+		return nil
+	})
+}
+
+func (cw *collectionWatcher) run(done <-chan struct{}) {
+	defer cw.fs.Close()
+	var flush <-chan time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case err, ok := <-cw.fs.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("WARNING: collections watcher: %v", err)
+		case ev, ok := <-cw.fs.Events:
+			if !ok {
+				return
+			}
+			cw.handle(ev)
+			if len(cw.pending) > 0 && flush == nil {
+				flush = time.After(watchDebounce)
+			}
+		case <-flush:
+			flush = nil
+			now := time.Now().UTC()
+			for file, typ := range cw.pending {
+				rel, _ := filepath.Rel(cw.store.dir, file)
+				cw.store.publish(CollectionEvent{Type: typ, ID: cw.store.idOf(file), File: filepath.ToSlash(rel), At: now})
+			}
+			clear(cw.pending)
+		}
+	}
+}
+
+func (cw *collectionWatcher) handle(ev fsnotify.Event) {
+	if strings.HasPrefix(filepath.Base(ev.Name), ".") {
+		return
+	}
+	if ev.Has(fsnotify.Create) {
+		if st, err := os.Stat(ev.Name); err == nil && st.IsDir() {
+			cw.addTree(ev.Name, true)
+			return
+		}
+	}
+	if !isRequestFile(ev.Name) {
+		return
+	}
+	switch {
+	case ev.Has(fsnotify.Remove), ev.Has(fsnotify.Rename):
+		if _, err := os.Stat(ev.Name); err == nil {
+			return // replaced in place; the Create that follows reports it
+		}
+		if cw.pending[ev.Name] == "created" || !cw.known[ev.Name] {
+			delete(cw.pending, ev.Name) // created and removed within the debounce
+		} else {
+			cw.pending[ev.Name] = "removed"
+		}
+		delete(cw.known, ev.Name)
+	case ev.Has(fsnotify.Create), ev.Has(fsnotify.Write):
+		if cw.pending[ev.Name] == "created" {
+			return
+		}
+		if cw.known[ev.Name] {
+			cw.pending[ev.Name] = "updated"
+		} else {
+			cw.pending[ev.Name] = "created"
+		}
+		cw.known[ev.Name] = true
+	}
+}
+
+// writeCollectionError maps store errors to HTTP statuses.
+func writeCollectionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errCollectionNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errCollectionConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// collectionsHandler lists every collection. With ?watch=true it streams
+// CollectionEvents as Server-Sent Events instead.
+func (s *Server) collectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.collections.dir == "" {
+		http.Error(w, "no collections workspace is configured (GRPS_WORKSPACE_DIR)", http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Query().Get("watch") != "true" {
+		list, err := s.collections.list()
+		if err != nil {
+			writeCollectionError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	events, unsubscribe := s.collections.subscribe()
+	defer unsubscribe()
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "streaming is not supported by this connection", http.StatusInternalServerError)
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			if err := sse.send("change", ev); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// collectionHandler serves /collections/{path}: GET returns a request or the
+// listing of a collection or folder, PUT saves a request and DELETE removes a
+// request, or a folder with ?recursive=true.
+func (s *Server) collectionHandler(w http.ResponseWriter, r *http.Request) {
+	if s.collections.dir == "" {
+		http.Error(w, "no collections workspace is configured (GRPS_WORKSPACE_DIR)", http.StatusServiceUnavailable)
+		return
+	}
+	id, err := cleanRequestID(strings.TrimPrefix(r.URL.Path, "/collections/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if req, err := s.collections.get(id); err == nil {
+			writeJSON(w, http.StatusOK, req)
+			return
+		} else if !errors.Is(err, errCollectionNotFound) {
+			writeCollectionError(w, err)
+			return
+		}
+		c, err := s.collections.collection(id)
+		if err != nil {
+			writeCollectionError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+	case http.MethodPut, http.MethodPost:
+		var req SavedRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		saved, err := s.collections.put(id, req, r.URL.Query().Get("format"))
+		if errors.Is(err, errCollectionConflict) {
+			writeCollectionError(w, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, saved)
+	case http.MethodDelete:
+		if err := s.collections.remove(id, r.URL.Query().Get("recursive") == "true"); err != nil {
+			writeCollectionError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
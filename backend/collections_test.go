@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanRequestID(t *testing.T) {
+	tests := []struct {
+		id, want string
+		ok       bool
+	}{
+		{id: "users/get-user", want: "users/get-user", ok: true},
+		{id: "/users/admin/get user/", want: "users/admin/get user", ok: true},
+		{id: "v1.2/list_all", want: "v1.2/list_all", ok: true},
+		{id: ""},
+		{id: "/"},
+		{id: ".."},
+		{id: "users/../../etc/passwd"},
+		{id: "users/./get-user"},
+		{id: "users//get-user"},
+		{id: "users/.hidden"},
+		{id: `users\..\secret`},
+		{id: "-users/get"},
+		{id: "users/get:1"},
+	}
+	for _, tt := range tests {
+		got, err := cleanRequestID(tt.id)
+		if tt.ok != (err == nil) || got != tt.want && tt.ok {
+			t.Errorf("cleanRequestID(%q) = %q, %v; want %q ok=%v", tt.id, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCollectionHandlerRejectsInvalidPaths(t *testing.T) {
+	root := t.TempDir()
+	workspace := filepath.Join(root, "workspace")
+	outside := filepath.Join(root, "secret.yaml")
+	if err := os.WriteFile(outside, []byte("name: secret\nfullMethod: s/M\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(Config{WorkspaceDir: workspace})
+	t.Cleanup(srv.conns.closeAll)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.collectionHandler(rec, httptest.NewRequest(method, target, bytes.NewReader([]byte(body))))
+		return rec
+	}
+	const body = `{"fullMethod":"grpc.health.v1.Health/Check"}`
+	for _, target := range []string{
+		"/collections/../secret",
+		"/collections/users/../../secret",
+		"/collections/users/%2E%2E/%2E%2E/secret",
+		"/collections/users/%2F/secret",
+		"/collections/users/.hidden",
+		"/collections/",
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+			if rec := do(method, target, body); rec.Code != http.StatusBadRequest {
+				t.Errorf("%s %s = %d %s, want 400", method, target, rec.Code, rec.Body)
+			}
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside the workspace: %v", err)
+	}
+	if entries, _ := os.ReadDir(workspace); len(entries) != 0 {
+		t.Errorf("workspace = %v, want nothing written", entries)
+	}
+
+	if rec := do(http.MethodPut, "/collections/users/get-user", body); rec.Code != http.StatusOK {
+		t.Fatalf("PUT a valid request = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, "/collections/users/get-user", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET a valid request = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodDelete, "/collections/users/get-user", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE a valid request = %d %s", rec.Code, rec.Body)
+	}
+}
+
+// collectEvents returns the events published until none has arrived for a
+// few debounce periods.
+func collectEvents(t *testing.T, events <-chan CollectionEvent) []CollectionEvent {
+	t.Helper()
+	var got []CollectionEvent
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+		case <-time.After(3 * watchDebounce):
+			return got
+		case <-deadline:
+			t.Fatalf("events kept coming: %+v", got)
+		}
+	}
+}
+
+func TestCollectionWatchDebouncesFileWrites(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "users"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	store := newCollectionStore(dir)
+	events, unsubscribe := store.subscribe()
+	defer unsubscribe()
+	done := make(chan struct{})
+	defer close(done)
+	if err := store.watch(done); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "users", "get-user.yaml")
+	expectOne := func(step, typ string) {
+		t.Helper()
+		got := collectEvents(t, events)
+		if len(got) != 1 {
+			t.Fatalf("%s: events = %+v, want exactly one", step, got)
+		}
+		if ev := got[0]; ev.Type != typ || ev.ID != "users/get-user" || ev.File != "users/get-user.yaml" {
+			t.Errorf("%s: event = %+v, want %s users/get-user", step, ev, typ)
+		}
+	}
+
+	// An editor's save: create, several writes and a chmod.
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range []string{"name: get user\n", "fullMethod: users.Users/Get\n", "payload: {}\n"} {
+		if _, err := f.WriteString(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	if err := os.Chmod(file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expectOne("create", "created")
+
+	// The API's atomic write replaces the file through a rename.
+	if _, err := store.put("users/get-user", SavedRequest{FullMethod: "users.Users/Get"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	expectOne("rewrite", "updated")
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	expectOne("remove", "removed")
+
+	// A file that comes and goes within the debounce is not reported.
+	if err := os.WriteFile(file, []byte("name: x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := collectEvents(t, events); len(got) != 0 {
+		t.Errorf("events for a short-lived file = %+v, want none", got)
+	}
+
+	// Non-request files are ignored.
+	if err := os.WriteFile(filepath.Join(dir, "users", "notes.txt"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := collectEvents(t, events); len(got) != 0 {
+		t.Errorf("events for a non-request file = %+v, want none", got)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// RuntimeConfig is the view of Config exposed by /inspector/config.
+type RuntimeConfig struct {
+	BackendAddr         string              `json:"backendAddr"`
+	UseTLS              bool                `json:"useTLS"`
+	ServerName          string              `json:"serverName,omitempty"`
+	CAFile              string              `json:"caFile,omitempty"`
+	CertFile            string              `json:"certFile,omitempty"`
+	KeyFile             string              `json:"keyFile,omitempty"`
+	InsecureSkipVerify  bool                `json:"insecureSkipVerify"`
+	Transport           string              `json:"transport,omitempty"`
+	DefaultMetadata     map[string][]string `json:"defaultMetadata"`
+	AllowOrigins        []string            `json:"allowOrigins"`
+	AutoAllowDevOrigins bool                `json:"autoAllowDevOrigins"`
+	HTTPAddr            string              `json:"httpAddr"` // read-only
+	GRPCAddr            string              `json:"grpcAddr"` // read-only
+}
+
+// ConfigUpdate is the body accepted by PUT /inspector/config. Fields that are
+// omitted keep their current value.
+type ConfigUpdate struct {
+	BackendAddr         *string              `json:"backendAddr"`
+	UseTLS              *bool                `json:"useTLS"`
+	ServerName          *string              `json:"serverName"`
+	CAFile              *string              `json:"caFile"`
+	CertFile            *string              `json:"certFile"`
+	KeyFile             *string              `json:"keyFile"`
+	InsecureSkipVerify  *bool                `json:"insecureSkipVerify"`
+	Transport           *string              `json:"transport"`
+	DefaultMetadata     *map[string][]string `json:"defaultMetadata"`
+	AllowOrigins        *[]string            `json:"allowOrigins"`
+	AutoAllowDevOrigins *bool                `json:"autoAllowDevOrigins"`
+}
+
+// config returns a copy of the current configuration.
+func (s *Server) config() Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg.clone()
+}
+
+// clone returns a copy of cfg that shares no slices or maps with it.
+func (cfg Config) clone() Config {
+	cfg.AllowOrigin = append([]string(nil), cfg.AllowOrigin...)
+	cfg.DefaultMD = cfg.DefaultMD.Copy()
+	return cfg
+}
+
+func (cfg Config) runtimeView() RuntimeConfig {
+	allow := cfg.AllowOrigin
+	if allow == nil {
+		allow = []string{}
+	}
+	md := metadataToMap(cfg.DefaultMD)
+	if md == nil {
+		md = map[string][]string{}
+	}
+	return RuntimeConfig{
+		BackendAddr:         cfg.BackendAddr,
+		UseTLS:              cfg.UseTLS,
+		ServerName:          cfg.ServerName,
+		CAFile:              cfg.CAFile,
+		CertFile:            cfg.CertFile,
+		KeyFile:             cfg.KeyFile,
+		InsecureSkipVerify:  cfg.InsecureSkipVerify,
+		Transport:           cfg.Transport,
+		DefaultMetadata:     md,
+		AllowOrigins:        allow,
+		AutoAllowDevOrigins: cfg.AutoAllowDev,
+		HTTPAddr:            cfg.HTTPAddr,
+		GRPCAddr:            cfg.GRPCAddr,
+	}
+}
+
+// apply returns cfg with the update applied. As at startup, TLS material
+// implies TLS. It does not validate the result.
+func (u ConfigUpdate) apply(cfg Config) Config {
+	if u.BackendAddr != nil {
+		cfg.BackendAddr = strings.TrimSpace(*u.BackendAddr)
+	}
+	if u.UseTLS != nil {
+		cfg.UseTLS = *u.UseTLS
+	}
+	if u.ServerName != nil {
+		cfg.ServerName = strings.TrimSpace(*u.ServerName)
+	}
+	if u.CAFile != nil {
+		cfg.CAFile = strings.TrimSpace(*u.CAFile)
+	}
+	if u.CertFile != nil {
+		cfg.CertFile = strings.TrimSpace(*u.CertFile)
+	}
+	if u.KeyFile != nil {
+		cfg.KeyFile = strings.TrimSpace(*u.KeyFile)
+	}
+	if u.InsecureSkipVerify != nil {
+		cfg.InsecureSkipVerify = *u.InsecureSkipVerify
+	}
+	if u.Transport != nil {
+		cfg.Transport = strings.TrimSpace(*u.Transport)
+	}
+	if u.DefaultMetadata != nil {
+		md := metadata.MD{}
+		for k, vals := range *u.DefaultMetadata {
+			for _, v := range vals {
+				md.Append(strings.TrimSpace(k), strings.TrimSpace(v))
+			}
+		}
+		cfg.DefaultMD = md
+	}
+	if u.AllowOrigins != nil {
+		cfg.AllowOrigin = nil
+		for _, o := range *u.AllowOrigins {
+			if o = strings.TrimSpace(o); o != "" {
+				cfg.AllowOrigin = append(cfg.AllowOrigin, o)
+			}
+		}
+	}
+	if u.AutoAllowDevOrigins != nil {
+		cfg.AutoAllowDev = *u.AutoAllowDevOrigins
+	}
+	cfg.implyTLS()
+	return cfg
+}
+
+// validateConfig checks the runtime-changeable parts of cfg.
+func validateConfig(cfg Config) error {
+	if err := validateTarget(cfg.defaultTarget()); err != nil {
+		return err
+	}
+	if sameHostPort(cfg.BackendAddr, cfg.HTTPAddr) || sameHostPort(cfg.BackendAddr, cfg.GRPCAddr) {
+		return fmt.Errorf("backendAddr %s points at the inspector itself; it should be the address of your gRPC server", cfg.BackendAddr)
+	}
+	for key, vals := range cfg.DefaultMD {
+		if key == "" || strings.ContainsAny(key, " :\t") {
+			return fmt.Errorf("invalid metadata key %q", key)
+		}
+		for _, v := range vals {
+			if v == "" {
+				return fmt.Errorf("metadata %q has an empty value", key)
+			}
+		}
+	}
+	for _, origin := range cfg.AllowOrigin {
+		if origin != "*" && !strings.Contains(origin, "://") {
+			return fmt.Errorf("invalid origin %q: expected a scheme such as http://", origin)
+		}
+	}
+	return nil
+}
+
+// sameHostPort reports whether addr refers to the local listen address listen.
+func sameHostPort(addr, listen string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	lhost, lport, err := net.SplitHostPort(listen)
+	if err != nil || port != lport {
+		return false
+	}
+	isLocal := func(h string) bool {
+		return h == "" || h == "localhost" || h == "0.0.0.0" || h == "::" || h == "::1" || strings.HasPrefix(h, "127.")
+	}
+	return (lhost == "" || isLocal(lhost)) && isLocal(host)
+}
+
+// updateConfig applies fn to the current configuration, then validates and
+// installs the result. The default target is updated so the connection
+// manager swaps the backend connection; the traffic buffer is kept. The new
+// backend is dialed first, so a config that fails leaves everything as it
+// was. All of it happens under cfgMu, so concurrent updates cannot overwrite
+// each other. It returns the configuration before and after the update.
+func (s *Server) updateConfig(fn func(Config) Config) (before, next Config, err error) {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+	before = s.cfg.clone()
+	next = fn(s.cfg.clone())
+	if err := validateConfig(next); err != nil {
+		return before, before, err
+	}
+	def := next.defaultTarget()
+	if _, err := s.conns.get(def); err != nil {
+		return before, before, err
+	}
+	if err := s.targets.put(def); err != nil {
+		return before, before, err
+	}
+	s.cfg = next
+	s.schemas.invalidate(def.Name)
+	return before, next, nil
+}
+
+// configHandler serves GET and PUT on /inspector/config.
+func (s *Server) configHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.config().runtimeView())
+	case http.MethodPut, http.MethodPatch:
+		var update ConfigUpdate
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&update); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		before, next, err := s.updateConfig(update.apply)
+		if err != nil {
+			http.Error(w, "invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Configuration updated: %s", strings.Join(changedFields(before, next), ", "))
+		writeJSON(w, http.StatusOK, next.runtimeView())
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// changedFields lists the runtime config fields that differ between a and b.
+func changedFields(a, b Config) []string {
+	av, bv := a.runtimeView(), b.runtimeView()
+	aj, _ := json.Marshal(av)
+	bj, _ := json.Marshal(bv)
+	var am, bm map[string]json.RawMessage
+	_ = json.Unmarshal(aj, &am)
+	_ = json.Unmarshal(bj, &bm)
+	var out []string
+	for k, v := range bm {
+		if string(am[k]) != string(v) {
+			out = append(out, k)
+		}
+	}
+	if len(out) == 0 {
+		return []string{"no changes"}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestConfigUpdateImpliesTLS(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := writeTestFile(t, "ca.pem", ca.certPEM)
+	tests := []struct {
+		name   string
+		update ConfigUpdate
+		want   bool
+	}{
+		{"CA bundle", ConfigUpdate{CAFile: &caFile}, true},
+		{"skip verify", ConfigUpdate{InsecureSkipVerify: ptr(true)}, true},
+		{"address only", ConfigUpdate{BackendAddr: ptr("localhost:50052")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.update.apply(Config{BackendAddr: "localhost:50051"})
+			if cfg.UseTLS != tt.want {
+				t.Errorf("UseTLS = %v, want %v", cfg.UseTLS, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigHandlerKeepsConfigOnError(t *testing.T) {
+	addr, _, _ := startTestBackend(t)
+	srv := newServer(Config{BackendAddr: addr, HTTPAddr: ":8081", GRPCAddr: ":50055"})
+	defer srv.conns.closeAll()
+
+	put := func(body string) int {
+		rec := httptest.NewRecorder()
+		srv.configHandler(rec, httptest.NewRequest(http.MethodPut, "/inspector/config", bytes.NewBufferString(body)))
+		return rec.Code
+	}
+	if code := put(`{"backendAddr":"localhost:8081"}`); code != http.StatusBadRequest {
+		t.Fatalf("PUT pointing at the inspector = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := put(`{"caFile":"/nonexistent/ca.pem"}`); code != http.StatusBadRequest {
+		t.Fatalf("PUT with a missing CA bundle = %d, want %d", code, http.StatusBadRequest)
+	}
+	if got := srv.config(); got.BackendAddr != addr || got.UseTLS || got.CAFile != "" {
+		t.Errorf("rejected updates were applied: %+v", got.runtimeView())
+	}
+	if def, _ := srv.targets.get(""); def.Addr != addr || def.UseTLS {
+		t.Errorf("rejected updates changed the default target: %+v", def)
+	}
+
+	if code := put(`{"backendAddr":"127.0.0.1:1"}`); code != http.StatusOK {
+		t.Fatalf("valid PUT = %d, want %d", code, http.StatusOK)
+	}
+	if def, _ := srv.targets.get(""); def.Addr != "127.0.0.1:1" || srv.config().BackendAddr != "127.0.0.1:1" {
+		t.Errorf("valid update was not applied to both the config and the default target: %+v", def)
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestConcurrentConfigUpdatesKeepEveryField(t *testing.T) {
+	addr, _, _ := startTestBackend(t)
+	updates := []string{
+		`{"allowOrigins":["http://a.test"]}`,
+		`{"serverName":"backend.test"}`,
+		`{"defaultMetadata":{"x-team":["core"]}}`,
+		`{"autoAllowDevOrigins":false}`,
+	}
+	for range 50 {
+		srv := newServer(Config{BackendAddr: addr, HTTPAddr: ":8081", GRPCAddr: ":50055", AutoAllowDev: true})
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for _, body := range updates {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				rec := httptest.NewRecorder()
+				srv.configHandler(rec, httptest.NewRequest(http.MethodPatch, "/inspector/config", bytes.NewBufferString(body)))
+				if rec.Code != http.StatusOK {
+					t.Errorf("PATCH %s = %d %s", body, rec.Code, rec.Body)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		cfg := srv.config()
+		if len(cfg.AllowOrigin) != 1 || cfg.ServerName != "backend.test" || len(cfg.DefaultMD.Get("x-team")) != 1 || cfg.AutoAllowDev {
+			t.Fatalf("an update was lost: %+v", cfg.runtimeView())
+		}
+		if def, _ := srv.targets.get(""); def.ServerName != "backend.test" {
+			t.Fatalf("default target lost the server name: %+v", def)
+		}
+		srv.conns.closeAll()
+	}
+}
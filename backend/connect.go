@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The Connect protocol (connectrpc.com) is accepted on the HTTP listener for
+// any method in the schema: unary calls as POST or GET with application/json
+// or application/proto, and server-streaming calls as POST with
+// application/connect+json or application/connect+proto. Calls are relayed to
+// the backend over the target's transport, like gRPC-Web calls.
+
+const trafficSourceConnect = "connect"
+
+// connectMaxMessageBytes limits a request message.
+const connectMaxMessageBytes = 16 << 20
+
+// Envelope flags of Connect streaming messages.
+const (
+	connectFlagCompressed = 0x01
+	connectFlagEndStream  = 0x02
+)
+
+// connectProtocolHeaders are HTTP headers of the protocol itself rather than
+// call metadata, so they are not forwarded to the backend.
+var connectProtocolHeaders = map[string]bool{
+	"accept": true, "accept-encoding": true, "connection": true, "content-encoding": true,
+	"content-length": true, "content-type": true, "host": true, "keep-alive": true,
+	"origin": true, "referer": true, "te": true, "trailer": true, "transfer-encoding": true,
+	"upgrade": true, "user-agent": true,
+	"connect-protocol-version": true, "connect-timeout-ms": true,
+	"connect-content-encoding": true, "connect-accept-encoding": true,
+	targetHeader: true,
+}
+
+// connectRequest is a Connect call parsed from an HTTP request.
+type connectRequest struct {
+	fullMethod string
+	codec      string // json or proto
+	streaming  bool
+	message    []byte // as sent, in codec
+}
+
+// isConnectRequest reports whether r looks like a Connect call: a request
+// for /package.Service/Method with a Connect content type, or a GET with the
+// Connect query parameters.
+func isConnectRequest(r *http.Request) bool {
+	if strings.Count(r.URL.Path, "/") != 2 || strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		return q.Get("connect") == "v1" || (q.Has("message") && q.Has("encoding"))
+	case http.MethodPost:
+		_, _, ok := connectContentType(r.Header.Get("Content-Type"))
+		return ok
+	case http.MethodOptions:
+		return r.Header.Get("Access-Control-Request-Method") != "" && r.Header.Get("Origin") != ""
+	}
+	return false
+}
+
+// connectContentType returns the codec and whether the content type is a
+// streaming one.
+func connectContentType(ct string) (codec string, streaming, ok bool) {
+	ct, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(ct)), ";")
+	switch strings.TrimSpace(ct) {
+	case "application/json":
+		return "json", false, true
+	case "application/proto":
+		return "proto", false, true
+	case "application/connect+json":
+		return "json", true, true
+	case "application/connect+proto":
+		return "proto", true, true
+	}
+	return "", false, false
+}
+
+func connectResponseContentType(codec string, streaming bool) string {
+	if streaming {
+		return "application/connect+" + codec
+	}
+	return "application/" + codec
+}
+
+// setCallCORSHeaders answers CORS for a relayed call, allowing methods on
+// preflights. Origins are checked like the other endpoints, through
+// allowOrigin.
+func (s *Server) setCallCORSHeaders(w http.ResponseWriter, r *http.Request, methods string) {
+	if origin := r.Header.Get("Origin"); origin != "" && s.allowOrigin(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", "*")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+			w.Header().Set("Access-Control-Max-Age", "600")
+		}
+	}
+}
+
+// connectHandler serves Connect calls.
+func (s *Server) connectHandler(w http.ResponseWriter, r *http.Request) {
+	s.setCallCORSHeaders(w, r, "GET,POST")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	req, err := parseConnectRequest(r)
+	if err != nil {
+		writeConnectError(w, nil, err)
+		return
+	}
+	targetName := s.config().ProxyTarget
+	if name := r.Header.Get(targetHeader); name != "" {
+		targetName = name
+	}
+	conn, target, err := s.backend(targetName)
+	if err != nil {
+		writeConnectError(w, nil, status.Errorf(codes.Unavailable, "%v", err))
+		return
+	}
+	ctx := r.Context()
+	methodDesc, _, err := s.resolveMethod(ctx, conn, target, req.fullMethod)
+	if err != nil {
+		ie, _ := newInvokeError(ctx, err, target, nil, false)
+		code, _ := parseStatusCode(ie.Code)
+		if ie.Kind == errKindDescriptor {
+			code = codes.Unimplemented
+		}
+		writeConnectError(w, nil, status.Error(code, ie.Message))
+		return
+	}
+	switch {
+	case methodDesc.IsClientStreaming():
+		writeConnectError(w, nil, status.Errorf(codes.Unimplemented, "%s is a client or bidi streaming method; use native gRPC or /invoke/ws", req.fullMethod))
+		return
+	case methodDesc.IsServerStreaming() != req.streaming:
+		kind := "a unary"
+		if methodDesc.IsServerStreaming() {
+			kind = "a server-streaming"
+		}
+		writeConnectError(w, nil, status.Errorf(codes.InvalidArgument, "%s is %s method; send it with the matching Connect content type", req.fullMethod, kind))
+		return
+	}
+	frame, err := connectDecodeRequest(methodDesc, req)
+	if err != nil {
+		writeConnectError(w, nil, err)
+		return
+	}
+
+	var timeoutMs int64
+	if v := r.Header.Get("Connect-Timeout-Ms"); v != "" {
+		if timeoutMs, err = strconv.ParseInt(v, 10, 64); err != nil || timeoutMs <= 0 {
+			writeConnectError(w, nil, status.Errorf(codes.InvalidArgument, "invalid Connect-Timeout-Ms %q", v))
+			return
+		}
+	}
+	ctx, call, done, err := s.inflight.start(ctx, "", target.Name, req.fullMethod, "connect", timeoutMs)
+	if err != nil {
+		writeConnectError(w, nil, status.Error(codes.Internal, err.Error()))
+		return
+	}
+	defer done()
+	md := connectRequestMetadata(r.Header)
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	session := &proxySession{start: call.StartedAt}
+	session.add("send", frame)
+	up, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: methodDesc.IsServerStreaming()}, req.fullMethod, grpc.ForceCodec(rawCodec{}))
+	if err == nil {
+		err = up.SendMsg(&rawFrame{data: frame})
+		if err == nil || errors.Is(err, io.EOF) {
+			err = up.CloseSend()
+		}
+	}
+	var answered bool
+	if err == nil {
+		if req.streaming {
+			answered, err = relayConnectStream(w, up, methodDesc, req.codec, session)
+		} else {
+			answered, err = relayConnectUnary(w, up, methodDesc, req.codec, session)
+		}
+	} else {
+		writeConnectError(w, nil, err)
+	}
+	session.end = time.Now()
+
+	origin := proxyOrigin{source: trafficSourceConnect, header: r.Header.Clone()}
+	go s.recordProxyCall(target, req.fullMethod, origin, md, session, answered, err)
+}
+
+// parseConnectRequest reads the method and request message of a Connect call.
+func parseConnectRequest(r *http.Request) (connectRequest, error) {
+	req := connectRequest{fullMethod: r.URL.Path}
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		req.codec = q.Get("encoding")
+		if req.codec != "json" && req.codec != "proto" {
+			return req, status.Errorf(codes.InvalidArgument, "unsupported encoding %q", req.codec)
+		}
+		msg := []byte(q.Get("message"))
+		if q.Get("base64") == "1" {
+			decoded, err := decodeConnectBase64(string(msg))
+			if err != nil {
+				return req, status.Errorf(codes.InvalidArgument, "message is not base64: %v", err)
+			}
+			msg = decoded
+		}
+		msg, err := connectDecompress(q.Get("compression"), msg)
+		if err != nil {
+			return req, err
+		}
+		req.message = msg
+		return req, nil
+	}
+
+	codec, streaming, _ := connectContentType(r.Header.Get("Content-Type"))
+	req.codec, req.streaming = codec, streaming
+	body := http.MaxBytesReader(nil, r.Body, connectMaxMessageBytes+5)
+	if !streaming {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return req, status.Errorf(codes.ResourceExhausted, "read request: %v", err)
+		}
+		req.message, err = connectDecompress(r.Header.Get("Content-Encoding"), data)
+		return req, err
+	}
+
+	var head [5]byte
+	if _, err := io.ReadFull(body, head[:]); err != nil {
+		return req, status.Errorf(codes.InvalidArgument, "read request envelope: %v", err)
+	}
+	size := binary.BigEndian.Uint32(head[1:])
+	if size > connectMaxMessageBytes {
+		return req, status.Errorf(codes.ResourceExhausted, "request message of %d bytes exceeds %d", size, connectMaxMessageBytes)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return req, status.Errorf(codes.InvalidArgument, "read request message: %v", err)
+	}
+	if head[0]&connectFlagCompressed != 0 {
+		var err error
+		if data, err = connectDecompress(r.Header.Get("Connect-Content-Encoding"), data); err != nil {
+			return req, err
+		}
+	}
+	req.message = data
+	return req, nil
+}
+
+func decodeConnectBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func connectDecompress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case "", "identity":
+		return data, nil
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "gzip: %v", err)
+		}
+		out, err := io.ReadAll(io.LimitReader(zr, connectMaxMessageBytes+1))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "gzip: %v", err)
+		}
+		if len(out) > connectMaxMessageBytes {
+			return nil, status.Errorf(codes.ResourceExhausted, "request message exceeds %d bytes", connectMaxMessageBytes)
+		}
+		return out, nil
+	}
+	return nil, status.Errorf(codes.Unimplemented, "unsupported compression %q", encoding)
+}
+
+// connectDecodeRequest returns the request in the protobuf wire format.
+func connectDecodeRequest(methodDesc *desc.MethodDescriptor, req connectRequest) ([]byte, error) {
+	if req.codec == "proto" {
+		return req.message, nil
+	}
+	msg := dynamic.NewMessage(methodDesc.GetInputType())
+	if len(bytes.TrimSpace(req.message)) > 0 {
+		if err := msg.UnmarshalJSON(req.message); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "decode request: %v", err)
+		}
+	}
+	return msg.Marshal()
+}
+
+// connectEncodeResponse converts a response from the protobuf wire format to
+// the call's codec.
+func connectEncodeResponse(methodDesc *desc.MethodDescriptor, codec string, data []byte) ([]byte, error) {
+	if codec == "proto" {
+		return data, nil
+	}
+	msg := dynamic.NewMessage(methodDesc.GetOutputType())
+	if err := msg.Unmarshal(data); err != nil {
+		return nil, status.Errorf(codes.Internal, "decode response: %v", err)
+	}
+	return msg.MarshalJSON()
+}
+
+// relayConnectUnary writes the single response of a unary call, with the
+// backend's trailers as Trailer- headers.
+func relayConnectUnary(w http.ResponseWriter, up grpc.ClientStream, methodDesc *desc.MethodDescriptor, codec string, session *proxySession) (bool, error) {
+	header, _ := up.Header()
+	f := &rawFrame{}
+	err := up.RecvMsg(f)
+	if err == nil {
+		session.add("recv", f.data)
+		if extra := up.RecvMsg(&rawFrame{}); extra == nil {
+			err = status.Error(codes.Unimplemented, "unary method returned more than one response")
+		} else if !errors.Is(extra, io.EOF) {
+			err = extra
+		}
+	} else if errors.Is(err, io.EOF) {
+		err = status.Error(codes.Internal, "unary method returned no response")
+	}
+	trailer := up.Trailer()
+	answered := answeredBy(header, trailer)
+
+	var body []byte
+	if err == nil {
+		body, err = connectEncodeResponse(methodDesc, codec, f.data)
+	}
+	if err != nil {
+		setConnectHeaders(w.Header(), trailer, "Trailer-")
+		writeConnectError(w, header, err)
+		return answered, err
+	}
+	setConnectHeaders(w.Header(), header, "")
+	setConnectHeaders(w.Header(), trailer, "Trailer-")
+	w.Header().Set("Content-Type", connectResponseContentType(codec, false))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+	return true, nil
+}
+
+// relayConnectStream writes each response as an envelope and ends with the
+// end-of-stream envelope carrying the status and trailers.
+func relayConnectStream(w http.ResponseWriter, up grpc.ClientStream, methodDesc *desc.MethodDescriptor, codec string, session *proxySession) (bool, error) {
+	flusher, _ := w.(http.Flusher)
+	header, _ := up.Header()
+	setConnectHeaders(w.Header(), header, "")
+	w.Header().Set("Content-Type", connectResponseContentType(codec, true))
+	w.WriteHeader(http.StatusOK)
+
+	var err error
+	for {
+		f := &rawFrame{}
+		if err = up.RecvMsg(f); err != nil {
+			break
+		}
+		session.add("recv", f.data)
+		var body []byte
+		if body, err = connectEncodeResponse(methodDesc, codec, f.data); err != nil {
+			break
+		}
+		if writeErr := writeConnectEnvelope(w, 0, body); writeErr != nil {
+			return true, writeErr
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	trailer := up.Trailer()
+
+	end := struct {
+		Error    *connectError       `json:"error,omitempty"`
+		Metadata map[string][]string `json:"metadata,omitempty"`
+	}{}
+	if err != nil {
+		ce := newConnectError(err)
+		end.Error = &ce
+	}
+	if len(trailer) > 0 {
+		h := http.Header{}
+		setConnectHeaders(h, trailer, "")
+		end.Metadata = h
+	}
+	body, _ := json.Marshal(end)
+	_ = writeConnectEnvelope(w, connectFlagEndStream, body)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return err == nil || answeredBy(header, trailer), err
+}
+
+func writeConnectEnvelope(w io.Writer, flags byte, body []byte) error {
+	var head [5]byte
+	head[0] = flags
+	binary.BigEndian.PutUint32(head[1:], uint32(len(body)))
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// connectError is the JSON form of an error in the Connect protocol.
+type connectError struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message,omitempty"`
+	Details []connectErrorDetail `json:"details,omitempty"`
+}
+
+type connectErrorDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"` // base64 of the serialized message, without padding
+}
+
+func newConnectError(err error) connectError {
+	st := status.Convert(err)
+	if st.Code() == codes.Unknown {
+		if ctxSt := status.FromContextError(err); ctxSt.Code() != codes.Unknown {
+			st = ctxSt
+		}
+	}
+	ce := connectError{Code: connectCodeName(st.Code()), Message: st.Message()}
+	for _, d := range st.Proto().GetDetails() {
+		ce.Details = append(ce.Details, connectErrorDetail{
+			Type:  strings.TrimPrefix(d.GetTypeUrl(), "type.googleapis.com/"),
+			Value: base64.RawStdEncoding.EncodeToString(d.GetValue()),
+		})
+	}
+	return ce
+}
+
+// writeConnectError writes the error response of a unary call (or of a
+// streaming call that failed before it started).
+func writeConnectError(w http.ResponseWriter, header metadata.MD, err error) {
+	ce := newConnectError(err)
+	code, _ := parseStatusCode(ce.Code)
+	setConnectHeaders(w.Header(), header, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusForCode(code))
+	_ = json.NewEncoder(w).Encode(ce)
+}
+
+// connectCodeName is the Connect name of a code, e.g. "not_found".
+func connectCodeName(code codes.Code) string {
+	name := code.String()
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// connectRequestMetadata turns the request headers that are not part of the
+// protocol into gRPC metadata. Binary (-bin) values arrive base64-encoded.
+func connectRequestMetadata(h http.Header) metadata.MD {
+	md := metadata.MD{}
+	for key, vals := range h {
+		key = strings.ToLower(key)
+		if connectProtocolHeaders[key] || strings.HasPrefix(key, "grpc-") {
+			continue
+		}
+		for _, v := range vals {
+			if strings.HasSuffix(key, "-bin") {
+				decoded, err := decodeConnectBase64(v)
+				if err != nil {
+					continue
+				}
+				v = string(decoded)
+			}
+			md.Append(key, v)
+		}
+	}
+	return md
+}
+
+// setConnectHeaders copies backend metadata to HTTP headers, with prefix
+// ("Trailer-" for the trailers of unary calls).
+func setConnectHeaders(h http.Header, md metadata.MD, prefix string) {
+	for key, vals := range md {
+		if key == "content-type" || strings.HasPrefix(key, "grpc-") || strings.HasPrefix(key, ":") {
+			continue
+		}
+		for _, v := range vals {
+			if strings.HasSuffix(key, "-bin") {
+				v = base64.RawStdEncoding.EncodeToString([]byte(v))
+			}
+			h.Add(prefix+key, v)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func envelope(t *testing.T, flags byte, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writeEnvelope(t, &buf, flags, string(data))
+	return buf.Bytes()
+}
+
+func TestParseConnectRequest(t *testing.T) {
+	const method = "/grpc.health.v1.Health/Check"
+	protoMsg, err := proto.Marshal(&healthpb.HealthCheckRequest{Service: "svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonMsg := []byte(`{"service":"svc"}`)
+	get := func(query url.Values) *http.Request {
+		return httptest.NewRequest(http.MethodGet, method+"?"+query.Encode(), nil)
+	}
+	post := func(contentType string, body []byte, header ...string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, method, bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		return r
+	}
+	oversized := make([]byte, 5)
+	binary.BigEndian.PutUint32(oversized[1:], connectMaxMessageBytes+1)
+
+	tests := []struct {
+		name      string
+		req       *http.Request
+		codec     string
+		streaming bool
+		message   []byte
+		code      codes.Code
+	}{
+		{
+			name:    "get json",
+			req:     get(url.Values{"connect": {"v1"}, "encoding": {"json"}, "message": {string(jsonMsg)}}),
+			codec:   "json",
+			message: jsonMsg,
+		},
+		{
+			name:    "get proto base64url",
+			req:     get(url.Values{"encoding": {"proto"}, "base64": {"1"}, "message": {base64.RawURLEncoding.EncodeToString(protoMsg)}}),
+			codec:   "proto",
+			message: protoMsg,
+		},
+		{
+			name:    "get padded standard base64",
+			req:     get(url.Values{"encoding": {"proto"}, "base64": {"1"}, "message": {base64.StdEncoding.EncodeToString([]byte{0xfb, 0xff})}}),
+			codec:   "proto",
+			message: []byte{0xfb, 0xff},
+		},
+		{
+			name:    "get gzip",
+			req:     get(url.Values{"encoding": {"json"}, "base64": {"1"}, "compression": {"gzip"}, "message": {base64.RawURLEncoding.EncodeToString(gzipBytes(t, jsonMsg))}}),
+			codec:   "json",
+			message: jsonMsg,
+		},
+		{
+			name: "get unsupported encoding",
+			req:  get(url.Values{"encoding": {"xml"}, "message": {"<a/>"}}),
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "get bad base64",
+			req:  get(url.Values{"encoding": {"proto"}, "base64": {"1"}, "message": {"!!"}}),
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "get unsupported compression",
+			req:  get(url.Values{"encoding": {"json"}, "compression": {"br"}, "message": {string(jsonMsg)}}),
+			code: codes.Unimplemented,
+		},
+		{
+			name: "get corrupt gzip",
+			req:  get(url.Values{"encoding": {"json"}, "compression": {"gzip"}, "message": {string(jsonMsg)}}),
+			code: codes.InvalidArgument,
+		},
+		{
+			name:    "post json",
+			req:     post("application/json; charset=utf-8", jsonMsg),
+			codec:   "json",
+			message: jsonMsg,
+		},
+		{
+			name:    "post gzipped proto",
+			req:     post("application/proto", gzipBytes(t, protoMsg), "Content-Encoding", "gzip"),
+			codec:   "proto",
+			message: protoMsg,
+		},
+		{
+			name:      "post streaming json",
+			req:       post("application/connect+json", envelope(t, 0, jsonMsg)),
+			codec:     "json",
+			streaming: true,
+			message:   jsonMsg,
+		},
+		{
+			name:      "post streaming compressed proto",
+			req:       post("application/connect+proto", envelope(t, connectFlagCompressed, gzipBytes(t, protoMsg)), "Connect-Content-Encoding", "gzip"),
+			codec:     "proto",
+			streaming: true,
+			message:   protoMsg,
+		},
+		{
+			name: "post truncated envelope",
+			req:  post("application/connect+json", envelope(t, 0, jsonMsg)[:8]),
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "post oversized envelope",
+			req:  post("application/connect+proto", oversized),
+			code: codes.ResourceExhausted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseConnectRequest(tt.req)
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("parseConnectRequest() error = %v, want code %v", err, tt.code)
+			}
+			if err != nil {
+				return
+			}
+			if req.fullMethod != method || req.codec != tt.codec || req.streaming != tt.streaming {
+				t.Errorf("request = %s %s streaming=%v, want %s %s streaming=%v", req.fullMethod, req.codec, req.streaming, method, tt.codec, tt.streaming)
+			}
+			if !bytes.Equal(req.message, tt.message) {
+				t.Errorf("message = %q, want %q", req.message, tt.message)
+			}
+		})
+	}
+}
+
+// readConnectEnvelopes splits a Connect streaming response body.
+func readConnectEnvelopes(t *testing.T, body io.Reader) (flags []byte, messages []string) {
+	t.Helper()
+	for {
+		var head [5]byte
+		if _, err := io.ReadFull(body, head[:]); err == io.EOF {
+			return flags, messages
+		} else if err != nil {
+			t.Fatalf("read envelope: %v", err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(head[1:]))
+		if _, err := io.ReadFull(body, data); err != nil {
+			t.Fatalf("read envelope: %v", err)
+		}
+		flags = append(flags, head[0])
+		messages = append(messages, string(data))
+	}
+}
+
+func TestConnectHandler(t *testing.T) {
+	addr, _, _ := startEchoBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	t.Cleanup(srv.conns.closeAll)
+	ts := httptest.NewServer(http.HandlerFunc(srv.connectHandler))
+	t.Cleanup(ts.Close)
+
+	do := func(t *testing.T, method, path, contentType string, body []byte, header ...string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	readBody := func(t *testing.T, resp *http.Response) []byte {
+		t.Helper()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	// connectErrorOf checks that resp is a Connect error with code.
+	connectErrorOf := func(t *testing.T, resp *http.Response, code codes.Code) connectError {
+		t.Helper()
+		if resp.StatusCode != httpStatusForCode(code) || resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("status = %d %s, want %d application/json", resp.StatusCode, resp.Header.Get("Content-Type"), httpStatusForCode(code))
+		}
+		var ce connectError
+		if err := json.Unmarshal(readBody(t, resp), &ce); err != nil {
+			t.Fatalf("error body: %v", err)
+		}
+		if ce.Code != connectCodeName(code) {
+			t.Errorf("error code = %q (%s), want %q", ce.Code, ce.Message, connectCodeName(code))
+		}
+		return ce
+	}
+
+	t.Run("unary get json", func(t *testing.T) {
+		q := url.Values{"connect": {"v1"}, "encoding": {"json"}, "message": {`{"service":"svc"}`}}
+		resp := do(t, http.MethodGet, "/grpc.health.v1.Health/Check?"+q.Encode(), "", nil)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("status = %d %s, want 200 application/json", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		assertJSONEqual(t, readBody(t, resp), `{"status":"SERVING"}`)
+	})
+
+	t.Run("unary get proto", func(t *testing.T) {
+		msg, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: "svc"})
+		q := url.Values{"connect": {"v1"}, "encoding": {"proto"}, "base64": {"1"}, "message": {base64.RawURLEncoding.EncodeToString(msg)}}
+		resp := do(t, http.MethodGet, "/grpc.health.v1.Health/Check?"+q.Encode(), "", nil)
+		if resp.Header.Get("Content-Type") != "application/proto" {
+			t.Errorf("Content-Type = %q, want application/proto", resp.Header.Get("Content-Type"))
+		}
+		var out healthpb.HealthCheckResponse
+		if err := proto.Unmarshal(readBody(t, resp), &out); err != nil || out.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("response = %v, %v; want SERVING", &out, err)
+		}
+	})
+
+	t.Run("unary post json with metadata", func(t *testing.T) {
+		resp := do(t, http.MethodPost, "/grpc.health.v1.Health/Check", "application/json", []byte(`{"service":"svc"}`), "X-Custom", "hello", "Connect-Timeout-Ms", "5000")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d: %s", resp.StatusCode, readBody(t, resp))
+		}
+		if got := resp.Header.Get("X-Echo"); got != "hello" {
+			t.Errorf("X-Echo = %q, want hello", got)
+		}
+		if got := resp.Header.Get("Trailer-X-Trail"); got != "t1" {
+			t.Errorf("Trailer-X-Trail = %q, want t1", got)
+		}
+		assertJSONEqual(t, readBody(t, resp), `{"status":"SERVING"}`)
+	})
+
+	t.Run("server stream json", func(t *testing.T) {
+		// Watch never ends by itself; the timeout ends it.
+		resp := do(t, http.MethodPost, "/grpc.health.v1.Health/Watch", "application/connect+json", envelope(t, 0, []byte(`{"service":"svc"}`)), "Connect-Timeout-Ms", "200")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/connect+json" {
+			t.Fatalf("status = %d %s, want 200 application/connect+json", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		flags, messages := readConnectEnvelopes(t, resp.Body)
+		if len(messages) != 2 || flags[0] != 0 || flags[1] != connectFlagEndStream {
+			t.Fatalf("envelopes = %v %q, want a message and the end of stream", flags, messages)
+		}
+		assertJSONEqual(t, []byte(messages[0]), `{"status":"SERVING"}`)
+		var end struct {
+			Error connectError `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(messages[1]), &end); err != nil || end.Error.Code != "deadline_exceeded" {
+			t.Errorf("end of stream = %s, want deadline_exceeded", messages[1])
+		}
+	})
+
+	t.Run("error shape", func(t *testing.T) {
+		resp := do(t, http.MethodPost, "/grpc.health.v1.Health/Check", "application/json", []byte(`{"service":"fail"}`))
+		if got := resp.Header.Get("Trailer-X-Trail"); got != "t1" {
+			t.Errorf("Trailer-X-Trail = %q, want t1", got)
+		}
+		ce := connectErrorOf(t, resp, codes.FailedPrecondition)
+		if ce.Message != "bad state: 100%" {
+			t.Errorf("message = %q, want the backend's message", ce.Message)
+		}
+		if len(ce.Details) != 1 || ce.Details[0].Type != "google.rpc.ErrorInfo" {
+			t.Fatalf("details = %+v, want one google.rpc.ErrorInfo", ce.Details)
+		}
+		if strings.HasSuffix(ce.Details[0].Value, "=") {
+			t.Errorf("detail value %q is padded", ce.Details[0].Value)
+		}
+		raw, err := base64.RawStdEncoding.DecodeString(ce.Details[0].Value)
+		var info errdetails.ErrorInfo
+		if err == nil {
+			err = proto.Unmarshal(raw, &info)
+		}
+		if err != nil || info.Reason != "BROKEN" {
+			t.Errorf("detail = %v, %v; want ErrorInfo BROKEN", &info, err)
+		}
+	})
+
+	for _, tt := range []struct {
+		name, path, contentType string
+		body                    []byte
+		header                  []string
+		code                    codes.Code
+		message                 string
+	}{
+		{
+			name: "unary method as stream", path: "/grpc.health.v1.Health/Check", contentType: "application/connect+json",
+			body: envelope(t, 0, []byte(`{}`)), code: codes.InvalidArgument, message: "is a unary method",
+		},
+		{
+			name: "streaming method as unary", path: "/grpc.health.v1.Health/Watch", contentType: "application/json",
+			body: []byte(`{}`), code: codes.InvalidArgument, message: "is a server-streaming method",
+		},
+		{
+			name: "unknown method", path: "/grpc.health.v1.Health/Nope", contentType: "application/json",
+			body: []byte(`{}`), code: codes.Unimplemented,
+		},
+		{
+			name: "invalid json", path: "/grpc.health.v1.Health/Check", contentType: "application/json",
+			body: []byte(`{"service":1}`), code: codes.InvalidArgument, message: "decode request",
+		},
+		{
+			name: "non-numeric timeout", path: "/grpc.health.v1.Health/Check", contentType: "application/json",
+			body: []byte(`{}`), header: []string{"Connect-Timeout-Ms", "soon"}, code: codes.InvalidArgument, message: "Connect-Timeout-Ms",
+		},
+		{
+			name: "zero timeout", path: "/grpc.health.v1.Health/Check", contentType: "application/json",
+			body: []byte(`{}`), header: []string{"Connect-Timeout-Ms", "0"}, code: codes.InvalidArgument, message: "Connect-Timeout-Ms",
+		},
+		{
+			name: "unknown target", path: "/grpc.health.v1.Health/Check", contentType: "application/json",
+			body: []byte(`{}`), header: []string{targetHeader, "nope"}, code: codes.Unavailable,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ce := connectErrorOf(t, do(t, http.MethodPost, tt.path, tt.contentType, tt.body, tt.header...), tt.code)
+			if !strings.Contains(ce.Message, tt.message) {
+				t.Errorf("message = %q, want it to mention %q", ce.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestConnectCodeName(t *testing.T) {
+	for code, want := range map[codes.Code]string{
+		codes.NotFound:           "not_found",
+		codes.DeadlineExceeded:   "deadline_exceeded",
+		codes.FailedPrecondition: "failed_precondition",
+		codes.Unimplemented:      "unimplemented",
+	} {
+		if got := connectCodeName(code); got != want {
+			t.Errorf("connectCodeName(%v) = %q, want %q", code, got, want)
+		}
+	}
+}
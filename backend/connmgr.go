@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+)
+
+// connManager keeps one long-lived client connection per backend target.
+// Connections are created lazily, shared by all handlers and only replaced
+// when the dial settings for a target change.
+type connManager struct {
+	mu    sync.Mutex
+	conns map[string]*managedConn
+}
+
+type managedConn struct {
+	fingerprint string
+	conn        backendConn
+	stop        context.CancelFunc
+}
+
+func newConnManager() *connManager {
+	return &connManager{conns: make(map[string]*managedConn)}
+}
+
+// get returns the shared connection for the target, dialing it if needed. If
+// the target's dial settings differ from the ones the existing connection was
+// created with, the old connection is closed and replaced; if the new one
+// cannot be dialed, the old one is kept.
+func (m *connManager) get(t Target) (backendConn, error) {
+	key := t.Name
+	fp := dialFingerprint(t)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.conns[key]
+	if ok && old.fingerprint == fp {
+		return old.conn, nil
+	}
+
+	conn, err := dialBackend(t)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		log.Printf("Dial settings for %s changed, replacing connection", key)
+		old.close()
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	m.conns[key] = &managedConn{fingerprint: fp, conn: conn, stop: stop}
+	if cc, ok := conn.(*grpc.ClientConn); ok {
+		go watchConnState(ctx, key, cc)
+	}
+	return conn, nil
+}
+
+// state reports the connectivity state of the connection for key, or false if
+// no connection has been created yet.
+func (m *connManager) state(key string) (connectivity.State, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mc, ok := m.conns[key]
+	if !ok {
+		return connectivity.Idle, false
+	}
+	return mc.conn.GetState(), true
+}
+
+// remove closes and forgets the connection for key.
+func (m *connManager) remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mc, ok := m.conns[key]; ok {
+		mc.close()
+		delete(m.conns, key)
+	}
+}
+
+func (m *connManager) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, mc := range m.conns {
+		mc.close()
+		delete(m.conns, key)
+	}
+}
+
+func (mc *managedConn) close() {
+	mc.stop()
+	if err := mc.conn.Close(); err != nil {
+		log.Printf("Error closing backend connection: %v", err)
+	}
+}
+
+// watchConnState logs connectivity transitions and kicks idle connections so
+// the channel is re-established (with backoff) before the next request needs it.
+func watchConnState(ctx context.Context, key string, conn *grpc.ClientConn) {
+	conn.Connect()
+	state := conn.GetState()
+	for {
+		if !conn.WaitForStateChange(ctx, state) {
+			return
+		}
+		next := conn.GetState()
+		log.Printf("Backend connection %s: %s -> %s", key, state, next)
+		switch next {
+		case connectivity.Idle:
+			conn.Connect()
+		case connectivity.Shutdown:
+			return
+		}
+		state = next
+	}
+}
+
+// dialFingerprint identifies the settings a connection was dialed with.
+func dialFingerprint(t Target) string {
+	return fmt.Sprintf("%s|%v|%s|%s|%s|%s|%v|%s",
+		t.Addr, t.UseTLS, t.ServerName, t.CAFile, t.CertFile, t.KeyFile, t.InsecureSkipVerify, t.Transport)
+}
+
+var backendConnectParams = grpc.ConnectParams{
+	Backoff: backoff.Config{
+		BaseDelay:  250 * time.Millisecond,
+		Multiplier: 1.6,
+		Jitter:     0.2,
+		MaxDelay:   10 * time.Second,
+	},
+	MinConnectTimeout: 5 * time.Second,
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func waitForState(t *testing.T, conn backendConn, want connectivity.State) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.GetState() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection state is %s, want %s", conn.GetState(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnManagerSharesConnection(t *testing.T) {
+	addr, _, _ := startTestBackend(t)
+	m := newConnManager()
+	defer m.closeAll()
+
+	target := Target{Name: "default", Addr: addr}
+	first, err := m.get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("get returned a new connection for unchanged dial settings")
+	}
+}
+
+func TestConnManagerReplacesOnFingerprintChange(t *testing.T) {
+	addr, _, _ := startTestBackend(t)
+	other, _, _ := startTestBackend(t)
+	m := newConnManager()
+	defer m.closeAll()
+
+	old, err := m.get(Target{Name: "default", Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, old, connectivity.Ready)
+
+	replaced, err := m.get(Target{Name: "default", Addr: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced == old {
+		t.Fatal("get kept the connection after the address changed")
+	}
+	if got := old.GetState(); got != connectivity.Shutdown {
+		t.Errorf("old connection state is %s, want %s", got, connectivity.Shutdown)
+	}
+	waitForState(t, replaced, connectivity.Ready)
+
+	// Any dial setting takes part in the fingerprint.
+	withTLS, err := m.get(Target{Name: "default", Addr: other, UseTLS: true, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withTLS == replaced || replaced.GetState() != connectivity.Shutdown {
+		t.Error("enabling TLS did not replace and close the connection")
+	}
+}
+
+func TestConnManagerState(t *testing.T) {
+	addr, _, _ := startTestBackend(t)
+	m := newConnManager()
+	defer m.closeAll()
+
+	if _, ok := m.state("default"); ok {
+		t.Error("state reported a connection before one was created")
+	}
+	conn, err := m.get(Target{Name: "default", Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The manager connects eagerly, without waiting for a call.
+	waitForState(t, conn, connectivity.Ready)
+	if state, ok := m.state("default"); !ok || state != connectivity.Ready {
+		t.Errorf("state() = %s, %v, want %s, true", state, ok, connectivity.Ready)
+	}
+
+	m.remove("default")
+	if _, ok := m.state("default"); ok {
+		t.Error("state reported a removed connection")
+	}
+	if got := conn.GetState(); got != connectivity.Shutdown {
+		t.Errorf("removed connection state is %s, want %s", got, connectivity.Shutdown)
+	}
+
+	// A target nobody listens on does not become ready.
+	down, err := m.get(Target{Name: "down", Addr: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, down, connectivity.TransientFailure)
+}
+
+func TestConnManagerConcurrentAccess(t *testing.T) {
+	addrs := make([]string, 2)
+	for i := range addrs {
+		addrs[i], _, _ = startTestBackend(t)
+	}
+	m := newConnManager()
+	defer m.closeAll()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := fmt.Sprintf("t%d", j%3)
+				switch (i + j) % 4 {
+				case 0, 1:
+					conn, err := m.get(Target{Name: name, Addr: addrs[(i+j)%len(addrs)]})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					conn.GetState()
+				case 2:
+					m.state(name)
+				case 3:
+					m.remove(name)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The manager is still usable after the churn.
+	conn, err := m.get(Target{Name: "t0", Addr: addrs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Errorf("health check over the shared connection: %v", err)
+	}
+}
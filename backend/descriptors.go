@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Descriptor modes control how local descriptors combine with reflection.
+const (
+	descriptorModeMerge   = "merge"   // local and reflected services are combined; local wins on conflicts
+	descriptorModeReplace = "replace" // only local descriptors are used; reflection is not consulted
+)
+
+// descriptorSource lists and resolves the services of a target.
+// *grpcreflect.Client satisfies it.
+type descriptorSource interface {
+	ListServices() ([]string, error)
+	ResolveService(name string) (*desc.ServiceDescriptor, error)
+}
+
+// fileSource serves services from descriptors loaded from .proto files or
+// FileDescriptorSets instead of server reflection.
+type fileSource struct {
+	files    []*desc.FileDescriptor
+	services map[string]*desc.ServiceDescriptor
+}
+
+func newFileSource(files []*desc.FileDescriptor) *fileSource {
+	src := &fileSource{services: make(map[string]*desc.ServiceDescriptor)}
+	seen := make(map[string]bool)
+	var add func(fd *desc.FileDescriptor)
+	add = func(fd *desc.FileDescriptor) {
+		if seen[fd.GetName()] {
+			return
+		}
+		seen[fd.GetName()] = true
+		src.files = append(src.files, fd)
+		for _, dep := range fd.GetDependencies() {
+			add(dep)
+		}
+		for _, svc := range fd.GetServices() {
+			src.services[svc.GetFullyQualifiedName()] = svc
+		}
+	}
+	for _, fd := range files {
+		add(fd)
+	}
+	return src
+}
+
+func (f *fileSource) ListServices() ([]string, error) {
+	names := make([]string, 0, len(f.services))
+	for name := range f.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *fileSource) ResolveService(name string) (*desc.ServiceDescriptor, error) {
+	svc, ok := f.services[name]
+	if !ok {
+		return nil, fmt.Errorf("service %s not found in loaded descriptors", name)
+	}
+	return svc, nil
+}
+
+// merge returns a source containing the files of f and other. Files in other
+// replace files of the same name in f.
+func (f *fileSource) merge(other *fileSource) *fileSource {
+	byName := make(map[string]*desc.FileDescriptor)
+	for _, fd := range f.files {
+		byName[fd.GetName()] = fd
+	}
+	for _, fd := range other.files {
+		byName[fd.GetName()] = fd
+	}
+	files := make([]*desc.FileDescriptor, 0, len(byName))
+	for _, fd := range byName {
+		files = append(files, fd)
+	}
+	return newFileSource(files)
+}
+
+// compositeSource combines local descriptors with server reflection.
+type compositeSource struct {
+	local     *fileSource
+	reflected descriptorSource
+}
+
+func (c *compositeSource) ListServices() ([]string, error) {
+	names, _ := c.local.ListServices()
+	remote, err := c.reflected.ListServices()
+	if err != nil {
+		if len(names) == 0 {
+			return nil, err
+		}
+		log.Printf("WARN: reflection unavailable, using loaded descriptors only: %v", err)
+		return names, nil
+	}
+	seen := make(map[string]bool, len(names))
+	for _, n := range names {
+		seen[n] = true
+	}
+	for _, n := range remote {
+		if !seen[n] {
+			names = append(names, n)
+		}
+	}
+	return names, nil
+}
+
+func (c *compositeSource) ResolveService(name string) (*desc.ServiceDescriptor, error) {
+	if svc, err := c.local.ResolveService(name); err == nil {
+		return svc, nil
+	}
+	return c.reflected.ResolveService(name)
+}
+
+// localDescriptors holds descriptors loaded for a target, from configured
+// files or uploaded at runtime.
+type localDescriptors struct {
+	Source *fileSource
+	Mode   string
+}
+
+// descriptorStore keeps the local descriptors of each target.
+type descriptorStore struct {
+	mu      sync.RWMutex
+	targets map[string]localDescriptors
+}
+
+func newDescriptorStore() *descriptorStore {
+	return &descriptorStore{targets: make(map[string]localDescriptors)}
+}
+
+func (ds *descriptorStore) get(target string) (localDescriptors, bool) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	ld, ok := ds.targets[target]
+	return ld, ok
+}
+
+func (ds *descriptorStore) set(target string, ld localDescriptors) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.targets[target] = ld
+}
+
+func (ds *descriptorStore) clear(target string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	delete(ds.targets, target)
+}
+
+// descriptorSource returns the source used to resolve the services of a
+// target, combining reflection with any local descriptors. The returned
+// function releases the reflection stream and must always be called.
+func (s *Server) descriptorSource(ctx context.Context, conn grpc.ClientConnInterface, t Target) (descriptorSource, func()) {
+	ld, hasLocal := s.descriptors.get(t.Name)
+	if hasLocal && ld.Mode == descriptorModeReplace {
+		return ld.Source, func() {}
+	}
+
+	if _, ok := metadata.FromOutgoingContext(ctx); !ok {
+		if md := s.config().DefaultMD; len(md) > 0 {
+			ctx = metadata.NewOutgoingContext(ctx, md)
+		}
+	}
+	client := newReflectionSource(ctx, conn, t.Name, s.reflection)
+	if !hasLocal {
+		return client, client.Reset
+	}
+	return &compositeSource{local: ld.Source, reflected: client}, client.Reset
+}
+
+// loadTargetDescriptors compiles the .proto files and descriptor set configured
+// for a target and installs them as its local descriptors.
+func (s *Server) loadTargetDescriptors(t Target) error {
+	ld, err := readTargetDescriptors(t)
+	if err != nil || ld == nil {
+		return err
+	}
+	s.installTargetDescriptors(t, *ld)
+	return nil
+}
+
+// installTargetDescriptors makes ld the local descriptors of t.
+func (s *Server) installTargetDescriptors(t Target, ld localDescriptors) {
+	s.descriptors.set(t.Name, ld)
+	log.Printf("Loaded %d files (%d services) for target %s (mode: %s)", len(ld.Source.files), len(ld.Source.services), t.Name, ld.Mode)
+}
+
+// readTargetDescriptors compiles the .proto files and descriptor set configured
+// for a target without installing them. It returns nil if none are configured.
+func readTargetDescriptors(t Target) (*localDescriptors, error) {
+	if t.ProtoDir == "" && t.DescriptorSet == "" {
+		return nil, nil
+	}
+	var files []*desc.FileDescriptor
+	if t.ProtoDir != "" {
+		fds, err := loadProtoFiles(t.ProtoDir, t.ImportPaths)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fds...)
+	}
+	if t.DescriptorSet != "" {
+		data, err := os.ReadFile(t.DescriptorSet)
+		if err != nil {
+			return nil, fmt.Errorf("read descriptor set: %w", err)
+		}
+		fds, err := parseDescriptorSet(data, false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t.DescriptorSet, err)
+		}
+		files = append(files, fds...)
+	}
+	mode := t.DescriptorMode
+	if mode == "" {
+		mode = descriptorModeMerge
+	}
+	return &localDescriptors{Source: newFileSource(files), Mode: mode}, nil
+}
+
+// loadProtoFiles compiles every .proto file under dir. The directory itself
+// and importPaths are searched for imports; well-known types are built in.
+func loadProtoFiles(dir string, importPaths []string) ([]*desc.FileDescriptor, error) {
+	var names []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".proto") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan %s: %w", dir, err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no .proto files found in %s", dir)
+	}
+
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			ImportPaths: append([]string{dir}, importPaths...),
+		}),
+	}
+	linked, err := compiler.Compile(context.Background(), names...)
+	if err != nil {
+		return nil, fmt.Errorf("compile protos: %w", err)
+	}
+	files := make([]protoreflect.FileDescriptor, 0, len(linked))
+	for _, f := range linked {
+		files = append(files, f)
+	}
+	return desc.WrapFiles(files)
+}
+
+// parseDescriptorSet decodes a FileDescriptorSet in binary or protojson form.
+func parseDescriptorSet(data []byte, isJSON bool) ([]*desc.FileDescriptor, error) {
+	var fds descriptorpb.FileDescriptorSet
+	var err error
+	if isJSON {
+		err = protojson.Unmarshal(data, &fds)
+	} else {
+		err = proto.Unmarshal(data, &fds)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode FileDescriptorSet: %w", err)
+	}
+	if len(fds.GetFile()) == 0 {
+		return nil, errors.New("FileDescriptorSet contains no files")
+	}
+	byName, err := desc.CreateFileDescriptorsFromSet(&fds)
+	if err != nil {
+		return nil, fmt.Errorf("link FileDescriptorSet: %w", err)
+	}
+	files := make([]*desc.FileDescriptor, 0, len(byName))
+	for _, fd := range byName {
+		files = append(files, fd)
+	}
+	return files, nil
+}
+
+// DescriptorsInfo describes the local descriptors loaded for a target.
+type DescriptorsInfo struct {
+	Target   string   `json:"target"`
+	Mode     string   `json:"mode,omitempty"`
+	Files    []string `json:"files"`
+	Services []string `json:"services"`
+}
+
+func describeLocal(target string, ld localDescriptors, ok bool) DescriptorsInfo {
+	info := DescriptorsInfo{Target: target, Files: []string{}, Services: []string{}}
+	if !ok {
+		return info
+	}
+	info.Mode = ld.Mode
+	for _, fd := range ld.Source.files {
+		info.Files = append(info.Files, fd.GetName())
+	}
+	sort.Strings(info.Files)
+	info.Services, _ = ld.Source.ListServices()
+	return info
+}
+
+// descriptorsHandler manages runtime-uploaded descriptors on /schema/descriptors.
+//
+//	GET    lists the local descriptors of the target
+//	POST   uploads a FileDescriptorSet (binary, or protojson with a JSON content type);
+//	       ?mode=merge|replace, ?append=true adds to instead of replacing the current upload
+//	DELETE drops the local descriptors of the target
+func (s *Server) descriptorsHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.targets.get(targetParam(r))
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown target %q", targetParam(r)), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ld, ok := s.descriptors.get(t.Name)
+		writeJSON(w, http.StatusOK, describeLocal(t.Name, ld, ok))
+	case http.MethodPost, http.MethodPut:
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = descriptorModeMerge
+		}
+		if mode != descriptorModeMerge && mode != descriptorModeReplace {
+			http.Error(w, fmt.Sprintf("invalid mode %q: use %q or %q", mode, descriptorModeMerge, descriptorModeReplace), http.StatusBadRequest)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<20))
+		if err != nil {
+			http.Error(w, "read body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		isJSON := strings.Contains(r.Header.Get("Content-Type"), "json")
+		files, err := parseDescriptorSet(data, isJSON)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		src := newFileSource(files)
+		if r.URL.Query().Get("append") == "true" {
+			if existing, ok := s.descriptors.get(t.Name); ok {
+				src = existing.Source.merge(src)
+			}
+		}
+		ld := localDescriptors{Source: src, Mode: mode}
+		s.descriptors.set(t.Name, ld)
+		s.schemas.invalidate(t.Name)
+		log.Printf("Uploaded %d files (%d services) for target %s (mode: %s)", len(src.files), len(src.services), t.Name, mode)
+		writeJSON(w, http.StatusOK, describeLocal(t.Name, ld, true))
+	case http.MethodDelete:
+		s.descriptors.clear(t.Name)
+		s.schemas.invalidate(t.Name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
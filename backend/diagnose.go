@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// Outcomes of a diagnostic check.
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// What answered on the backend port, as detected by the protocol check.
+const (
+	wireTLS     = "tls"
+	wireH2C     = "h2c"      // plaintext HTTP/2
+	wireHTTP1   = "http/1.1" // plaintext HTTP/1.x
+	wireUnknown = "unknown"
+)
+
+const diagnoseStepTimeout = 3 * time.Second
+
+// DiagnosticCheck is one step of a diagnosis.
+type DiagnosticCheck struct {
+	Name       string         `json:"name"`
+	Status     string         `json:"status"` // pass, warn, fail or skip
+	Detail     string         `json:"detail"`
+	Hint       string         `json:"hint,omitempty"`
+	DurationMs float64        `json:"durationMs"`
+	Data       map[string]any `json:"data,omitempty"`
+}
+
+// DiagnosisReport is the result of GET /inspector/diagnose.
+type DiagnosisReport struct {
+	Target    string            `json:"target"`
+	Addr      string            `json:"addr"`
+	UseTLS    bool              `json:"useTLS"`
+	Transport string            `json:"transport,omitempty"`
+	OK        bool              `json:"ok"` // no check failed
+	StartedAt time.Time         `json:"startedAt"`
+	Checks    []DiagnosticCheck `json:"checks"`
+}
+
+// diagnoseHandler runs the connection checks against a target. ?target=
+// selects the target; ?addr= and ?tls= try different settings without
+// changing it.
+func (s *Server) diagnoseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t, ok := s.targets.get(targetParam(r))
+	if !ok {
+		http.Error(w, fmt.Sprintf("%v %q", errUnknownTarget, targetParam(r)), http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if addr := strings.TrimSpace(q.Get("addr")); addr != "" {
+		t.Addr = addr
+	}
+	switch strings.ToLower(q.Get("tls")) {
+	case "true", "1":
+		t.UseTLS = true
+	case "false", "0":
+		t.UseTLS = false
+	}
+	writeJSON(w, http.StatusOK, diagnose(r.Context(), t))
+}
+
+// diagnose runs every check in order. Checks whose prerequisites failed are
+// skipped.
+func diagnose(ctx context.Context, t Target) DiagnosisReport {
+	report := DiagnosisReport{Target: t.Name, Addr: t.Addr, UseTLS: t.UseTLS, Transport: t.Transport, StartedAt: time.Now().UTC()}
+	add := func(c DiagnosticCheck) DiagnosticCheck {
+		report.Checks = append(report.Checks, c)
+		return c
+	}
+	skip := func(name, reason string) {
+		add(DiagnosticCheck{Name: name, Status: checkSkip, Detail: reason})
+	}
+
+	host, port, err := net.SplitHostPort(t.Addr)
+	if err != nil {
+		add(DiagnosticCheck{Name: "address", Status: checkFail, Detail: err.Error(), Hint: "Use host:port, e.g. localhost:9090."})
+		report.OK = false
+		return report
+	}
+
+	dns := add(timed(func() DiagnosticCheck { return checkDNS(ctx, host) }))
+	if dns.Status == checkFail {
+		skip("tcp", "DNS resolution failed")
+		skip("protocol", "DNS resolution failed")
+		skip("reflection", "DNS resolution failed")
+		skip("health", "DNS resolution failed")
+		return finish(report)
+	}
+	tcp := add(timed(func() DiagnosticCheck { return checkTCP(ctx, net.JoinHostPort(host, port)) }))
+	if tcp.Status == checkFail {
+		skip("protocol", "TCP connect failed")
+		skip("reflection", "TCP connect failed")
+		skip("health", "TCP connect failed")
+		return finish(report)
+	}
+	proto := add(timed(func() DiagnosticCheck { return checkProtocol(ctx, t) }))
+	if proto.Status == checkFail {
+		skip("reflection", "the server does not speak gRPC with the configured settings")
+		skip("health", "the server does not speak gRPC with the configured settings")
+		return finish(report)
+	}
+
+	conn, err := dialBackend(t)
+	if err != nil {
+		add(DiagnosticCheck{Name: "reflection", Status: checkFail, Detail: err.Error()})
+		skip("health", "could not create a client")
+		return finish(report)
+	}
+	defer conn.Close()
+	add(timed(func() DiagnosticCheck { return checkReflection(ctx, conn) }))
+	add(timed(func() DiagnosticCheck { return checkHealth(ctx, conn) }))
+	return finish(report)
+}
+
+func finish(report DiagnosisReport) DiagnosisReport {
+	report.OK = true
+	for _, c := range report.Checks {
+		if c.Status == checkFail {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+func timed(check func() DiagnosticCheck) DiagnosticCheck {
+	start := time.Now()
+	c := check()
+	c.DurationMs = durationMs(time.Since(start))
+	return c
+}
+
+func checkDNS(ctx context.Context, host string) DiagnosticCheck {
+	c := DiagnosticCheck{Name: "dns"}
+	if host == "" {
+		c.Status, c.Detail = checkPass, "no host given; using the local machine"
+		return c
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		c.Status, c.Detail = checkPass, fmt.Sprintf("%s is an IP address", host)
+		return c
+	}
+	ctx, cancel := context.WithTimeout(ctx, diagnoseStepTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		c.Hint = fmt.Sprintf("%s does not resolve. Check the spelling of the host name or your DNS settings.", host)
+		return c
+	}
+	c.Status, c.Detail = checkPass, fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", "))
+	c.Data = map[string]any{"addresses": addrs}
+	return c
+}
+
+func checkTCP(ctx context.Context, addr string) DiagnosticCheck {
+	c := DiagnosticCheck{Name: "tcp"}
+	d := net.Dialer{Timeout: diagnoseStepTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		var opErr *net.OpError
+		switch {
+		case errors.As(err, &opErr) && opErr.Timeout():
+			c.Hint = fmt.Sprintf("Connecting to %s timed out. A firewall may be dropping traffic, or the host is down.", addr)
+		default:
+			c.Hint = fmt.Sprintf("Nothing accepts connections on %s. Make sure your gRPC server is running and listening on this port.", addr)
+		}
+		return c
+	}
+	_ = conn.Close()
+	c.Status, c.Detail = checkPass, fmt.Sprintf("connected to %s", conn.RemoteAddr())
+	return c
+}
+
+// checkProtocol works out what answers on the port: a TLS ServerHello, a
+// plaintext HTTP/2 server (its SETTINGS frame after our preface) or an
+// HTTP/1.x response, and compares it with the target's TLS setting.
+func checkProtocol(ctx context.Context, t Target) DiagnosticCheck {
+	c := DiagnosticCheck{Name: "protocol"}
+	wire, detail, data := sniffProtocol(ctx, t)
+	c.Data = data
+	c.Data["detected"] = wire
+
+	switch {
+	case wire == wireTLS && t.UseTLS:
+		c.Status, c.Detail = checkPass, detail
+		if alpn, _ := data["alpn"].(string); alpn != "h2" && !t.isHTTPTransport() {
+			c.Status = checkWarn
+			c.Hint = "The server did not negotiate HTTP/2 (ALPN h2) over TLS; gRPC clients may refuse the connection."
+		}
+	case wire == wireTLS:
+		c.Status, c.Detail = checkFail, detail
+		c.Hint = "The server expects TLS but TLS is disabled. Set GRPS_BACKEND_USE_TLS=true (or useTLS on the target)."
+	case wire == wireH2C && !t.UseTLS:
+		c.Status, c.Detail = checkPass, detail
+	case wire == wireH2C:
+		c.Status, c.Detail = checkFail, detail
+		c.Hint = "The server speaks plaintext HTTP/2 but TLS is enabled. Set GRPS_BACKEND_USE_TLS=false (or useTLS on the target)."
+	case wire == wireHTTP1 && t.isHTTPTransport() && !t.UseTLS:
+		// gRPC-Web and Connect servers commonly speak HTTP/1.1 only.
+		c.Status, c.Detail = checkPass, detail
+	case wire == wireHTTP1 && t.isHTTPTransport():
+		c.Status, c.Detail = checkFail, detail
+		c.Hint = "The server speaks plaintext HTTP but TLS is enabled. Set GRPS_BACKEND_USE_TLS=false (or useTLS on the target)."
+	case wire == wireHTTP1:
+		c.Status, c.Detail = checkFail, detail
+		c.Hint = fmt.Sprintf("%s is an HTTP/1.x server, not a gRPC server. Point the target at your gRPC port, or set the target's transport to grpc-web or connect.", t.Addr)
+	default:
+		c.Status, c.Detail = checkWarn, detail
+		c.Hint = "Could not tell what is listening on this port; the gRPC checks below may explain more."
+	}
+	return c
+}
+
+func sniffProtocol(ctx context.Context, t Target) (string, string, map[string]any) {
+	data := map[string]any{}
+	d := net.Dialer{Timeout: diagnoseStepTimeout}
+
+	// First try a TLS handshake, without verification: only the protocol matters here.
+	raw, err := d.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return wireUnknown, err.Error(), data
+	}
+	serverName := t.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(t.Addr)
+	}
+	tc := tls.Client(raw, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true, // the TLS check only identifies the protocol
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	_ = tc.SetDeadline(time.Now().Add(diagnoseStepTimeout))
+	err = tc.HandshakeContext(ctx)
+	if err == nil {
+		st := tc.ConnectionState()
+		_ = tc.Close()
+		data["alpn"] = st.NegotiatedProtocol
+		data["tlsVersion"] = tls.VersionName(st.Version)
+		if len(st.PeerCertificates) > 0 {
+			cert := st.PeerCertificates[0]
+			data["certificateSubject"] = cert.Subject.String()
+			data["certificateNames"] = cert.DNSNames
+			data["certificateExpires"] = cert.NotAfter
+		}
+		return wireTLS, fmt.Sprintf("TLS handshake succeeded (%s, ALPN %q)", tls.VersionName(st.Version), st.NegotiatedProtocol), data
+	}
+	_ = raw.Close()
+	var rhErr tls.RecordHeaderError
+	if errors.As(err, &rhErr) && bytes.HasPrefix(rhErr.RecordHeader[:], []byte("HTTP/")) {
+		return wireHTTP1, "the server answered the TLS handshake with an HTTP/1.x response", data
+	}
+
+	// Not TLS: send the HTTP/2 client preface and an empty SETTINGS frame.
+	raw, err = d.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return wireUnknown, err.Error(), data
+	}
+	defer raw.Close()
+	_ = raw.SetDeadline(time.Now().Add(diagnoseStepTimeout))
+	preface := append([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), 0, 0, 0, 0x4, 0, 0, 0, 0, 0)
+	if _, err := raw.Write(preface); err != nil {
+		return wireUnknown, err.Error(), data
+	}
+	head := make([]byte, 9)
+	n, err := io.ReadFull(raw, head)
+	switch {
+	case n >= 5 && bytes.HasPrefix(head, []byte("HTTP/")):
+		return wireHTTP1, "the server answered the HTTP/2 preface with an HTTP/1.x response", data
+	case n == 9 && head[3] == 0x4:
+		return wireH2C, "plaintext HTTP/2: the server answered the preface with a SETTINGS frame", data
+	case err != nil && n == 0:
+		return wireUnknown, fmt.Sprintf("the server closed the connection without answering TLS or HTTP/2 (%v)", err), data
+	}
+	return wireUnknown, fmt.Sprintf("unrecognized response %q", head[:n]), data
+}
+
+// checkReflection asks for the service list over both reflection versions.
+func checkReflection(ctx context.Context, conn grpc.ClientConnInterface) DiagnosticCheck {
+	c := DiagnosticCheck{Name: "reflection", Data: map[string]any{}}
+	var available []string
+	var lastErr error
+	for _, version := range []string{reflectionV1, reflectionV1Alpha} {
+		callCtx, cancel := context.WithTimeout(ctx, diagnoseStepTimeout)
+		client := newReflectionClient(callCtx, conn, version)
+		services, err := client.ListServices()
+		client.Reset()
+		cancel()
+		if err != nil {
+			c.Data[version] = status.Code(err).String()
+			lastErr = err
+			continue
+		}
+		available = append(available, version)
+		c.Data[version] = "OK"
+		c.Data["services"] = len(services)
+	}
+	c.Data["available"] = available
+	switch {
+	case len(available) > 0:
+		c.Status, c.Detail = checkPass, fmt.Sprintf("server reflection available (%s)", strings.Join(available, ", "))
+	case status.Code(lastErr) == codes.Unimplemented:
+		c.Status, c.Detail = checkWarn, "server reflection is not enabled on the backend"
+		c.Hint = "Enable reflection on the server, or provide descriptors with GRPS_PROTO_DIR, GRPS_DESCRIPTOR_SET or POST /schema/descriptors."
+	default:
+		c.Status, c.Detail = checkFail, lastErr.Error()
+	}
+	return c
+}
+
+// checkHealth calls grpc.health.v1.Health/Check for the whole server.
+func checkHealth(ctx context.Context, conn grpc.ClientConnInterface) DiagnosticCheck {
+	c := DiagnosticCheck{Name: "health"}
+	callCtx, cancel := context.WithTimeout(ctx, diagnoseStepTimeout)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(conn).Check(callCtx, &healthpb.HealthCheckRequest{})
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		c.Status, c.Detail = checkWarn, "the gRPC health service is not implemented"
+	case err != nil:
+		c.Status, c.Detail = checkFail, err.Error()
+	case resp.GetStatus() == healthpb.HealthCheckResponse_SERVING:
+		c.Status, c.Detail = checkPass, "SERVING"
+	default:
+		c.Status, c.Detail = checkWarn, resp.GetStatus().String()
+	}
+	return c
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+func hostPort(url string) string {
+	return url[strings.Index(url, "://")+3:]
+}
+
+func TestCheckDNS(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"", checkPass},
+		{"127.0.0.1", checkPass},
+		{"::1", checkPass},
+		{"localhost", checkPass},
+		{"nonexistent.invalid", checkFail}, // .invalid never resolves (RFC 2606)
+	}
+	for _, tt := range tests {
+		c := checkDNS(context.Background(), tt.host)
+		if c.Status != tt.want {
+			t.Errorf("checkDNS(%q) = %s (%s), want %s", tt.host, c.Status, c.Detail, tt.want)
+		}
+		if c.Status == checkFail && !strings.Contains(c.Hint, "does not resolve") {
+			t.Errorf("checkDNS(%q) hint = %q", tt.host, c.Hint)
+		}
+	}
+}
+
+func TestCheckTCP(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	if c := checkTCP(context.Background(), lis.Addr().String()); c.Status != checkPass {
+		t.Errorf("checkTCP(listening) = %s (%s), want %s", c.Status, c.Detail, checkPass)
+	}
+	c := checkTCP(context.Background(), closedAddr(t))
+	if c.Status != checkFail || !strings.Contains(c.Hint, "Nothing accepts connections") {
+		t.Errorf("checkTCP(closed) = %s (%s, %s), want a failure with the not-listening hint", c.Status, c.Detail, c.Hint)
+	}
+}
+
+// silentListener accepts connections and closes them without a word.
+func silentListener(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func TestSniffProtocol(t *testing.T) {
+	tlsH2 := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tlsH2.EnableHTTP2 = true
+	tlsH2.StartTLS()
+	defer tlsH2.Close()
+	tlsH1 := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsH1.Close()
+	h2c := httptest.NewUnstartedServer(http.NotFoundHandler())
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+	http1 := httptest.NewServer(http.NotFoundHandler())
+	defer http1.Close()
+	grpcAddr, _, _ := startTestBackend(t)
+
+	tests := []struct {
+		name     string
+		addr     string
+		wantWire string
+		wantALPN string
+	}{
+		{"TLS with HTTP/2", hostPort(tlsH2.URL), wireTLS, "h2"},
+		{"TLS with HTTP/1.1", hostPort(tlsH1.URL), wireTLS, ""},
+		{"h2c", hostPort(h2c.URL), wireH2C, ""},
+		{"HTTP/1.1", hostPort(http1.URL), wireHTTP1, ""},
+		{"gRPC server", grpcAddr, wireH2C, ""},
+		{"silent", silentListener(t), wireUnknown, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wire, detail, data := sniffProtocol(context.Background(), Target{Addr: tt.addr})
+			if wire != tt.wantWire {
+				t.Fatalf("sniffProtocol() = %s (%s), want %s", wire, detail, tt.wantWire)
+			}
+			if tt.wantALPN != "" && data["alpn"] != tt.wantALPN {
+				t.Errorf("alpn = %v, want %s", data["alpn"], tt.wantALPN)
+			}
+		})
+	}
+}
+
+func TestCheckProtocol(t *testing.T) {
+	tlsH2 := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tlsH2.EnableHTTP2 = true
+	tlsH2.StartTLS()
+	defer tlsH2.Close()
+	tlsH1 := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsH1.Close()
+	http1 := httptest.NewServer(http.NotFoundHandler())
+	defer http1.Close()
+	grpcAddr, _, _ := startTestBackend(t)
+
+	tests := []struct {
+		name     string
+		target   Target
+		want     string
+		wantHint string
+	}{
+		{"TLS expected", Target{Addr: hostPort(tlsH2.URL), UseTLS: true}, checkPass, ""},
+		{"TLS without h2", Target{Addr: hostPort(tlsH1.URL), UseTLS: true}, checkWarn, "ALPN h2"},
+		{"TLS without h2 over gRPC-Web", Target{Addr: hostPort(tlsH1.URL), UseTLS: true, Transport: transportGRPCWeb}, checkPass, ""},
+		{"TLS not enabled", Target{Addr: hostPort(tlsH2.URL)}, checkFail, "GRPS_BACKEND_USE_TLS=true"},
+		{"plaintext gRPC", Target{Addr: grpcAddr}, checkPass, ""},
+		{"TLS against plaintext gRPC", Target{Addr: grpcAddr, UseTLS: true}, checkFail, "GRPS_BACKEND_USE_TLS=false"},
+		{"HTTP/1.1 for gRPC", Target{Addr: hostPort(http1.URL)}, checkFail, "not a gRPC server"},
+		{"HTTP/1.1 for Connect", Target{Addr: hostPort(http1.URL), Transport: transportConnect}, checkPass, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := checkProtocol(context.Background(), tt.target)
+			if c.Status != tt.want || !strings.Contains(c.Hint, tt.wantHint) {
+				t.Errorf("checkProtocol() = %s (%s, hint %q), want %s with hint %q", c.Status, c.Detail, c.Hint, tt.want, tt.wantHint)
+			}
+		})
+	}
+}
+
+func TestCheckReflectionAndHealth(t *testing.T) {
+	ctx := context.Background()
+	addr, _, _ := startTestBackend(t)
+	conn := dialForTest(t, addr, nil)
+	if c := checkReflection(ctx, conn); c.Status != checkPass || len(c.Data["available"].([]string)) != 2 {
+		t.Errorf("checkReflection() = %s (%s, %v), want both versions", c.Status, c.Detail, c.Data)
+	}
+	if c := checkHealth(ctx, conn); c.Status != checkPass || c.Detail != "SERVING" {
+		t.Errorf("checkHealth() = %s (%s), want SERVING", c.Status, c.Detail)
+	}
+
+	// A server with neither service.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare := grpc.NewServer()
+	go bare.Serve(lis)
+	defer bare.Stop()
+	conn = dialForTest(t, lis.Addr().String(), nil)
+	if c := checkReflection(ctx, conn); c.Status != checkWarn || !strings.Contains(c.Hint, "GRPS_PROTO_DIR") {
+		t.Errorf("checkReflection() without reflection = %s (%s), want a warning", c.Status, c.Detail)
+	}
+	if c := checkHealth(ctx, conn); c.Status != checkWarn {
+		t.Errorf("checkHealth() without health = %s (%s), want a warning", c.Status, c.Detail)
+	}
+
+	// Nothing listening.
+	conn = dialForTest(t, closedAddr(t), nil)
+	if c := checkHealth(ctx, conn); c.Status != checkFail {
+		t.Errorf("checkHealth() against a closed port = %s (%s), want %s", c.Status, c.Detail, checkFail)
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	addr, _, _ := startTestBackend(t)
+	report := diagnose(context.Background(), Target{Name: "default", Addr: addr})
+	if !report.OK {
+		t.Errorf("diagnose() of a healthy backend failed: %+v", report.Checks)
+	}
+	var names []string
+	for _, c := range report.Checks {
+		names = append(names, c.Name)
+		if c.Status != checkPass {
+			t.Errorf("check %s = %s (%s)", c.Name, c.Status, c.Detail)
+		}
+	}
+	if got := strings.Join(names, ","); got != "dns,tcp,protocol,reflection,health" {
+		t.Errorf("checks = %s", got)
+	}
+
+	report = diagnose(context.Background(), Target{Name: "down", Addr: closedAddr(t)})
+	if report.OK {
+		t.Error("diagnose() of a closed port passed")
+	}
+	statuses := map[string]string{}
+	for _, c := range report.Checks {
+		statuses[c.Name] = c.Status
+	}
+	if statuses["tcp"] != checkFail || statuses["protocol"] != checkSkip || statuses["health"] != checkSkip {
+		t.Errorf("checks after a failed connect = %v", statuses)
+	}
+
+	if report := diagnose(context.Background(), Target{Addr: "no-port"}); report.OK || report.Checks[0].Name != "address" {
+		t.Errorf("diagnose() of an invalid address = %+v", report)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	// Registers the standard google.rpc error detail types (ErrorInfo,
+	// BadRequest, RetryInfo, DebugInfo, ...) so they decode without reflection.
+	_ "google.golang.org/genproto/googleapis/rpc/errdetails"
+)
+
+// ErrorDetail is one entry of google.rpc.Status.details.
+type ErrorDetail struct {
+	Type  string          `json:"type"`            // full message name, e.g. google.rpc.BadRequest
+	Value json.RawMessage `json:"value,omitempty"` // the detail as JSON, if its type is known
+	Raw   []byte          `json:"raw,omitempty"`   // the encoded detail, if its type is unknown
+}
+
+// statusDetails decodes the details attached to a gRPC status error. Types are
+// resolved from the well-known error details first and then from the target's
+// schema; details of unknown types are returned undecoded.
+func statusDetails(err error, snap *schemaSnapshot) []ErrorDetail {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil
+	}
+	anys := st.Proto().GetDetails()
+	if len(anys) == 0 {
+		return nil
+	}
+	out := make([]ErrorDetail, 0, len(anys))
+	for _, a := range anys {
+		out = append(out, decodeDetail(a, snap))
+	}
+	return out
+}
+
+func decodeDetail(a *anypb.Any, snap *schemaSnapshot) ErrorDetail {
+	name := string(a.MessageName())
+	if name == "" {
+		name = a.GetTypeUrl()
+	}
+	detail := ErrorDetail{Type: name}
+
+	if msg, err := a.UnmarshalNew(); err == nil {
+		if b, err := protojson.Marshal(msg); err == nil {
+			detail.Value = b
+			return detail
+		}
+	}
+	if snap != nil {
+		if md := snap.findMessage(name); md != nil {
+			msg := dynamic.NewMessage(md)
+			if err := msg.Unmarshal(a.GetValue()); err == nil {
+				if b, err := msg.MarshalJSON(); err == nil {
+					detail.Value = b
+					return detail
+				}
+			}
+		}
+	}
+	detail.Raw = a.GetValue()
+	return detail
+}
+
+// findMessage looks a message type up in the files of the snapshot's services
+// and their dependencies.
+func (snap *schemaSnapshot) findMessage(name string) *desc.MessageDescriptor {
+	name = strings.TrimPrefix(name, ".")
+	seen := make(map[string]bool)
+	var find func(fd *desc.FileDescriptor) *desc.MessageDescriptor
+	find = func(fd *desc.FileDescriptor) *desc.MessageDescriptor {
+		if seen[fd.GetName()] {
+			return nil
+		}
+		seen[fd.GetName()] = true
+		if md := fd.FindMessage(name); md != nil {
+			return md
+		}
+		for _, dep := range fd.GetDependencies() {
+			if md := find(dep); md != nil {
+				return md
+			}
+		}
+		return nil
+	}
+	for _, svc := range snap.Services {
+		if md := find(svc.GetFile()); md != nil {
+			return md
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Classes of invocation errors, reported as InvokeError.Kind.
+const (
+	errKindTransport        = "transport"         // the backend could not be reached
+	errKindProtocolMismatch = "protocol_mismatch" // something answered, but not gRPC (or TLS mismatch)
+	errKindDescriptor       = "descriptor"        // the method or its types could not be resolved
+	errKindPayload          = "payload"           // the request payload does not match the input type
+	errKindApplication      = "application"       // the backend returned a gRPC status
+)
+
+// kindError marks an error with its class where it is raised.
+type kindError struct {
+	kind string
+	err  error
+}
+
+func (e *kindError) Error() string { return e.err.Error() }
+func (e *kindError) Unwrap() error { return e.err }
+
+func withKind(kind string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// grpc-go flattens connection failures into status messages, so the client's
+// own failures can only be told apart from statuses sent by the backend by
+// their text. The signatures live here and nowhere else; errorclass_test.go
+// checks them against errors produced by grpc-go.
+var (
+	// protocolMismatchSignatures are fragments of the errors reported when
+	// the other end does not speak gRPC over HTTP/2, or TLS settings
+	// disagree.
+	protocolMismatchSignatures = []string{
+		"frame too large",
+		"server preface",
+		"malformed http response",
+		"unexpected http status code",
+		"received unexpected content-type",
+		"first record does not look like a tls handshake",
+	}
+	// transportSignatures are fragments of the Unavailable statuses the
+	// client synthesizes when the backend could not be reached. httpConn
+	// reports its failures in the same form.
+	transportSignatures = []string{
+		"connection error",
+		"name resolver error",
+		"produced zero addresses",
+		"error reading from server",
+		"transport is closing",
+	}
+)
+
+// classifyError returns the class of err. answered reports whether the
+// backend sent response metadata; a call that got any is never a transport
+// failure. An Unavailable status without metadata is only a transport failure
+// if the client synthesized it: backends shedding load reply with Unavailable
+// too, and that is the application's answer.
+func classifyError(err error, answered bool) string {
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return ke.kind
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			return errKindTransport
+		}
+		if matchesSignature(err.Error(), protocolMismatchSignatures) {
+			return errKindProtocolMismatch
+		}
+		return errKindTransport
+	}
+	// A reply that is not gRPC is mapped onto any code, e.g. Unimplemented
+	// for an HTTP 404.
+	if matchesSignature(st.Message(), protocolMismatchSignatures) {
+		return errKindProtocolMismatch
+	}
+	if !answered && st.Code() == codes.Unavailable && matchesSignature(st.Message(), transportSignatures) {
+		return errKindTransport
+	}
+	return errKindApplication
+}
+
+func matchesSignature(msg string, signatures []string) bool {
+	msg = strings.ToLower(msg)
+	for _, sig := range signatures {
+		if strings.Contains(msg, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorMessage describes a failed call with guidance that follows from its
+// class. Application errors are the backend's own message.
+func errorMessage(kind string, err error, target Target) string {
+	switch kind {
+	case errKindTransport, errKindProtocolMismatch:
+		if hint := describeTLSError(err, target); hint != "" {
+			return hint
+		}
+	}
+	detail := status.Convert(err).Message()
+	switch kind {
+	case errKindTransport:
+		return fmt.Sprintf("Backend unreachable: the gRPC backend at %s could not be reached (%s). Please check that it is running and that GRPS_BACKEND_ADDR in Settings is correct.", target.Addr, detail)
+	case errKindProtocolMismatch:
+		return fmt.Sprintf("Protocol mismatch: the address %s answered, but not as a gRPC server (%s). Please verify GRPS_BACKEND_ADDR is pointing to a gRPC server and that its transport and TLS settings match.", target.Addr, detail)
+	}
+	return err.Error()
+}
+
+// httpStatusForError is the HTTP status used for an error of the given class.
+func httpStatusForError(kind string, code codes.Code) int {
+	switch kind {
+	case errKindTransport:
+		return http.StatusServiceUnavailable
+	case errKindProtocolMismatch:
+		return http.StatusBadGateway
+	case errKindDescriptor:
+		return http.StatusNotFound
+	case errKindPayload:
+		return http.StatusBadRequest
+	}
+	return httpStatusForCode(code)
+}
+
+// httpStatusForCode maps a gRPC status code returned by the backend to the
+// closest HTTP status, following the gRPC-HTTP mapping used by gateways.
+func httpStatusForCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // client closed request
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// answeredBy reports whether any response metadata was received.
+func answeredBy(header, trailer metadata.MD) bool {
+	return len(header) > 0 || len(trailer) > 0
+}
+
+// newInvokeError builds the InvokeError reported for a failed call, and the
+// HTTP status that goes with it.
+func newInvokeError(ctx context.Context, err error, target Target, snap *schemaSnapshot, answered bool) (*InvokeError, int) {
+	kind := classifyError(err, answered)
+	code := status.Code(err)
+	if _, isStatus := status.FromError(err); !isStatus {
+		// Raised locally, so there is no status from the backend to report.
+		switch kind {
+		case errKindDescriptor:
+			code = codes.NotFound
+		case errKindPayload:
+			code = codes.InvalidArgument
+		case errKindTransport, errKindProtocolMismatch:
+			code = codes.Unavailable
+		}
+	}
+	ie := &InvokeError{
+		Kind:    kind,
+		Message: callErrorMessage(ctx, kind, err, target),
+		Code:    code.String(),
+	}
+	if kind == errKindApplication {
+		ie.Details = statusDetails(err, snap)
+	}
+	return ie, httpStatusForError(kind, code)
+}
+
+// schemaError classifies a failure to load a target's schema. A backend that
+// answers without reflection, with nothing local to describe it, is a
+// descriptor problem rather than an application error.
+func schemaError(err error) error {
+	if status.Code(err) == codes.Unimplemented {
+		return withKind(errKindDescriptor, err)
+	}
+	return err
+}
+
+// writeClassifiedError writes a plain-text error with the HTTP status of its
+// class, which is also sent in the X-Error-Kind header.
+func writeClassifiedError(w http.ResponseWriter, msg string, err error) {
+	kind := classifyError(err, false)
+	w.Header().Set("X-Error-Kind", kind)
+	http.Error(w, msg, httpStatusForError(kind, status.Code(err)))
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// sheddingHealth answers Check like a backend under load for some services.
+type sheddingHealth struct {
+	*health.Server
+}
+
+func (h sheddingHealth) Check(ctx context.Context, r *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	switch r.Service {
+	case "shed":
+		return nil, status.Error(codes.Unavailable, "server overloaded, retry later")
+	case "shed-with-metadata":
+		_ = grpc.SetHeader(ctx, metadata.Pairs("retry-after", "1"))
+		return nil, status.Error(codes.Unavailable, "server overloaded, retry later")
+	}
+	return h.Server.Check(ctx, r)
+}
+
+func startSheddingBackend(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, sheddingHealth{health.NewServer()})
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	return lis.Addr().String()
+}
+
+// closedAddr returns a local address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+// callCheck calls Health/Check and returns the error and whether the backend
+// sent any metadata.
+func callCheck(t *testing.T, conn grpc.ClientConnInterface, service string) (error, bool) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var header, trailer metadata.MD
+	_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service}, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err == nil {
+		t.Fatal("call succeeded, want an error")
+	}
+	return err, answeredBy(header, trailer)
+}
+
+func dialForTest(t *testing.T, addr string, creds credentials.TransportCredentials) *grpc.ClientConn {
+	t.Helper()
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestClassifyGRPCErrors(t *testing.T) {
+	shedding := startSheddingBackend(t)
+	plainGRPC, _, _ := startTestBackend(t)
+	http1 := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(http1.Close)
+	h2c := httptest.NewUnstartedServer(http.NotFoundHandler())
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	t.Cleanup(h2c.Close)
+	tlsBackend := startTLSBackend(t, newTestCA(t), nil)
+
+	tests := []struct {
+		name    string
+		call    func(t *testing.T) (error, bool)
+		want    string
+		message string // prefix of errorMessage
+	}{
+		{
+			name: "connection refused",
+			call: func(t *testing.T) (error, bool) {
+				return callCheck(t, dialForTest(t, closedAddr(t), nil), "")
+			},
+			want:    errKindTransport,
+			message: "Backend unreachable",
+		},
+		{
+			name: "HTTP/1.1 server",
+			call: func(t *testing.T) (error, bool) {
+				return callCheck(t, dialForTest(t, strings.TrimPrefix(http1.URL, "http://"), nil), "")
+			},
+			want:    errKindProtocolMismatch,
+			message: "Protocol mismatch",
+		},
+		{
+			name: "HTTP/2 server that is not gRPC",
+			call: func(t *testing.T) (error, bool) {
+				return callCheck(t, dialForTest(t, strings.TrimPrefix(h2c.URL, "http://"), nil), "")
+			},
+			want:    errKindProtocolMismatch,
+			message: "Protocol mismatch",
+		},
+		{
+			name: "plaintext against TLS",
+			call: func(t *testing.T) (error, bool) {
+				return callCheck(t, dialForTest(t, tlsBackend, nil), "")
+			},
+			want:    errKindProtocolMismatch,
+			message: "TLS mismatch",
+		},
+		{
+			name: "TLS against plaintext",
+			call: func(t *testing.T) (error, bool) {
+				return callCheck(t, dialForTest(t, plainGRPC, credentials.NewClientTLSFromCert(nil, "")), "")
+			},
+			want:    errKindProtocolMismatch,
+			message: "TLS mismatch",
+		},
+		{
+			name: "Unavailable from a backend shedding load",
+			call: func(t *testing.T) (error, bool) {
+				return callCheck(t, dialForTest(t, shedding, nil), "shed")
+			},
+			want:    errKindApplication,
+			message: "rpc error: code = Unavailable desc = server overloaded",
+		},
+		{
+			name: "Unavailable with metadata",
+			call: func(t *testing.T) (error, bool) {
+				return callCheck(t, dialForTest(t, shedding, nil), "shed-with-metadata")
+			},
+			want:    errKindApplication,
+			message: "rpc error: code = Unavailable",
+		},
+		{
+			name: "NotFound from the backend",
+			call: func(t *testing.T) (error, bool) {
+				return callCheck(t, dialForTest(t, shedding, nil), "unknown-service")
+			},
+			want:    errKindApplication,
+			message: "rpc error: code = NotFound",
+		},
+		{
+			name: "gRPC-Web transport refused",
+			call: func(t *testing.T) (error, bool) {
+				conn, err := dialBackend(Target{Addr: closedAddr(t), Transport: transportGRPCWeb})
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { conn.Close() })
+				return callCheck(t, conn, "")
+			},
+			want:    errKindTransport,
+			message: "Backend unreachable",
+		},
+		{
+			name: "classified where raised",
+			call: func(t *testing.T) (error, bool) {
+				return withKind(errKindPayload, errors.New("decode payload")), false
+			},
+			want:    errKindPayload,
+			message: "decode payload",
+		},
+		{
+			name: "local network error",
+			call: func(t *testing.T) (error, bool) {
+				_, err := net.DialTimeout("tcp", closedAddr(t), time.Second)
+				return err, false
+			},
+			want:    errKindTransport,
+			message: "Backend unreachable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err, answered := tt.call(t)
+			kind := classifyError(err, answered)
+			if kind != tt.want {
+				t.Errorf("classifyError(%v, %v) = %s, want %s", err, answered, kind, tt.want)
+			}
+			target := Target{Addr: "backend:50051"}
+			if msg := errorMessage(kind, err, target); !strings.HasPrefix(msg, tt.message) {
+				t.Errorf("errorMessage() = %q, want prefix %q", msg, tt.message)
+			}
+		})
+	}
+}
+
+func TestClassifyStreamBrokenByServer(t *testing.T) {
+	addr, gs, _ := startTestBackend(t)
+	conn := dialForTest(t, addr, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{Service: "svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	header, _ := stream.Header()
+	gs.Stop()
+	_, err = stream.Recv()
+	if err == nil {
+		t.Fatal("stream survived the server stopping")
+	}
+	// The stream had its headers, so the backend answered before going away.
+	if kind := classifyError(err, answeredBy(header, stream.Trailer())); kind != errKindApplication {
+		t.Errorf("classifyError(%v, answered) = %s, want %s", err, kind, errKindApplication)
+	}
+	if kind := classifyError(err, false); kind != errKindTransport {
+		t.Errorf("classifyError(%v, false) = %s, want %s", err, kind, errKindTransport)
+	}
+}
@@ -0,0 +1,823 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// In gateway mode (GRPS_GATEWAY) methods annotated with google.api.http are
+// served as REST routes on HTTPAddr, transcoded to gRPC calls on the proxy
+// target like Connect calls. Path variables, query parameters and the body are
+// bound to request fields as the annotation says; responses are JSON, and
+// server-streaming methods answer with one JSON object per line.
+
+const trafficSourceHTTP = "http"
+
+// gatewayMaxBodyBytes limits the body of a REST request.
+const gatewayMaxBodyBytes = 16 << 20
+
+// httpRoute is a REST route declared by a google.api.http rule.
+type httpRoute struct {
+	HTTPMethod   string
+	Template     string // the path template as declared, e.g. /v1/{name=shelves/*}
+	Body         string // "", "*" or the request field the body is bound to
+	ResponseBody string // the response field sent as the body; the whole response if empty
+	FullMethod   string
+	MethodDesc   *desc.MethodDescriptor
+
+	path *pathTemplate
+}
+
+// collectHTTPRoutes returns the routes declared on methods, most specific
+// first. Rules that cannot be served are logged and skipped.
+func collectHTTPRoutes(methods []MethodInfo) []*httpRoute {
+	var routes []*httpRoute
+	for _, m := range methods {
+		if m.MethodDesc == nil {
+			continue
+		}
+		for _, rule := range httpRules(m.MethodDesc) {
+			route, err := newHTTPRoute(m.FullName, m.MethodDesc, rule)
+			if err != nil {
+				log.Printf("WARNING: ignoring HTTP rule of %s: %v", m.FullName, err)
+				continue
+			}
+			routes = append(routes, route)
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].path.moreSpecific(routes[j].path)
+	})
+	return routes
+}
+
+// httpRules returns the google.api.http rule of a method and its additional
+// bindings. Options that arrive over reflection keep the extension as unknown
+// fields, so they are parsed again against the registered extension.
+func httpRules(methodDesc *desc.MethodDescriptor) []*annotations.HttpRule {
+	opts := methodDesc.GetMethodOptions()
+	if opts == nil {
+		return nil
+	}
+	raw, err := proto.Marshal(opts)
+	if err != nil {
+		return nil
+	}
+	parsed := &descriptorpb.MethodOptions{}
+	if err := (proto.UnmarshalOptions{Resolver: protoregistry.GlobalTypes}).Unmarshal(raw, parsed); err != nil {
+		return nil
+	}
+	rule, _ := proto.GetExtension(parsed, annotations.E_Http).(*annotations.HttpRule)
+	if rule == nil || rule.GetPattern() == nil {
+		return nil
+	}
+	return append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...)
+}
+
+func newHTTPRoute(fullMethod string, methodDesc *desc.MethodDescriptor, rule *annotations.HttpRule) (*httpRoute, error) {
+	route := &httpRoute{
+		Body:         rule.GetBody(),
+		ResponseBody: rule.GetResponseBody(),
+		FullMethod:   fullMethod,
+		MethodDesc:   methodDesc,
+	}
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		route.HTTPMethod, route.Template = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		route.HTTPMethod, route.Template = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		route.HTTPMethod, route.Template = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		route.HTTPMethod, route.Template = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		route.HTTPMethod, route.Template = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		route.HTTPMethod, route.Template = strings.ToUpper(p.Custom.GetKind()), p.Custom.GetPath()
+	}
+	if methodDesc.IsClientStreaming() {
+		return nil, errors.New("client-streaming methods cannot be served over REST")
+	}
+	path, err := parsePathTemplate(route.Template)
+	if err != nil {
+		return nil, fmt.Errorf("path %q: %w", route.Template, err)
+	}
+	route.path = path
+
+	in := methodDesc.GetInputType()
+	for _, v := range path.vars {
+		fd, err := resolveFieldPath(in, v.fieldPath)
+		if err != nil {
+			return nil, fmt.Errorf("path variable %s: %w", strings.Join(v.fieldPath, "."), err)
+		}
+		if fd.IsRepeated() || fd.IsMap() {
+			return nil, fmt.Errorf("path variable %s is a repeated field", strings.Join(v.fieldPath, "."))
+		}
+	}
+	if route.Body != "" && route.Body != "*" {
+		if _, err := resolveFieldPath(in, strings.Split(route.Body, ".")); err != nil {
+			return nil, fmt.Errorf("body: %w", err)
+		}
+	}
+	if route.ResponseBody != "" {
+		if findField(methodDesc.GetOutputType(), route.ResponseBody) == nil {
+			return nil, fmt.Errorf("response_body: no field %q in %s", route.ResponseBody, methodDesc.GetOutputType().GetFullyQualifiedName())
+		}
+	}
+	return route, nil
+}
+
+// Kinds of path template segments.
+const (
+	segLiteral  = iota
+	segWildcard // *: exactly one segment
+	segDeep     // **: any number of trailing segments
+)
+
+type templateSegment struct {
+	kind    int
+	literal string
+}
+
+// templateVar binds the path segments [start, end) to a request field. end is
+// -1 for a variable that ends with **.
+type templateVar struct {
+	fieldPath []string
+	start     int
+	end       int
+}
+
+// pathTemplate is a parsed google.api.http path template:
+//
+//	Template = "/" Segments [ ":" Verb ]
+//	Segment  = "*" | "**" | LITERAL | "{" FieldPath [ "=" Segments ] "}"
+type pathTemplate struct {
+	segments []templateSegment
+	vars     []templateVar
+	verb     string
+}
+
+func parsePathTemplate(tmpl string) (*pathTemplate, error) {
+	if !strings.HasPrefix(tmpl, "/") {
+		return nil, errors.New("must start with /")
+	}
+	body := tmpl[1:]
+	t := &pathTemplate{}
+
+	// The verb follows the last colon outside of a variable.
+	depth := 0
+	for i := len(body) - 1; i >= 0; i-- {
+		switch body[i] {
+		case '}':
+			depth++
+		case '{':
+			depth--
+		case '/':
+			if depth == 0 {
+				i = 0 // the verb can only be in the last segment
+			}
+		case ':':
+			if depth == 0 {
+				body, t.verb = body[:i], body[i+1:]
+				if t.verb == "" {
+					return nil, errors.New("empty verb")
+				}
+				i = 0
+			}
+		}
+	}
+
+	for _, part := range splitTemplate(body) {
+		if strings.HasPrefix(part, "{") {
+			if !strings.HasSuffix(part, "}") {
+				return nil, fmt.Errorf("unterminated variable %q", part)
+			}
+			field, segs, hasSegs := strings.Cut(part[1:len(part)-1], "=")
+			if field == "" {
+				return nil, fmt.Errorf("variable %q has no field", part)
+			}
+			if !hasSegs {
+				segs = "*"
+			}
+			v := templateVar{fieldPath: strings.Split(field, "."), start: len(t.segments)}
+			for _, s := range strings.Split(segs, "/") {
+				seg, err := parseTemplateSegment(s)
+				if err != nil {
+					return nil, err
+				}
+				t.segments = append(t.segments, seg)
+			}
+			v.end = len(t.segments)
+			if t.segments[v.end-1].kind == segDeep {
+				v.end = -1
+			}
+			t.vars = append(t.vars, v)
+			continue
+		}
+		seg, err := parseTemplateSegment(part)
+		if err != nil {
+			return nil, err
+		}
+		t.segments = append(t.segments, seg)
+	}
+	for i, seg := range t.segments {
+		if seg.kind == segDeep && i != len(t.segments)-1 {
+			return nil, errors.New("** must be the last segment")
+		}
+	}
+	return t, nil
+}
+
+// splitTemplate splits a template at the slashes outside of variables.
+func splitTemplate(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '/':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseTemplateSegment(s string) (templateSegment, error) {
+	switch {
+	case s == "*":
+		return templateSegment{kind: segWildcard}, nil
+	case s == "**":
+		return templateSegment{kind: segDeep}, nil
+	case s == "" || strings.ContainsAny(s, "{}*="):
+		return templateSegment{}, fmt.Errorf("invalid segment %q", s)
+	}
+	return templateSegment{kind: segLiteral, literal: s}, nil
+}
+
+// match matches an escaped request path and returns the values of the
+// variables. A variable of one segment is unescaped; one of several keeps
+// escaped slashes as they are.
+func (t *pathTemplate) match(path string) (map[string]string, bool) {
+	if t.verb != "" {
+		var ok bool
+		if path, ok = strings.CutSuffix(path, ":"+t.verb); !ok {
+			return nil, false
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	parts := strings.Split(path[1:], "/")
+	n := len(t.segments)
+	deep := n > 0 && t.segments[n-1].kind == segDeep
+	if len(parts) != n && !(deep && len(parts) >= n-1) {
+		return nil, false
+	}
+	for i, seg := range t.segments {
+		switch seg.kind {
+		case segLiteral:
+			if p, err := url.PathUnescape(parts[i]); err != nil || p != seg.literal {
+				return nil, false
+			}
+		case segWildcard:
+			if parts[i] == "" {
+				return nil, false
+			}
+		}
+	}
+
+	values := make(map[string]string, len(t.vars))
+	for _, v := range t.vars {
+		end := v.end
+		if end < 0 {
+			end = len(parts)
+		}
+		var value string
+		if end-v.start == 1 {
+			value, _ = url.PathUnescape(parts[v.start])
+		} else {
+			segs := make([]string, 0, end-v.start)
+			for _, p := range parts[v.start:end] {
+				p, _ = url.PathUnescape(strings.ReplaceAll(strings.ReplaceAll(p, "%2F", "%252F"), "%2f", "%252f"))
+				segs = append(segs, p)
+			}
+			value = strings.Join(segs, "/")
+		}
+		values[strings.Join(v.fieldPath, ".")] = value
+	}
+	return values, true
+}
+
+// moreSpecific orders templates so that literals win over wildcards and fixed
+// lengths over trailing **.
+func (t *pathTemplate) moreSpecific(o *pathTemplate) bool {
+	tl, ol := t.literals(), o.literals()
+	if tl != ol {
+		return tl > ol
+	}
+	if t.deep() != o.deep() {
+		return !t.deep()
+	}
+	if (t.verb != "") != (o.verb != "") {
+		return t.verb != ""
+	}
+	return len(t.segments) > len(o.segments)
+}
+
+func (t *pathTemplate) literals() int {
+	n := 0
+	for _, seg := range t.segments {
+		if seg.kind == segLiteral {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *pathTemplate) deep() bool {
+	return len(t.segments) > 0 && t.segments[len(t.segments)-1].kind == segDeep
+}
+
+// matchRoute finds the route for a request. allowed lists the methods of
+// routes whose path matched when none of them has the request's method.
+func (snap *schemaSnapshot) matchRoute(method, path string) (route *httpRoute, vars map[string]string, allowed []string) {
+	for _, rt := range snap.Routes {
+		values, ok := rt.path.match(path)
+		if !ok {
+			continue
+		}
+		if rt.HTTPMethod == method || rt.HTTPMethod == "*" {
+			return rt, values, nil
+		}
+		allowed = append(allowed, rt.HTTPMethod)
+	}
+	return nil, nil, allowed
+}
+
+// serveGateway serves r if it matches a REST route of the proxy target, or
+// of the target named by the x-servicelens-target header, and reports whether
+// it did.
+func (s *Server) serveGateway(w http.ResponseWriter, r *http.Request) bool {
+	targetName := s.config().ProxyTarget
+	if name := r.Header.Get(targetHeader); name != "" {
+		targetName = name
+	}
+	conn, target, err := s.backend(targetName)
+	if err != nil {
+		return false
+	}
+	method := r.Method
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if preflight {
+		method = r.Header.Get("Access-Control-Request-Method")
+	}
+	ctx := r.Context()
+	snap, err := s.schema(ctx, conn, target, false)
+	if err != nil {
+		// Without a schema the routes are unknown. The failure is only this
+		// request's answer if a route of the last schema seen for the target
+		// would have matched; any other path is left to the other handlers.
+		cached, ok := s.schemas.get(target.Name)
+		if !ok || isConnectRequest(r) {
+			return false
+		}
+		if route, _, allowed := cached.matchRoute(method, r.URL.EscapedPath()); route == nil && len(allowed) == 0 {
+			return false
+		}
+		writeGatewayError(w, status.Errorf(codes.Unavailable, "gateway: load schema of target %s: %v", target.Name, err))
+		return true
+	}
+
+	route, vars, allowed := snap.matchRoute(method, r.URL.EscapedPath())
+	if route == nil {
+		if len(allowed) == 0 || isConnectRequest(r) {
+			return false
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, _ = w.Write(gatewayStatusJSON(status.Errorf(codes.Unimplemented, "%s is not allowed on %s", r.Method, r.URL.Path)))
+		return true
+	}
+	s.setCallCORSHeaders(w, r, route.HTTPMethod)
+	if preflight {
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+
+	reqMsg, err := route.newRequest(r, vars)
+	if err != nil {
+		writeGatewayError(w, err)
+		return true
+	}
+	frame, err := reqMsg.Marshal()
+	if err != nil {
+		writeGatewayError(w, status.Errorf(codes.Internal, "encode request: %v", err))
+		return true
+	}
+
+	ctx, call, done, err := s.inflight.start(ctx, "", target.Name, route.FullMethod, "http", 0)
+	if err != nil {
+		writeGatewayError(w, status.Error(codes.Internal, err.Error()))
+		return true
+	}
+	defer done()
+	md := connectRequestMetadata(r.Header)
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	session := &proxySession{start: call.StartedAt}
+	session.add("send", frame)
+	up, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: route.MethodDesc.IsServerStreaming()}, route.FullMethod, grpc.ForceCodec(rawCodec{}))
+	if err == nil {
+		err = up.SendMsg(&rawFrame{data: frame})
+		if err == nil || errors.Is(err, io.EOF) {
+			err = up.CloseSend()
+		}
+	}
+	var answered bool
+	if err == nil {
+		if route.MethodDesc.IsServerStreaming() {
+			answered, err = relayGatewayStream(w, up, route, session)
+		} else {
+			answered, err = relayGatewayUnary(w, up, route, session)
+		}
+	} else {
+		writeGatewayError(w, err)
+	}
+	session.end = time.Now()
+
+	origin := proxyOrigin{source: trafficSourceHTTP, header: r.Header.Clone()}
+	go s.recordProxyCall(target, route.FullMethod, origin, md, session, answered, err)
+	return true
+}
+
+// relayGatewayUnary writes the response of a unary call. Backend headers and
+// trailers are returned as Grpc-Metadata- and Grpc-Trailer- headers.
+func relayGatewayUnary(w http.ResponseWriter, up grpc.ClientStream, route *httpRoute, session *proxySession) (bool, error) {
+	header, _ := up.Header()
+	f := &rawFrame{}
+	err := up.RecvMsg(f)
+	if err == nil {
+		session.add("recv", f.data)
+		if extra := up.RecvMsg(&rawFrame{}); extra == nil {
+			err = status.Error(codes.Unimplemented, "unary method returned more than one response")
+		} else if !errors.Is(extra, io.EOF) {
+			err = extra
+		}
+	} else if errors.Is(err, io.EOF) {
+		err = status.Error(codes.Internal, "unary method returned no response")
+	}
+	trailer := up.Trailer()
+	answered := answeredBy(header, trailer)
+
+	var body []byte
+	if err == nil {
+		body, err = route.encodeResponse(f.data)
+	}
+	setConnectHeaders(w.Header(), header, "Grpc-Metadata-")
+	setConnectHeaders(w.Header(), trailer, "Grpc-Trailer-")
+	if err != nil {
+		writeGatewayError(w, err)
+		return answered, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+	return true, nil
+}
+
+// relayGatewayStream writes each response of a server-streaming call as a
+// line {"result": ...}. A failure after the stream started is written as a
+// final line {"error": ...}.
+func relayGatewayStream(w http.ResponseWriter, up grpc.ClientStream, route *httpRoute, session *proxySession) (bool, error) {
+	flusher, _ := w.(http.Flusher)
+	header, _ := up.Header()
+	setConnectHeaders(w.Header(), header, "Grpc-Metadata-")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	var err error
+	for {
+		f := &rawFrame{}
+		if err = up.RecvMsg(f); err != nil {
+			break
+		}
+		session.add("recv", f.data)
+		var body []byte
+		if body, err = route.encodeResponse(f.data); err != nil {
+			break
+		}
+		if _, writeErr := fmt.Fprintf(w, "{\"result\":%s}\n", body); writeErr != nil {
+			return true, writeErr
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(w, "{\"error\":%s}\n", gatewayStatusJSON(err))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return err == nil || answeredBy(header, up.Trailer()), err
+}
+
+// newRequest builds the request message from the body, the path variables
+// and, unless the whole body is the request, the query parameters.
+func (route *httpRoute) newRequest(r *http.Request, vars map[string]string) (*dynamic.Message, error) {
+	msg := dynamic.NewMessage(route.MethodDesc.GetInputType())
+	if route.Body != "" {
+		body, err := io.ReadAll(io.LimitReader(r.Body, gatewayMaxBodyBytes+1))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "read body: %v", err)
+		}
+		if len(body) > gatewayMaxBodyBytes {
+			return nil, status.Errorf(codes.ResourceExhausted, "request body exceeds %d bytes", gatewayMaxBodyBytes)
+		}
+		if err := bindBody(msg, route.Body, body); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "decode body: %v", err)
+		}
+	}
+	for field, value := range vars {
+		if err := setFieldFromStrings(msg, strings.Split(field, "."), []string{value}); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "path variable %s: %v", field, err)
+		}
+	}
+	if route.Body == "*" {
+		return msg, nil
+	}
+	for key, values := range r.URL.Query() {
+		if _, isVar := vars[key]; isVar || key == route.Body || strings.HasPrefix(key, route.Body+".") && route.Body != "" {
+			continue
+		}
+		path := strings.Split(key, ".")
+		if _, err := resolveFieldPath(msg.GetMessageDescriptor(), path); err != nil {
+			continue // unknown parameters are ignored, as other gateways do
+		}
+		if err := setFieldFromStrings(msg, path, values); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "query parameter %s: %v", key, err)
+		}
+	}
+	return msg, nil
+}
+
+// bindBody decodes a JSON body into the whole message ("*") or into the field
+// at fieldPath.
+func bindBody(msg *dynamic.Message, fieldPath string, body []byte) error {
+	if strings.TrimSpace(string(body)) == "" {
+		return nil
+	}
+	if fieldPath == "*" {
+		return msg.UnmarshalJSON(body)
+	}
+	path := strings.Split(fieldPath, ".")
+	parent := msg
+	for _, name := range path[:len(path)-1] {
+		parent = nestedMessage(parent, findField(parent.GetMessageDescriptor(), name))
+	}
+	fd := findField(parent.GetMessageDescriptor(), path[len(path)-1])
+	// Decoding {"field": body} into a scratch message handles every field kind.
+	wrapped, err := json.Marshal(map[string]json.RawMessage{fd.GetJSONName(): body})
+	if err != nil {
+		return err
+	}
+	scratch := dynamic.NewMessage(parent.GetMessageDescriptor())
+	if err := scratch.UnmarshalJSON(wrapped); err != nil {
+		return err
+	}
+	return parent.TrySetField(fd, scratch.GetField(fd))
+}
+
+// findField looks a field up by its proto name or its JSON name.
+func findField(md *desc.MessageDescriptor, name string) *desc.FieldDescriptor {
+	if fd := md.FindFieldByName(name); fd != nil {
+		return fd
+	}
+	return md.FindFieldByJSONName(name)
+}
+
+// resolveFieldPath returns the field a dotted path such as book.author.name
+// refers to. Every field but the last must be a singular message.
+func resolveFieldPath(md *desc.MessageDescriptor, path []string) (*desc.FieldDescriptor, error) {
+	var fd *desc.FieldDescriptor
+	for i, name := range path {
+		if fd = findField(md, name); fd == nil {
+			return nil, fmt.Errorf("no field %q in %s", name, md.GetFullyQualifiedName())
+		}
+		if i < len(path)-1 {
+			if md = fd.GetMessageType(); md == nil || fd.IsRepeated() {
+				return nil, fmt.Errorf("%s is not a singular message field", name)
+			}
+		}
+	}
+	return fd, nil
+}
+
+// nestedMessage returns the message in a singular message field, setting an
+// empty one first if needed.
+func nestedMessage(parent *dynamic.Message, fd *desc.FieldDescriptor) *dynamic.Message {
+	if parent.HasField(fd) {
+		if m, ok := parent.GetField(fd).(*dynamic.Message); ok {
+			return m
+		}
+	}
+	m := dynamic.NewMessage(fd.GetMessageType())
+	parent.SetField(fd, m)
+	return m
+}
+
+// setFieldFromStrings sets the field at path from path or query values.
+// Repeated fields take every value, others the last one.
+func setFieldFromStrings(msg *dynamic.Message, path []string, values []string) error {
+	parent := msg
+	for _, name := range path[:len(path)-1] {
+		parent = nestedMessage(parent, findField(parent.GetMessageDescriptor(), name))
+	}
+	fd := findField(parent.GetMessageDescriptor(), path[len(path)-1])
+	if fd.IsMap() {
+		return errors.New("map fields cannot be set from a string")
+	}
+	if fd.IsRepeated() {
+		for _, v := range values {
+			val, err := parseFieldValue(fd, v)
+			if err != nil {
+				return err
+			}
+			if err := parent.TryAddRepeatedField(fd, val); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	val, err := parseFieldValue(fd, values[len(values)-1])
+	if err != nil {
+		return err
+	}
+	return parent.TrySetField(fd, val)
+}
+
+// parseFieldValue converts a string to the Go value of a field's type. Enums
+// take a name or a number; message fields take their JSON form, which covers
+// well-known types such as Timestamp ("2024-01-02T15:04:05Z") and wrappers.
+func parseFieldValue(fd *desc.FieldDescriptor, s string) (any, error) {
+	switch fd.GetType() {
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING:
+		return s, nil
+	case descriptorpb.FieldDescriptorProto_TYPE_BYTES:
+		if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+			return b, nil
+		}
+		return base64.URLEncoding.DecodeString(s)
+	case descriptorpb.FieldDescriptorProto_TYPE_BOOL:
+		return strconv.ParseBool(s)
+	case descriptorpb.FieldDescriptorProto_TYPE_INT32, descriptorpb.FieldDescriptorProto_TYPE_SINT32, descriptorpb.FieldDescriptorProto_TYPE_SFIXED32:
+		n, err := strconv.ParseInt(s, 10, 32)
+		return int32(n), err
+	case descriptorpb.FieldDescriptorProto_TYPE_INT64, descriptorpb.FieldDescriptorProto_TYPE_SINT64, descriptorpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return strconv.ParseInt(s, 10, 64)
+	case descriptorpb.FieldDescriptorProto_TYPE_UINT32, descriptorpb.FieldDescriptorProto_TYPE_FIXED32:
+		n, err := strconv.ParseUint(s, 10, 32)
+		return uint32(n), err
+	case descriptorpb.FieldDescriptorProto_TYPE_UINT64, descriptorpb.FieldDescriptorProto_TYPE_FIXED64:
+		return strconv.ParseUint(s, 10, 64)
+	case descriptorpb.FieldDescriptorProto_TYPE_FLOAT:
+		f, err := strconv.ParseFloat(s, 32)
+		return float32(f), err
+	case descriptorpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return strconv.ParseFloat(s, 64)
+	case descriptorpb.FieldDescriptorProto_TYPE_ENUM:
+		if v := fd.GetEnumType().FindValueByName(s); v != nil {
+			return v.GetNumber(), nil
+		}
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || fd.GetEnumType().FindValueByNumber(int32(n)) == nil {
+			return nil, fmt.Errorf("%q is not a value of %s", s, fd.GetEnumType().GetFullyQualifiedName())
+		}
+		return int32(n), nil
+	case descriptorpb.FieldDescriptorProto_TYPE_MESSAGE:
+		m := dynamic.NewMessage(fd.GetMessageType())
+		quoted, _ := json.Marshal(s)
+		if err := m.UnmarshalJSON(quoted); err == nil {
+			return m, nil
+		}
+		if err := m.UnmarshalJSON([]byte(s)); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported field type %s", fd.GetType())
+}
+
+// encodeResponse converts a response from the protobuf wire format to JSON,
+// or only the response_body field of it.
+func (route *httpRoute) encodeResponse(data []byte) ([]byte, error) {
+	msg := dynamic.NewMessage(route.MethodDesc.GetOutputType())
+	if err := msg.Unmarshal(data); err != nil {
+		return nil, status.Errorf(codes.Internal, "decode response: %v", err)
+	}
+	body, err := msg.MarshalJSON()
+	if err != nil || route.ResponseBody == "" {
+		return body, err
+	}
+	fd := findField(msg.GetMessageDescriptor(), route.ResponseBody)
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	if v, ok := fields[fd.GetJSONName()]; ok {
+		return v, nil
+	}
+	// Unset fields are left out of the JSON form; send their zero value.
+	switch {
+	case fd.IsMap() || fd.GetMessageType() != nil && !fd.IsRepeated():
+		return []byte("{}"), nil
+	case fd.IsRepeated():
+		return []byte("[]"), nil
+	}
+	return json.Marshal(fd.GetDefaultValue())
+}
+
+// writeGatewayError writes err as the JSON form of a google.rpc.Status with
+// the HTTP status that corresponds to its code.
+func writeGatewayError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusForCode(gatewayStatus(err).Code()))
+	_, _ = w.Write(gatewayStatusJSON(err))
+}
+
+func gatewayStatus(err error) *status.Status {
+	st := status.Convert(err)
+	if st.Code() == codes.Unknown {
+		if ctxSt := status.FromContextError(err); ctxSt.Code() != codes.Unknown {
+			st = ctxSt
+		}
+	}
+	return st
+}
+
+// gatewayStatusJSON renders a status as JSON. Details of types the inspector
+// does not know are dropped rather than failing the whole error.
+func gatewayStatusJSON(err error) []byte {
+	p := gatewayStatus(err).Proto()
+	if b, err := protojson.Marshal(p); err == nil {
+		return b
+	}
+	p.Details = []*anypb.Any{}
+	b, _ := protojson.Marshal(p)
+	return b
+}
+
+// gatewayMethods lists the REST routes of a schema for the capability
+// manifest.
+func gatewayMethods(snap *schemaSnapshot) []MethodDescriptor {
+	out := make([]MethodDescriptor, 0, len(snap.Routes))
+	for _, rt := range snap.Routes {
+		out = append(out, MethodDescriptor{
+			ID:                rt.HTTPMethod + " " + rt.Template,
+			DisplayName:       rt.HTTPMethod + " " + rt.Template,
+			Protocol:          "http",
+			Path:              rt.Template,
+			HTTPMethod:        rt.HTTPMethod,
+			HTTPBody:          rt.Body,
+			RPC:               rt.FullMethod,
+			RequestType:       rt.MethodDesc.GetInputType().GetFullyQualifiedName(),
+			ResponseType:      rt.MethodDesc.GetOutputType().GetFullyQualifiedName(),
+			SupportsStreaming: rt.MethodDesc.IsServerStreaming(),
+		})
+	}
+	return out
+}
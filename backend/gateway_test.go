@@ -0,0 +1,537 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const gatewayTestProto = `syntax = "proto3";
+package lib;
+import "google/api/annotations.proto";
+enum Kind { KIND_UNSPECIFIED = 0; NOVEL = 1; }
+message Author { string name = 1; }
+message Book {
+  string name = 1;
+  string title = 2;
+  int32 pages = 3;
+  Kind kind = 4;
+  repeated string tags = 5;
+  Author author = 6;
+}
+message GetBookRequest {
+  string name = 1;
+  Kind kind = 2;
+  repeated string tags = 3;
+  Author author = 4;
+  int32 page_size = 5;
+}
+message CreateBookRequest { string parent = 1; Book book = 2; }
+service Library {
+  rpc GetBook(GetBookRequest) returns (Book) {
+    option (google.api.http) = {
+      get: "/v1/{name=shelves/*/books/*}"
+      additional_bindings { get: "/v1/books/{name=**}" }
+    };
+  }
+  rpc CreateBook(CreateBookRequest) returns (Book) {
+    option (google.api.http) = { post: "/v1/{parent=shelves/*}/books" body: "book" };
+  }
+  rpc UpdateBook(Book) returns (Book) {
+    option (google.api.http) = { patch: "/v1/{name=shelves/*/books/*}:update" body: "*" response_body: "title" };
+  }
+}`
+
+// parseGatewayTestProto returns the lib.Library service of gatewayTestProto.
+func parseGatewayTestProto(t *testing.T) *desc.ServiceDescriptor {
+	t.Helper()
+	p := protoparse.Parser{
+		Accessor: protoparse.FileContentsFromMap(map[string]string{"lib.proto": gatewayTestProto}),
+		LookupImportProto: func(name string) (*descriptorpb.FileDescriptorProto, error) {
+			switch name {
+			case "google/api/annotations.proto":
+				return protodesc.ToFileDescriptorProto(annotations.File_google_api_annotations_proto), nil
+			case "google/api/http.proto":
+				return protodesc.ToFileDescriptorProto(annotations.File_google_api_http_proto), nil
+			}
+			return nil, protoregistry.NotFound
+		},
+	}
+	fds, err := p.ParseFiles("lib.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fds[0].FindService("lib.Library")
+}
+
+type serviceInfos map[string]grpc.ServiceInfo
+
+func (i serviceInfos) GetServiceInfo() map[string]grpc.ServiceInfo { return i }
+
+// startLibraryBackend serves lib.Library, whose methods answer with a book
+// titled after the requested name, and reflection for it.
+func startLibraryBackend(t *testing.T) string {
+	t.Helper()
+	svc := parseGatewayTestProto(t)
+	files := &protoregistry.Files{}
+	var register func(fd *desc.FileDescriptor)
+	register = func(fd *desc.FileDescriptor) {
+		for _, dep := range fd.GetDependencies() {
+			register(dep)
+		}
+		if _, err := files.FindFileByPath(fd.GetName()); err != nil {
+			if err := files.RegisterFile(fd.UnwrapFile()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	register(svc.GetFile())
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		fullMethod, _ := grpc.MethodFromServerStream(stream)
+		method := svc.FindMethodByName(parseMethod(fullMethod))
+		if method == nil {
+			return status.Errorf(codes.Unimplemented, "unknown method %s", fullMethod)
+		}
+		in := &rawFrame{}
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		req := dynamic.NewMessage(method.GetInputType())
+		if err := req.Unmarshal(in.data); err != nil {
+			return err
+		}
+		name, _ := req.TryGetFieldByName("name")
+		book := dynamic.NewMessage(method.GetOutputType())
+		book.SetFieldByName("name", name)
+		book.SetFieldByName("title", fmt.Sprintf("title of %v", name))
+		data, err := book.Marshal()
+		if err != nil {
+			return err
+		}
+		return stream.SendMsg(&rawFrame{data: data})
+	}))
+	reflectionpb.RegisterServerReflectionServer(gs, reflection.NewServerV1(reflection.ServerOptions{
+		Services:           serviceInfos{"lib.Library": {}},
+		DescriptorResolver: files,
+	}))
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	return lis.Addr().String()
+}
+
+// gatewayDo sends a request through serveGateway, falling back to a 404 like
+// the root handler, and returns the response.
+func gatewayDo(t *testing.T, srv *Server, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if !srv.serveGateway(rec, r) {
+		http.NotFound(rec, r)
+	}
+	return rec
+}
+
+// gatewayGet sends a GET through serveGateway and returns the status and body.
+func gatewayGet(t *testing.T, srv *Server, path string) (int, string) {
+	t.Helper()
+	rec := gatewayDo(t, srv, http.MethodGet, path, "")
+	return rec.Code, rec.Body.String()
+}
+
+func TestServeGateway(t *testing.T) {
+	srv := newServer(Config{BackendAddr: startLibraryBackend(t), Gateway: true})
+	defer srv.conns.closeAll()
+
+	code, body := gatewayGet(t, srv, "/v1/shelves/1/books/dune")
+	if code != http.StatusOK || !strings.Contains(body, `"title":"title of shelves/1/books/dune"`) {
+		t.Errorf("GET of a route = %d %s, want the book", code, body)
+	}
+	if code, _ := gatewayGet(t, srv, "/v2/unknown"); code != http.StatusNotFound {
+		t.Errorf("GET of an unknown path = %d, want 404", code)
+	}
+	rec := gatewayDo(t, srv, http.MethodPatch, "/v1/shelves/1/books/dune:update", `{"pages":3}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `"title of shelves/1/books/dune"` {
+		t.Errorf("PATCH with response_body = %d %s, want only the title", rec.Code, rec.Body)
+	}
+	rec = gatewayDo(t, srv, http.MethodDelete, "/v1/shelves/1/books/dune", "")
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET" {
+		t.Errorf("DELETE of a GET route = %d with Allow %q, want 405 with Allow GET", rec.Code, rec.Header().Get("Allow"))
+	}
+	if !strings.Contains(rec.Body.String(), `"code":12`) {
+		t.Errorf("405 body = %s, want an Unimplemented status", rec.Body)
+	}
+}
+
+func TestServeGatewayBackendDown(t *testing.T) {
+	// Nothing cached: no path can be known to be a route.
+	srv := newServer(Config{BackendAddr: closedAddr(t), Gateway: true})
+	defer srv.conns.closeAll()
+	for _, path := range []string{"/v1/shelves/1/books/dune", "/favicon.ico"} {
+		if code, _ := gatewayGet(t, srv, path); code != http.StatusNotFound {
+			t.Errorf("GET %s without a schema = %d, want 404", path, code)
+		}
+	}
+
+	// A schema of the target is cached, but the backend moved and is down:
+	// only its routes report the failure.
+	srv = newServer(Config{BackendAddr: startLibraryBackend(t), Gateway: true})
+	defer srv.conns.closeAll()
+	if code, body := gatewayGet(t, srv, "/v1/shelves/1/books/dune"); code != http.StatusOK {
+		t.Fatalf("GET of a route = %d %s, want 200", code, body)
+	}
+	target := srv.cfg.defaultTarget()
+	target.Addr = closedAddr(t)
+	if err := srv.targets.put(target); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := gatewayGet(t, srv, "/v1/shelves/1/books/dune"); code != http.StatusServiceUnavailable {
+		t.Errorf("GET of a cached route = %d %s, want 503", code, body)
+	}
+	if code, _ := gatewayGet(t, srv, "/favicon.ico"); code != http.StatusNotFound {
+		t.Errorf("GET of an unknown path = %d, want 404", code)
+	}
+}
+
+func TestServeGatewayBacksOffSchemaLoads(t *testing.T) {
+	// A backend without reflection: every schema load fails.
+	var loads atomic.Int32
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		loads.Add(1)
+		return status.Error(codes.Unimplemented, "no reflection")
+	}))
+	go gs.Serve(lis)
+	defer gs.Stop()
+
+	srv := newServer(Config{BackendAddr: lis.Addr().String(), Gateway: true})
+	defer srv.conns.closeAll()
+	if code, _ := gatewayGet(t, srv, "/favicon.ico"); code != http.StatusNotFound {
+		t.Fatalf("GET without a schema = %d, want 404", code)
+	}
+	first := loads.Load()
+	if first == 0 {
+		t.Fatal("the first request did not try to load the schema")
+	}
+	for range 5 {
+		gatewayGet(t, srv, "/favicon.ico")
+	}
+	if got := loads.Load(); got != first {
+		t.Errorf("reflection calls = %d after stray requests, want %d: the failure was not remembered", got, first)
+	}
+}
+
+func TestParsePathTemplate(t *testing.T) {
+	type variable struct {
+		field      string
+		start, end int
+	}
+	tests := []struct {
+		tmpl     string
+		segments int
+		vars     []variable
+		verb     string
+		wantErr  string
+	}{
+		{tmpl: "/v1/books", segments: 2},
+		{tmpl: "/v1/{name}", segments: 2, vars: []variable{{"name", 1, 2}}},
+		{tmpl: "/v1/{name=shelves/*/books/*}", segments: 5, vars: []variable{{"name", 1, 5}}},
+		{tmpl: "/v1/{parent=shelves/*}/books/{book.author.name=authors/*}", segments: 6, vars: []variable{{"parent", 1, 3}, {"book.author.name", 4, 6}}},
+		{tmpl: "/v1/books/{name=**}", segments: 3, vars: []variable{{"name", 2, -1}}},
+		{tmpl: "/v1/*/**", segments: 3},
+		{tmpl: "/v1/{name=shelves/*}:publish", segments: 3, vars: []variable{{"name", 1, 3}}, verb: "publish"},
+		{tmpl: "/v1/books:batchGet", segments: 2, verb: "batchGet"},
+		{tmpl: "v1/books", wantErr: "must start with /"},
+		{tmpl: "/v1/books:", wantErr: "empty verb"},
+		{tmpl: "/v1/**/books", wantErr: "** must be the last segment"},
+		{tmpl: "/v1/{name=**}/books", wantErr: "** must be the last segment"},
+		{tmpl: "/v1/{name", wantErr: "unterminated variable"},
+		{tmpl: "/v1/{=books/*}", wantErr: "has no field"},
+		{tmpl: "/v1//books", wantErr: "invalid segment"},
+		{tmpl: "/v1/bo*ks", wantErr: "invalid segment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			got, err := parsePathTemplate(tt.tmpl)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parsePathTemplate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var vars []variable
+			for _, v := range got.vars {
+				vars = append(vars, variable{strings.Join(v.fieldPath, "."), v.start, v.end})
+			}
+			if len(got.segments) != tt.segments || got.verb != tt.verb || !slices.Equal(vars, tt.vars) {
+				t.Errorf("parsePathTemplate() = %d segments, vars %v, verb %q; want %d, %v, %q", len(got.segments), vars, got.verb, tt.segments, tt.vars, tt.verb)
+			}
+		})
+	}
+}
+
+func TestPathTemplateMatch(t *testing.T) {
+	tests := []struct {
+		tmpl, path string
+		want       map[string]string // nil if the path must not match
+	}{
+		{"/v1/books", "/v1/books", map[string]string{}},
+		{"/v1/books", "/v1/b%6Foks", map[string]string{}},
+		{"/v1/books", "/v1/books/1", nil},
+		{"/v1/{name}", "/v1/a%20b", map[string]string{"name": "a b"}},
+		// A single-segment variable unescapes %2F; a multi-segment one keeps
+		// it so the value still tells escaped slashes from separators.
+		{"/v1/{name}", "/v1/a%2Fb", map[string]string{"name": "a/b"}},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books/a%2Fb", map[string]string{"name": "shelves/1/books/a%2Fb"}},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books/a%2fb", map[string]string{"name": "shelves/1/books/a%2fb"}},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books/a%20b", map[string]string{"name": "shelves/1/books/a b"}},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books", nil},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves//books/2", nil},
+		{"/v1/{name=shelves/*/books/*}", "/v1/racks/1/books/2", nil},
+		{"/v1/books/{name=**}", "/v1/books/a/b%2Fc/d", map[string]string{"name": "a/b%2Fc/d"}},
+		{"/v1/books/{name=**}", "/v1/books/a", map[string]string{"name": "a"}},
+		{"/v1/books/{name=**}", "/v1/books", map[string]string{"name": ""}},
+		{"/v1/books/{name=**}", "/v1", nil},
+		{"/v1/{name=shelves/*}:publish", "/v1/shelves/1:publish", map[string]string{"name": "shelves/1"}},
+		{"/v1/{name=shelves/*}:publish", "/v1/shelves/1", nil},
+		{"/v1/{name=shelves/*}:publish", "/v1/shelves/1:archive", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tmpl+" "+tt.path, func(t *testing.T) {
+			tmpl, err := parsePathTemplate(tt.tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := tmpl.match(tt.path)
+			if ok != (tt.want != nil) || ok && !maps.Equal(got, tt.want) {
+				t.Errorf("match() = %v, %v; want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathTemplateMoreSpecific(t *testing.T) {
+	want := []string{
+		"/v1/books/special", // most literals
+		"/v1/books/{name}",
+		"/v1/{name}:get", // a verb beats none
+		"/v1/{name}/{id}",
+		"/v1/{name}", // fixed length beats **
+		"/v1/**",
+	}
+	for range 10 {
+		templates := slices.Clone(want)
+		rand.Shuffle(len(templates), func(i, j int) { templates[i], templates[j] = templates[j], templates[i] })
+		parsed := make(map[string]*pathTemplate)
+		for _, tmpl := range templates {
+			p, err := parsePathTemplate(tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed[tmpl] = p
+		}
+		sort.SliceStable(templates, func(i, j int) bool { return parsed[templates[i]].moreSpecific(parsed[templates[j]]) })
+		if !slices.Equal(templates, want) {
+			t.Fatalf("order = %v, want %v", templates, want)
+		}
+	}
+}
+
+// gatewayTestRoutes returns the routes of a lib.Library method.
+func gatewayTestRoutes(t *testing.T, methodName string) []*httpRoute {
+	t.Helper()
+	method := parseGatewayTestProto(t).FindMethodByName(methodName)
+	var routes []*httpRoute
+	for _, rule := range httpRules(method) {
+		route, err := newHTTPRoute("/lib.Library/"+methodName, method, rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// gatewayTestRoute returns the first route of a lib.Library method.
+func gatewayTestRoute(t *testing.T, methodName string) *httpRoute {
+	t.Helper()
+	routes := gatewayTestRoutes(t, methodName)
+	if len(routes) == 0 {
+		t.Fatalf("%s has no routes", methodName)
+	}
+	return routes[0]
+}
+
+func TestHTTPRouteNewRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		http     string
+		target   string
+		body     string
+		want     string // the request message as JSON
+		wantCode codes.Code
+	}{
+		{
+			name: "path and query", method: "GetBook", http: http.MethodGet,
+			target: "/v1/shelves/1/books/a%20b?kind=NOVEL&tags=x&tags=y&author.name=ann&pageSize=5&unknown=1",
+			want:   `{"name":"shelves/1/books/a b","kind":"NOVEL","tags":["x","y"],"author":{"name":"ann"},"pageSize":5}`,
+		},
+		{
+			name: "enum by number and proto field name", method: "GetBook", http: http.MethodGet,
+			target: "/v1/shelves/1/books/b?kind=1&page_size=7",
+			want:   `{"name":"shelves/1/books/b","kind":"NOVEL","pageSize":7}`,
+		},
+		{
+			name: "path variable wins over query", method: "GetBook", http: http.MethodGet,
+			target: "/v1/shelves/1/books/b?name=other",
+			want:   `{"name":"shelves/1/books/b"}`,
+		},
+		{
+			name: "deep path", method: "GetBook", http: http.MethodGet,
+			target: "/v1/books/a/b%2Fc",
+			want:   `{"name":"a/b%2Fc"}`,
+		},
+		{name: "unknown enum value", method: "GetBook", http: http.MethodGet, target: "/v1/shelves/1/books/b?kind=POEM", wantCode: codes.InvalidArgument},
+		{name: "invalid number", method: "GetBook", http: http.MethodGet, target: "/v1/shelves/1/books/b?pageSize=x", wantCode: codes.InvalidArgument},
+		{
+			name: "body bound to a field", method: "CreateBook", http: http.MethodPost,
+			target: "/v1/shelves/7/books?book.pages=3", body: `{"title":"T","pages":10}`,
+			want: `{"parent":"shelves/7","book":{"title":"T","pages":10}}`,
+		},
+		{
+			name: "empty body", method: "CreateBook", http: http.MethodPost,
+			target: "/v1/shelves/7/books",
+			want:   `{"parent":"shelves/7"}`,
+		},
+		{name: "body with an unknown field", method: "CreateBook", http: http.MethodPost, target: "/v1/shelves/7/books", body: `{"nope":1}`, wantCode: codes.InvalidArgument},
+		{
+			name: "whole body ignores the query", method: "UpdateBook", http: http.MethodPatch,
+			target: "/v1/shelves/1/books/2:update?title=ignored", body: `{"pages":4}`,
+			want: `{"name":"shelves/1/books/2","pages":4}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.http, tt.target, strings.NewReader(tt.body))
+			snap := &schemaSnapshot{Routes: gatewayTestRoutes(t, tt.method)}
+			route, vars, _ := snap.matchRoute(tt.http, r.URL.EscapedPath())
+			if route == nil {
+				t.Fatalf("no route of %s matches %s %s", tt.method, tt.http, tt.target)
+			}
+			msg, err := route.newRequest(r, vars)
+			if tt.wantCode != codes.OK {
+				if status.Code(err) != tt.wantCode {
+					t.Fatalf("newRequest() error = %v, want %v", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := msg.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSONEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestHTTPRouteEncodeResponse(t *testing.T) {
+	route := gatewayTestRoute(t, "UpdateBook")
+	book := dynamic.NewMessage(route.MethodDesc.GetOutputType())
+	book.SetFieldByName("name", "shelves/1/books/2")
+	book.SetFieldByName("title", "T")
+	full, _ := book.Marshal()
+	empty, _ := dynamic.NewMessage(route.MethodDesc.GetOutputType()).Marshal()
+
+	tests := []struct {
+		responseBody string
+		data         []byte
+		want         string
+	}{
+		{"", full, `{"name":"shelves/1/books/2","title":"T"}`},
+		{"title", full, `"T"`},
+		// Unset fields are sent as their zero value.
+		{"title", empty, `""`},
+		{"pages", empty, `0`},
+		{"tags", empty, `[]`},
+		{"author", empty, `{}`},
+	}
+	for _, tt := range tests {
+		r := *route
+		r.ResponseBody = tt.responseBody
+		got, err := r.encodeResponse(tt.data)
+		if err != nil {
+			t.Fatalf("response_body %q: %v", tt.responseBody, err)
+		}
+		assertJSONEqual(t, got, tt.want)
+	}
+	if _, err := route.encodeResponse([]byte{0xff}); status.Code(err) != codes.Internal {
+		t.Errorf("encodeResponse() of garbage = %v, want Internal", err)
+	}
+}
+
+func TestMatchRouteAllowed(t *testing.T) {
+	snap := &schemaSnapshot{Routes: []*httpRoute{
+		gatewayTestRoute(t, "GetBook"),
+		gatewayTestRoute(t, "CreateBook"),
+	}}
+	if route, vars, _ := snap.matchRoute(http.MethodGet, "/v1/shelves/1/books/2"); route == nil || vars["name"] != "shelves/1/books/2" {
+		t.Errorf("matchRoute(GET) = %v, %v", route, vars)
+	}
+	if route, _, allowed := snap.matchRoute(http.MethodDelete, "/v1/shelves/1/books"); route != nil || !slices.Equal(allowed, []string{http.MethodPost}) {
+		t.Errorf("matchRoute(DELETE) = %v, allowed %v; want no route and POST allowed", route, allowed)
+	}
+	if route, _, allowed := snap.matchRoute(http.MethodGet, "/v2/x"); route != nil || allowed != nil {
+		t.Errorf("matchRoute of an unknown path = %v, %v", route, allowed)
+	}
+}
+
+func assertJSONEqual(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
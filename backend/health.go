@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+// Statuses reported for a service besides the grpc.health.v1 serving states.
+const (
+	healthUnimplemented = "UNIMPLEMENTED" // the backend has no health service
+	healthUnreachable   = "UNREACHABLE"   // the check itself failed
+)
+
+// HealthReport is the response of GET /healthz. The inspector is live if it
+// answers at all; Ready reports whether the backend can take calls.
+type HealthReport struct {
+	Live      bool          `json:"live"`
+	Ready     bool          `json:"ready"`
+	Backend   BackendHealth `json:"backend"`
+	CheckedAt time.Time     `json:"checkedAt"`
+}
+
+// BackendHealth is the readiness of one target, from grpc.health.v1.Health/Check.
+type BackendHealth struct {
+	Target   string          `json:"target"`
+	Addr     string          `json:"addr"`
+	State    string          `json:"state"`  // connectivity state of the shared connection
+	Status   string          `json:"status"` // overall server status (service "")
+	Error    string          `json:"error,omitempty"`
+	Services []ServiceHealth `json:"services,omitempty"`
+}
+
+// ServiceHealth is the serving status of one service.
+type ServiceHealth struct {
+	Service string    `json:"service"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	At      time.Time `json:"at,omitempty"`
+}
+
+// healthHandler reports inspector liveness and the readiness of the backend
+// selected by ?target=. It answers 503 when the backend is not ready, so
+// monitors can use the status code alone.
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := HealthReport{Live: true, CheckedAt: time.Now().UTC()}
+	conn, target, err := s.backend(targetParam(r))
+	if errors.Is(err, errUnknownTarget) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	report.Backend = BackendHealth{Target: target.Name, Addr: target.Addr, State: s.targetStatus(target).State}
+	if err != nil {
+		report.Backend.Status = healthUnreachable
+		report.Backend.Error = err.Error()
+	} else {
+		report.Backend = s.checkBackendHealth(r.Context(), conn, target, report.Backend)
+		report.Ready = backendReady(report.Backend)
+	}
+	httpStatus := http.StatusOK
+	if !report.Ready {
+		httpStatus = http.StatusServiceUnavailable
+	}
+	writeJSON(w, httpStatus, report)
+}
+
+// liveHandler is a liveness probe that does not touch the backend.
+func (s *Server) liveHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// checkBackendHealth checks the overall server and every service in the
+// target's schema. Services are checked concurrently.
+func (s *Server) checkBackendHealth(ctx context.Context, conn grpc.ClientConnInterface, t Target, bh BackendHealth) BackendHealth {
+	client := healthpb.NewHealthClient(conn)
+	overall := checkServiceHealth(ctx, client, "")
+	bh.Status, bh.Error = overall.Status, overall.Error
+	if overall.Status == healthUnimplemented || overall.Status == healthUnreachable {
+		return bh
+	}
+
+	snap, err := s.schema(ctx, conn, t, false)
+	if err != nil {
+		return bh
+	}
+	names := make([]string, 0, len(snap.Services))
+	for name := range snap.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bh.Services = make([]ServiceHealth, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bh.Services[i] = checkServiceHealth(ctx, client, name)
+		}()
+	}
+	wg.Wait()
+	return bh
+}
+
+func checkServiceHealth(ctx context.Context, client healthpb.HealthClient, service string) ServiceHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	sh := ServiceHealth{Service: service, At: time.Now().UTC()}
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	switch status.Code(err) {
+	case codes.OK:
+		sh.Status = resp.GetStatus().String()
+	case codes.NotFound:
+		// The health server does not know the service; it still answered.
+		sh.Status = healthpb.HealthCheckResponse_SERVICE_UNKNOWN.String()
+	case codes.Unimplemented:
+		sh.Status = healthUnimplemented
+	default:
+		sh.Status, sh.Error = healthUnreachable, status.Convert(err).Message()
+	}
+	return sh
+}
+
+// backendReady reports whether the backend can take calls: the server is
+// SERVING (or answers without a health service) and no service is NOT_SERVING.
+func backendReady(bh BackendHealth) bool {
+	switch bh.Status {
+	case healthpb.HealthCheckResponse_SERVING.String(), healthUnimplemented:
+	default:
+		return false
+	}
+	for _, svc := range bh.Services {
+		if svc.Status == healthpb.HealthCheckResponse_NOT_SERVING.String() {
+			return false
+		}
+	}
+	return true
+}
+
+// healthWatchHandler streams serving status changes as Server-Sent Events,
+// using grpc.health.v1.Health/Watch. ?service= (repeatable) selects the
+// services; by default the overall server and every service in the schema
+// are watched. Broken watches are re-opened until the client disconnects.
+func (s *Server) healthWatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	conn, target, err := s.backend(targetParam(r))
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	ctx := r.Context()
+
+	services := r.URL.Query()["service"]
+	if len(services) == 0 {
+		services = []string{""}
+		if snap, err := s.schema(ctx, conn, target, false); err == nil {
+			names := make([]string, 0, len(snap.Services))
+			for name := range snap.Services {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			services = append(services, names...)
+		}
+	}
+	for i := range services {
+		services[i] = strings.TrimSpace(services[i])
+	}
+
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "streaming is not supported by this connection", http.StatusInternalServerError)
+		return
+	}
+	_ = sse.send("watch", map[string]any{"target": target.Name, "addr": target.Addr, "services": services})
+
+	updates := make(chan ServiceHealth)
+	client := healthpb.NewHealthClient(conn)
+	for _, service := range services {
+		go watchServiceHealth(ctx, client, service, updates)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case u := <-updates:
+			if err := sse.send("status", u); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// watchServiceHealth forwards the statuses of one service to updates. When
+// the watch breaks, an UNREACHABLE status is sent and the watch is re-opened
+// with backoff.
+func watchServiceHealth(ctx context.Context, client healthpb.HealthClient, service string, updates chan<- ServiceHealth) {
+	send := func(sh ServiceHealth) bool {
+		sh.Service, sh.At = service, time.Now().UTC()
+		select {
+		case updates <- sh:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	backoff := time.Second
+	for {
+		err := func() error {
+			stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: service})
+			if err != nil {
+				return err
+			}
+			for {
+				resp, err := stream.Recv()
+				if err != nil {
+					return err
+				}
+				backoff = time.Second
+				if !send(ServiceHealth{Status: resp.GetStatus().String()}) {
+					return ctx.Err()
+				}
+			}
+		}()
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.Unimplemented {
+			send(ServiceHealth{Status: healthUnimplemented, Error: status.Convert(err).Message()})
+			return
+		}
+		msg := "watch ended"
+		if err != nil && !errors.Is(err, io.EOF) {
+			msg = status.Convert(err).Message()
+		}
+		if !send(ServiceHealth{Status: healthUnreachable, Error: fmt.Sprintf("%s; retrying in %s", msg, backoff)}) {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
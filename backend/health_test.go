@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+func getHealthz(t *testing.T, srv *Server, query string) (int, HealthReport) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	srv.healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz"+query, nil))
+	var report HealthReport
+	if rec.Code != http.StatusNotFound {
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("healthz body %q: %v", rec.Body, err)
+		}
+	}
+	return rec.Code, report
+}
+
+func serviceStatus(report HealthReport, service string) string {
+	for _, svc := range report.Backend.Services {
+		if svc.Service == service {
+			return svc.Status
+		}
+	}
+	return ""
+}
+
+func TestHealthz(t *testing.T) {
+	addr, _, hs := startTestBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	t.Cleanup(srv.conns.closeAll)
+
+	code, report := getHealthz(t, srv, "")
+	if code != http.StatusOK || !report.Live || !report.Ready {
+		t.Fatalf("healthz = %d %+v, want 200 and ready", code, report)
+	}
+	if report.Backend.Target != defaultTargetName || report.Backend.Addr != addr || report.Backend.Status != "SERVING" {
+		t.Errorf("backend = %+v, want the default target SERVING", report.Backend)
+	}
+	if got := serviceStatus(report, "grpc.health.v1.Health"); got != "SERVICE_UNKNOWN" {
+		t.Errorf("grpc.health.v1.Health status = %q, want SERVICE_UNKNOWN", got)
+	}
+
+	hs.SetServingStatus("grpc.health.v1.Health", healthpb.HealthCheckResponse_NOT_SERVING)
+	code, report = getHealthz(t, srv, "")
+	if code != http.StatusServiceUnavailable || report.Ready || !report.Live {
+		t.Errorf("healthz with a service NOT_SERVING = %d ready %v, want 503, live and not ready", code, report.Ready)
+	}
+	if got := serviceStatus(report, "grpc.health.v1.Health"); got != "NOT_SERVING" {
+		t.Errorf("grpc.health.v1.Health status = %q, want NOT_SERVING", got)
+	}
+
+	hs.SetServingStatus("grpc.health.v1.Health", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	code, report = getHealthz(t, srv, "")
+	if code != http.StatusServiceUnavailable || report.Backend.Status != "NOT_SERVING" {
+		t.Errorf("healthz with the server NOT_SERVING = %d %s, want 503 NOT_SERVING", code, report.Backend.Status)
+	}
+
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	if code, _ := getHealthz(t, srv, ""); code != http.StatusOK {
+		t.Errorf("healthz after recovering = %d, want 200", code)
+	}
+	if code, _ := getHealthz(t, srv, "?target=nope"); code != http.StatusNotFound {
+		t.Errorf("healthz for an unknown target = %d, want 404", code)
+	}
+}
+
+func TestHealthzWithoutHealthService(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer()
+	reflection.Register(gs)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	srv := newServer(Config{BackendAddr: lis.Addr().String()})
+	t.Cleanup(srv.conns.closeAll)
+
+	code, report := getHealthz(t, srv, "")
+	if code != http.StatusOK || report.Backend.Status != healthUnimplemented {
+		t.Errorf("healthz = %d %s, want 200 %s", code, report.Backend.Status, healthUnimplemented)
+	}
+}
+
+func TestHealthzBackendDown(t *testing.T) {
+	srv := newServer(Config{BackendAddr: closedAddr(t)})
+	t.Cleanup(srv.conns.closeAll)
+
+	code, report := getHealthz(t, srv, "")
+	if code != http.StatusServiceUnavailable || !report.Live || report.Ready || report.Backend.Status != healthUnreachable || report.Backend.Error == "" {
+		t.Errorf("healthz = %d %+v, want 503, live, %s with an error", code, report, healthUnreachable)
+	}
+}
+
+// readSSEEvent reads the next Server-Sent Event.
+func readSSEEvent(t *testing.T, r *bufio.Reader) (string, []byte) {
+	t.Helper()
+	var event, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, []byte(data)
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestHealthzWatch(t *testing.T) {
+	addr, _, hs := startTestBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	t.Cleanup(srv.conns.closeAll)
+	ts := httptest.NewServer(http.HandlerFunc(srv.healthWatchHandler))
+	t.Cleanup(ts.Close)
+
+	watch := func(t *testing.T, query string) (*bufio.Reader, []string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		t.Cleanup(cancel)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("watch = %d %s, want an event stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		r := bufio.NewReader(resp.Body)
+		event, data := readSSEEvent(t, r)
+		var opened struct {
+			Target   string   `json:"target"`
+			Services []string `json:"services"`
+		}
+		if err := json.Unmarshal(data, &opened); event != "watch" || err != nil || opened.Target != defaultTargetName {
+			t.Fatalf("first event = %s %s, want the watch of the default target", event, data)
+		}
+		return r, opened.Services
+	}
+	nextStatus := func(t *testing.T, r *bufio.Reader) ServiceHealth {
+		t.Helper()
+		event, data := readSSEEvent(t, r)
+		var sh ServiceHealth
+		if err := json.Unmarshal(data, &sh); event != "status" || err != nil {
+			t.Fatalf("event = %s %s, want a status", event, data)
+		}
+		return sh
+	}
+
+	t.Run("selected service", func(t *testing.T) {
+		r, services := watch(t, "?service=svc")
+		if len(services) != 1 || services[0] != "svc" {
+			t.Errorf("watched services = %q, want [svc]", services)
+		}
+		if sh := nextStatus(t, r); sh.Service != "svc" || sh.Status != "SERVING" {
+			t.Errorf("first status = %+v, want svc SERVING", sh)
+		}
+		hs.SetServingStatus("svc", healthpb.HealthCheckResponse_NOT_SERVING)
+		if sh := nextStatus(t, r); sh.Service != "svc" || sh.Status != "NOT_SERVING" {
+			t.Errorf("status after the flip = %+v, want svc NOT_SERVING", sh)
+		}
+		hs.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+		if sh := nextStatus(t, r); sh.Status != "SERVING" {
+			t.Errorf("status after recovering = %+v, want SERVING", sh)
+		}
+	})
+
+	t.Run("schema services", func(t *testing.T) {
+		r, services := watch(t, "")
+		if len(services) < 2 || services[0] != "" {
+			t.Fatalf("watched services = %q, want the server and the schema's services", services)
+		}
+		got := map[string]string{}
+		for len(got) < len(services) {
+			sh := nextStatus(t, r)
+			got[sh.Service] = sh.Status
+		}
+		if got[""] != "SERVING" || got["grpc.health.v1.Health"] != "SERVICE_UNKNOWN" {
+			t.Errorf("statuses = %v, want the server SERVING and grpc.health.v1.Health SERVICE_UNKNOWN", got)
+		}
+	})
+}
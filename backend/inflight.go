@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errCallCancelled is the cancellation cause of calls cancelled through
+// DELETE /invoke/{id}.
+var errCallCancelled = errors.New("call cancelled by request")
+
+// InflightCall describes a call that is still running.
+type InflightCall struct {
+	ID         string     `json:"id"`
+	Target     string     `json:"target"`
+	FullMethod string     `json:"fullMethod"`
+	Kind       string     `json:"kind"` // unary, stream or websocket
+	StartedAt  time.Time  `json:"startedAt"`
+	TimeoutMs  int64      `json:"timeoutMs,omitempty"`
+	Deadline   *time.Time `json:"deadline,omitempty"`
+	ElapsedMs  float64    `json:"elapsedMs"`
+}
+
+type inflightEntry struct {
+	call   InflightCall
+	cancel context.CancelCauseFunc
+}
+
+// inflightRegistry tracks running calls so they can be listed and cancelled.
+type inflightRegistry struct {
+	mu    sync.Mutex
+	calls map[string]*inflightEntry
+}
+
+func newInflightRegistry() *inflightRegistry {
+	return &inflightRegistry{calls: make(map[string]*inflightEntry)}
+}
+
+// start registers a call and returns its context, which carries the timeout if
+// timeoutMs is positive, and a function to call when the call ends. id may be
+// supplied by the client; a random one is generated otherwise.
+func (ir *inflightRegistry) start(ctx context.Context, id, target, fullMethod, kind string, timeoutMs int64) (context.Context, InflightCall, func(), error) {
+	if id == "" {
+		id = newCallID()
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := func() {}
+	if timeoutMs > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
+		stop = cancelTimeout
+	}
+	call := InflightCall{
+		ID:         id,
+		Target:     target,
+		FullMethod: fullMethod,
+		Kind:       kind,
+		StartedAt:  time.Now(),
+		TimeoutMs:  timeoutMs,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		call.Deadline = &deadline
+	}
+
+	ir.mu.Lock()
+	if _, exists := ir.calls[id]; exists {
+		ir.mu.Unlock()
+		stop()
+		cancel(nil)
+		return nil, InflightCall{}, nil, fmt.Errorf("call %q is already in flight", id)
+	}
+	ir.calls[id] = &inflightEntry{call: call, cancel: cancel}
+	ir.mu.Unlock()
+
+	done := func() {
+		ir.mu.Lock()
+		delete(ir.calls, id)
+		ir.mu.Unlock()
+		stop()
+		cancel(nil)
+	}
+	return ctx, call, done, nil
+}
+
+// cancel cancels a running call. It reports whether the call was found.
+func (ir *inflightRegistry) cancel(id string) bool {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	e, ok := ir.calls[id]
+	if ok {
+		e.cancel(errCallCancelled)
+	}
+	return ok
+}
+
+func (ir *inflightRegistry) get(id string) (InflightCall, bool) {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	e, ok := ir.calls[id]
+	if !ok {
+		return InflightCall{}, false
+	}
+	call := e.call
+	call.ElapsedMs = durationMs(time.Since(call.StartedAt))
+	return call, true
+}
+
+// list returns the running calls, oldest first.
+func (ir *inflightRegistry) list() []InflightCall {
+	ir.mu.Lock()
+	out := make([]InflightCall, 0, len(ir.calls))
+	for _, e := range ir.calls {
+		call := e.call
+		call.ElapsedMs = durationMs(time.Since(call.StartedAt))
+		out = append(out, call)
+	}
+	ir.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].StartedAt.Before(out[j].StartedAt)
+	})
+	return out
+}
+
+func newCallID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// callMeta is the InvokeResponse.Meta of a finished call.
+func callMeta(call InflightCall, elapsed time.Duration) map[string]any {
+	meta := map[string]any{
+		"callId":    call.ID,
+		"startedAt": call.StartedAt,
+		"elapsedMs": durationMs(elapsed),
+	}
+	if call.Deadline != nil {
+		meta["deadline"] = *call.Deadline
+	}
+	if call.TimeoutMs > 0 {
+		meta["timeoutMs"] = call.TimeoutMs
+	}
+	return meta
+}
+
+// callErrorMessage is errorMessage, except that calls cancelled through
+// DELETE /invoke/{id} say so.
+func callErrorMessage(ctx context.Context, kind string, err error, target Target) string {
+	if status.Code(err) == codes.Canceled && errors.Is(context.Cause(ctx), errCallCancelled) {
+		return "Cancelled: the call was cancelled through DELETE /invoke/{id}."
+	}
+	return errorMessage(kind, err, target)
+}
+
+// inflightHandler lists running calls on GET /invoke/inflight.
+func (s *Server) inflightHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	calls := s.inflight.list()
+	if name := targetParam(r); name != "" {
+		filtered := calls[:0]
+		for _, c := range calls {
+			if c.Target == name {
+				filtered = append(filtered, c)
+			}
+		}
+		calls = filtered
+	}
+	writeJSON(w, http.StatusOK, calls)
+}
+
+// invokeCallHandler serves GET and DELETE on /invoke/{id}.
+func (s *Server) invokeCallHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/invoke/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		call, ok := s.inflight.get(id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("call %q is not in flight", id), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, call)
+	case http.MethodDelete:
+		if !s.inflight.cancel(id) {
+			http.Error(w, fmt.Sprintf("call %q is not in flight", id), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// hangingHealth answers Check only when the call ends.
+type hangingHealth struct{ *health.Server }
+
+func (hangingHealth) Check(ctx context.Context, _ *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func startHangingBackend(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, hangingHealth{health.NewServer()})
+	reflection.Register(gs)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	return lis.Addr().String()
+}
+
+func TestCancelInflightCall(t *testing.T) {
+	srv := newServer(Config{BackendAddr: startHangingBackend(t)})
+	t.Cleanup(srv.conns.closeAll)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/invoke", srv.invokeHandler)
+	mux.HandleFunc("/invoke/inflight", srv.inflightHandler)
+	mux.HandleFunc("/invoke/", srv.invokeCallHandler)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	do := func(method, path string, body []byte) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	listInflight := func() []InflightCall {
+		t.Helper()
+		var calls []InflightCall
+		if err := json.NewDecoder(do(http.MethodGet, "/invoke/inflight", nil).Body).Decode(&calls); err != nil {
+			t.Fatal(err)
+		}
+		return calls
+	}
+
+	type result struct {
+		status int
+		body   InvokeResponse
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		body, _ := json.Marshal(InvokeRequest{FullMethod: "grpc.health.v1.Health/Check", CallID: "slow-1", TimeoutMs: 60000})
+		resp, err := http.Post(ts.URL+"/invoke", "application/json", bytes.NewReader(body))
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		var out InvokeResponse
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		done <- result{status: resp.StatusCode, body: out, err: err}
+	}()
+
+	var listed []InflightCall
+	for deadline := time.Now().Add(5 * time.Second); len(listed) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the call never showed up in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+		listed = listInflight()
+	}
+	if len(listed) != 1 {
+		t.Fatalf("in flight = %+v, want one call", listed)
+	}
+	call := listed[0]
+	if call.ID != "slow-1" || call.Target != defaultTargetName || call.FullMethod != "/grpc.health.v1.Health/Check" || call.Kind != "unary" || call.TimeoutMs != 60000 || call.Deadline == nil {
+		t.Errorf("in flight = %+v", call)
+	}
+	if resp := do(http.MethodGet, "/invoke/slow-1", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /invoke/slow-1 = %d, want 200", resp.StatusCode)
+	}
+	var other []InflightCall
+	if err := json.NewDecoder(do(http.MethodGet, "/invoke/inflight?target=other", nil).Body).Decode(&other); err != nil || len(other) != 0 {
+		t.Errorf("in flight on another target = %+v, %v; want none", other, err)
+	}
+
+	// A second call cannot take the same ID while the first runs.
+	dup, _ := json.Marshal(InvokeRequest{FullMethod: "grpc.health.v1.Health/Check", CallID: "slow-1"})
+	if resp := do(http.MethodPost, "/invoke", dup); resp.StatusCode != http.StatusConflict {
+		t.Errorf("duplicate call ID = %d, want 409", resp.StatusCode)
+	}
+
+	if resp := do(http.MethodDelete, "/invoke/slow-1", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /invoke/slow-1 = %d, want 204", resp.StatusCode)
+	}
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cancelled call did not return")
+	}
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.body.Error == nil {
+		t.Fatalf("cancelled call = %d %+v, want an error", res.status, res.body)
+	}
+	if want := httpStatusForError(res.body.Error.Kind, codes.Canceled); res.status != want {
+		t.Errorf("cancelled call status = %d, want %d", res.status, want)
+	}
+	if res.body.Error.Code != codes.Canceled.String() || res.body.Error.Message != "Cancelled: the call was cancelled through DELETE /invoke/{id}." {
+		t.Errorf("cancelled call error = %+v, want the cancel cause", res.body.Error)
+	}
+
+	if calls := listInflight(); len(calls) != 0 {
+		t.Errorf("in flight after cancelling = %+v, want none", calls)
+	}
+	if resp := do(http.MethodGet, "/invoke/slow-1", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /invoke/slow-1 after cancelling = %d, want 404", resp.StatusCode)
+	}
+	if resp := do(http.MethodDelete, "/invoke/slow-1", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE /invoke/slow-1 after cancelling = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestInflightCancelCause(t *testing.T) {
+	const cancelledMsg = "Cancelled: the call was cancelled through DELETE /invoke/{id}."
+	ir := newInflightRegistry()
+	target := Target{Name: defaultTargetName}
+
+	ctx, _, done, err := ir.start(context.Background(), "c1", target.Name, "/s/M", "unary", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ir.cancel("c1") {
+		t.Fatal("cancel(c1) did not find the call")
+	}
+	<-ctx.Done()
+	if !errors.Is(context.Cause(ctx), errCallCancelled) {
+		t.Errorf("cause = %v, want errCallCancelled", context.Cause(ctx))
+	}
+	callErr := status.FromContextError(ctx.Err()).Err()
+	if msg := callErrorMessage(ctx, classifyError(callErr, false), callErr, target); msg != cancelledMsg {
+		t.Errorf("message = %q, want %q", msg, cancelledMsg)
+	}
+	done()
+	if _, ok := ir.get("c1"); ok || len(ir.list()) != 0 || ir.cancel("c1") {
+		t.Errorf("c1 is still registered after it ended")
+	}
+
+	// A call that times out is not reported as cancelled through the API.
+	ctx, _, done, err = ir.start(context.Background(), "", target.Name, "/s/M", "unary", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	<-ctx.Done()
+	callErr = status.FromContextError(ctx.Err()).Err()
+	if msg := callErrorMessage(ctx, classifyError(callErr, false), callErr, target); msg == cancelledMsg {
+		t.Errorf("a timed-out call is reported as cancelled through the API")
+	}
+}
@@ -5,25 +5,29 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/dynamic"
-	"github.com/jhump/protoreflect/grpcreflect"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
-	refv1 "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
-	"google.golang.org/grpc/status"
 )
 
 // InvokeRequest is the payload from the UI playground.
 type InvokeRequest struct {
+	Target     string            `json:"target,omitempty"` // named target; the default target if empty
 	FullMethod string            `json:"fullMethod"`
 	Metadata   map[string]string `json:"metadata"`
 	Payload    map[string]any    `json:"payload"`
+	TimeoutMs  int64             `json:"timeoutMs,omitempty"` // gRPC deadline; no deadline if zero
+	CallID     string            `json:"callId,omitempty"`    // optional client-chosen ID for DELETE /invoke/{id}
+	Env        string            `json:"env,omitempty"`       // variable set for {{var}} placeholders; the active set if empty
+	Variables  map[string]string `json:"variables,omitempty"` // values that override the variable set
+	// CorrelationID groups related calls in the traffic buffer, e.g. the
+	// steps of a workflow.
+	CorrelationID string `json:"correlationId,omitempty"`
 }
 
 type InvokeResponse struct {
@@ -35,18 +39,15 @@ type InvokeResponse struct {
 }
 
 type InvokeError struct {
-	Message string `json:"message"`
-	Code    string `json:"code"`
+	Kind    string        `json:"kind"` // transport, protocol_mismatch, descriptor, payload or application
+	Message string        `json:"message"`
+	Code    string        `json:"code"`
+	Details []ErrorDetail `json:"details,omitempty"` // decoded google.rpc.Status details
 }
 
 // invokeHandler executes dynamic unary RPCs against the connected backend.
 func (s *Server) invokeHandler(w http.ResponseWriter, r *http.Request) {
-	// Ensure connection exists and is healthy
 	ctx := r.Context()
-	if err := s.ensureConnection(ctx); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to connect to backend: %v. Please check GRPS_BACKEND_ADDR in Settings.", err), http.StatusServiceUnavailable)
-		return
-	}
 	var in InvokeRequest
 	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
 		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
@@ -56,145 +57,139 @@ func (s *Server) invokeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "fullMethod is required", http.StatusBadRequest)
 		return
 	}
+	if in.TimeoutMs < 0 {
+		http.Error(w, "timeoutMs must not be negative", http.StatusBadRequest)
+		return
+	}
+	if in.Target == "" {
+		in.Target = targetParam(r)
+	}
+	conn, target, err := s.backend(in.Target)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+
+	resp, httpStatus, snap, err := s.invokeCall(ctx, conn, target, in, "unary")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if snap != nil {
+		snap.setHeaders(w)
+	}
+	writeJSON(w, httpStatus, resp)
+}
 
+// invokeCall runs one unary request: it registers the call as in flight,
+// applies the metadata, invokes the method and records the traffic entry.
+// Failed invocations are reported in the response along with the HTTP status
+// of their class; the error is only set if the call could not be registered.
+func (s *Server) invokeCall(ctx context.Context, conn grpc.ClientConnInterface, target Target, in InvokeRequest, kind string) (InvokeResponse, int, *schemaSnapshot, error) {
 	normalizedMethod := normalizeFullMethod(in.FullMethod)
 
-	md := metadata.Join(s.cfg.DefaultMD, buildOutgoingMetadata(in.Metadata))
+	in, resolved, err := s.resolveRequest(in)
+	if err != nil {
+		invokeErr, httpStatus := newInvokeError(ctx, err, target, nil, false)
+		return InvokeResponse{Error: invokeErr}, httpStatus, nil, nil
+	}
+
+	ctx, call, done, err := s.inflight.start(ctx, in.CallID, target.Name, normalizedMethod, kind, in.TimeoutMs)
+	if err != nil {
+		return InvokeResponse{}, http.StatusConflict, nil, err
+	}
+	defer done()
+
+	md := metadata.Join(s.config().DefaultMD, buildOutgoingMetadata(in.Metadata))
 	if len(md) > 0 {
 		ctx = metadata.NewOutgoingContext(ctx, md)
 	}
 
 	start := time.Now()
-	result, headers, trailers, err := s.invokeUnary(ctx, normalizedMethod, in.Payload)
+	result, headers, trailers, snap, err := s.invokeUnary(ctx, conn, target, normalizedMethod, in.Payload)
 	duration := time.Since(start)
 
-	s.recordTraffic(normalizedMethod, md, in.Payload, result, err, start, duration)
-
+	var invokeErr *InvokeError
+	httpStatus := http.StatusOK
 	if err != nil {
-		// Provide helpful error messages for common issues
-		errMsg := err.Error()
-		if strings.Contains(errMsg, "tls: first record does not look like a TLS handshake") {
-			// This error shouldn't happen since TLS is forced to false
-			// Force connection reset and retry once
-			log.Printf("TLS error detected, resetting connection and retrying...")
-			s.resetConnection()
-			if err := s.ensureConnection(ctx); err != nil {
-				errMsg = fmt.Sprintf("Connection error after reset: %v. The gRPC backend at %s may not be running or is using TLS. Please check GRPS_BACKEND_ADDR and ensure your gRPC server is running without TLS.", err, s.cfg.BackendAddr)
-			} else {
-				// Retry the invocation with fresh connection
-				result, headers, trailers, retryErr := s.invokeUnary(ctx, normalizedMethod, in.Payload)
-				if retryErr == nil {
-					// Success after retry - return the result
-					writeJSON(w, http.StatusOK, InvokeResponse{
-						Response: result,
-						Headers:  metadataToMap(headers),
-						Trailers: metadataToMap(trailers),
-					})
-					return
-				}
-				errMsg = fmt.Sprintf("Connection reset but retry failed: %v", retryErr)
-			}
-		} else if strings.Contains(errMsg, "connection refused") {
-			errMsg = "Connection refused: The gRPC backend is not running or the address is incorrect. Please check GRPS_BACKEND_ADDR in Settings."
-		} else if strings.Contains(errMsg, "no such host") {
-			errMsg = "Host not found: The gRPC backend address is invalid. Please check GRPS_BACKEND_ADDR in Settings."
-		} else if strings.Contains(errMsg, "http2") || strings.Contains(errMsg, "HTTP/1.1") || strings.Contains(errMsg, "frame too large") {
-			errMsg = fmt.Sprintf("Protocol mismatch: The address %s appears to be running an HTTP server, not a gRPC server. gRPC requires HTTP/2, but received HTTP/1.1 responses. Please verify GRPS_BACKEND_ADDR is pointing to a gRPC server.", s.cfg.BackendAddr)
-		}
-
-		writeJSON(w, http.StatusBadGateway, InvokeResponse{
-			Error: &InvokeError{
-				Message: errMsg,
-				Code:    status.Code(err).String(),
-			},
-		})
-		return
+		invokeErr, httpStatus = newInvokeError(ctx, err, target, snap, answeredBy(headers, trailers))
 	}
+	s.recordTraffic(target.Name, in.CorrelationID, normalizedMethod, md, in.Payload, result, err, invokeErr, start, duration)
 
-	writeJSON(w, http.StatusOK, InvokeResponse{
+	meta := callMeta(call, duration)
+	if resolved != nil {
+		meta["resolved"] = resolved
+	}
+	return InvokeResponse{
 		Response: result,
 		Headers:  metadataToMap(headers),
 		Trailers: metadataToMap(trailers),
-	})
+		Error:    invokeErr,
+		Meta:     meta,
+	}, httpStatus, snap, nil
 }
 
-func (s *Server) invokeUnary(ctx context.Context, fullMethod string, payload map[string]any) (map[string]any, metadata.MD, metadata.MD, error) {
-	methodDesc, err := s.lookupMethodDescriptor(ctx, fullMethod)
+// invokeUnary calls a unary method and also returns the schema snapshot the
+// method was resolved from.
+func (s *Server) invokeUnary(ctx context.Context, conn grpc.ClientConnInterface, target Target, fullMethod string, payload map[string]any) (map[string]any, metadata.MD, metadata.MD, *schemaSnapshot, error) {
+	methodDesc, snap, err := s.resolveMethod(ctx, conn, target, fullMethod)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, snap, err
 	}
+	respMap, headerMD, trailerMD, err := invokeDynamic(ctx, conn, methodDesc, fullMethod, payload)
+	return respMap, headerMD, trailerMD, snap, err
+}
+
+func invokeDynamic(ctx context.Context, conn grpc.ClientConnInterface, methodDesc *desc.MethodDescriptor, fullMethod string, payload map[string]any) (map[string]any, metadata.MD, metadata.MD, error) {
 	if methodDesc.IsServerStreaming() || methodDesc.IsClientStreaming() {
-		return nil, nil, nil, errors.New("streaming methods are not supported yet")
+		return nil, nil, nil, withKind(errKindPayload, errors.New("streaming methods are not supported by /invoke; use /invoke/stream for server-streaming methods"))
 	}
 
-	reqJSON, err := json.Marshal(payload)
+	reqMsg, err := newRequestMessage(methodDesc, payload)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("encode payload: %w", err)
-	}
-
-	reqMsg := dynamic.NewMessage(methodDesc.GetInputType())
-	if err := reqMsg.UnmarshalJSON(reqJSON); err != nil {
-		return nil, nil, nil, fmt.Errorf("decode payload: %w", err)
+		return nil, nil, nil, err
 	}
 
 	respMsg := dynamic.NewMessage(methodDesc.GetOutputType())
 
-	// ALWAYS ensure connection is fresh before invoking
-	// This prevents any possibility of using a stale TLS connection
-	if err := s.ensureConnection(ctx); err != nil {
-		log.Printf("ERROR: Failed to ensure connection before invoke: %v", err)
-		return nil, nil, nil, fmt.Errorf("connection error: %w", err)
-	}
-	
 	var headerMD metadata.MD
 	var trailerMD metadata.MD
-	
-	state := s.backendConn.GetState()
-	log.Printf("Invoking %s on connection (state: %s)", fullMethod, state.String())
-	
-	if err := s.backendConn.Invoke(ctx, fullMethod, reqMsg, respMsg, grpc.Header(&headerMD), grpc.Trailer(&trailerMD)); err != nil {
-		// If we get a TLS error, the connection is definitely wrong - reset it immediately
-		if strings.Contains(err.Error(), "tls:") || strings.Contains(err.Error(), "TLS") {
-			log.Printf("TLS error during invoke - connection is corrupted, resetting immediately")
-			s.resetConnection()
-		}
+
+	if err := conn.Invoke(ctx, fullMethod, reqMsg, respMsg, grpc.Header(&headerMD), grpc.Trailer(&trailerMD)); err != nil {
 		return nil, headerMD, trailerMD, err
 	}
 
-	respJSON, err := respMsg.MarshalJSON()
+	respMap, err := messageToMap(respMsg)
 	if err != nil {
-		return nil, headerMD, trailerMD, fmt.Errorf("encode response: %w", err)
-	}
-
-	var respMap map[string]any
-	if err := json.Unmarshal(respJSON, &respMap); err != nil {
-		return nil, headerMD, trailerMD, fmt.Errorf("decode response: %w", err)
+		return nil, headerMD, trailerMD, err
 	}
-
 	return respMap, headerMD, trailerMD, nil
 }
 
-func (s *Server) lookupMethodDescriptor(ctx context.Context, fullMethod string) (*desc.MethodDescriptor, error) {
-	serviceName := parseService(fullMethod)
-	methodName := parseMethod(fullMethod)
-	if serviceName == "" || methodName == "" {
-		return nil, fmt.Errorf("invalid full method name: %s", fullMethod)
+// newRequestMessage builds the request message of a method from a JSON payload.
+func newRequestMessage(methodDesc *desc.MethodDescriptor, payload map[string]any) (*dynamic.Message, error) {
+	reqJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, withKind(errKindPayload, fmt.Errorf("encode payload: %w", err))
 	}
+	reqMsg := dynamic.NewMessage(methodDesc.GetInputType())
+	if err := reqMsg.UnmarshalJSON(reqJSON); err != nil {
+		return nil, withKind(errKindPayload, fmt.Errorf("decode payload: %w", err))
+	}
+	return reqMsg, nil
+}
 
-	client := grpcreflect.NewClientV1Alpha(ctx, refv1.NewServerReflectionClient(s.backendConn))
-	defer client.Reset()
-
-	svc, err := client.ResolveService(serviceName)
+// messageToMap converts a response message to its JSON object form.
+func messageToMap(msg *dynamic.Message) (map[string]any, error) {
+	respJSON, err := msg.MarshalJSON()
 	if err != nil {
-		return nil, fmt.Errorf("resolve service %s: %w", serviceName, err)
+		return nil, withKind(errKindDescriptor, fmt.Errorf("encode response: %w", err))
 	}
-
-	method := svc.FindMethodByName(methodName)
-	if method == nil {
-		return nil, fmt.Errorf("method %s not found on service %s", methodName, serviceName)
+	var respMap map[string]any
+	if err := json.Unmarshal(respJSON, &respMap); err != nil {
+		return nil, withKind(errKindDescriptor, fmt.Errorf("decode response: %w", err))
 	}
-
-	return method, nil
+	return respMap, nil
 }
 
 func buildOutgoingMetadata(src map[string]string) metadata.MD {
@@ -243,23 +238,29 @@ func writeJSON(w http.ResponseWriter, statusCode int, payload any) {
 	_ = json.NewEncoder(w).Encode(payload)
 }
 
-func (s *Server) recordTraffic(fullMethod string, md metadata.MD, payload map[string]any, response map[string]any, err error, started time.Time, duration time.Duration) {
+func (s *Server) recordTraffic(target, correlationID, fullMethod string, md metadata.MD, payload map[string]any, response any, err error, invokeErr *InvokeError, started time.Time, duration time.Duration) {
 	reqJSON, _ := json.Marshal(payload)
 	var respJSON []byte
 	if response != nil {
 		respJSON, _ = json.Marshal(response)
 	}
 	entry := TrafficEntry{
-		Service:   parseService(fullMethod),
-		Method:    parseMethod(fullMethod),
-		Metadata:  metadataToMap(md),
-		Request:   json.RawMessage(reqJSON),
-		Response:  json.RawMessage(respJSON),
-		StartedAt: started,
-		Duration:  duration,
+		Target:        target,
+		CorrelationID: correlationID,
+		Service:       parseService(fullMethod),
+		Method:        parseMethod(fullMethod),
+		Metadata:      metadataToMap(md),
+		Request:       json.RawMessage(reqJSON),
+		Response:      json.RawMessage(respJSON),
+		StartedAt:     started,
+		Duration:      duration,
 	}
 	if err != nil {
 		entry.Error = err.Error()
 	}
+	if invokeErr != nil {
+		entry.ErrorKind = invokeErr.Kind
+		entry.ErrorDetails = invokeErr.Details
+	}
 	s.traffic.add(entry)
 }
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultLoadTestRequests    = 200
+	defaultLoadTestConcurrency = 10
+	maxLoadTestConcurrency     = 1000
+	loadTestHistogramBuckets   = 10
+	loadTestMaxErrors          = 10 // distinct error messages kept in a report
+	loadTestProgressInterval   = 500 * time.Millisecond
+)
+
+// LoadTestRequest describes a load test of one unary method. The test runs
+// for Requests calls, or for DurationMs if that is set.
+type LoadTestRequest struct {
+	Target          string            `json:"target,omitempty"`
+	FullMethod      string            `json:"fullMethod"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Payload         map[string]any    `json:"payload,omitempty"`
+	PayloadTemplate string            `json:"payloadTemplate,omitempty"` // JSON rendered per call; see renderLoadTestPayload
+	Requests        int               `json:"requests,omitempty"`
+	DurationMs      int64             `json:"durationMs,omitempty"`
+	Concurrency     int               `json:"concurrency,omitempty"`
+	RPS             float64           `json:"rps,omitempty"`       // calls started per second across all workers; unlimited if zero
+	TimeoutMs       int64             `json:"timeoutMs,omitempty"` // deadline of each call
+	CallID          string            `json:"callId,omitempty"`    // ID of the whole test, for DELETE /invoke/{id}
+}
+
+// LoadTestReport is the result of a load test.
+type LoadTestReport struct {
+	Target      string            `json:"target"`
+	FullMethod  string            `json:"fullMethod"`
+	Concurrency int               `json:"concurrency"`
+	RPS         float64           `json:"rps,omitempty"`
+	Total       int               `json:"total"`
+	Succeeded   int               `json:"succeeded"`
+	Failed      int               `json:"failed"`
+	DurationMs  float64           `json:"durationMs"`
+	Throughput  float64           `json:"throughput"` // completed calls per second
+	Latency     LatencyStats      `json:"latency"`
+	Histogram   []HistogramBucket `json:"histogram"`
+	StatusCodes map[string]int    `json:"statusCodes"`
+	Errors      map[string]int    `json:"errors,omitempty"` // the most common error messages
+	Cancelled   bool              `json:"cancelled,omitempty"`
+	Meta        map[string]any    `json:"meta,omitempty"`
+}
+
+// LatencyStats summarizes call latencies in milliseconds.
+type LatencyStats struct {
+	MinMs  float64 `json:"minMs"`
+	MeanMs float64 `json:"meanMs"`
+	MaxMs  float64 `json:"maxMs"`
+	P50Ms  float64 `json:"p50Ms"`
+	P90Ms  float64 `json:"p90Ms"`
+	P95Ms  float64 `json:"p95Ms"`
+	P99Ms  float64 `json:"p99Ms"`
+}
+
+// HistogramBucket counts the calls slower than the previous bucket and at
+// most UpToMs.
+type HistogramBucket struct {
+	UpToMs   float64 `json:"upToMs"`
+	Count    int     `json:"count"`
+	Fraction float64 `json:"fraction"`
+}
+
+// LoadTestProgress is sent periodically while a load test runs. Throughput
+// and latencies cover the calls completed since the previous update.
+type LoadTestProgress struct {
+	Completed  int          `json:"completed"`
+	Failed     int          `json:"failed"`
+	ElapsedMs  float64      `json:"elapsedMs"`
+	Throughput float64      `json:"throughput"`
+	Latency    LatencyStats `json:"latency"`
+}
+
+type loadSample struct {
+	latency time.Duration
+	code    codes.Code
+	err     string
+}
+
+// loadTest is a prepared load test: the method is resolved and the request
+// message built once, so calls only encode, send and decode.
+type loadTest struct {
+	req        LoadTestRequest
+	target     Target
+	conn       grpc.ClientConnInterface
+	fullMethod string
+	method     *desc.MethodDescriptor
+	message    *dynamic.Message // shared by all calls unless a template is used
+	md         metadata.MD
+
+	mu      sync.Mutex
+	samples []loadSample
+}
+
+// prepareLoadTest validates the request and resolves the method. Errors are
+// classified like invocation errors.
+func (s *Server) prepareLoadTest(ctx context.Context, req LoadTestRequest) (*loadTest, *schemaSnapshot, Target, error) {
+	if req.FullMethod == "" {
+		return nil, nil, Target{}, withKind(errKindPayload, errors.New("fullMethod is required"))
+	}
+	if req.Requests < 0 || req.DurationMs < 0 || req.RPS < 0 || req.TimeoutMs < 0 {
+		return nil, nil, Target{}, withKind(errKindPayload, errors.New("requests, durationMs, rps and timeoutMs must not be negative"))
+	}
+	if req.RPS != 0 && rateInterval(req.RPS) <= 0 {
+		return nil, nil, Target{}, withKind(errKindPayload, fmt.Errorf("rps must be 0 (unlimited) or between %g and %g", minRate, maxRate))
+	}
+	if req.Concurrency == 0 {
+		req.Concurrency = defaultLoadTestConcurrency
+	}
+	if req.Concurrency < 0 || req.Concurrency > maxLoadTestConcurrency {
+		return nil, nil, Target{}, withKind(errKindPayload, fmt.Errorf("concurrency must be between 1 and %d", maxLoadTestConcurrency))
+	}
+	if req.Requests == 0 && req.DurationMs == 0 {
+		req.Requests = defaultLoadTestRequests
+	}
+
+	conn, target, err := s.backend(req.Target)
+	if err != nil {
+		return nil, nil, target, err
+	}
+	lt := &loadTest{
+		req:        req,
+		target:     target,
+		conn:       conn,
+		fullMethod: normalizeFullMethod(req.FullMethod),
+		md:         metadata.Join(s.config().DefaultMD, buildOutgoingMetadata(req.Metadata)),
+	}
+	methodDesc, snap, err := s.resolveMethod(ctx, conn, target, lt.fullMethod)
+	if err != nil {
+		return nil, snap, target, err
+	}
+	if methodDesc.IsServerStreaming() || methodDesc.IsClientStreaming() {
+		return nil, snap, target, withKind(errKindPayload, fmt.Errorf("%s is a streaming method; load tests support unary methods", lt.fullMethod))
+	}
+	lt.method = methodDesc
+
+	// Build the first message now, so a bad payload or template fails the
+	// request instead of every call.
+	msg, err := lt.newMessage(0, 0)
+	if err != nil {
+		return nil, snap, target, err
+	}
+	if req.PayloadTemplate == "" {
+		lt.message = msg
+	}
+	return lt, snap, target, nil
+}
+
+// renderLoadTestPayload fills the placeholders of a payload template:
+// {{requestNumber}} is the 0-based number of the call and {{workerId}} the
+// worker that makes it.
+func renderLoadTestPayload(tmpl string, n int64, worker int) string {
+	return strings.NewReplacer(
+		"{{requestNumber}}", strconv.FormatInt(n, 10),
+		"{{workerId}}", strconv.Itoa(worker),
+	).Replace(tmpl)
+}
+
+func (lt *loadTest) newMessage(n int64, worker int) (*dynamic.Message, error) {
+	if lt.req.PayloadTemplate == "" {
+		if lt.message != nil {
+			return lt.message, nil
+		}
+		return newRequestMessage(lt.method, lt.req.Payload)
+	}
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(renderLoadTestPayload(lt.req.PayloadTemplate, n, worker)), &payload); err != nil {
+		return nil, withKind(errKindPayload, fmt.Errorf("render payload template: %w", err))
+	}
+	return newRequestMessage(lt.method, payload)
+}
+
+// run starts the workers and blocks until the test is over or ctx is done.
+// progress, if not nil, is called every loadTestProgressInterval.
+func (lt *loadTest) run(ctx context.Context, progress func(LoadTestProgress)) LoadTestReport {
+	if len(lt.md) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, lt.md)
+	}
+	// stop ends the test; calls already started still complete under ctx.
+	stop, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if lt.req.DurationMs > 0 {
+		stop, cancel = context.WithTimeout(ctx, time.Duration(lt.req.DurationMs)*time.Millisecond)
+		defer cancel()
+	}
+
+	var tick <-chan time.Time
+	if lt.req.RPS > 0 {
+		ticker := time.NewTicker(rateInterval(lt.req.RPS))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	start := time.Now()
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for worker := range lt.req.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := dynamic.NewMessage(lt.method.GetOutputType())
+			for {
+				n := next.Add(1) - 1
+				if lt.req.DurationMs == 0 && n >= int64(lt.req.Requests) {
+					return
+				}
+				if tick != nil {
+					select {
+					case <-tick:
+					case <-stop.Done():
+						return
+					}
+				} else if stop.Err() != nil {
+					return
+				}
+				resp.Reset()
+				lt.record(lt.call(ctx, n, worker, resp))
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	if progress != nil {
+		ticker := time.NewTicker(loadTestProgressInterval)
+		defer ticker.Stop()
+		seen, last := 0, start
+	wait:
+		for {
+			select {
+			case <-done:
+				break wait
+			case now := <-ticker.C:
+				p, n := lt.progress(seen, now.Sub(last))
+				p.ElapsedMs = durationMs(now.Sub(start))
+				progress(p)
+				seen, last = n, now
+			}
+		}
+	}
+	<-done
+
+	report := lt.report(time.Since(start))
+	report.Cancelled = ctx.Err() != nil
+	return report
+}
+
+func (lt *loadTest) call(ctx context.Context, n int64, worker int, resp *dynamic.Message) loadSample {
+	msg, err := lt.newMessage(n, worker)
+	if err != nil {
+		return loadSample{code: codes.InvalidArgument, err: err.Error()}
+	}
+	if lt.req.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(lt.req.TimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+	start := time.Now()
+	err = lt.conn.Invoke(ctx, lt.fullMethod, msg, resp)
+	sample := loadSample{latency: time.Since(start), code: status.Code(err)}
+	if err != nil {
+		sample.err = status.Convert(err).Message()
+	}
+	return sample
+}
+
+func (lt *loadTest) record(sample loadSample) {
+	lt.mu.Lock()
+	lt.samples = append(lt.samples, sample)
+	lt.mu.Unlock()
+}
+
+// progress summarizes the samples recorded after the first seen, over a
+// window of the given length, and returns the new sample count.
+func (lt *loadTest) progress(seen int, window time.Duration) (LoadTestProgress, int) {
+	lt.mu.Lock()
+	total := len(lt.samples)
+	recent := append([]loadSample(nil), lt.samples[seen:]...)
+	failed := 0
+	for _, s := range lt.samples {
+		if s.code != codes.OK {
+			failed++
+		}
+	}
+	lt.mu.Unlock()
+
+	p := LoadTestProgress{Completed: total, Failed: failed, Latency: latencyStats(sortedLatencies(recent))}
+	if window > 0 {
+		p.Throughput = math.Round(float64(len(recent))/window.Seconds()*100) / 100
+	}
+	return p, total
+}
+
+func (lt *loadTest) report(elapsed time.Duration) LoadTestReport {
+	lt.mu.Lock()
+	samples := lt.samples
+	lt.mu.Unlock()
+
+	report := LoadTestReport{
+		Target:      lt.target.Name,
+		FullMethod:  lt.fullMethod,
+		Concurrency: lt.req.Concurrency,
+		RPS:         lt.req.RPS,
+		Total:       len(samples),
+		DurationMs:  durationMs(elapsed),
+		StatusCodes: map[string]int{},
+	}
+	errs := map[string]int{}
+	for _, s := range samples {
+		report.StatusCodes[s.code.String()]++
+		if s.code == codes.OK {
+			report.Succeeded++
+		} else {
+			report.Failed++
+			errs[s.err]++
+		}
+	}
+	report.Errors = topErrors(errs, loadTestMaxErrors)
+	if elapsed > 0 {
+		report.Throughput = math.Round(float64(len(samples))/elapsed.Seconds()*100) / 100
+	}
+	latencies := sortedLatencies(samples)
+	report.Latency = latencyStats(latencies)
+	report.Histogram = histogram(latencies, loadTestHistogramBuckets)
+	return report
+}
+
+func sortedLatencies(samples []loadSample) []float64 {
+	out := make([]float64, len(samples))
+	for i, s := range samples {
+		out[i] = durationMs(s.latency)
+	}
+	sort.Float64s(out)
+	return out
+}
+
+// latencyStats summarizes sorted latencies.
+func latencyStats(sorted []float64) LatencyStats {
+	if len(sorted) == 0 {
+		return LatencyStats{}
+	}
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	return LatencyStats{
+		MinMs:  sorted[0],
+		MeanMs: math.Round(sum/float64(len(sorted))*1000) / 1000,
+		MaxMs:  sorted[len(sorted)-1],
+		P50Ms:  percentile(sorted, 50),
+		P90Ms:  percentile(sorted, 90),
+		P95Ms:  percentile(sorted, 95),
+		P99Ms:  percentile(sorted, 99),
+	}
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+// histogram splits sorted latencies into equal-width buckets between the
+// fastest and the slowest call.
+func histogram(sorted []float64, buckets int) []HistogramBucket {
+	if len(sorted) == 0 {
+		return nil
+	}
+	lo, hi := sorted[0], sorted[len(sorted)-1]
+	width := (hi - lo) / float64(buckets)
+	if width == 0 {
+		return []HistogramBucket{{UpToMs: hi, Count: len(sorted), Fraction: 1}}
+	}
+	out := make([]HistogramBucket, buckets)
+	i := 0
+	for b := range out {
+		upTo := lo + width*float64(b+1)
+		if b == buckets-1 {
+			upTo = hi
+		}
+		out[b].UpToMs = math.Round(upTo*1000) / 1000
+		for i < len(sorted) && sorted[i] <= upTo {
+			out[b].Count++
+			i++
+		}
+		out[b].Fraction = math.Round(float64(out[b].Count)/float64(len(sorted))*10000) / 10000
+	}
+	return out
+}
+
+func topErrors(errs map[string]int, limit int) map[string]int {
+	if len(errs) <= limit {
+		if len(errs) == 0 {
+			return nil
+		}
+		return errs
+	}
+	msgs := make([]string, 0, len(errs))
+	for msg := range errs {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return errs[msgs[i]] > errs[msgs[j]] })
+	out := make(map[string]int, limit)
+	for _, msg := range msgs[:limit] {
+		out[msg] = errs[msg]
+	}
+	return out
+}
+
+// loadTestHandler runs a load test. The report is returned as JSON, or, with
+// ?stream=true or Accept: text/event-stream, the test is streamed as
+// Server-Sent Events: "start", a "progress" event every 500ms and a final
+// "report". Disconnecting or DELETE /invoke/{callId} stops the test.
+func (s *Server) loadTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req LoadTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Target == "" {
+		req.Target = targetParam(r)
+	}
+	ctx := r.Context()
+
+	lt, snap, target, err := s.prepareLoadTest(ctx, req)
+	if snap != nil {
+		snap.setHeaders(w)
+	}
+	if errors.Is(err, errUnknownTarget) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		invokeErr, httpStatus := newInvokeError(ctx, err, target, snap, false)
+		writeJSON(w, httpStatus, InvokeResponse{Error: invokeErr})
+		return
+	}
+
+	ctx, call, done, err := s.inflight.start(ctx, req.CallID, target.Name, lt.fullMethod, "loadtest", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer done()
+
+	stream := r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if !stream {
+		report := lt.run(ctx, nil)
+		report.Meta = callMeta(call, time.Since(call.StartedAt))
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "streaming is not supported by this connection", http.StatusInternalServerError)
+		return
+	}
+	_ = sse.send("start", call)
+	report := lt.run(ctx, func(p LoadTestProgress) {
+		_ = sse.send("progress", p)
+	})
+	report.Meta = callMeta(call, time.Since(call.StartedAt))
+	_ = sse.send("report", report)
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPrepareLoadTestRejectsUnpaceableRPS(t *testing.T) {
+	srv := newServer(Config{BackendAddr: closedAddr(t)})
+	for _, rps := range []float64{-1, 1e-12, 5e-324, 2e9, 1e300} {
+		_, _, _, err := srv.prepareLoadTest(context.Background(), LoadTestRequest{FullMethod: "/grpc.health.v1.Health/Check", RPS: rps})
+		if err == nil || classifyError(err, false) != errKindPayload {
+			t.Errorf("prepareLoadTest(rps=%g) error = %v, want a payload error", rps, err)
+		}
+	}
+}
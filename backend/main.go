@@ -1,106 +1,157 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/improbable-eng/grpc-web/go/grpcweb"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 )
 
 type Config struct {
-	BackendAddr  string
-	HTTPAddr     string
-	GRPCAddr     string
-	UseTLS       bool
-	ServerName   string
-	AllowOrigin  []string
-	DefaultMD    metadata.MD
-	AutoAllowDev bool
+	BackendAddr        string
+	HTTPAddr           string
+	GRPCAddr           string
+	UseTLS             bool
+	ServerName         string // overrides the name verified against the backend certificate
+	CAFile             string // PEM bundle used to verify the backend certificate
+	CertFile           string // client certificate for mutual TLS
+	KeyFile            string // client key for mutual TLS
+	InsecureSkipVerify bool
+	Transport          string // how the default target is called: grpc, grpc-web, grpc-web-text or connect
+	AllowOrigin        []string
+	DefaultMD          metadata.MD
+	AutoAllowDev       bool
+	Targets            []Target // additional named targets from GRPS_TARGETS
+	ProtoDir           string   // .proto files used when reflection is unavailable
+	ImportPaths        []string
+	DescriptorSet      string // compiled FileDescriptorSet (protoc --descriptor_set_out)
+	DescriptorMode     string // how local descriptors combine with reflection: merge or replace
+	SchemaTTL          time.Duration
+	SchemaCacheDir     string // where resolved schemas are persisted; empty disables persistence
+	VariablesFile      string // where variable sets are persisted; empty keeps them in memory
+	WorkspaceDir       string // directory of saved request collections; empty disables collections
+	Proxy              bool   // relay calls received on GRPCAddr to ProxyTarget
+	ProxyTarget        string // target the proxy forwards to; the default target if empty
+	Gateway            bool   // serve REST routes from google.api.http annotations on HTTPAddr
 }
 
 type Server struct {
+	cfgMu       sync.RWMutex
 	cfg         Config
 	grpcServer  *grpc.Server
-	backendConn *grpc.ClientConn // nil if backend is not connected
+	targets     *targetRegistry
+	conns       *connManager
+	descriptors *descriptorStore
+	reflection  *reflectionVersions
+	schemas     *schemaCache
+	inflight    *inflightRegistry
+	variables   *variableStore
+	collections *collectionStore
 	traffic     *trafficBuffer
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if code, ok := runCommand(os.Args[1:]); ok {
+			os.Exit(code)
+		}
+	}
+
 	cfg := loadConfig()
 
 	if cfg.BackendAddr == "" {
 		log.Fatalf("GRPS_BACKEND_ADDR must be configured (set via environment variable or UI settings)")
 	}
-
-	srv := &Server{
-		cfg:         cfg,
-		traffic:     newTrafficBuffer(500),
-		backendConn: nil, // Will be connected lazily or on startup
+	if err := validateTarget(cfg.defaultTarget()); err != nil {
+		log.Fatalf("Invalid backend settings: %v", err)
 	}
 
-	// Try to connect to backend, but don't fail if it's not available yet
-	// The HTTP server will start anyway and return appropriate errors
-	// TLS IS FORCED TO FALSE - always using plaintext
-	log.Printf("Attempting to connect to gRPC backend at %s (TLS: FALSE - FORCED)", cfg.BackendAddr)
-	log.Printf("DEBUG: GRPS_BACKEND_USE_TLS env var = %q (ignored, TLS forced to false)", os.Getenv("GRPS_BACKEND_USE_TLS"))
-	log.Printf("DEBUG: UseTLS = %v (FORCED TO FALSE)", cfg.UseTLS)
-
-	// Always create a fresh connection - close any existing one first
-	srv.resetConnection()
+	srv := newServer(cfg)
 
-	conn, err := dialBackend(context.Background(), cfg)
-	if err != nil {
-		log.Printf("WARNING: Failed to connect to gRPC backend at %s: %v", cfg.BackendAddr, err)
-		log.Printf("The HTTP server will start anyway. Configure the correct backend address in Settings and restart.")
-		log.Printf("Make sure:\n1. The gRPC backend is running\n2. GRPS_BACKEND_ADDR is correct (currently: %s)", cfg.BackendAddr)
-		log.Printf("NOTE: TLS is FORCED TO FALSE - always using plaintext connections")
-		// If it's a TLS error, this shouldn't happen but provide guidance
-		if strings.Contains(err.Error(), "tls") || strings.Contains(err.Error(), "TLS") {
-			log.Printf("TLS ERROR DETECTED (this shouldn't happen - TLS is forced to false):")
-			log.Printf("  This may indicate a stale connection. Try fully restarting the ServiceLens app.")
-			log.Printf("  Error: %v", err)
+	// Start connecting to the backends in the background; the connection manager
+	// keeps retrying with backoff, so the HTTP server can start right away.
+	for _, t := range srv.targets.list() {
+		if err := srv.loadTargetDescriptors(t); err != nil {
+			log.Printf("WARNING: Failed to load descriptors for target %s: %v", t.Name, err)
 		}
-	} else {
-		log.Printf("Successfully connected to gRPC backend at %s", cfg.BackendAddr)
-		srv.backendConn = conn
+		log.Printf("Connecting to gRPC target %s at %s (TLS: %v)", t.Name, t.Addr, t.UseTLS)
+		if _, err := srv.conns.get(t); err != nil {
+			log.Printf("WARNING: Failed to set up gRPC connection to %s: %v", t.Addr, err)
+			log.Printf("The HTTP server will start anyway. Fix the backend configuration in Settings and restart.")
+		}
+	}
+
+	// Report edits made to the collections on disk (editors, git) to the UI.
+	if err := srv.collections.watch(nil); err != nil {
+		log.Printf("WARNING: not watching collections in %s: %v", cfg.WorkspaceDir, err)
 	}
 
-	srv.grpcServer = grpc.NewServer(grpc.ChainUnaryInterceptor(srv.loggingUnaryInterceptor))
-	reflection.Register(srv.grpcServer)
+	if cfg.Proxy {
+		// Every call, reflection included, is relayed so that clients see the
+		// backend's services rather than the inspector's.
+		srv.grpcServer = grpc.NewServer(srv.proxyServerOptions()...)
+	} else {
+		srv.grpcServer = grpc.NewServer(grpc.ChainUnaryInterceptor(srv.loggingUnaryInterceptor))
+		reflection.Register(srv.grpcServer)
+	}
 
-	wrapped := grpcweb.WrapServer(
-		srv.grpcServer,
-		grpcweb.WithOriginFunc(srv.allowOrigin),
-	)
+	wrapped := srv.grpcWebProxy()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/schema", srv.corsMiddleware(srv.schemaHandler))
+	mux.HandleFunc("/schema/descriptors", srv.corsMiddleware(srv.descriptorsHandler))
+	mux.HandleFunc("/schema/invalidate", srv.corsMiddleware(srv.schemaInvalidateHandler))
 	mux.HandleFunc("/traffic", srv.corsMiddleware(srv.trafficHandler))
 	mux.HandleFunc("/invoke", srv.corsMiddleware(srv.invokeHandler))
+	mux.HandleFunc("/invoke/batch", srv.corsMiddleware(srv.invokeBatchHandler))
+	mux.HandleFunc("/invoke/stream", srv.corsMiddleware(srv.invokeStreamHandler))
+	mux.HandleFunc("/invoke/ws", srv.invokeWSHandler)
+	mux.HandleFunc("/invoke/inflight", srv.corsMiddleware(srv.inflightHandler))
+	mux.HandleFunc("/invoke/", srv.corsMiddleware(srv.invokeCallHandler))
+	mux.HandleFunc("/variables", srv.corsMiddleware(srv.variablesHandler))
+	mux.HandleFunc("/variables/", srv.corsMiddleware(srv.variableSetHandler))
+	mux.HandleFunc("/collections", srv.corsMiddleware(srv.collectionsHandler))
+	mux.HandleFunc("/collections/", srv.corsMiddleware(srv.collectionHandler))
+	mux.HandleFunc("/tests/run", srv.corsMiddleware(srv.testsRunHandler))
+	mux.HandleFunc("/workflows/run", srv.corsMiddleware(srv.workflowsRunHandler))
+	mux.HandleFunc("/loadtest", srv.corsMiddleware(srv.loadTestHandler))
 	mux.HandleFunc("/inspector/capabilities", srv.corsMiddleware(srv.capabilitiesHandler))
+	mux.HandleFunc("/inspector/config", srv.corsMiddleware(srv.configHandler))
+	mux.HandleFunc("/inspector/diagnose", srv.corsMiddleware(srv.diagnoseHandler))
 	mux.HandleFunc("/healthz", srv.corsMiddleware(srv.healthHandler))
+	mux.HandleFunc("/healthz/live", srv.corsMiddleware(srv.liveHandler))
+	mux.HandleFunc("/healthz/watch", srv.corsMiddleware(srv.healthWatchHandler))
+	mux.HandleFunc("/targets", srv.corsMiddleware(srv.targetsHandler))
+	mux.HandleFunc("/targets/", srv.corsMiddleware(srv.targetHandler))
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if wrapped.IsGrpcWebRequest(r) || wrapped.IsAcceptableGrpcCorsRequest(r) {
-			wrapped.ServeHTTP(w, r)
+			srv.serveGRPCWeb(wrapped, w, r)
+			return
+		}
+		if srv.config().Gateway && srv.serveGateway(w, r) {
+			return
+		}
+		if isConnectRequest(r) {
+			srv.connectHandler(w, r)
 			return
 		}
 		http.NotFound(w, r)
 	})
 
 	// Start gRPC server in a goroutine (non-blocking, non-fatal)
-	// This is used for reflection but the HTTP proxy can work without it
+	// This is used for reflection, or for relaying in proxy mode, but the HTTP
+	// proxy can work without it
 	go func() {
 		lis, err := net.Listen("tcp", cfg.GRPCAddr)
 		if err != nil {
@@ -109,6 +160,13 @@ func main() {
 			return
 		}
 		log.Printf("gRPC server listening on %s\n", cfg.GRPCAddr)
+		if cfg.Proxy {
+			if t, ok := srv.targets.get(cfg.ProxyTarget); ok {
+				log.Printf("Relaying gRPC calls on %s to target %s at %s", cfg.GRPCAddr, t.Name, t.Addr)
+			} else {
+				log.Printf("WARNING: proxy target %q is not configured; relayed calls will fail", cfg.ProxyTarget)
+			}
+		}
 		if err := srv.grpcServer.Serve(lis); err != nil {
 			log.Printf("WARNING: gRPC server error: %v (HTTP proxy continues)", err)
 		}
@@ -120,113 +178,106 @@ func main() {
 	}
 }
 
-func loadConfig() Config {
-	// FORCE TLS TO FALSE - always use insecure (plaintext) connections
-	// This matches grpcurl -plaintext behavior
-	useTLS := false
+// newServer creates the server state for cfg, with the targets from
+// GRPS_TARGETS registered next to the default target.
+func newServer(cfg Config) *Server {
+	srv := &Server{
+		cfg:         cfg,
+		targets:     newTargetRegistry(cfg.defaultTarget()),
+		conns:       newConnManager(),
+		descriptors: newDescriptorStore(),
+		reflection:  newReflectionVersions(),
+		schemas:     newSchemaCache(cfg.SchemaTTL, cfg.SchemaCacheDir),
+		inflight:    newInflightRegistry(),
+		variables:   newVariableStore(cfg.VariablesFile),
+		collections: newCollectionStore(cfg.WorkspaceDir),
+		traffic:     newTrafficBuffer(500),
+	}
+	for _, t := range cfg.Targets {
+		if err := srv.targets.put(t); err != nil {
+			log.Printf("WARNING: ignoring target %q from GRPS_TARGETS: %v", t.Name, err)
+		}
+	}
+	return srv
+}
 
+func loadConfig() Config {
 	cfg := Config{
-		BackendAddr:  envOr("GRPS_BACKEND_ADDR", "localhost:9090"), // Console gRPC server (where inspector backend connects TO)
-		HTTPAddr:     envOr("GRPS_HTTP_ADDR", ":8081"),             // Inspector backend HTTP server (where UI connects)
-		GRPCAddr:     envOr("GRPS_GRPC_ADDR", ":50052"),
-		ServerName:   os.Getenv("GRPS_BACKEND_SERVER_NAME"),
-		AllowOrigin:  splitCSV(envOr("GRPS_ALLOW_ORIGINS", "*")),
-		UseTLS:       useTLS, // FORCED TO FALSE - always use plaintext
-		DefaultMD:    parseMetadata(envOr("GRPS_DEFAULT_METADATA", "")),
-		AutoAllowDev: envBool("GRPS_AUTO_ALLOW_DEV_ORIGINS", true),
-	}
-	log.Printf("FORCED TLS TO FALSE - Using plaintext (insecure) connections only")
+		BackendAddr:        envOr("GRPS_BACKEND_ADDR", "localhost:9090"), // Console gRPC server (where inspector backend connects TO)
+		HTTPAddr:           envOr("GRPS_HTTP_ADDR", ":8081"),             // Inspector backend HTTP server (where UI connects)
+		GRPCAddr:           envOr("GRPS_GRPC_ADDR", ":50052"),
+		ServerName:         os.Getenv("GRPS_BACKEND_SERVER_NAME"),
+		CAFile:             os.Getenv("GRPS_BACKEND_CA_FILE"),
+		CertFile:           os.Getenv("GRPS_BACKEND_CERT_FILE"),
+		KeyFile:            os.Getenv("GRPS_BACKEND_KEY_FILE"),
+		InsecureSkipVerify: envBool("GRPS_BACKEND_INSECURE_SKIP_VERIFY", false),
+		Transport:          os.Getenv("GRPS_BACKEND_TRANSPORT"),
+		AllowOrigin:        splitCSV(envOr("GRPS_ALLOW_ORIGINS", "*")),
+		UseTLS:             envBool("GRPS_BACKEND_USE_TLS", false),
+		DefaultMD:          parseMetadata(envOr("GRPS_DEFAULT_METADATA", "")),
+		AutoAllowDev:       envBool("GRPS_AUTO_ALLOW_DEV_ORIGINS", true),
+		Targets:            parseTargets(os.Getenv("GRPS_TARGETS")),
+		ProtoDir:           os.Getenv("GRPS_PROTO_DIR"),
+		ImportPaths:        splitCSV(os.Getenv("GRPS_PROTO_IMPORT_PATHS")),
+		DescriptorSet:      os.Getenv("GRPS_DESCRIPTOR_SET"),
+		DescriptorMode:     os.Getenv("GRPS_DESCRIPTOR_MODE"),
+		SchemaTTL:          envDuration("GRPS_SCHEMA_TTL", 5*time.Minute),
+		SchemaCacheDir:     schemaCacheDir(os.Getenv("GRPS_SCHEMA_CACHE_DIR")),
+		VariablesFile:      variablesFile(os.Getenv("GRPS_VARIABLES_FILE")),
+		WorkspaceDir:       workspaceDir(os.Getenv("GRPS_WORKSPACE_DIR")),
+		Proxy:              envBool("GRPS_PROXY", false),
+		ProxyTarget:        os.Getenv("GRPS_PROXY_TARGET"),
+		Gateway:            envBool("GRPS_GATEWAY", false),
+	}
+	cfg.implyTLS()
 	return cfg
 }
 
-func dialBackend(ctx context.Context, cfg Config) (*grpc.ClientConn, error) {
-	// FORCE TLS TO FALSE - always use insecure (plaintext) connections
-	// This matches grpcurl -plaintext behavior
-	// IGNORE cfg.UseTLS completely - always use insecure
-	log.Printf("FORCED: Using insecure (no TLS) credentials for connection to %s", cfg.BackendAddr)
-	log.Printf("FORCED: cfg.UseTLS=%v (IGNORED - always using insecure)", cfg.UseTLS)
-	
-	// Create insecure credentials - this is the ONLY way to connect
-	creds := insecure.NewCredentials()
-	
-	// Add unique identifier to target to force new connection (prevent connection pooling)
-	// This ensures gRPC doesn't reuse any cached connections
-	uniqueTarget := fmt.Sprintf("%s?nocache=%d", cfg.BackendAddr, time.Now().UnixNano())
-	log.Printf("Using unique target: %s (to prevent connection reuse)", uniqueTarget)
-	
-	// Build dial options - ONLY insecure credentials, nothing else
-	opts := []grpc.DialOption{
-		grpc.WithTransportCredentials(creds),
-		grpc.WithBlock(), // Ensure connection is established
-		grpc.WithDisableServiceConfig(), // Disable service config to prevent connection reuse
-		grpc.WithDisableRetry(), // Disable retries
-	}
-	
-	log.Printf("Dial options: WithTransportCredentials(insecure), WithBlock, WithDisableServiceConfig, WithDisableRetry")
-	
-	// Use a timeout context to prevent hanging
-	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-	
-	conn, err := grpc.DialContext(dialCtx, uniqueTarget, opts...)
-	if err != nil {
-		log.Printf("ERROR dialing backend: %v", err)
-		log.Printf("ERROR: This should not happen with insecure credentials. Check that %s is a plaintext gRPC server.", cfg.BackendAddr)
-		return nil, err
-	}
-	
-	// Verify connection state and credentials
-	state := conn.GetState()
-	log.Printf("SUCCESS: Connected to %s with insecure (no TLS) credentials (state: %s)", cfg.BackendAddr, state.String())
-	
-	// Double-check: try to get connection info
-	// The connection should be using insecure transport
-	return conn, nil
+// implyTLS turns TLS on when TLS material is configured; plaintext with a CA
+// bundle is never what was meant.
+func (cfg *Config) implyTLS() {
+	if cfg.CAFile != "" || cfg.CertFile != "" || cfg.InsecureSkipVerify {
+		cfg.UseTLS = true
+	}
 }
 
-// resetConnection closes and clears the backend connection
-func (s *Server) resetConnection() {
-	if s.backendConn != nil {
-		log.Printf("Closing existing backend connection...")
-		if err := s.backendConn.Close(); err != nil {
-			log.Printf("Error closing backend connection: %v", err)
+// dialBackend creates a non-blocking client connection to a target. The
+// connection is established in the background and re-established with backoff
+// whenever it drops. gRPC-Web and Connect targets get an httpConn instead.
+func dialBackend(t Target) (backendConn, error) {
+	if t.isHTTPTransport() {
+		conn, err := newHTTPConn(t)
+		if err != nil {
+			return nil, fmt.Errorf("configure TLS: %w", err)
 		}
-		s.backendConn = nil
-		log.Printf("Backend connection reset")
+		return conn, nil
 	}
-}
-
-// ensureConnection ensures the backend connection exists and is healthy
-// ALWAYS resets and recreates connection to prevent stale TLS connections
-func (s *Server) ensureConnection(ctx context.Context) error {
-	// Always reset existing connection to ensure it's fresh with TLS=false
-	if s.backendConn != nil {
-		state := s.backendConn.GetState()
-		log.Printf("Resetting existing connection (state: %s) to ensure fresh TLS=false connection...", state.String())
-		s.resetConnection()
+	creds, err := backendCredentials(t)
+	if err != nil {
+		return nil, fmt.Errorf("configure TLS: %w", err)
 	}
 
-	log.Printf("Creating fresh backend connection (TLS forced to false)...")
-	conn, err := dialBackend(ctx, s.cfg)
+	conn, err := grpc.NewClient(t.Addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithConnectParams(backendConnectParams),
+	)
 	if err != nil {
-		log.Printf("ERROR: Failed to create backend connection: %v", err)
-		return err
+		return nil, fmt.Errorf("create client for %s: %w", t.Addr, err)
 	}
-	s.backendConn = conn
-	log.Printf("Fresh backend connection created successfully (TLS=false)")
-	return nil
+	return conn, nil
 }
 
 func (s *Server) allowOrigin(origin string) bool {
-	if len(s.cfg.AllowOrigin) == 0 {
+	cfg := s.config()
+	if len(cfg.AllowOrigin) == 0 {
 		return true
 	}
-	for _, allowed := range s.cfg.AllowOrigin {
+	for _, allowed := range cfg.AllowOrigin {
 		if allowed == "*" || strings.EqualFold(allowed, origin) {
 			return true
 		}
 	}
-	if s.cfg.AutoAllowDev && isLocalDevOrigin(origin) {
+	if cfg.AutoAllowDev && isLocalDevOrigin(origin) {
 		return true
 	}
 	return false
@@ -241,7 +292,7 @@ func (s *Server) corsMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,X-Grpc-Web")
-			w.Header().Set("Access-Control-Expose-Headers", "grpc-status,grpc-message")
+			w.Header().Set("Access-Control-Expose-Headers", "grpc-status,grpc-message,X-Schema-Age,X-Schema-Source,X-Schema-Stale,X-Error-Kind")
 		}
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
@@ -262,11 +313,6 @@ func (s *Server) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte("ok"))
-}
-
 func envOr(key, def string) string {
 	if val := os.Getenv(key); val != "" {
 		return val
@@ -289,6 +335,51 @@ func envBool(key string, def bool) bool {
 	}
 }
 
+func envDuration(key string, def time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		log.Printf("WARNING: invalid %s %q, using %s", key, val, def)
+		return def
+	}
+	return d
+}
+
+// schemaCacheDir resolves GRPS_SCHEMA_CACHE_DIR: empty selects the user cache
+// directory and "off" disables persistence.
+func schemaCacheDir(val string) string {
+	switch val {
+	case "off":
+		return ""
+	case "":
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return ""
+		}
+		return filepath.Join(dir, "servicelens", "schemas")
+	}
+	return val
+}
+
+// workspaceDir resolves GRPS_WORKSPACE_DIR: empty selects the user config
+// directory and "off" disables collections.
+func workspaceDir(val string) string {
+	switch val {
+	case "off":
+		return ""
+	case "":
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return ""
+		}
+		return filepath.Join(dir, "servicelens", "collections")
+	}
+	return val
+}
+
 func splitCSV(input string) []string {
 	if input == "" {
 		return nil
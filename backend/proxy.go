@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// In proxy mode (GRPS_PROXY) the gRPC server on GRPCAddr relays every call
+// to the backend as raw frames, so applications can be pointed at the
+// inspector instead of the service. gRPC-Web calls on HTTPAddr are always
+// relayed the same way, so browser apps can use the inspector as their
+// gRPC-Web proxy. Frames are decoded with the target's
+// descriptors only after the call has finished and recorded in the traffic
+// buffer; a schema problem never breaks the relayed call.
+
+// proxyMaxLoggedMessages caps the message log of one proxied streaming call.
+// Later messages are still relayed, just not recorded.
+const proxyMaxLoggedMessages = 1000
+
+// Sources of relayed traffic entries.
+const (
+	trafficSourceProxy   = "proxy"    // native gRPC on GRPCAddr
+	trafficSourceGRPCWeb = "grpc-web" // gRPC-Web on HTTPAddr
+)
+
+// targetHeader lets a relayed call pick a named target instead of the proxy
+// target. It is not forwarded to the backend.
+const targetHeader = "x-servicelens-target"
+
+// proxyOrigin describes how a relayed call reached the inspector when it did
+// not arrive as native gRPC.
+type proxyOrigin struct {
+	source string
+	header http.Header // the original HTTP request headers
+}
+
+type proxyOriginKey struct{}
+
+func withProxyOrigin(ctx context.Context, origin proxyOrigin) context.Context {
+	return context.WithValue(ctx, proxyOriginKey{}, origin)
+}
+
+// grpcWebProxy returns a handler that relays gRPC-Web calls from browsers to
+// the backend, with CORS answered according to allowOrigin.
+func (s *Server) grpcWebProxy() *grpcweb.WrappedGrpcServer {
+	relay := grpc.NewServer(s.proxyServerOptions()...)
+	return grpcweb.WrapServer(relay,
+		grpcweb.WithOriginFunc(s.allowOrigin),
+		// Nothing is registered on relay; every method is forwarded.
+		grpcweb.WithCorsForRegisteredEndpointsOnly(false),
+	)
+}
+
+// serveGRPCWeb relays a gRPC-Web request, keeping its HTTP headers for the
+// traffic log.
+func (s *Server) serveGRPCWeb(wrapped *grpcweb.WrappedGrpcServer, w http.ResponseWriter, r *http.Request) {
+	ctx := withProxyOrigin(r.Context(), proxyOrigin{source: trafficSourceGRPCWeb, header: r.Header.Clone()})
+	wrapped.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// rawFrame is a message the proxy relays without decoding it.
+type rawFrame struct {
+	data []byte
+}
+
+// rawCodec passes rawFrames through unchanged. Other messages are marshalled
+// as protobuf, so services registered next to the proxy keep working.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *rawFrame:
+		return m.data, nil
+	case proto.Message:
+		return proto.Marshal(m)
+	}
+	return nil, fmt.Errorf("rawCodec: cannot marshal %T", v)
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *rawFrame:
+		m.data = append([]byte(nil), data...)
+		return nil
+	case proto.Message:
+		return proto.Unmarshal(data, m)
+	}
+	return fmt.Errorf("rawCodec: cannot unmarshal into %T", v)
+}
+
+func (rawCodec) Name() string { return "proto" }
+
+// proxyServerOptions makes a grpc.Server forward calls to unknown services to
+// the proxy target.
+func (s *Server) proxyServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ForceServerCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(s.proxyHandler),
+	}
+}
+
+// proxyFrame is a relayed message kept for the traffic log.
+type proxyFrame struct {
+	direction string
+	elapsedMs float64
+	data      []byte
+}
+
+// proxySession collects the frames of one proxied call. Both directions are
+// relayed concurrently.
+type proxySession struct {
+	mu      sync.Mutex
+	start   time.Time
+	end     time.Time
+	frames  []proxyFrame
+	dropped int
+}
+
+func (ps *proxySession) add(direction string, data []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if len(ps.frames) >= proxyMaxLoggedMessages {
+		ps.dropped++
+		return
+	}
+	ps.frames = append(ps.frames, proxyFrame{direction: direction, elapsedMs: durationMs(time.Since(ps.start)), data: data})
+}
+
+// proxyHandler relays a call of any kind to the proxy target. Headers,
+// messages, trailers and the final status are passed through as the backend
+// sent them.
+func (s *Server) proxyHandler(_ any, stream grpc.ServerStream) error {
+	fullMethod, ok := grpc.MethodFromServerStream(stream)
+	if !ok {
+		return status.Error(codes.Internal, "proxy: no method in stream")
+	}
+	origin, _ := stream.Context().Value(proxyOriginKey{}).(proxyOrigin)
+	if origin.source == "" {
+		origin.source = trafficSourceProxy
+	}
+	inMD, _ := metadata.FromIncomingContext(stream.Context())
+	inMD = inMD.Copy()
+	targetName := s.config().ProxyTarget
+	if names := inMD.Get(targetHeader); len(names) > 0 {
+		targetName = names[0]
+		delete(inMD, targetHeader)
+	}
+	conn, target, err := s.backend(targetName)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "proxy: %v", err)
+	}
+
+	ctx, call, done, err := s.inflight.start(stream.Context(), "", target.Name, fullMethod, "proxy", 0)
+	if err != nil {
+		return status.Errorf(codes.Internal, "proxy: %v", err)
+	}
+	defer done()
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, inMD))
+	defer cancel()
+
+	// Any method can be relayed as a bidi stream, except to Connect backends,
+	// which frame unary calls differently.
+	streamDesc := &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}
+	if target.Transport == transportConnect {
+		if methodDesc, _, err := s.resolveMethod(ctx, conn, target, fullMethod); err == nil {
+			streamDesc = &grpc.StreamDesc{ClientStreams: methodDesc.IsClientStreaming(), ServerStreams: methodDesc.IsServerStreaming()}
+		}
+	}
+
+	session := &proxySession{start: call.StartedAt}
+	answered, err := relayStream(ctx, cancel, conn, streamDesc, fullMethod, stream, session)
+	session.end = time.Now()
+	// Recording may resolve the schema; the client gets its status first.
+	go s.recordProxyCall(target, fullMethod, origin, inMD, session, answered, err)
+	return err
+}
+
+// relayStream copies client frames to the backend and backend frames to the
+// client until the backend ends the call, and returns the backend's status
+// and whether the backend answered at all.
+func relayStream(ctx context.Context, cancel context.CancelFunc, conn grpc.ClientConnInterface, streamDesc *grpc.StreamDesc, fullMethod string, down grpc.ServerStream, session *proxySession) (bool, error) {
+	up, err := conn.NewStream(ctx, streamDesc, fullMethod, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return false, err
+	}
+
+	go func() {
+		for {
+			f := &rawFrame{}
+			if err := down.RecvMsg(f); err != nil {
+				if errors.Is(err, io.EOF) {
+					_ = up.CloseSend()
+				} else {
+					cancel() // the client went away
+				}
+				return
+			}
+			session.add("send", f.data)
+			if err := up.SendMsg(f); err != nil {
+				return // RecvMsg below reports the status
+			}
+		}
+	}()
+
+	header, err := up.Header()
+	if err == nil && len(header) > 0 {
+		if err := down.SendHeader(header); err != nil {
+			return true, err
+		}
+	}
+	for {
+		f := &rawFrame{}
+		if err = up.RecvMsg(f); err != nil {
+			break
+		}
+		session.add("recv", f.data)
+		if err := down.SendMsg(f); err != nil {
+			return true, err
+		}
+	}
+	trailer := up.Trailer()
+	down.SetTrailer(trailer)
+	if errors.Is(err, io.EOF) {
+		return true, nil
+	}
+	return answeredBy(header, trailer), err
+}
+
+// recordProxyCall decodes the frames of a finished call and adds it to the
+// traffic buffer. A unary call is recorded with its request and response, a
+// streaming call with its message log.
+func (s *Server) recordProxyCall(target Target, fullMethod string, origin proxyOrigin, md metadata.MD, session *proxySession, answered bool, callErr error) {
+	entry := TrafficEntry{
+		Target:      target.Name,
+		Source:      origin.source,
+		Service:     parseService(fullMethod),
+		Method:      parseMethod(fullMethod),
+		Metadata:    metadataToMap(md),
+		HTTPHeaders: origin.header,
+		StartedAt:   session.start,
+		Duration:    session.end.Sub(session.start),
+	}
+	if ids := md.Get(correlationHeader); len(ids) > 0 {
+		entry.CorrelationID = ids[0]
+	}
+
+	// Decoding may need a reflection round trip when the schema is not cached,
+	// so it gets its own deadline rather than the finished call's context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var methodDesc *desc.MethodDescriptor
+	var snap *schemaSnapshot
+	if conn, err := s.conns.get(target); err == nil {
+		methodDesc, snap, _ = s.resolveMethod(ctx, conn, target, fullMethod)
+	}
+
+	if callErr != nil {
+		invokeErr, _ := newInvokeError(ctx, callErr, target, snap, answered)
+		entry.Error = callErr.Error()
+		entry.ErrorKind = invokeErr.Kind
+		entry.ErrorDetails = invokeErr.Details
+	}
+
+	session.mu.Lock()
+	frames := session.frames
+	dropped := session.dropped
+	session.mu.Unlock()
+
+	unary := methodDesc != nil && !methodDesc.IsClientStreaming() && !methodDesc.IsServerStreaming()
+	if methodDesc == nil {
+		unary = len(frames) <= 2 && dropped == 0 && countFrames(frames, "send") <= 1 && countFrames(frames, "recv") <= 1
+	}
+	if unary {
+		for _, f := range frames {
+			msg := decodeProxyFrame(methodDesc, f)
+			if f.direction == "send" {
+				entry.Request = msg
+			} else {
+				entry.Response = msg
+			}
+		}
+	} else {
+		entry.Messages = make([]StreamLogEntry, 0, len(frames))
+		for _, f := range frames {
+			entry.Messages = append(entry.Messages, StreamLogEntry{Direction: f.direction, ElapsedMs: f.elapsedMs, Message: decodeProxyFrame(methodDesc, f)})
+		}
+	}
+	s.traffic.add(entry)
+}
+
+func countFrames(frames []proxyFrame, direction string) int {
+	n := 0
+	for _, f := range frames {
+		if f.direction == direction {
+			n++
+		}
+	}
+	return n
+}
+
+// decodeProxyFrame renders a frame as JSON. Frames that cannot be decoded
+// because the method is unknown to the schema are kept as base64 strings.
+func decodeProxyFrame(methodDesc *desc.MethodDescriptor, f proxyFrame) json.RawMessage {
+	if methodDesc != nil {
+		msgType := methodDesc.GetInputType()
+		if f.direction == "recv" {
+			msgType = methodDesc.GetOutputType()
+		}
+		msg := dynamic.NewMessage(msgType)
+		if err := msg.Unmarshal(f.data); err == nil {
+			if b, err := msg.MarshalJSON(); err == nil {
+				return b
+			}
+		}
+	}
+	b, _ := json.Marshal(f.data)
+	return b
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// startProxyBackend serves echoHealth and reflection like startEchoBackend,
+// echoes every message of an unknown method back, and reports the metadata
+// of each unary call and each call of an unknown method on seen.
+func startProxyBackend(t *testing.T) (string, *health.Server, <-chan metadata.MD) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(chan metadata.MD, 16)
+	note := func(ctx context.Context) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		select {
+		case seen <- md:
+		default:
+		}
+	}
+	gs := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			note(ctx)
+			return handler(ctx, req)
+		}),
+		grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+			note(stream.Context())
+			for {
+				// Empty keeps the frame's fields as unknown fields, so it is
+				// sent back byte for byte.
+				msg := &emptypb.Empty{}
+				if err := stream.RecvMsg(msg); errors.Is(err, io.EOF) {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if err := stream.SendMsg(msg); err != nil {
+					return err
+				}
+			}
+		}),
+	)
+	hs := health.NewServer()
+	hs.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(gs, echoHealth{hs})
+	reflection.Register(gs)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	return lis.Addr().String(), hs, seen
+}
+
+// startProxy serves srv's proxy on a native gRPC listener and dials it.
+func startProxy(t *testing.T, srv *Server) *grpc.ClientConn {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := grpc.NewServer(srv.proxyServerOptions()...)
+	go ps.Serve(lis)
+	t.Cleanup(ps.Stop)
+	return dialForTest(t, lis.Addr().String(), nil)
+}
+
+// waitForTraffic waits for the traffic entry of method, which is recorded
+// after the relayed call has returned.
+func waitForTraffic(t *testing.T, srv *Server, method string) TrafficEntry {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, e := range srv.traffic.snapshot() {
+			if e.Method == method {
+				return e
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no traffic entry for %s in %+v", method, srv.traffic.snapshot())
+	return TrafficEntry{}
+}
+
+func TestProxyRelaysUnaryCalls(t *testing.T) {
+	addr, _, seen := startProxyBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	t.Cleanup(srv.conns.closeAll)
+	client := healthpb.NewHealthClient(startProxy(t, srv))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-custom", "hello", targetHeader, defaultTargetName)
+	var header, trailer metadata.MD
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "svc"}, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatalf("Check through proxy: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("status = %v, want SERVING", resp.Status)
+	}
+	if got := header.Get("x-echo"); len(got) != 1 || got[0] != "hello" {
+		t.Errorf("header x-echo = %v, want [hello]", got)
+	}
+	if got := trailer.Get("x-trail"); len(got) != 1 || got[0] != "t1" {
+		t.Errorf("trailer x-trail = %v, want [t1]", got)
+	}
+	md := <-seen
+	if got := md.Get(targetHeader); len(got) != 0 {
+		t.Errorf("backend saw %s: %v", targetHeader, got)
+	}
+	if got := md.Get("x-custom"); len(got) != 1 || got[0] != "hello" {
+		t.Errorf("backend saw x-custom = %v, want [hello]", got)
+	}
+
+	entry := waitForTraffic(t, srv, "Check")
+	if entry.Source != trafficSourceProxy || entry.Target != defaultTargetName || entry.Service != "grpc.health.v1.Health" {
+		t.Errorf("entry = %s %s %s, want proxy default grpc.health.v1.Health", entry.Source, entry.Target, entry.Service)
+	}
+	if _, ok := entry.Metadata[targetHeader]; ok {
+		t.Errorf("recorded metadata keeps %s: %v", targetHeader, entry.Metadata)
+	}
+	if got := entry.Metadata["x-custom"]; len(got) != 1 || got[0] != "hello" {
+		t.Errorf("recorded x-custom = %v, want [hello]", got)
+	}
+	assertJSONEqual(t, entry.Request, `{"service":"svc"}`)
+	assertJSONEqual(t, entry.Response, `{"status":"SERVING"}`)
+	if entry.Error != "" || len(entry.Messages) != 0 {
+		t.Errorf("unary entry has error %q and %d messages", entry.Error, len(entry.Messages))
+	}
+}
+
+func TestProxyPassesErrorStatus(t *testing.T) {
+	addr, _, _ := startProxyBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	t.Cleanup(srv.conns.closeAll)
+	client := healthpb.NewHealthClient(startProxy(t, srv))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var trailer metadata.MD
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "fail"}, grpc.Trailer(&trailer))
+	st := status.Convert(err)
+	if st.Code() != codes.FailedPrecondition || st.Message() != "bad state: 100%" {
+		t.Fatalf("status = %v %q, want FailedPrecondition %q", st.Code(), st.Message(), "bad state: 100%")
+	}
+	if details := st.Details(); len(details) != 1 {
+		t.Errorf("details = %v, want the ErrorInfo", details)
+	} else if info, ok := details[0].(*errdetails.ErrorInfo); !ok || info.Reason != "BROKEN" {
+		t.Errorf("detail = %v, want ErrorInfo BROKEN", details[0])
+	}
+	if got := trailer.Get("x-trail"); len(got) != 1 || got[0] != "t1" {
+		t.Errorf("trailer x-trail = %v, want [t1]", got)
+	}
+
+	entry := waitForTraffic(t, srv, "Check")
+	if entry.ErrorKind != errKindApplication || !strings.Contains(entry.Error, "bad state") {
+		t.Errorf("entry error = %s %q, want an application error", entry.ErrorKind, entry.Error)
+	}
+	if len(entry.ErrorDetails) != 1 {
+		t.Errorf("entry error details = %+v, want the ErrorInfo", entry.ErrorDetails)
+	}
+	assertJSONEqual(t, entry.Request, `{"service":"fail"}`)
+}
+
+func TestProxyRelaysServerStreams(t *testing.T) {
+	addr, hs, _ := startProxyBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	t.Cleanup(srv.conns.closeAll)
+	client := healthpb.NewHealthClient(startProxy(t, srv))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := watch.Recv()
+	if err != nil || first.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("first Watch message = %v, %v; want SERVING", first, err)
+	}
+	hs.SetServingStatus("svc", healthpb.HealthCheckResponse_NOT_SERVING)
+	second, err := watch.Recv()
+	if err != nil || second.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("second Watch message = %v, %v; want NOT_SERVING", second, err)
+	}
+	cancel()
+
+	entry := waitForTraffic(t, srv, "Watch")
+	if entry.Request != nil || entry.Response != nil {
+		t.Errorf("streaming entry has request %s and response %s", entry.Request, entry.Response)
+	}
+	if len(entry.Messages) != 3 {
+		t.Fatalf("messages = %+v, want one sent and two received", entry.Messages)
+	}
+	want := []struct{ direction, message string }{
+		{"send", `{"service":"svc"}`},
+		{"recv", `{"status":"SERVING"}`},
+		{"recv", `{"status":"NOT_SERVING"}`},
+	}
+	for i, w := range want {
+		if entry.Messages[i].Direction != w.direction {
+			t.Errorf("message %d direction = %s, want %s", i, entry.Messages[i].Direction, w.direction)
+		}
+		assertJSONEqual(t, entry.Messages[i].Message, w.message)
+	}
+}
+
+func TestProxyRecordsUnknownMethodsAsBase64(t *testing.T) {
+	addr, _, _ := startProxyBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	t.Cleanup(srv.conns.closeAll)
+	conn := startProxy(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	frame := func(s string) string {
+		b, err := proto.Marshal(wrapperspb.String(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	base64JSON := func(raw json.RawMessage) string {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			t.Errorf("message %s is not a base64 string: %v", raw, err)
+		}
+		return s
+	}
+
+	t.Run("unary", func(t *testing.T) {
+		var out wrapperspb.StringValue
+		if err := conn.Invoke(ctx, "/echo.Raw/Echo", wrapperspb.String("ping"), &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Value != "ping" {
+			t.Errorf("echo = %q, want ping", out.Value)
+		}
+		entry := waitForTraffic(t, srv, "Echo")
+		if entry.Service != "echo.Raw" {
+			t.Errorf("service = %q, want echo.Raw", entry.Service)
+		}
+		if got := base64JSON(entry.Request); got != frame("ping") {
+			t.Errorf("request = %s, want %s", got, frame("ping"))
+		}
+		if got := base64JSON(entry.Response); got != frame("ping") {
+			t.Errorf("response = %s, want %s", got, frame("ping"))
+		}
+	})
+
+	t.Run("bidi", func(t *testing.T) {
+		stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, "/echo.Raw/Chat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{"a", "b"} {
+			if err := stream.SendMsg(wrapperspb.String(s)); err != nil {
+				t.Fatal(err)
+			}
+			var out wrapperspb.StringValue
+			if err := stream.RecvMsg(&out); err != nil || out.Value != s {
+				t.Fatalf("echo = %q, %v; want %q", out.Value, err, s)
+			}
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.RecvMsg(&wrapperspb.StringValue{}); !errors.Is(err, io.EOF) {
+			t.Fatalf("end of stream = %v, want EOF", err)
+		}
+
+		entry := waitForTraffic(t, srv, "Chat")
+		if len(entry.Messages) != 4 {
+			t.Fatalf("messages = %+v, want four", entry.Messages)
+		}
+		for i, s := range []string{"a", "a", "b", "b"} {
+			if got := base64JSON(entry.Messages[i].Message); got != frame(s) {
+				t.Errorf("message %d = %s, want %s", i, got, frame(s))
+			}
+		}
+	})
+}
+
+func TestProxyRejectsUnknownTarget(t *testing.T) {
+	addr, _, _ := startProxyBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	t.Cleanup(srv.conns.closeAll)
+	client := healthpb.NewHealthClient(startProxy(t, srv))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, targetHeader, "nope")
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "svc"})
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("code = %v, want Unavailable", code)
+	}
+}
+
+// startGRPCWebProxy serves srv's gRPC-Web relay the way main's "/" handler
+// does and returns its URL.
+func startGRPCWebProxy(t *testing.T, srv *Server) string {
+	t.Helper()
+	wrapped := srv.grpcWebProxy()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wrapped.IsGrpcWebRequest(r) || wrapped.IsAcceptableGrpcCorsRequest(r) {
+			srv.serveGRPCWeb(wrapped, w, r)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestGRPCWebProxyRelaysToGRPCBackend(t *testing.T) {
+	addr, _, seen := startProxyBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	t.Cleanup(srv.conns.closeAll)
+	conn := newTestHTTPConn(t, hostPort(startGRPCWebProxy(t, srv)), transportGRPCWeb)
+	client := healthpb.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-custom", "hello")
+	var header, trailer metadata.MD
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "svc"}, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatalf("Check over gRPC-Web: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("status = %v, want SERVING", resp.Status)
+	}
+	if got := header.Get("x-echo"); len(got) != 1 || got[0] != "hello" {
+		t.Errorf("header x-echo = %v, want [hello]", got)
+	}
+	if got := trailer.Get("x-trail"); len(got) != 1 || got[0] != "t1" {
+		t.Errorf("trailer x-trail = %v, want [t1]", got)
+	}
+	if got := (<-seen).Get("x-custom"); len(got) != 1 || got[0] != "hello" {
+		t.Errorf("backend saw x-custom = %v, want [hello]", got)
+	}
+
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "fail"})
+	if st := status.Convert(err); st.Code() != codes.FailedPrecondition || st.Message() != "bad state: 100%" {
+		t.Errorf("failing Check = %v, want FailedPrecondition %q", err, "bad state: 100%")
+	}
+
+	entry := waitForTraffic(t, srv, "Check")
+	if entry.Source != trafficSourceGRPCWeb {
+		t.Errorf("source = %q, want %q", entry.Source, trafficSourceGRPCWeb)
+	}
+	if got := http.Header(entry.HTTPHeaders).Get("X-Grpc-Web"); got != "1" {
+		t.Errorf("recorded HTTP headers = %v, want X-Grpc-Web: 1", entry.HTTPHeaders)
+	}
+	if got := http.Header(entry.HTTPHeaders).Get("X-Custom"); got != "hello" {
+		t.Errorf("recorded HTTP header X-Custom = %q, want hello", got)
+	}
+	if got := entry.Metadata["x-custom"]; len(got) != 1 || got[0] != "hello" {
+		t.Errorf("recorded x-custom = %v, want [hello]", got)
+	}
+	assertJSONEqual(t, entry.Request, `{"service":"svc"}`)
+	assertJSONEqual(t, entry.Response, `{"status":"SERVING"}`)
+}
+
+func TestGRPCWebProxyCORS(t *testing.T) {
+	addr, _, _ := startProxyBackend(t)
+	srv := newServer(Config{BackendAddr: addr, AllowOrigin: []string{"http://app.example"}})
+	t.Cleanup(srv.conns.closeAll)
+	url := startGRPCWebProxy(t, srv)
+	method := url + "/grpc.health.v1.Health/Check"
+
+	body, err := proto.Marshal(&healthpb.HealthCheckRequest{Service: "svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frame bytes.Buffer
+	writeEnvelope(t, &frame, 0, string(body))
+
+	for _, tt := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{"http://app.example", true},
+		{"http://evil.example", false},
+	} {
+		t.Run(tt.origin, func(t *testing.T) {
+			wantACAO := ""
+			if tt.allowed {
+				wantACAO = tt.origin
+			}
+
+			preflight, _ := http.NewRequest(http.MethodOptions, method, nil)
+			preflight.Header.Set("Origin", tt.origin)
+			preflight.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			preflight.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+			resp, err := http.DefaultClient.Do(preflight)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != wantACAO {
+				t.Errorf("preflight Access-Control-Allow-Origin = %q, want %q", got, wantACAO)
+			}
+
+			call, _ := http.NewRequest(http.MethodPost, method, bytes.NewReader(frame.Bytes()))
+			call.Header.Set("Origin", tt.origin)
+			call.Header.Set("Content-Type", "application/grpc-web+proto")
+			call.Header.Set("X-Grpc-Web", "1")
+			resp, err = http.DefaultClient.Do(call)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != wantACAO {
+				t.Errorf("call Access-Control-Allow-Origin = %q, want %q", got, wantACAO)
+			}
+			if !tt.allowed {
+				return
+			}
+			prefix := make([]byte, 5)
+			if _, err := io.ReadFull(resp.Body, prefix); err != nil {
+				t.Fatalf("read response frame: %v", err)
+			}
+			msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+			if _, err := io.ReadFull(resp.Body, msg); err != nil {
+				t.Fatalf("read response frame: %v", err)
+			}
+			var out healthpb.HealthCheckResponse
+			if err := proto.Unmarshal(msg, &out); err != nil || prefix[0] != 0 || out.Status != healthpb.HealthCheckResponse_SERVING {
+				t.Errorf("response frame = flags %#x %v (%v), want SERVING", prefix[0], &out, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	reflectionv1alpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+// Versions of the server reflection protocol.
+const (
+	reflectionV1      = "v1"
+	reflectionV1Alpha = "v1alpha"
+)
+
+// reflectionServices are the reflection services themselves, which are never
+// listed as methods of a target.
+var reflectionServices = map[string]bool{
+	"grpc.reflection.v1.ServerReflection":      true,
+	"grpc.reflection.v1alpha.ServerReflection": true,
+}
+
+// reflectionVersions remembers which reflection version each target speaks,
+// so later requests skip the negotiation round trip.
+type reflectionVersions struct {
+	mu       sync.Mutex
+	byTarget map[string]string
+}
+
+func newReflectionVersions() *reflectionVersions {
+	return &reflectionVersions{byTarget: make(map[string]string)}
+}
+
+func (rv *reflectionVersions) get(target string) string {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	return rv.byTarget[target]
+}
+
+func (rv *reflectionVersions) set(target, version string) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.byTarget[target] = version
+}
+
+// reflectionSource resolves services over server reflection. It tries
+// grpc.reflection.v1 first and falls back to v1alpha if the server does not
+// implement v1.
+type reflectionSource struct {
+	ctx      context.Context
+	conn     grpc.ClientConnInterface
+	target   string
+	versions *reflectionVersions
+
+	client   *grpcreflect.Client
+	version  string
+	services []string // result of the negotiating ListServices call
+}
+
+func newReflectionSource(ctx context.Context, conn grpc.ClientConnInterface, target string, versions *reflectionVersions) *reflectionSource {
+	return &reflectionSource{ctx: ctx, conn: conn, target: target, versions: versions}
+}
+
+func (r *reflectionSource) newClient(version string) *grpcreflect.Client {
+	return newReflectionClient(r.ctx, r.conn, version)
+}
+
+// newReflectionClient returns a client pinned to one reflection version.
+func newReflectionClient(ctx context.Context, conn grpc.ClientConnInterface, version string) *grpcreflect.Client {
+	if version == reflectionV1Alpha {
+		return grpcreflect.NewClientV1Alpha(ctx, reflectionv1alpha.NewServerReflectionClient(conn))
+	}
+	// grpcreflect.NewClientV1 falls back to a nil v1alpha stub, and panics, when
+	// the server does not implement v1. An auto client that cannot reach v1alpha
+	// reports Unimplemented instead.
+	return grpcreflect.NewClientAuto(ctx, v1OnlyConn{conn})
+}
+
+// v1OnlyConn refuses calls to the v1alpha reflection service.
+type v1OnlyConn struct {
+	grpc.ClientConnInterface
+}
+
+func (c v1OnlyConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if strings.HasPrefix(method, "/grpc.reflection.v1alpha.") {
+		return nil, status.Error(codes.Unimplemented, "reflection v1alpha is not used by this client")
+	}
+	return c.ClientConnInterface.NewStream(ctx, desc, method, opts...)
+}
+
+// negotiate picks the reflection version, starting with the one last seen for
+// the target (or v1), and switches to the other one on Unimplemented.
+func (r *reflectionSource) negotiate() error {
+	if r.client != nil {
+		return nil
+	}
+	first := r.versions.get(r.target)
+	if first == "" {
+		first = reflectionV1
+	}
+	second := reflectionV1Alpha
+	if first == reflectionV1Alpha {
+		second = reflectionV1
+	}
+
+	var err error
+	for _, version := range []string{first, second} {
+		client := r.newClient(version)
+		var services []string
+		services, err = client.ListServices()
+		if err == nil {
+			r.client, r.version, r.services = client, version, services
+			r.versions.set(r.target, version)
+			return nil
+		}
+		client.Reset()
+		if status.Code(err) != codes.Unimplemented {
+			return err
+		}
+	}
+	return err
+}
+
+func (r *reflectionSource) ListServices() ([]string, error) {
+	if r.client == nil {
+		if err := r.negotiate(); err != nil {
+			return nil, err
+		}
+		return r.services, nil
+	}
+	return r.client.ListServices()
+}
+
+func (r *reflectionSource) ResolveService(name string) (*desc.ServiceDescriptor, error) {
+	if err := r.negotiate(); err != nil {
+		return nil, err
+	}
+	return r.client.ResolveService(name)
+}
+
+// Reset releases the reflection stream.
+func (r *reflectionSource) Reset() {
+	if r.client != nil {
+		r.client.Reset()
+	}
+}
+
+// reflectionVersionOf reports the reflection version a source used, or "" if
+// it did not use reflection.
+func reflectionVersionOf(src descriptorSource) string {
+	switch s := src.(type) {
+	case *reflectionSource:
+		return s.version
+	case *compositeSource:
+		return reflectionVersionOf(s.reflected)
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	reflectionv1alpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+// startReflectionVersionBackend serves health with only the given
+// reflection version registered.
+func startReflectionVersionBackend(t *testing.T, version string) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, health.NewServer())
+	if version == reflectionV1Alpha {
+		reflectionv1alpha.RegisterServerReflectionServer(gs, reflection.NewServer(reflection.ServerOptions{Services: gs}))
+	} else {
+		reflection.RegisterV1(gs)
+	}
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	return lis.Addr().String()
+}
+
+func TestReflectionClientV1AgainstV1AlphaOnlyServer(t *testing.T) {
+	conn := dialForTest(t, startReflectionVersionBackend(t, reflectionV1Alpha), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A v1 client used to fall back to a nil v1alpha stub and panic here.
+	client := newReflectionClient(ctx, conn, reflectionV1)
+	defer client.Reset()
+	if _, err := client.ListServices(); status.Code(err) != codes.Unimplemented {
+		t.Errorf("v1 ListServices() error = %v, want Unimplemented", err)
+	}
+
+	alpha := newReflectionClient(ctx, conn, reflectionV1Alpha)
+	defer alpha.Reset()
+	if _, err := alpha.ListServices(); err != nil {
+		t.Errorf("v1alpha ListServices(): %v", err)
+	}
+}
+
+func TestSchemaNegotiatesReflectionVersion(t *testing.T) {
+	for _, version := range []string{reflectionV1, reflectionV1Alpha} {
+		t.Run(version, func(t *testing.T) {
+			srv := newServer(Config{BackendAddr: startReflectionVersionBackend(t, version), SchemaTTL: time.Hour})
+			t.Cleanup(srv.conns.closeAll)
+			target := srv.cfg.defaultTarget()
+
+			for _, refresh := range []bool{false, true} {
+				snap, err := schemaForTest(t, srv, target, refresh)
+				if err != nil {
+					t.Fatalf("schema (refresh %v): %v", refresh, err)
+				}
+				if snap.Reflection != version || snap.Source != schemaSourceReflection {
+					t.Errorf("schema (refresh %v) = %s via %q, want reflection %q", refresh, snap.Source, snap.Reflection, version)
+				}
+				if _, err := snap.lookupMethod("/grpc.health.v1.Health/Check"); err != nil {
+					t.Errorf("schema (refresh %v): %v", refresh, err)
+				}
+			}
+			if got := srv.reflection.get(target.Name); got != version {
+				t.Errorf("remembered version = %q, want %q", got, version)
+			}
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -11,10 +10,6 @@ import (
 
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/dynamic"
-	"github.com/jhump/protoreflect/grpcreflect"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/metadata"
-	refv1 "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
 	"google.golang.org/protobuf/types/descriptorpb"
 )
 
@@ -29,25 +24,19 @@ type MethodInfo struct {
 	MethodDesc      *desc.MethodDescriptor `json:"-"` // Internal use for generating examples
 }
 
-func collectMethods(ctx context.Context, cc *grpc.ClientConn, baseMD metadata.MD) ([]MethodInfo, error) {
-	if len(baseMD) > 0 {
-		ctx = metadata.NewOutgoingContext(ctx, baseMD)
-	}
-	client := grpcreflect.NewClientV1Alpha(ctx, refv1.NewServerReflectionClient(cc))
-	defer client.Reset()
-
-	services, err := client.ListServices()
+func collectMethods(src descriptorSource) ([]MethodInfo, error) {
+	services, err := src.ListServices()
 	if err != nil {
-		log.Printf("ERROR: failed to list services via reflection: %v", err)
+		log.Printf("ERROR: failed to list services: %v", err)
 		return nil, fmt.Errorf("list services: %w", err)
 	}
 
 	var descriptors []*desc.ServiceDescriptor
 	for _, svcName := range services {
-		if svcName == "grpc.reflection.v1alpha.ServerReflection" {
+		if reflectionServices[svcName] {
 			continue
 		}
-		svc, err := client.ResolveService(svcName)
+		svc, err := src.ResolveService(svcName)
 		if err != nil {
 			continue
 		}
@@ -79,20 +68,21 @@ func collectMethods(ctx context.Context, cc *grpc.ClientConn, baseMD metadata.MD
 }
 
 func (s *Server) schemaHandler(w http.ResponseWriter, r *http.Request) {
-	if s.backendConn == nil {
-		http.Error(w, "Backend not connected. Please configure GRPS_BACKEND_ADDR in Settings and restart the backend.", http.StatusServiceUnavailable)
+	conn, target, err := s.backend(targetParam(r))
+	if err != nil {
+		writeBackendError(w, err)
 		return
 	}
-	ctx := r.Context()
 
-	methods, err := collectMethods(ctx, s.backendConn, s.cfg.DefaultMD)
+	snap, err := s.schema(r.Context(), conn, target, r.URL.Query().Get("refresh") == "true")
 	if err != nil {
-		http.Error(w, "failed to load schema: "+err.Error(), http.StatusInternalServerError)
+		writeClassifiedError(w, "failed to load schema: "+err.Error(), schemaError(err))
 		return
 	}
 
+	snap.setHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(methods)
+	_ = json.NewEncoder(w).Encode(snap.Methods)
 }
 
 // generateExamplePayload creates a sample JSON payload from a message descriptor
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Where a schema snapshot came from.
+const (
+	schemaSourceReflection = "reflection"
+	schemaSourceLocal      = "local"
+	schemaSourceDisk       = "disk"
+)
+
+// schemaSnapshot is the resolved schema of a target at a point in time.
+type schemaSnapshot struct {
+	Target     string
+	Addr       string
+	Methods    []MethodInfo
+	Services   map[string]*desc.ServiceDescriptor
+	Reflection string // reflection version used, if any
+	Source     string
+	FetchedAt  time.Time
+	Stale      bool         // served from cache because a refresh failed
+	Routes     []*httpRoute // REST routes from google.api.http annotations
+}
+
+// SchemaInfo describes the cached schema in API responses.
+type SchemaInfo struct {
+	Source     string    `json:"source"`
+	Reflection string    `json:"reflection,omitempty"`
+	FetchedAt  time.Time `json:"fetchedAt"`
+	AgeSeconds float64   `json:"ageSeconds"`
+	Stale      bool      `json:"stale"`
+}
+
+func (snap *schemaSnapshot) info() SchemaInfo {
+	return SchemaInfo{
+		Source:     snap.Source,
+		Reflection: snap.Reflection,
+		FetchedAt:  snap.FetchedAt,
+		AgeSeconds: time.Since(snap.FetchedAt).Round(time.Millisecond).Seconds(),
+		Stale:      snap.Stale,
+	}
+}
+
+// setHeaders exposes the snapshot's age on an HTTP response.
+func (snap *schemaSnapshot) setHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Schema-Age", strconv.Itoa(int(time.Since(snap.FetchedAt).Seconds())))
+	w.Header().Set("X-Schema-Source", snap.Source)
+	if snap.Stale {
+		w.Header().Set("X-Schema-Stale", "true")
+	}
+}
+
+// asStale returns a copy of the snapshot marked as stale.
+func (snap *schemaSnapshot) asStale() *schemaSnapshot {
+	stale := *snap
+	stale.Stale = true
+	return &stale
+}
+
+// lookupMethod finds a method by its full name (/package.Service/Method).
+func (snap *schemaSnapshot) lookupMethod(fullMethod string) (*desc.MethodDescriptor, error) {
+	serviceName := parseService(fullMethod)
+	methodName := parseMethod(fullMethod)
+	if serviceName == "" || methodName == "" {
+		return nil, withKind(errKindDescriptor, fmt.Errorf("invalid full method name: %s", fullMethod))
+	}
+	svc, ok := snap.Services[serviceName]
+	if !ok {
+		return nil, withKind(errKindDescriptor, fmt.Errorf("resolve service %s: service not found", serviceName))
+	}
+	method := svc.FindMethodByName(methodName)
+	if method == nil {
+		return nil, withKind(errKindDescriptor, fmt.Errorf("method %s not found on service %s", methodName, serviceName))
+	}
+	return method, nil
+}
+
+// schemaCache keeps the last resolved schema of each target in memory and,
+// if dir is set, on disk so it survives restarts and backend outages.
+type schemaCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	dir      string
+	entries  map[string]*schemaSnapshot
+	failures map[string]schemaFailure // last failed load per target
+}
+
+// schemaRetryBackoff is how long a failed schema load is remembered before a
+// request may try again, so a backend that is down is not asked on every
+// request.
+const schemaRetryBackoff = 5 * time.Second
+
+type schemaFailure struct {
+	addr string
+	at   time.Time
+	err  error
+}
+
+func newSchemaCache(ttl time.Duration, dir string) *schemaCache {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			log.Printf("WARNING: schema cache directory %s unavailable, caching in memory only: %v", dir, err)
+			dir = ""
+		}
+	}
+	return &schemaCache{ttl: ttl, dir: dir, entries: make(map[string]*schemaSnapshot), failures: make(map[string]schemaFailure)}
+}
+
+func (c *schemaCache) get(target string) (*schemaSnapshot, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snap, ok := c.entries[target]
+	return snap, ok
+}
+
+func (c *schemaCache) put(snap *schemaSnapshot) {
+	c.mu.Lock()
+	c.entries[snap.Target] = snap
+	delete(c.failures, snap.Target)
+	c.mu.Unlock()
+	if err := c.save(snap); err != nil {
+		log.Printf("WARNING: failed to persist schema for %s: %v", snap.Target, err)
+	}
+}
+
+// setLoaded keeps a schema that was loaded from disk in memory. Unlike put,
+// it does not write it back.
+func (c *schemaCache) setLoaded(snap *schemaSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[snap.Target] = snap
+}
+
+// invalidate drops the in-memory entry for target so the next request
+// refreshes it. The on-disk copy is kept as an offline fallback.
+func (c *schemaCache) invalidate(target string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, target)
+	delete(c.failures, target)
+}
+
+func (c *schemaCache) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*schemaSnapshot)
+	c.failures = make(map[string]schemaFailure)
+}
+
+// setFailed remembers that loading the schema of target at addr failed.
+func (c *schemaCache) setFailed(target, addr string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures[target] = schemaFailure{addr: addr, at: time.Now(), err: err}
+}
+
+// recentFailure returns the error of a load of target at addr that failed
+// less than schemaRetryBackoff ago.
+func (c *schemaCache) recentFailure(target, addr string) (error, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.failures[target]
+	if !ok || f.addr != addr || time.Since(f.at) >= schemaRetryBackoff {
+		return nil, false
+	}
+	return f.err, true
+}
+
+func (c *schemaCache) fresh(snap *schemaSnapshot, addr string) bool {
+	return !snap.Stale && snap.Addr == addr && time.Since(snap.FetchedAt) < c.ttl
+}
+
+type schemaFileMeta struct {
+	Target     string    `json:"target"`
+	Addr       string    `json:"addr"`
+	Reflection string    `json:"reflection,omitempty"`
+	Source     string    `json:"source"`
+	FetchedAt  time.Time `json:"fetchedAt"`
+}
+
+func (c *schemaCache) paths(target string) (string, string) {
+	base := filepath.Join(c.dir, target)
+	return base + ".pb", base + ".json"
+}
+
+// save writes the snapshot's files as a FileDescriptorSet next to a small
+// JSON metadata file.
+func (c *schemaCache) save(snap *schemaSnapshot) error {
+	if c.dir == "" {
+		return nil
+	}
+	var fds descriptorpb.FileDescriptorSet
+	seen := make(map[string]bool)
+	var add func(fd *desc.FileDescriptor)
+	add = func(fd *desc.FileDescriptor) {
+		if seen[fd.GetName()] {
+			return
+		}
+		seen[fd.GetName()] = true
+		for _, dep := range fd.GetDependencies() {
+			add(dep)
+		}
+		fds.File = append(fds.File, fd.AsFileDescriptorProto())
+	}
+	for _, svc := range snap.Services {
+		add(svc.GetFile())
+	}
+	data, err := proto.Marshal(&fds)
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(schemaFileMeta{
+		Target:     snap.Target,
+		Addr:       snap.Addr,
+		Reflection: snap.Reflection,
+		Source:     snap.Source,
+		FetchedAt:  snap.FetchedAt,
+	})
+	if err != nil {
+		return err
+	}
+	pbPath, metaPath := c.paths(snap.Target)
+	if err := writeFileAtomic(pbPath, data, 0o644); err != nil {
+		return err
+	}
+	return writeFileAtomic(metaPath, meta, 0o644)
+}
+
+// load reads the on-disk snapshot of a target. It is always marked stale.
+func (c *schemaCache) load(target, addr string) (*schemaSnapshot, error) {
+	if c.dir == "" {
+		return nil, os.ErrNotExist
+	}
+	pbPath, metaPath := c.paths(target)
+	rawMeta, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	var meta schemaFileMeta
+	if err := json.Unmarshal(rawMeta, &meta); err != nil {
+		return nil, err
+	}
+	if meta.Addr != addr {
+		return nil, fmt.Errorf("cached schema is for %s, not %s", meta.Addr, addr)
+	}
+	data, err := os.ReadFile(pbPath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := parseDescriptorSet(data, false)
+	if err != nil {
+		return nil, err
+	}
+	methods, err := collectMethods(newFileSource(files))
+	if err != nil {
+		return nil, err
+	}
+	snap := newSchemaSnapshot(target, addr, methods)
+	snap.Reflection = meta.Reflection
+	snap.Source = schemaSourceDisk
+	snap.FetchedAt = meta.FetchedAt
+	snap.Stale = true
+	return snap, nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func newSchemaSnapshot(target, addr string, methods []MethodInfo) *schemaSnapshot {
+	snap := &schemaSnapshot{
+		Target:    target,
+		Addr:      addr,
+		Methods:   methods,
+		Services:  make(map[string]*desc.ServiceDescriptor),
+		FetchedAt: time.Now(),
+	}
+	for _, m := range methods {
+		if m.MethodDesc != nil {
+			snap.Services[m.Service] = m.MethodDesc.GetService()
+		}
+	}
+	snap.Routes = collectHTTPRoutes(methods)
+	return snap
+}
+
+// schema returns the schema of a target, from cache while it is fresh.
+// A failed refresh falls back to the last known schema, in memory or on disk,
+// marked as stale. For schemaRetryBackoff after a failure, unless refresh is
+// set, that stale schema (or without one, the failure) is returned without
+// asking the backend again.
+func (s *Server) schema(ctx context.Context, conn grpc.ClientConnInterface, t Target, refresh bool) (*schemaSnapshot, error) {
+	cached, ok := s.schemas.get(t.Name)
+	if ok && !refresh && s.schemas.fresh(cached, t.Addr) {
+		return cached, nil
+	}
+	usable := ok && cached.Addr == t.Addr
+	if !refresh {
+		if err, failed := s.schemas.recentFailure(t.Name, t.Addr); failed {
+			if usable {
+				return cached.asStale(), nil
+			}
+			return nil, err
+		}
+	}
+
+	src, done := s.descriptorSource(ctx, conn, t)
+	methods, err := collectMethods(src)
+	reflection := reflectionVersionOf(src)
+	done()
+	if err == nil {
+		snap := newSchemaSnapshot(t.Name, t.Addr, methods)
+		snap.Reflection = reflection
+		snap.Source = schemaSourceLocal
+		if reflection != "" {
+			snap.Source = schemaSourceReflection
+		}
+		s.schemas.put(snap)
+		return snap, nil
+	}
+
+	s.schemas.setFailed(t.Name, t.Addr, err)
+	if usable {
+		log.Printf("WARNING: schema refresh for %s failed, serving cached schema from %s: %v", t.Name, cached.FetchedAt.Format(time.RFC3339), err)
+		return cached.asStale(), nil
+	}
+	if snap, diskErr := s.schemas.load(t.Name, t.Addr); diskErr == nil {
+		log.Printf("WARNING: schema refresh for %s failed, serving schema cached on disk from %s: %v", t.Name, snap.FetchedAt.Format(time.RFC3339), err)
+		s.schemas.setLoaded(snap)
+		return snap, nil
+	}
+	return nil, err
+}
+
+// resolveMethod looks up a method in the target's schema, refreshing a cached
+// schema once if the method is missing from it.
+func (s *Server) resolveMethod(ctx context.Context, conn grpc.ClientConnInterface, t Target, fullMethod string) (*desc.MethodDescriptor, *schemaSnapshot, error) {
+	snap, err := s.schema(ctx, conn, t, false)
+	if err != nil {
+		return nil, nil, schemaError(err)
+	}
+	method, err := snap.lookupMethod(fullMethod)
+	if err == nil {
+		return method, snap, nil
+	}
+	if time.Since(snap.FetchedAt) < time.Second {
+		return nil, snap, err
+	}
+	snap, refreshErr := s.schema(ctx, conn, t, true)
+	if refreshErr != nil {
+		return nil, nil, err
+	}
+	method, err = snap.lookupMethod(fullMethod)
+	return method, snap, err
+}
+
+// schemaInvalidateHandler drops cached schemas on POST /schema/invalidate.
+// ?target= selects one target; without it every target is invalidated.
+func (s *Server) schemaInvalidateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if name := targetParam(r); name != "" {
+		if _, ok := s.targets.get(name); !ok {
+			http.Error(w, fmt.Sprintf("unknown target %q", name), http.StatusNotFound)
+			return
+		}
+		s.schemas.invalidate(name)
+	} else {
+		s.schemas.invalidateAll()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// reflectionBackend serves health and reflection, counts reflection streams
+// and fails them while down is set.
+type reflectionBackend struct {
+	addr  string
+	calls atomic.Int32
+	down  atomic.Bool
+}
+
+func startReflectionBackend(t *testing.T) *reflectionBackend {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &reflectionBackend{addr: lis.Addr().String()}
+	gs := grpc.NewServer(grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasPrefix(info.FullMethod, "/grpc.reflection.") {
+			b.calls.Add(1)
+			if b.down.Load() {
+				return status.Error(codes.Unavailable, "backend is down")
+			}
+		}
+		return handler(srv, ss)
+	}))
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(gs, hs)
+	reflection.Register(gs)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	return b
+}
+
+// captureLog collects the standard logger's output for the rest of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func schemaForTest(t *testing.T, srv *Server, target Target, refresh bool) (*schemaSnapshot, error) {
+	t.Helper()
+	conn, err := srv.conns.get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.schema(ctx, conn, target, refresh)
+}
+
+func TestSchemaCacheTTL(t *testing.T) {
+	b := startReflectionBackend(t)
+	srv := newServer(Config{BackendAddr: b.addr, SchemaTTL: time.Hour})
+	t.Cleanup(srv.conns.closeAll)
+	target := srv.cfg.defaultTarget()
+
+	first, err := schemaForTest(t, srv, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Source != schemaSourceReflection || first.Stale {
+		t.Errorf("first schema: source %q stale %v, want fresh from reflection", first.Source, first.Stale)
+	}
+	calls := b.calls.Load()
+	if again, err := schemaForTest(t, srv, target, false); err != nil || again != first {
+		t.Errorf("schema within the TTL = %p, %v; want the cached %p", again, err, first)
+	}
+	if b.calls.Load() != calls {
+		t.Errorf("schema within the TTL asked the backend")
+	}
+
+	srv.schemas.ttl = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	expired, err := schemaForTest(t, srv, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired == first || expired.Stale || !expired.FetchedAt.After(first.FetchedAt) {
+		t.Errorf("schema after the TTL was not fetched again")
+	}
+	if b.calls.Load() == calls {
+		t.Errorf("schema after the TTL did not ask the backend")
+	}
+}
+
+func TestSchemaCacheAddrMismatch(t *testing.T) {
+	a := startReflectionBackend(t)
+	b := startReflectionBackend(t)
+	srv := newServer(Config{BackendAddr: a.addr, SchemaTTL: time.Hour})
+	t.Cleanup(srv.conns.closeAll)
+	target := srv.cfg.defaultTarget()
+	if _, err := schemaForTest(t, srv, target, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The target now points elsewhere; the cached schema is not reused.
+	moved := target
+	moved.Addr = b.addr
+	snap, err := schemaForTest(t, srv, moved, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Addr != b.addr || b.calls.Load() == 0 {
+		t.Errorf("schema for the new address = %s after %d calls, want it fetched from %s", snap.Addr, b.calls.Load(), b.addr)
+	}
+
+	// Nor is it served as a stale fallback for another address.
+	if _, err := schemaForTest(t, srv, target, false); err != nil {
+		t.Fatal(err)
+	}
+	b.down.Store(true)
+	if snap, err := schemaForTest(t, srv, moved, false); err == nil {
+		t.Errorf("schema for an unreachable address = %s from %s, want an error", snap.Source, snap.Addr)
+	}
+}
+
+func TestSchemaCacheBacksOffStaleRefresh(t *testing.T) {
+	b := startReflectionBackend(t)
+	srv := newServer(Config{BackendAddr: b.addr, SchemaTTL: time.Millisecond})
+	t.Cleanup(srv.conns.closeAll)
+	target := srv.cfg.defaultTarget()
+	first, err := schemaForTest(t, srv, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	b.down.Store(true)
+	logs := captureLog(t)
+	calls := b.calls.Load()
+	var failedCalls int32
+	for i := 0; i < 3; i++ {
+		snap, err := schemaForTest(t, srv, target, false)
+		if err != nil {
+			t.Fatalf("schema %d with the backend down: %v", i, err)
+		}
+		if !snap.Stale || !snap.FetchedAt.Equal(first.FetchedAt) {
+			t.Errorf("schema %d = stale %v from %v, want the stale cached schema", i, snap.Stale, snap.FetchedAt)
+		}
+		if i == 0 {
+			failedCalls = b.calls.Load()
+		}
+	}
+	if first.Stale {
+		t.Errorf("serving the stale copy marked the cached schema stale")
+	}
+	if failedCalls == calls {
+		t.Errorf("the expired schema was served without asking the backend")
+	}
+	if got := b.calls.Load(); got != failedCalls {
+		t.Errorf("backend asked again %d times within the back-off", got-failedCalls)
+	}
+	if n := strings.Count(logs.String(), "schema refresh for default failed"); n != 1 {
+		t.Errorf("logged %d warnings, want 1:\n%s", n, logs)
+	}
+
+	// An explicit refresh still asks, and a recovered backend is used again.
+	b.down.Store(false)
+	snap, err := schemaForTest(t, srv, target, true)
+	if err != nil || snap.Stale {
+		t.Fatalf("refresh after recovery = %v, %v; want a fresh schema", snap, err)
+	}
+	if _, failed := srv.schemas.recentFailure(target.Name, target.Addr); failed {
+		t.Errorf("a successful refresh kept the failure")
+	}
+}
+
+func TestSchemaCacheDiskRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	b := startReflectionBackend(t)
+	srv := newServer(Config{BackendAddr: b.addr, SchemaTTL: time.Hour, SchemaCacheDir: dir})
+	t.Cleanup(srv.conns.closeAll)
+	target := srv.cfg.defaultTarget()
+	fetched, err := schemaForTest(t, srv, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := newSchemaCache(time.Hour, dir)
+	loaded, err := cache.load(target.Name, target.Addr)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if loaded.Source != schemaSourceDisk || !loaded.Stale || loaded.Reflection != fetched.Reflection || !loaded.FetchedAt.Equal(fetched.FetchedAt) {
+		t.Errorf("loaded = source %q stale %v reflection %q fetched %v, want disk, stale, %q, %v",
+			loaded.Source, loaded.Stale, loaded.Reflection, loaded.FetchedAt, fetched.Reflection, fetched.FetchedAt)
+	}
+	if len(loaded.Methods) != len(fetched.Methods) {
+		t.Errorf("loaded %d methods, want %d", len(loaded.Methods), len(fetched.Methods))
+	}
+	if _, err := loaded.lookupMethod("/grpc.health.v1.Health/Check"); err != nil {
+		t.Errorf("loaded schema: %v", err)
+	}
+	if _, err := cache.load(target.Name, "127.0.0.1:1"); err == nil {
+		t.Errorf("load for another address succeeded")
+	}
+	if _, err := cache.load("other", target.Addr); err == nil {
+		t.Errorf("load of an unknown target succeeded")
+	}
+
+	// A restarted inspector serves the disk copy while the backend is down,
+	// and keeps it in memory without writing it back.
+	b.down.Store(true)
+	restarted := newServer(Config{BackendAddr: b.addr, SchemaTTL: time.Hour, SchemaCacheDir: dir})
+	t.Cleanup(restarted.conns.closeAll)
+	captureLog(t)
+	snap, err := schemaForTest(t, restarted, target, false)
+	if err != nil {
+		t.Fatalf("schema from disk: %v", err)
+	}
+	calls := b.calls.Load()
+	if snap.Source != schemaSourceDisk || !snap.Stale {
+		t.Errorf("schema = source %q stale %v, want the stale disk copy", snap.Source, snap.Stale)
+	}
+	if kept, ok := restarted.schemas.get(target.Name); !ok || kept.Source != schemaSourceDisk {
+		t.Errorf("disk copy not kept in memory")
+	}
+	if _, err := schemaForTest(t, restarted, target, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.calls.Load(); got != calls {
+		t.Errorf("backend asked again %d times within the back-off", got-calls)
+	}
+	if again, err := cache.load(target.Name, target.Addr); err != nil || !again.FetchedAt.Equal(fetched.FetchedAt) {
+		t.Errorf("disk copy after serving it = %v, %v; want it unchanged", again, err)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// StreamMessage is one response of a server stream, sent as a "message" event.
+type StreamMessage struct {
+	Index     int            `json:"index"`
+	ElapsedMs float64        `json:"elapsedMs"` // since the call started
+	DeltaMs   float64        `json:"deltaMs"`   // since the previous message
+	Message   map[string]any `json:"message"`
+}
+
+// StreamStatus is the final "status" event of a stream.
+type StreamStatus struct {
+	Kind       string         `json:"kind,omitempty"` // error class, see InvokeError.Kind
+	Code       string         `json:"code"`
+	Message    string         `json:"message,omitempty"`
+	Messages   int            `json:"messages"`
+	DurationMs float64        `json:"durationMs"`
+	Details    []ErrorDetail  `json:"details,omitempty"`
+	Meta       map[string]any `json:"meta,omitempty"`
+}
+
+// sseWriter writes Server-Sent Events and flushes after each one.
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &sseWriter{w: w, flusher: flusher}, true
+}
+
+func (sse *sseWriter) send(event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(sse.w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return err
+	}
+	sse.flusher.Flush()
+	return nil
+}
+
+// parseStreamRequest reads an InvokeRequest from a POST body, or from the
+// query string of a GET so the endpoint can be used with EventSource:
+// ?target=&fullMethod=&payload=<json>&metadata=<json>&timeoutMs=&callId=&env=.
+func parseStreamRequest(r *http.Request) (InvokeRequest, error) {
+	var in InvokeRequest
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			return in, fmt.Errorf("invalid json: %w", err)
+		}
+	case http.MethodGet:
+		q := r.URL.Query()
+		in.FullMethod = q.Get("fullMethod")
+		in.CallID = q.Get("callId")
+		in.Env = q.Get("env")
+		if raw := q.Get("timeoutMs"); raw != "" {
+			timeout, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return in, fmt.Errorf("invalid timeoutMs: %w", err)
+			}
+			in.TimeoutMs = timeout
+		}
+		if raw := q.Get("payload"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &in.Payload); err != nil {
+				return in, fmt.Errorf("invalid payload: %w", err)
+			}
+		}
+		if raw := q.Get("metadata"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &in.Metadata); err != nil {
+				return in, fmt.Errorf("invalid metadata: %w", err)
+			}
+		}
+	}
+	if in.TimeoutMs < 0 {
+		return in, errors.New("timeoutMs must not be negative")
+	}
+	if in.Target == "" {
+		in.Target = targetParam(r)
+	}
+	return in, nil
+}
+
+// invokeStreamHandler invokes a server-streaming method and forwards each
+// response as a Server-Sent Event. Events, in order: "call" (the in-flight call
+// and its ID), "headers", one "message" per response, "trailers" and a final
+// "status". Closing the connection or DELETE /invoke/{id} cancels the RPC.
+func (s *Server) invokeStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	in, err := parseStreamRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if in.FullMethod == "" {
+		http.Error(w, "fullMethod is required", http.StatusBadRequest)
+		return
+	}
+	conn, target, err := s.backend(in.Target)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	in, resolved, err := s.resolveRequest(in)
+	if err != nil {
+		invokeErr, httpStatus := newInvokeError(ctx, err, target, nil, false)
+		writeJSON(w, httpStatus, InvokeResponse{Error: invokeErr})
+		return
+	}
+
+	fullMethod := normalizeFullMethod(in.FullMethod)
+	methodDesc, snap, err := s.resolveMethod(ctx, conn, target, fullMethod)
+	if snap != nil {
+		snap.setHeaders(w)
+	}
+	var reqMsg *dynamic.Message
+	if err == nil {
+		if !methodDesc.IsServerStreaming() || methodDesc.IsClientStreaming() {
+			err = withKind(errKindPayload, fmt.Errorf("%s is not a server-streaming method", fullMethod))
+		} else {
+			reqMsg, err = newRequestMessage(methodDesc, in.Payload)
+		}
+	}
+	if err != nil {
+		invokeErr, httpStatus := newInvokeError(ctx, err, target, snap, false)
+		writeJSON(w, httpStatus, InvokeResponse{Error: invokeErr})
+		return
+	}
+
+	md := metadata.Join(s.config().DefaultMD, buildOutgoingMetadata(in.Metadata))
+	if len(md) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+
+	ctx, call, done, err := s.inflight.start(ctx, in.CallID, target.Name, fullMethod, "stream", in.TimeoutMs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer done()
+
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "streaming is not supported by this connection", http.StatusInternalServerError)
+		return
+	}
+	_ = sse.send("call", call)
+
+	start := time.Now()
+	var messages []map[string]any
+	var header, trailer metadata.MD
+	err = runServerStream(ctx, conn, fullMethod, reqMsg, methodDesc.GetOutputType(), sse, start, func(m map[string]any) {
+		messages = append(messages, m)
+	}, grpc.Header(&header), grpc.Trailer(&trailer))
+	duration := time.Since(start)
+
+	st := StreamStatus{
+		Code:       status.Code(err).String(),
+		Messages:   len(messages),
+		DurationMs: durationMs(duration),
+		Meta:       callMeta(call, duration),
+	}
+	if resolved != nil {
+		st.Meta["resolved"] = resolved
+	}
+	var invokeErr *InvokeError
+	if err != nil {
+		invokeErr, _ = newInvokeError(ctx, err, target, snap, answeredBy(header, trailer))
+		st.Kind = invokeErr.Kind
+		st.Code = invokeErr.Code
+		st.Message = invokeErr.Message
+		st.Details = invokeErr.Details
+	}
+	s.recordTraffic(target.Name, in.CorrelationID, fullMethod, md, in.Payload, messages, err, invokeErr, start, duration)
+
+	_ = sse.send("status", st)
+}
+
+// runServerStream opens the stream, sends the single request and forwards
+// every response. onMessage is called with each decoded response.
+func runServerStream(ctx context.Context, conn grpc.ClientConnInterface, fullMethod string, req *dynamic.Message, respType *desc.MessageDescriptor, sse *sseWriter, start time.Time, onMessage func(map[string]any), opts ...grpc.CallOption) error {
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, fullMethod, opts...)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(req); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	if header, err := stream.Header(); err == nil {
+		if err := sse.send("headers", metadataToMap(header)); err != nil {
+			return err
+		}
+	}
+
+	last := start
+	for index := 0; ; index++ {
+		resp := dynamic.NewMessage(respType)
+		err := stream.RecvMsg(resp)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			_ = sse.send("trailers", metadataToMap(stream.Trailer()))
+			return err
+		}
+		now := time.Now()
+		m, err := messageToMap(resp)
+		if err != nil {
+			return err
+		}
+		onMessage(m)
+		if err := sse.send("message", StreamMessage{
+			Index:     index,
+			ElapsedMs: durationMs(now.Sub(start)),
+			DeltaMs:   durationMs(now.Sub(last)),
+			Message:   m,
+		}); err != nil {
+			// The client went away; the deferred cancel ends the RPC.
+			return err
+		}
+		last = now
+	}
+	return sse.send("trailers", metadataToMap(stream.Trailer()))
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
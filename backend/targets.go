@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultTargetName = "default"
+
+// Target is a named backend the inspector can connect to.
+type Target struct {
+	Name               string `json:"name"`
+	Addr               string `json:"addr"`
+	UseTLS             bool   `json:"useTLS"`
+	ServerName         string `json:"serverName,omitempty"`
+	CAFile             string `json:"caFile,omitempty"`
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+	Transport          string `json:"transport,omitempty"` // "grpc" (default), "grpc-web", "grpc-web-text" or "connect"
+
+	// Local descriptors used instead of, or together with, server reflection.
+	ProtoDir       string   `json:"protoDir,omitempty"`       // directory of .proto files
+	ImportPaths    []string `json:"importPaths,omitempty"`    // extra import paths for ProtoDir
+	DescriptorSet  string   `json:"descriptorSet,omitempty"`  // compiled FileDescriptorSet
+	DescriptorMode string   `json:"descriptorMode,omitempty"` // "merge" (default) or "replace"
+}
+
+// TargetStatus is a target as listed by the /targets endpoint.
+type TargetStatus struct {
+	Target
+	Default bool   `json:"default"`
+	State   string `json:"state"`
+}
+
+var errUnknownTarget = errors.New("unknown target")
+
+var targetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// targetRegistry holds the named backends known to the inspector. Exactly one
+// of them is the default, used whenever a request does not select a target.
+type targetRegistry struct {
+	mu      sync.RWMutex
+	targets map[string]Target
+	def     string
+}
+
+func newTargetRegistry(def Target) *targetRegistry {
+	return &targetRegistry{
+		targets: map[string]Target{def.Name: def},
+		def:     def.Name,
+	}
+}
+
+// get returns the named target, or the default target if name is empty.
+func (r *targetRegistry) get(name string) (Target, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if name == "" {
+		name = r.def
+	}
+	t, ok := r.targets[name]
+	return t, ok
+}
+
+func (r *targetRegistry) defaultName() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.def
+}
+
+// list returns all targets sorted by name.
+func (r *targetRegistry) list() []Target {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]Target, 0, len(r.targets))
+	for _, t := range r.targets {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// put adds or replaces a target.
+func (r *targetRegistry) put(t Target) error {
+	if err := validateTarget(t); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.targets[t.Name] = t
+	return nil
+}
+
+// remove deletes a target. The default target cannot be removed.
+func (r *targetRegistry) remove(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name == r.def {
+		return fmt.Errorf("target %q is the default target and cannot be removed", name)
+	}
+	if _, ok := r.targets[name]; !ok {
+		return fmt.Errorf("target %q not found", name)
+	}
+	delete(r.targets, name)
+	return nil
+}
+
+func validateTarget(t Target) error {
+	if !targetNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("invalid target name %q: use letters, digits, '.', '_' or '-'", t.Name)
+	}
+	if strings.TrimSpace(t.Addr) == "" {
+		return errors.New("target addr is required")
+	}
+	if strings.Contains(t.Addr, "://") {
+		return fmt.Errorf("target addr %q must be host:port without a scheme", t.Addr)
+	}
+	if !validTransport(t.Transport) {
+		return fmt.Errorf("invalid transport %q: use %q, %q, %q or %q", t.Transport, transportGRPC, transportGRPCWeb, transportGRPCWebText, transportConnect)
+	}
+	if t.UseTLS {
+		if _, err := buildTLSConfig(t); err != nil {
+			return err
+		}
+	}
+	switch t.DescriptorMode {
+	case "", descriptorModeMerge, descriptorModeReplace:
+	default:
+		return fmt.Errorf("invalid descriptorMode %q: use %q or %q", t.DescriptorMode, descriptorModeMerge, descriptorModeReplace)
+	}
+	return nil
+}
+
+// parseTargets parses GRPS_TARGETS entries of the form name=host:port. The
+// address may be prefixed with a transport, as in web=grpc-web://envoy:8080.
+func parseTargets(input string) []Target {
+	var out []Target
+	for _, entry := range splitCSV(input) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(parts[0])
+		addr := strings.TrimSpace(parts[1])
+		if name == "" || addr == "" {
+			continue
+		}
+		t := Target{Name: name, Addr: addr}
+		if transport, rest, ok := strings.Cut(addr, "://"); ok && transport != "" && validTransport(transport) {
+			t.Transport, t.Addr = transport, rest
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// defaultTarget builds the default target from the backend settings in cfg.
+func (cfg Config) defaultTarget() Target {
+	return Target{
+		Name:               defaultTargetName,
+		Addr:               cfg.BackendAddr,
+		UseTLS:             cfg.UseTLS,
+		ServerName:         cfg.ServerName,
+		CAFile:             cfg.CAFile,
+		CertFile:           cfg.CertFile,
+		KeyFile:            cfg.KeyFile,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		Transport:          cfg.Transport,
+		ProtoDir:           cfg.ProtoDir,
+		ImportPaths:        cfg.ImportPaths,
+		DescriptorSet:      cfg.DescriptorSet,
+		DescriptorMode:     cfg.DescriptorMode,
+	}
+}
+
+// targetParam returns the target selected by the ?target= query parameter.
+func targetParam(r *http.Request) string {
+	return strings.TrimSpace(r.URL.Query().Get("target"))
+}
+
+// backend resolves the named target (or the default target if name is empty)
+// and returns its shared connection.
+func (s *Server) backend(name string) (backendConn, Target, error) {
+	t, ok := s.targets.get(name)
+	if !ok {
+		return nil, Target{}, fmt.Errorf("%w %q", errUnknownTarget, name)
+	}
+	conn, err := s.conns.get(t)
+	if err != nil {
+		return nil, t, err
+	}
+	return conn, t, nil
+}
+
+// writeBackendError reports a failure from Server.backend to the client.
+func writeBackendError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnknownTarget) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Failed to connect to backend: %v. Please check GRPS_BACKEND_ADDR in Settings.", err), http.StatusServiceUnavailable)
+}
+
+func (s *Server) targetStatus(t Target) TargetStatus {
+	st := TargetStatus{Target: t, Default: t.Name == s.targets.defaultName(), State: "NOT_CONNECTED"}
+	if state, ok := s.conns.state(t.Name); ok {
+		st.State = state.String()
+	}
+	return st
+}
+
+// targetsHandler serves GET (list) and POST (add or replace) on /targets.
+func (s *Server) targetsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		targets := s.targets.list()
+		out := make([]TargetStatus, 0, len(targets))
+		for _, t := range targets {
+			out = append(out, s.targetStatus(t))
+		}
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodPost, http.MethodPut:
+		var t Target
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.Name = strings.TrimSpace(t.Name)
+		t.Addr = strings.TrimSpace(t.Addr)
+		// Nothing is registered until the target is known to work, so a
+		// rejected target never shows up in the list.
+		if err := validateTarget(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The default target mirrors the backend settings of the config;
+		// replacing it here would leave the two out of step.
+		if t.Name == s.targets.defaultName() {
+			http.Error(w, fmt.Sprintf("target %q is the default target; change it through /inspector/config", t.Name), http.StatusBadRequest)
+			return
+		}
+		ld, err := readTargetDescriptors(t)
+		if err != nil {
+			http.Error(w, "load descriptors: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Dial eagerly so the first request against the new target does not pay for it.
+		if _, err := s.conns.get(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.targets.put(t); err != nil {
+			s.conns.remove(t.Name)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.descriptors.clear(t.Name)
+		if ld != nil {
+			s.installTargetDescriptors(t, *ld)
+		}
+		s.schemas.invalidate(t.Name)
+		writeJSON(w, http.StatusOK, s.targetStatus(t))
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// targetHandler serves GET and DELETE on /targets/{name}.
+func (s *Server) targetHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/targets/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		t, ok := s.targets.get(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("target %q not found", name), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.targetStatus(t))
+	case http.MethodDelete:
+		if err := s.targets.remove(name); err != nil {
+			status := http.StatusBadRequest
+			if _, ok := s.targets.get(name); !ok {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		s.conns.remove(name)
+		s.descriptors.clear(name)
+		s.schemas.invalidate(name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
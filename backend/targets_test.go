@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestTargetsHandlerRejectsBrokenTarget(t *testing.T) {
+	addr, _, _ := startTestBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	defer srv.conns.closeAll()
+
+	post := func(target Target) int {
+		body, _ := json.Marshal(target)
+		rec := httptest.NewRecorder()
+		srv.targetsHandler(rec, httptest.NewRequest(http.MethodPost, "/targets", bytes.NewReader(body)))
+		return rec.Code
+	}
+	registered := func(name string) bool {
+		rec := httptest.NewRecorder()
+		srv.targetsHandler(rec, httptest.NewRequest(http.MethodGet, "/targets", nil))
+		var list []TargetStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		for _, st := range list {
+			if st.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.pb")
+	if code := post(Target{Name: "broken", Addr: addr, DescriptorSet: missing}); code != http.StatusBadRequest {
+		t.Fatalf("POST with a missing descriptor set = %d, want %d", code, http.StatusBadRequest)
+	}
+	if registered("broken") {
+		t.Error("target with a missing descriptor set was registered")
+	}
+	if _, ok := srv.conns.state("broken"); ok {
+		t.Error("target with a missing descriptor set was dialed")
+	}
+
+	if code := post(Target{Name: "good", Addr: addr}); code != http.StatusOK {
+		t.Fatalf("POST of a valid target = %d, want %d", code, http.StatusOK)
+	}
+	if !registered("good") {
+		t.Error("valid target was not registered")
+	}
+
+	// A failed update keeps the target as it was.
+	if code := post(Target{Name: "good", Addr: addr, DescriptorSet: missing}); code != http.StatusBadRequest {
+		t.Fatalf("POST of a broken update = %d, want %d", code, http.StatusBadRequest)
+	}
+	if got, _ := srv.targets.get("good"); got.DescriptorSet != "" {
+		t.Errorf("broken update was applied: %+v", got)
+	}
+}
+
+func TestTargetsHandlerRejectsDefaultTarget(t *testing.T) {
+	addr, _, _ := startTestBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	defer srv.conns.closeAll()
+
+	body, _ := json.Marshal(Target{Name: defaultTargetName, Addr: "127.0.0.1:1"})
+	rec := httptest.NewRecorder()
+	srv.targetsHandler(rec, httptest.NewRequest(http.MethodPut, "/targets", bytes.NewReader(body)))
+	if rec.Code != http.StatusBadRequest || !bytes.Contains(rec.Body.Bytes(), []byte("/inspector/config")) {
+		t.Fatalf("PUT of the default target = %d %s, want 400 pointing at /inspector/config", rec.Code, rec.Body)
+	}
+	if def, _ := srv.targets.get(""); def.Addr != addr {
+		t.Errorf("default target was replaced: %+v", def)
+	}
+}
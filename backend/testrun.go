@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// TestOptions selects where the requests of a collection run.
+type TestOptions struct {
+	Collection string `json:"collection"`       // a collection, a folder inside one or a single request
+	Target     string `json:"target,omitempty"` // overrides the target of every request
+	Env        string `json:"env,omitempty"`    // overrides the variable set of every request
+}
+
+// TestReport is the outcome of running a collection as tests.
+type TestReport struct {
+	Collection string           `json:"collection"`
+	StartedAt  time.Time        `json:"startedAt"`
+	DurationMs float64          `json:"durationMs"`
+	Total      int              `json:"total"`
+	Passed     int              `json:"passed"`
+	Failed     int              `json:"failed"`
+	Cases      []TestCaseResult `json:"cases"`
+}
+
+// TestCaseResult is the outcome of one saved request. Error is set when the
+// request could not be run at all, e.g. because its file does not parse.
+type TestCaseResult struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	FullMethod string            `json:"fullMethod,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	Passed     bool              `json:"passed"`
+	DurationMs float64           `json:"durationMs"`
+	Code       string            `json:"code,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Assertions []AssertionResult `json:"assertions,omitempty"`
+	Call       *InvokeResponse   `json:"call,omitempty"` // the full response of a failed case
+}
+
+// runCollectionTests calls every request of a collection in order and checks
+// its assertions. A request without a status assertion must also succeed.
+func (s *Server) runCollectionTests(ctx context.Context, opts TestOptions) (TestReport, error) {
+	id, err := cleanRequestID(opts.Collection)
+	if err != nil {
+		return TestReport{}, err
+	}
+	var c Collection
+	if _, ok := s.collections.requestFile(id); ok {
+		// A single request rather than a collection or folder.
+		c, err = s.collections.collection(path.Dir(id))
+		c.Requests = slices.DeleteFunc(c.Requests, func(e CollectionEntry) bool { return e.ID != id })
+	} else {
+		c, err = s.collections.collection(id)
+	}
+	if err != nil {
+		return TestReport{}, err
+	}
+	report := TestReport{Collection: id, StartedAt: time.Now().UTC(), Cases: make([]TestCaseResult, 0, len(c.Requests))}
+	for _, entry := range c.Requests {
+		if ctx.Err() != nil {
+			break
+		}
+		tc := TestCaseResult{ID: entry.ID, Name: entry.Name, FullMethod: entry.FullMethod}
+		if entry.Error != "" {
+			tc.Error = entry.Error
+		} else if req, err := s.collections.get(entry.ID); err != nil {
+			tc.Error = err.Error()
+		} else {
+			s.runTestCase(ctx, req, opts, &tc)
+		}
+		report.Total++
+		if tc.Passed {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+		report.Cases = append(report.Cases, tc)
+	}
+	report.DurationMs = durationMs(time.Since(report.StartedAt))
+	return report, nil
+}
+
+func (s *Server) runTestCase(ctx context.Context, req SavedRequest, opts TestOptions, tc *TestCaseResult) {
+	for i, a := range req.Assertions {
+		if err := a.validate(); err != nil {
+			tc.Error = fmt.Sprintf("assertion %d: %v", i, err)
+			return
+		}
+	}
+	target, env := req.Target, req.Env
+	if opts.Target != "" {
+		target = opts.Target
+	}
+	if opts.Env != "" {
+		env = opts.Env
+	}
+	conn, t, err := s.backend(target)
+	if err != nil {
+		tc.Target = target
+		tc.Error = err.Error()
+		return
+	}
+	tc.Target = t.Name
+
+	start := time.Now()
+	resp, _, _, err := s.invokeCall(ctx, conn, t, InvokeRequest{
+		Target:     t.Name,
+		FullMethod: req.FullMethod,
+		Metadata:   req.Metadata,
+		Payload:    req.Payload,
+		TimeoutMs:  req.TimeoutMs,
+		Env:        env,
+	}, "test")
+	tc.DurationMs = durationMs(time.Since(start))
+	if err != nil {
+		tc.Error = err.Error()
+		return
+	}
+	latency := tc.DurationMs
+	if ms, ok := resp.Meta["elapsedMs"].(float64); ok {
+		latency = ms
+	}
+	tc.Code = responseCode(resp).String()
+
+	tc.Passed = true
+	checksStatus := false
+	for _, a := range req.Assertions {
+		res := a.check(resp, latency)
+		tc.Assertions = append(tc.Assertions, res)
+		tc.Passed = tc.Passed && res.Passed
+		checksStatus = checksStatus || a.Status != ""
+	}
+	if !checksStatus && resp.Error != nil {
+		tc.Passed = false
+		tc.Error = resp.Error.Message
+	}
+	if !tc.Passed {
+		tc.Call = &resp
+	}
+}
+
+// failureMessage summarises why a case failed.
+func (tc TestCaseResult) failureMessage() string {
+	var msgs []string
+	if tc.Error != "" {
+		msgs = append(msgs, tc.Error)
+	}
+	for _, a := range tc.Assertions {
+		if a.Passed {
+			continue
+		}
+		msg := a.Assertion
+		if a.Actual != "" {
+			msg += fmt.Sprintf(" (got %s)", a.Actual)
+		}
+		if a.Message != "" {
+			msg += ": " + a.Message
+		}
+		msgs = append(msgs, msg)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",cdata"`
+}
+
+func junitSeconds(ms float64) string {
+	return fmt.Sprintf("%.3f", ms/1000)
+}
+
+// writeJUnit writes the report as JUnit XML. Cases that could not run are
+// errors; cases whose assertions failed are failures. Folders become the
+// dotted classname, as CI tools group by it.
+func writeJUnit(w io.Writer, r TestReport) error {
+	suite := junitSuite{
+		Name:      r.Collection,
+		Tests:     r.Total,
+		Time:      junitSeconds(r.DurationMs),
+		Timestamp: r.StartedAt.Format("2006-01-02T15:04:05"),
+	}
+	for _, tc := range r.Cases {
+		jc := junitCase{
+			Name:      tc.Name,
+			Classname: strings.ReplaceAll(path.Dir(tc.ID), "/", "."),
+			Time:      junitSeconds(tc.DurationMs),
+		}
+		if !tc.Passed {
+			msg := tc.failureMessage()
+			detail, _ := json.MarshalIndent(tc, "", "  ")
+			problem := &junitProblem{Message: msg, Text: string(detail)}
+			if tc.Error != "" && tc.Code == "" {
+				problem.Type = "error"
+				jc.Error = problem
+				suite.Errors++
+			} else {
+				problem.Type = "assertion"
+				jc.Failure = problem
+				suite.Failures++
+			}
+		}
+		suite.Cases = append(suite.Cases, jc)
+	}
+	out := junitSuites{
+		Name:     "servicelens",
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Errors:   suite.Errors,
+		Time:     suite.Time,
+		Suites:   []junitSuite{suite},
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// testsRunHandler runs a collection posted as TestOptions and responds with
+// the TestReport, or JUnit XML with ?format=junit. The status is 200 even if
+// tests failed; the report says so.
+func (s *Server) testsRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.collections.dir == "" {
+		http.Error(w, "no collections workspace is configured (GRPS_WORKSPACE_DIR)", http.StatusServiceUnavailable)
+		return
+	}
+	var opts TestOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.Target == "" {
+		opts.Target = targetParam(r)
+	}
+	report, err := s.runCollectionTests(r.Context(), opts)
+	if errors.Is(err, errCollectionNotFound) {
+		writeCollectionError(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("format") == "junit" {
+		w.Header().Set("Content-Type", "application/xml")
+		_ = writeJUnit(w, report)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// backendCredentials returns the transport credentials used to dial a target.
+// Plaintext is used unless UseTLS is set.
+func backendCredentials(t Target) (credentials.TransportCredentials, error) {
+	if !t.UseTLS {
+		return insecure.NewCredentials(), nil
+	}
+	tlsCfg, err := buildTLSConfig(t)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(tlsCfg), nil
+}
+
+// buildTLSConfig assembles a client TLS config from the CA bundle, client key pair,
+// server name override and skip-verify settings of a target.
+func buildTLSConfig(t Target) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle %s: %w", t.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s contains no PEM certificates", t.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, errors.New("client certificate and key must be configured together")
+		}
+		pair, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{pair}
+	}
+
+	return tlsCfg, nil
+}
+
+// describeTLSError turns a TLS-related dial or call failure into guidance that
+// reflects the target's TLS settings. It returns "" if err is not TLS related.
+func describeTLSError(err error, t Target) string {
+	if err == nil {
+		return ""
+	}
+	msg := err.Error()
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalid x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+
+	switch {
+	case errors.As(err, &recordErr) || strings.Contains(msg, "first record does not look like a TLS handshake"):
+		return fmt.Sprintf("TLS mismatch: TLS is enabled but %s answered in plaintext. Disable GRPS_BACKEND_USE_TLS or point GRPS_BACKEND_ADDR at the TLS port.", t.Addr)
+	case errors.As(err, &unknownAuthority) || strings.Contains(msg, "certificate signed by unknown authority"):
+		if t.CAFile == "" {
+			return fmt.Sprintf("TLS error: the certificate presented by %s is signed by an unknown authority. Set GRPS_BACKEND_CA_FILE to the CA bundle that issued it.", t.Addr)
+		}
+		return fmt.Sprintf("TLS error: the certificate presented by %s is not signed by the CA bundle in %s.", t.Addr, t.CAFile)
+	case errors.As(err, &hostnameErr) || strings.Contains(msg, "certificate is valid for"):
+		return fmt.Sprintf("TLS error: the certificate presented by %s does not match the expected server name (%v). Set GRPS_BACKEND_SERVER_NAME to a name listed in the certificate.", t.Addr, err)
+	case errors.As(err, &certInvalid) || strings.Contains(msg, "certificate has expired"):
+		return fmt.Sprintf("TLS error: the certificate presented by %s is invalid: %v", t.Addr, err)
+	case strings.Contains(msg, "certificate required") || strings.Contains(msg, "bad certificate"):
+		return fmt.Sprintf("TLS error: %s rejected the client certificate. Check GRPS_BACKEND_CERT_FILE and GRPS_BACKEND_KEY_FILE.", t.Addr)
+	case !t.UseTLS && !strings.Contains(msg, "frame too large") && (strings.Contains(msg, "error reading server preface") || strings.Contains(msg, "connection closed before server preface received")):
+		// "frame too large" means an HTTP/1.1 server answered, which is not a TLS problem.
+		return fmt.Sprintf("TLS mismatch: TLS is disabled but %s closed the plaintext connection. The server probably requires TLS; set GRPS_BACKEND_USE_TLS=true.", t.Addr)
+	case strings.Contains(msg, "tls:") || strings.Contains(msg, "x509:"):
+		return fmt.Sprintf("TLS error talking to %s: %v", t.Addr, err)
+	}
+	return ""
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// testCA is a throwaway certificate authority for TLS tests.
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "servicelens test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key signed by the CA, for a server with
+// the given DNS names or, if client is set, for a client.
+func (ca *testCA) issue(t *testing.T, client bool, dnsNames ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "servicelens test"},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startTLSBackend serves the health service over TLS with a certificate for
+// backend.test. With clientCA set, clients must present a certificate it
+// signed.
+func startTLSBackend(t *testing.T, ca *testCA, clientCA *testCA) string {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, false, "backend.test")
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{pair}}
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.cert)
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer(grpc.Creds(credentials.NewTLS(cfg)))
+	healthpb.RegisterHealthServer(gs, health.NewServer())
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	return net.JoinHostPort("localhost", port)
+}
+
+// checkOverTLS calls Health/Check on the target with its TLS settings.
+func checkOverTLS(t *testing.T, target Target) error {
+	t.Helper()
+	creds, err := backendCredentials(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.NewClient(target.Addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func TestBackendTLS(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := writeTestFile(t, "ca.pem", ca.certPEM)
+	addr := startTLSBackend(t, ca, nil)
+
+	tests := []struct {
+		name     string
+		target   Target
+		wantHint string // empty if the call must succeed
+	}{
+		{
+			name:   "CA bundle and server name override",
+			target: Target{Addr: addr, UseTLS: true, CAFile: caFile, ServerName: "backend.test"},
+		},
+		{
+			name:     "unknown authority without CA bundle",
+			target:   Target{Addr: addr, UseTLS: true, ServerName: "backend.test"},
+			wantHint: "Set GRPS_BACKEND_CA_FILE",
+		},
+		{
+			name:     "unknown authority with other CA bundle",
+			target:   Target{Addr: addr, UseTLS: true, CAFile: writeTestFile(t, "other.pem", newTestCA(t).certPEM), ServerName: "backend.test"},
+			wantHint: "is not signed by the CA bundle",
+		},
+		{
+			name:     "server name mismatch",
+			target:   Target{Addr: addr, UseTLS: true, CAFile: caFile},
+			wantHint: "Set GRPS_BACKEND_SERVER_NAME",
+		},
+		{
+			name:   "insecure skip verify",
+			target: Target{Addr: addr, UseTLS: true, InsecureSkipVerify: true},
+		},
+		{
+			name:     "plaintext against TLS",
+			target:   Target{Addr: addr},
+			wantHint: "set GRPS_BACKEND_USE_TLS=true",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkOverTLS(t, tt.target)
+			if tt.wantHint == "" {
+				if err != nil {
+					t.Fatalf("call failed: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("call succeeded, want a TLS error")
+			}
+			if hint := describeTLSError(err, tt.target); !strings.Contains(hint, tt.wantHint) {
+				t.Errorf("describeTLSError(%v) = %q, want it to contain %q", err, hint, tt.wantHint)
+			}
+		})
+	}
+}
+
+func TestBackendMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := writeTestFile(t, "ca.pem", ca.certPEM)
+	addr := startTLSBackend(t, ca, ca)
+	target := Target{Addr: addr, UseTLS: true, CAFile: caFile, ServerName: "backend.test"}
+
+	certPEM, keyPEM := ca.issue(t, true)
+	withCert := target
+	withCert.CertFile = writeTestFile(t, "client.pem", certPEM)
+	withCert.KeyFile = writeTestFile(t, "client-key.pem", keyPEM)
+	if err := checkOverTLS(t, withCert); err != nil {
+		t.Fatalf("call with client certificate failed: %v", err)
+	}
+
+	err := checkOverTLS(t, target)
+	if err == nil {
+		t.Fatal("call without client certificate succeeded")
+	}
+	if hint := describeTLSError(err, target); !strings.Contains(hint, "rejected the client certificate") {
+		t.Errorf("describeTLSError(%v) = %q, want the client certificate hint", err, hint)
+	}
+}
+
+func TestBuildTLSConfigErrors(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, true)
+	certFile := writeTestFile(t, "client.pem", certPEM)
+
+	tests := []struct {
+		name    string
+		target  Target
+		wantErr string
+	}{
+		{"missing CA file", Target{CAFile: filepath.Join(t.TempDir(), "nope.pem")}, "read CA bundle"},
+		{"CA file without certificates", Target{CAFile: writeTestFile(t, "empty.pem", []byte("not pem"))}, "contains no PEM certificates"},
+		{"certificate without key", Target{CertFile: certFile}, "must be configured together"},
+		{"mismatched key", Target{CertFile: certFile, KeyFile: writeTestFile(t, "key.pem", []byte(strings.ReplaceAll(string(keyPEM), "A", "B")))}, "load client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := buildTLSConfig(tt.target)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("buildTLSConfig() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg, err := buildTLSConfig(Target{ServerName: "backend.test", InsecureSkipVerify: true, CAFile: writeTestFile(t, "ca.pem", ca.certPEM)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerName != "backend.test" || !cfg.InsecureSkipVerify || cfg.RootCAs == nil || cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("buildTLSConfig() = %+v, want server name, skip verify, root CAs and TLS 1.2 minimum", cfg)
+	}
+}
@@ -14,14 +14,28 @@ import (
 )
 
 type TrafficEntry struct {
-    Service   string              `json:"service"`
-    Method    string              `json:"method"`
-    Metadata  map[string][]string `json:"metadata"`
-    Request   json.RawMessage     `json:"request"`
-    Response  json.RawMessage     `json:"response"`
-    Error     string              `json:"error,omitempty"`
-    StartedAt time.Time           `json:"startedAt"`
-    Duration  time.Duration       `json:"duration"`
+    Target        string              `json:"target,omitempty"`
+    Source        string              `json:"source,omitempty"`        // how the call reached the inspector: "proxy", "grpc-web", "connect" or "http"; empty for calls it made itself
+    CorrelationID string              `json:"correlationId,omitempty"` // shared by related calls, e.g. the steps of a workflow
+    Service       string              `json:"service"`
+    Method        string              `json:"method"`
+    Metadata      map[string][]string `json:"metadata"`
+    HTTPHeaders   map[string][]string `json:"httpHeaders,omitempty"` // original HTTP request headers of a relayed gRPC-Web call
+    Request       json.RawMessage     `json:"request"`
+    Response      json.RawMessage     `json:"response"`
+    Error         string              `json:"error,omitempty"`
+    ErrorKind     string              `json:"errorKind,omitempty"`
+    ErrorDetails  []ErrorDetail       `json:"errorDetails,omitempty"`
+    StartedAt     time.Time           `json:"startedAt"`
+    Duration      time.Duration       `json:"duration"`
+    Messages      []StreamLogEntry    `json:"messages,omitempty"` // ordered message log of a streaming session
+}
+
+// StreamLogEntry is one message sent or received during a streaming session.
+type StreamLogEntry struct {
+    Direction string          `json:"direction"` // "send" or "recv"
+    ElapsedMs float64         `json:"elapsedMs"`
+    Message   json.RawMessage `json:"message"`
 }
 
 type trafficBuffer struct {
@@ -94,6 +108,19 @@ func (s *Server) loggingUnaryInterceptor(
 }
 
 func (s *Server) trafficHandler(w http.ResponseWriter, r *http.Request) {
+    entries := s.traffic.snapshot()
+    target := targetParam(r)
+    correlationID := r.URL.Query().Get("correlationId")
+    source := r.URL.Query().Get("source")
+    if target != "" || correlationID != "" || source != "" {
+        filtered := make([]TrafficEntry, 0, len(entries))
+        for _, e := range entries {
+            if (target == "" || e.Target == target) && (correlationID == "" || e.CorrelationID == correlationID) && (source == "" || e.Source == source) {
+                filtered = append(filtered, e)
+            }
+        }
+        entries = filtered
+    }
     w.Header().Set("Content-Type", "application/json")
-    _ = json.NewEncoder(w).Encode(s.traffic.snapshot())
+    _ = json.NewEncoder(w).Encode(entries)
 }
@@ -0,0 +1,791 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// A target is reached over native gRPC unless its Transport says otherwise.
+// Backends that only expose gRPC-Web (e.g. behind Envoy's grpc_web filter) or
+// the Connect protocol are called with httpConn, which implements
+// grpc.ClientConnInterface on top of plain HTTP requests, so invoking,
+// reflection, health checks and streaming work the same for every target.
+//
+// HTTP/1.1 cannot carry both directions of a call at once. Request messages
+// are therefore buffered until the client half-closes and sent as one request
+// body; bidi streams become half-duplex. The reflection stream is the
+// exception: each reflection request is sent as a call of its own, which is
+// what its request/response pattern needs.
+
+// Transports a target can be reached over.
+const (
+	transportGRPC        = "grpc"          // native gRPC over HTTP/2 (default)
+	transportGRPCWeb     = "grpc-web"      // gRPC-Web with binary frames
+	transportGRPCWebText = "grpc-web-text" // gRPC-Web with base64-encoded frames
+	transportConnect     = "connect"       // the Connect protocol with protobuf messages
+)
+
+// httpTransportMaxMessageBytes limits a response message on HTTP transports.
+const httpTransportMaxMessageBytes = 64 << 20
+
+// backendConn is a client connection to a target, over any transport.
+// *grpc.ClientConn implements it for native gRPC.
+type backendConn interface {
+	grpc.ClientConnInterface
+	GetState() connectivity.State
+	Close() error
+}
+
+func validTransport(name string) bool {
+	switch name {
+	case "", transportGRPC, transportGRPCWeb, transportGRPCWebText, transportConnect:
+		return true
+	}
+	return false
+}
+
+// isHTTPTransport reports whether calls to t are plain HTTP requests rather
+// than calls on a gRPC channel.
+func (t Target) isHTTPTransport() bool {
+	return t.Transport != "" && t.Transport != transportGRPC
+}
+
+// httpConn calls a gRPC-Web or Connect backend. It has no long-lived channel;
+// its state reflects the outcome of the last request.
+type httpConn struct {
+	transport string
+	baseURL   string
+	client    *http.Client
+	// h2c carries Connect bidi streams to plaintext backends: the Connect
+	// protocol only allows them over HTTP/2.
+	h2c *http.Client
+
+	mu    sync.Mutex
+	state connectivity.State
+}
+
+func newHTTPConn(t Target) (*httpConn, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	scheme := "http"
+	if t.UseTLS {
+		tlsCfg, err := buildTLSConfig(t)
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = tlsCfg
+		tr.ForceAttemptHTTP2 = true
+		scheme = "https"
+	}
+	c := &httpConn{
+		transport: t.Transport,
+		baseURL:   scheme + "://" + t.Addr,
+		client:    &http.Client{Transport: tr},
+		h2c:       &http.Client{Transport: tr},
+		state:     connectivity.Idle,
+	}
+	if !t.UseTLS && t.Transport == transportConnect {
+		h2c := tr.Clone()
+		h2c.Protocols = new(http.Protocols)
+		h2c.Protocols.SetUnencryptedHTTP2(true)
+		c.h2c = &http.Client{Transport: h2c}
+	}
+	return c, nil
+}
+
+func (c *httpConn) GetState() connectivity.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *httpConn) setState(state connectivity.State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != connectivity.Shutdown {
+		c.state = state
+	}
+}
+
+func (c *httpConn) Close() error {
+	c.setState(connectivity.Shutdown)
+	c.client.CloseIdleConnections()
+	c.h2c.CloseIdleConnections()
+	return nil
+}
+
+// Invoke performs a unary call.
+func (c *httpConn) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	stream, err := c.NewStream(ctx, &grpc.StreamDesc{}, method, opts...)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(args); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(reply)
+}
+
+// NewStream starts a call of any kind. No request is sent until the client
+// half-closes, except on the reflection stream (see above).
+func (c *httpConn) NewStream(ctx context.Context, sd *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if c.GetState() == connectivity.Shutdown {
+		return nil, status.Error(codes.Canceled, "the client connection is closing")
+	}
+	s := &httpStream{
+		conn:        c,
+		ctx:         ctx,
+		method:      method,
+		desc:        *sd,
+		paired:      sd.ClientStreams && sd.ServerStreams && reflectionServices[parseService(method)],
+		exchanges:   make(chan *httpExchange, 64),
+		headerReady: make(chan struct{}),
+		codec:       encoding.GetCodecV2("proto"),
+	}
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case grpc.HeaderCallOption:
+			s.headerAddr = o.HeaderAddr
+		case grpc.TrailerCallOption:
+			s.trailerAddr = o.TrailerAddr
+		case grpc.ForceCodecCallOption:
+			s.legacyCodec = o.Codec
+		case grpc.ForceCodecV2CallOption:
+			s.codec = o.CodecV2
+		}
+	}
+	return s, nil
+}
+
+// httpStream is a call on an httpConn. It is made of one or more exchanges,
+// each an HTTP request and its response.
+type httpStream struct {
+	conn   *httpConn
+	ctx    context.Context
+	method string
+	desc   grpc.StreamDesc
+	paired bool // one exchange per request message
+
+	codec       encoding.CodecV2
+	legacyCodec encoding.Codec // set by grpc.ForceCodec
+	headerAddr  *metadata.MD
+	trailerAddr *metadata.MD
+
+	sendMu     sync.Mutex
+	pending    [][]byte
+	halfClosed bool
+	started    bool
+
+	exchanges   chan *httpExchange
+	headerOnce  sync.Once
+	headerReady chan struct{}
+	header      metadata.MD
+	headerErr   error
+
+	cur      *httpExchange
+	trailer  metadata.MD
+	finished bool
+	err      error
+}
+
+func (s *httpStream) Context() context.Context { return s.ctx }
+
+func (s *httpStream) marshal(v any) ([]byte, error) {
+	if s.legacyCodec != nil {
+		return s.legacyCodec.Marshal(v)
+	}
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Free()
+	return data.Materialize(), nil
+}
+
+func (s *httpStream) unmarshal(data []byte, v any) error {
+	if s.legacyCodec != nil {
+		return s.legacyCodec.Unmarshal(data, v)
+	}
+	return s.codec.Unmarshal(mem.BufferSlice{mem.SliceBuffer(data)}, v)
+}
+
+func (s *httpStream) SendMsg(m any) error {
+	data, err := s.marshal(m)
+	if err != nil {
+		return status.Errorf(codes.Internal, "marshal request: %v", err)
+	}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.halfClosed {
+		return status.Error(codes.Internal, "SendMsg called after CloseSend")
+	}
+	if s.paired {
+		s.startExchange([][]byte{data})
+		return nil
+	}
+	s.pending = append(s.pending, data)
+	return nil
+}
+
+func (s *httpStream) CloseSend() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.halfClosed {
+		return nil
+	}
+	s.halfClosed = true
+	if !s.paired {
+		s.startExchange(s.pending)
+		s.pending = nil
+	}
+	if !s.started {
+		s.setHeader(nil, nil)
+	}
+	close(s.exchanges)
+	return nil
+}
+
+// startExchange sends msgs as one request. Responses are read in the order
+// the requests were started. Callers hold sendMu.
+func (s *httpStream) startExchange(msgs [][]byte) {
+	ex := &httpExchange{ready: make(chan struct{})}
+	first := !s.started
+	s.started = true
+	go func() {
+		s.conn.roundTrip(s.ctx, ex, s.method, s.desc, s.paired, msgs)
+		if first {
+			s.setHeader(ex.header, ex.transportErr)
+		}
+	}()
+	s.exchanges <- ex
+}
+
+func (s *httpStream) setHeader(md metadata.MD, err error) {
+	s.headerOnce.Do(func() {
+		s.header, s.headerErr = md, err
+		close(s.headerReady)
+	})
+}
+
+// Header waits for the response headers of the first exchange.
+func (s *httpStream) Header() (metadata.MD, error) {
+	select {
+	case <-s.headerReady:
+		return s.header, s.headerErr
+	case <-s.ctx.Done():
+		return nil, status.FromContextError(s.ctx.Err()).Err()
+	}
+}
+
+// Trailer returns the trailers once RecvMsg has reported the end of the call.
+func (s *httpStream) Trailer() metadata.MD {
+	return s.trailer
+}
+
+func (s *httpStream) RecvMsg(m any) error {
+	if s.finished {
+		if s.err != nil {
+			return s.err
+		}
+		return io.EOF
+	}
+	for {
+		if s.cur == nil {
+			select {
+			case ex, ok := <-s.exchanges:
+				if !ok {
+					return s.finish(io.EOF)
+				}
+				s.cur = ex
+			case <-s.ctx.Done():
+				return s.finish(status.FromContextError(s.ctx.Err()).Err())
+			}
+		}
+		data, err := s.cur.next(s.ctx)
+		if errors.Is(err, io.EOF) {
+			s.trailer = s.cur.trailer
+			s.cur = nil
+			if !s.desc.ServerStreams && !s.paired {
+				return s.finish(status.Error(codes.Internal, "the server sent no response message"))
+			}
+			continue
+		}
+		if err != nil {
+			s.trailer = s.cur.trailer
+			return s.finish(err)
+		}
+		if err := s.unmarshal(data, m); err != nil {
+			return s.finish(status.Errorf(codes.Internal, "unmarshal response: %v", err))
+		}
+		if !s.desc.ServerStreams && !s.paired {
+			// A unary response: the call only succeeded if the status says so.
+			extra, err := s.cur.next(s.ctx)
+			s.trailer = s.cur.trailer
+			switch {
+			case err == nil && extra != nil:
+				return s.finish(status.Error(codes.Internal, "the server sent more than one response message"))
+			case err != nil && !errors.Is(err, io.EOF):
+				return s.finish(err)
+			}
+			s.finish(io.EOF)
+		}
+		return nil
+	}
+}
+
+// finish ends the call with err (io.EOF for success) and fills in the header
+// and trailer call options.
+func (s *httpStream) finish(err error) error {
+	s.finished = true
+	if !errors.Is(err, io.EOF) {
+		s.err = err
+	}
+	if s.headerAddr != nil {
+		select {
+		case <-s.headerReady:
+			*s.headerAddr = s.header
+		default:
+		}
+	}
+	if s.trailerAddr != nil {
+		*s.trailerAddr = s.trailer
+	}
+	return err
+}
+
+// httpExchange is one HTTP request of a call and its response.
+type httpExchange struct {
+	ready        chan struct{} // closed once the response headers are in
+	header       metadata.MD
+	trailer      metadata.MD
+	transportErr error // the request failed before the server answered
+
+	transport string
+	body      io.ReadCloser
+	frames    io.Reader // gRPC-Web and Connect streaming
+	unary     []byte    // the response of a Connect unary call
+	ended     bool
+	err       error // the final status, once ended
+}
+
+// roundTrip sends msgs and waits for the response headers.
+func (c *httpConn) roundTrip(ctx context.Context, ex *httpExchange, method string, sd grpc.StreamDesc, paired bool, msgs [][]byte) {
+	defer close(ex.ready)
+	ex.transport = c.transport
+	connectUnary := c.transport == transportConnect && !sd.ClientStreams && !sd.ServerStreams
+	req, err := c.newRequest(ctx, method, connectUnary, msgs)
+	if err != nil {
+		ex.end(nil, status.Errorf(codes.Internal, "build request: %v", err))
+		ex.transportErr = ex.err
+		return
+	}
+	client := c.client
+	if c.transport == transportConnect && sd.ClientStreams && sd.ServerStreams {
+		client = c.h2c
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = status.FromContextError(ctx.Err()).Err()
+		} else {
+			c.setState(connectivity.TransientFailure)
+			// Worded like grpc-go's own connection failures.
+			err = status.Errorf(codes.Unavailable, "connection error: desc = %q", err.Error())
+		}
+		ex.end(nil, err)
+		ex.transportErr = err
+		return
+	}
+	c.setState(connectivity.Ready)
+	ex.body = resp.Body
+	if c.transport == transportConnect {
+		ex.readConnectResponse(resp, connectUnary)
+	} else {
+		ex.readGRPCWebResponse(resp)
+	}
+}
+
+// newRequest builds the HTTP request of an exchange. Outgoing metadata
+// becomes request headers and the deadline a timeout header.
+func (c *httpConn) newRequest(ctx context.Context, method string, connectUnary bool, msgs [][]byte) (*http.Request, error) {
+	var body bytes.Buffer
+	var contentType string
+	switch {
+	case connectUnary:
+		if len(msgs) != 1 {
+			return nil, fmt.Errorf("a unary call needs exactly one request message, got %d", len(msgs))
+		}
+		body.Write(msgs[0])
+		contentType = "application/proto"
+	case c.transport == transportConnect:
+		for _, m := range msgs {
+			_ = writeConnectEnvelope(&body, 0, m)
+		}
+		contentType = "application/connect+proto"
+	default:
+		for _, m := range msgs {
+			_ = writeConnectEnvelope(&body, 0, m) // gRPC-Web frames share the envelope format
+		}
+		contentType = "application/grpc-web+proto"
+		if c.transport == transportGRPCWebText {
+			encoded := base64.StdEncoding.EncodeToString(body.Bytes())
+			body.Reset()
+			body.WriteString(encoded)
+			contentType = "application/grpc-web-text+proto"
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+method, &body)
+	if err != nil {
+		return nil, err
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	setConnectHeaders(req.Header, md, "")
+	req.Header.Set("Content-Type", contentType)
+	if c.transport == transportConnect {
+		req.Header.Set("Connect-Protocol-Version", "1")
+	} else {
+		req.Header.Set("Accept", contentType)
+		req.Header.Set("X-Grpc-Web", "1")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := max(time.Until(deadline).Milliseconds(), 1)
+		ms = min(ms, 99999999) // both protocols allow at most 8 digits
+		if c.transport == transportConnect {
+			req.Header.Set("Connect-Timeout-Ms", strconv.FormatInt(ms, 10))
+		} else {
+			req.Header.Set("Grpc-Timeout", strconv.FormatInt(ms, 10)+"m")
+		}
+	}
+	return req, nil
+}
+
+// responseMetadata returns the headers of a response that are call metadata
+// rather than part of HTTP or the protocol.
+func responseMetadata(h http.Header) metadata.MD {
+	md := connectRequestMetadata(h)
+	for key := range md {
+		if key == "date" || key == "server" || key == "vary" || strings.HasPrefix(key, "access-control-") {
+			delete(md, key)
+		}
+	}
+	return md
+}
+
+// readGRPCWebResponse takes the headers of a gRPC-Web response. A response
+// that carries grpc-status in its headers is trailers-only and has no body.
+func (ex *httpExchange) readGRPCWebResponse(resp *http.Response) {
+	if resp.Header.Get("Grpc-Status") != "" {
+		ex.end(responseMetadata(resp.Header), grpcWebStatus(resp.Header))
+		return
+	}
+	ex.header = responseMetadata(resp.Header)
+	if resp.StatusCode != http.StatusOK {
+		ex.end(nil, status.Errorf(codeForHTTPStatus(resp.StatusCode), "grpc-web: unexpected HTTP status %s", resp.Status))
+		return
+	}
+	ct := resp.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(ct, "application/grpc-web-text"):
+		ex.frames = &base64QuadReader{r: bufio.NewReader(resp.Body)}
+	case strings.HasPrefix(ct, "application/grpc-web"):
+		ex.frames = bufio.NewReader(resp.Body)
+	default:
+		ex.end(nil, status.Errorf(codes.Unknown, "grpc-web: unexpected content-type %q", ct))
+	}
+}
+
+// readConnectResponse takes the headers of a Connect response. Errors of
+// unary calls come as a JSON body with a non-200 status; unary trailers are
+// Trailer- headers.
+func (ex *httpExchange) readConnectResponse(resp *http.Response, unary bool) {
+	header, trailer := http.Header{}, http.Header{}
+	for key, vals := range resp.Header {
+		if name, ok := strings.CutPrefix(key, "Trailer-"); ok {
+			trailer[name] = vals
+		} else {
+			header[key] = vals
+		}
+	}
+	ex.header = responseMetadata(header)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, httpTransportMaxMessageBytes))
+		ex.end(responseMetadata(trailer), connectErrorStatus(resp.StatusCode, body))
+		return
+	}
+	if !unary {
+		ex.frames = bufio.NewReader(resp.Body)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpTransportMaxMessageBytes+1))
+	switch {
+	case err != nil:
+		ex.end(nil, status.Errorf(codes.Unavailable, "read response: %v", err))
+	case len(body) > httpTransportMaxMessageBytes:
+		ex.end(nil, status.Errorf(codes.ResourceExhausted, "response message exceeds %d bytes", httpTransportMaxMessageBytes))
+	default:
+		ex.unary = body
+		ex.trailer = responseMetadata(trailer)
+	}
+}
+
+// next returns the next response message of the exchange, or io.EOF once it
+// ended with an OK status.
+func (ex *httpExchange) next(ctx context.Context) ([]byte, error) {
+	select {
+	case <-ex.ready:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	if ex.ended {
+		if ex.err != nil {
+			return nil, ex.err
+		}
+		return nil, io.EOF
+	}
+	if ex.frames == nil {
+		// Connect unary: the body is the message, the headers the status.
+		if ex.unary != nil {
+			msg := ex.unary
+			ex.unary = nil
+			return msg, nil
+		}
+		return nil, ex.end(ex.trailer, nil)
+	}
+
+	flags, data, err := readEnvelope(ex.frames)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ex.end(nil, status.FromContextError(ctx.Err()).Err())
+		}
+		if errors.Is(err, io.EOF) {
+			err = errors.New("the response ended before the call's status")
+		}
+		if _, ok := status.FromError(err); !ok {
+			err = status.Errorf(codes.Internal, "read response: %v", err)
+		}
+		return nil, ex.end(nil, err)
+	}
+	switch {
+	case ex.transport == transportConnect && flags&connectFlagEndStream != 0:
+		return nil, ex.end(connectEndStream(data))
+	case ex.transport != transportConnect && flags&grpcWebFlagTrailer != 0:
+		h, err := parseGRPCWebTrailer(data)
+		if err != nil {
+			return nil, ex.end(nil, status.Errorf(codes.Internal, "grpc-web trailers: %v", err))
+		}
+		return nil, ex.end(responseMetadata(h), grpcWebStatus(h))
+	case flags&connectFlagCompressed != 0:
+		return nil, ex.end(nil, status.Error(codes.Internal, "received a compressed message, but compression was not requested"))
+	}
+	return data, nil
+}
+
+// end records the final status and trailers and releases the body. It returns
+// io.EOF for an OK status.
+func (ex *httpExchange) end(trailer metadata.MD, err error) error {
+	if trailer != nil {
+		ex.trailer = trailer
+	}
+	ex.ended = true
+	ex.err = err
+	if ex.body != nil {
+		_ = ex.body.Close()
+	}
+	if err == nil {
+		return io.EOF
+	}
+	return err
+}
+
+// grpcWebFlagTrailer marks the frame of a gRPC-Web response that carries the
+// trailers.
+const grpcWebFlagTrailer = 0x80
+
+// readEnvelope reads one length-prefixed message as framed by both gRPC-Web
+// and Connect streaming: a flags byte, a big-endian length and the payload.
+func readEnvelope(r io.Reader) (byte, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n > httpTransportMaxMessageBytes {
+		return 0, nil, status.Errorf(codes.ResourceExhausted, "response message of %d bytes exceeds %d bytes", n, httpTransportMaxMessageBytes)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return head[0], data, nil
+}
+
+// base64QuadReader decodes a gRPC-Web text body. Servers may encode every
+// frame separately, so padding can appear mid-stream; decoding four
+// characters at a time handles that as well as a single encoded body.
+type base64QuadReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func (b *base64QuadReader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		var quad [4]byte
+		n := 0
+		for n < 4 {
+			c, err := b.r.ReadByte()
+			if err != nil {
+				if errors.Is(err, io.EOF) && n > 0 {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+			if c == '\r' || c == '\n' {
+				continue
+			}
+			quad[n] = c
+			n++
+		}
+		var out [3]byte
+		m, err := base64.StdEncoding.Decode(out[:], quad[:])
+		if err != nil {
+			return 0, err
+		}
+		b.buf = out[:m]
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// parseGRPCWebTrailer parses the HTTP/1-style header block of a gRPC-Web
+// trailer frame.
+func parseGRPCWebTrailer(data []byte) (http.Header, error) {
+	h := http.Header{}
+	for _, line := range strings.Split(string(data), "\r\n") {
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		h.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	return h, nil
+}
+
+// grpcWebStatus reads the status from grpc-status, grpc-message and
+// grpc-status-details-bin. It returns nil for OK.
+func grpcWebStatus(h http.Header) error {
+	code, err := strconv.Atoi(h.Get("Grpc-Status"))
+	if err != nil {
+		return status.Errorf(codes.Internal, "grpc-web: invalid grpc-status %q", h.Get("Grpc-Status"))
+	}
+	if code == int(codes.OK) {
+		return nil
+	}
+	msg, err := url.PathUnescape(h.Get("Grpc-Message"))
+	if err != nil {
+		msg = h.Get("Grpc-Message")
+	}
+	p := &spb.Status{Code: int32(code), Message: msg}
+	if v := h.Get("Grpc-Status-Details-Bin"); v != "" {
+		details := &spb.Status{}
+		if raw, err := decodeConnectBase64(v); err == nil && proto.Unmarshal(raw, details) == nil {
+			p.Details = details.GetDetails()
+		}
+	}
+	return status.ErrorProto(p)
+}
+
+// connectErrorStatus turns the error body of a failed Connect request into a
+// status. Bodies that are not Connect errors, e.g. from a proxy in between,
+// are mapped by HTTP status.
+func connectErrorStatus(httpStatus int, body []byte) error {
+	var ce connectError
+	if err := json.Unmarshal(body, &ce); err != nil || ce.Code == "" {
+		return status.Errorf(codeForHTTPStatus(httpStatus), "connect: HTTP status %d %s", httpStatus, http.StatusText(httpStatus))
+	}
+	return ce.status()
+}
+
+// connectEndStream reads the end-of-stream message of a Connect stream.
+func connectEndStream(data []byte) (metadata.MD, error) {
+	var end struct {
+		Error    *connectError       `json:"error"`
+		Metadata map[string][]string `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &end); err != nil {
+		return nil, status.Errorf(codes.Internal, "connect: invalid end-of-stream message: %v", err)
+	}
+	md := responseMetadata(http.Header(end.Metadata))
+	if end.Error == nil {
+		return md, nil
+	}
+	return md, end.Error.status()
+}
+
+// status converts a Connect error back into a gRPC status.
+func (ce connectError) status() error {
+	code, ok := parseStatusCode(ce.Code)
+	if !ok {
+		code = codes.Unknown
+	}
+	p := &spb.Status{Code: int32(code), Message: ce.Message}
+	for _, d := range ce.Details {
+		value, err := decodeConnectBase64(d.Value)
+		if err != nil {
+			continue
+		}
+		p.Details = append(p.Details, &anypb.Any{TypeUrl: "type.googleapis.com/" + d.Type, Value: value})
+	}
+	return status.ErrorProto(p)
+}
+
+// codeForHTTPStatus maps the HTTP status of a response without a gRPC status,
+// as both gRPC-Web and Connect specify.
+func codeForHTTPStatus(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.Internal
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	}
+	return codes.Unknown
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// echoHealth is a health service that echoes x-custom as a header, always
+// sets a trailer and fails for the service "fail" with error details.
+type echoHealth struct{ *health.Server }
+
+func (h echoHealth) Check(ctx context.Context, r *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	_ = grpc.SetHeader(ctx, metadata.Pairs("x-echo", strings.Join(md.Get("x-custom"), ",")))
+	_ = grpc.SetTrailer(ctx, metadata.Pairs("x-trail", "t1"))
+	if r.Service == "fail" {
+		st, _ := status.New(codes.FailedPrecondition, "bad state: 100%").WithDetails(&errdetails.ErrorInfo{Reason: "BROKEN", Domain: "test"})
+		return nil, st.Err()
+	}
+	return h.Server.Check(ctx, r)
+}
+
+// startEchoBackend serves echoHealth and reflection over native gRPC.
+func startEchoBackend(t *testing.T) (string, *grpc.Server, *health.Server) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer()
+	hs := health.NewServer()
+	hs.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(gs, echoHealth{hs})
+	reflection.Register(gs)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	return lis.Addr().String(), gs, hs
+}
+
+// startGRPCWebBackend puts a gRPC-Web proxy, as Envoy would, in front of an
+// echo backend. It speaks both the binary and the text encoding.
+func startGRPCWebBackend(t *testing.T) (string, *health.Server) {
+	t.Helper()
+	_, gs, hs := startEchoBackend(t)
+	ts := httptest.NewServer(grpcweb.WrapServer(gs))
+	t.Cleanup(ts.Close)
+	return hostPort(ts.URL), hs
+}
+
+// startConnectBackend serves an echo backend over the Connect protocol with
+// the inspector's own Connect handler, on HTTP/1.1 and h2c.
+func startConnectBackend(t *testing.T) (string, *health.Server) {
+	t.Helper()
+	addr, _, hs := startEchoBackend(t)
+	fdp := protodesc.ToFileDescriptorProto(healthpb.File_grpc_health_v1_health_proto)
+	set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fdp}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := newServer(Config{BackendAddr: addr, DescriptorSet: writeTestFile(t, "health.pb", set), DescriptorMode: "replace"})
+	if err := front.loadTargetDescriptors(front.cfg.defaultTarget()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(front.conns.closeAll)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(front.connectHandler))
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetHTTP1(true)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return hostPort(ts.URL), hs
+}
+
+func newTestHTTPConn(t *testing.T, addr, transport string) *httpConn {
+	t.Helper()
+	conn, err := newHTTPConn(Target{Addr: addr, Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHTTPTransportUnary(t *testing.T) {
+	webAddr, _ := startGRPCWebBackend(t)
+	connectAddr, _ := startConnectBackend(t)
+	for _, tt := range []struct{ transport, addr string }{
+		{transportGRPCWeb, webAddr},
+		{transportGRPCWebText, webAddr},
+		{transportConnect, connectAddr},
+	} {
+		t.Run(tt.transport, func(t *testing.T) {
+			conn := newTestHTTPConn(t, tt.addr, tt.transport)
+			client := healthpb.NewHealthClient(conn)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-custom", "hello")
+
+			var header, trailer metadata.MD
+			resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "svc"}, grpc.Header(&header), grpc.Trailer(&trailer))
+			if err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			if resp.Status != healthpb.HealthCheckResponse_SERVING {
+				t.Errorf("status = %v, want SERVING", resp.Status)
+			}
+			if got := header.Get("x-echo"); len(got) != 1 || got[0] != "hello" {
+				t.Errorf("header x-echo = %v, want [hello]", got)
+			}
+			if got := trailer.Get("x-trail"); len(got) != 1 || got[0] != "t1" {
+				t.Errorf("trailer x-trail = %v, want [t1]", got)
+			}
+			if conn.GetState() != connectivity.Ready {
+				t.Errorf("state = %v, want READY", conn.GetState())
+			}
+
+			trailer = nil
+			_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "fail"}, grpc.Trailer(&trailer))
+			st := status.Convert(err)
+			if st.Code() != codes.FailedPrecondition || st.Message() != "bad state: 100%" {
+				t.Errorf("Check(fail) = %v, want FailedPrecondition with the message intact", err)
+			}
+			if d := st.Details(); len(d) != 1 || d[0].(*errdetails.ErrorInfo).GetReason() != "BROKEN" {
+				t.Errorf("details = %v, want the ErrorInfo", d)
+			}
+			if got := trailer.Get("x-trail"); len(got) != 1 {
+				t.Errorf("trailer of a failed call = %v, want x-trail", trailer)
+			}
+
+			if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"}); status.Code(err) != codes.NotFound {
+				t.Errorf("Check(unknown) = %v, want NotFound", err)
+			}
+		})
+	}
+}
+
+func TestHTTPTransportServerStreaming(t *testing.T) {
+	webAddr, webHealth := startGRPCWebBackend(t)
+	connectAddr, connectHealth := startConnectBackend(t)
+	for _, tt := range []struct {
+		transport, addr string
+		hs              *health.Server
+	}{
+		{transportGRPCWeb, webAddr, webHealth},
+		{transportGRPCWebText, webAddr, webHealth},
+		{transportConnect, connectAddr, connectHealth},
+	} {
+		t.Run(tt.transport, func(t *testing.T) {
+			tt.hs.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+			conn := newTestHTTPConn(t, tt.addr, tt.transport)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			stream, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{Service: "svc"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			first, err := stream.Recv()
+			if err != nil || first.Status != healthpb.HealthCheckResponse_SERVING {
+				t.Fatalf("first message = %v, %v, want SERVING", first, err)
+			}
+			tt.hs.SetServingStatus("svc", healthpb.HealthCheckResponse_NOT_SERVING)
+			second, err := stream.Recv()
+			if err != nil || second.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+				t.Fatalf("second message = %v, %v, want NOT_SERVING", second, err)
+			}
+			cancel()
+			if _, err := stream.Recv(); status.Code(err) != codes.Canceled {
+				t.Errorf("Recv after cancel = %v, want Canceled", err)
+			}
+		})
+	}
+}
+
+func TestGRPCWebReflection(t *testing.T) {
+	webAddr, _ := startGRPCWebBackend(t)
+	for _, transport := range []string{transportGRPCWeb, transportGRPCWebText} {
+		t.Run(transport, func(t *testing.T) {
+			conn := newTestHTTPConn(t, webAddr, transport)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Each request is answered before the stream is half-closed.
+			if err := stream.Send(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{}}); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := stream.Recv()
+			if err != nil {
+				t.Fatalf("ListServices: %v", err)
+			}
+			var names []string
+			for _, s := range resp.GetListServicesResponse().GetService() {
+				names = append(names, s.Name)
+			}
+			if !strings.Contains(strings.Join(names, ","), "grpc.health.v1.Health") {
+				t.Errorf("services = %v, want grpc.health.v1.Health", names)
+			}
+			if err := stream.Send(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "grpc.health.v1.Health"}}); err != nil {
+				t.Fatal(err)
+			}
+			resp, err = stream.Recv()
+			if err != nil || len(resp.GetFileDescriptorResponse().GetFileDescriptorProto()) == 0 {
+				t.Fatalf("FileContainingSymbol = %v, %v, want a descriptor", resp, err)
+			}
+			if err := stream.CloseSend(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := stream.Recv(); err != io.EOF {
+				t.Errorf("Recv after CloseSend = %v, want io.EOF", err)
+			}
+
+			srv := newServer(Config{BackendAddr: webAddr, Transport: transport})
+			defer srv.conns.closeAll()
+			c, target, err := srv.backend("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			snap, err := srv.schema(ctx, c, target, true)
+			if err != nil {
+				t.Fatalf("schema: %v", err)
+			}
+			if _, ok := snap.Services["grpc.health.v1.Health"]; !ok {
+				t.Errorf("schema services = %v, want grpc.health.v1.Health", snap.Services)
+			}
+		})
+	}
+}
+
+// writeEnvelope writes one gRPC-Web or Connect frame.
+func writeEnvelope(t *testing.T, w io.Writer, flags byte, data string) {
+	t.Helper()
+	if err := writeConnectEnvelope(w, flags, []byte(data)); err != nil {
+		t.Error(err)
+	}
+}
+
+func marshalHealth(t *testing.T, st healthpb.HealthCheckResponse_ServingStatus) string {
+	t.Helper()
+	data, err := proto.Marshal(&healthpb.HealthCheckResponse{Status: st})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGRPCWebTrailersOnly(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc-web+proto")
+		w.Header().Set("Grpc-Status", "5")
+		w.Header().Set("Grpc-Message", "no%20such%20service")
+		w.Header().Set("X-Trail", "t1")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	conn := newTestHTTPConn(t, hostPort(ts.URL), transportGRPCWeb)
+	var header, trailer metadata.MD
+	_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{}, grpc.Header(&header), grpc.Trailer(&trailer))
+	if st := status.Convert(err); st.Code() != codes.NotFound || st.Message() != "no such service" {
+		t.Errorf("Check() = %v, want NotFound with the decoded message", err)
+	}
+	if got := trailer.Get("x-trail"); len(got) != 1 || got[0] != "t1" {
+		t.Errorf("trailer = %v, want the trailers-only headers", trailer)
+	}
+	if len(header) != 0 {
+		t.Errorf("header = %v, want none for a trailers-only response", header)
+	}
+}
+
+func TestGRPCWebTextPaddedFrames(t *testing.T) {
+	// Every frame is encoded on its own, so padding appears mid-stream.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc-web-text+proto")
+		for _, frame := range []struct {
+			flags byte
+			data  string
+		}{
+			{0, marshalHealth(t, healthpb.HealthCheckResponse_SERVING)},
+			{0, marshalHealth(t, healthpb.HealthCheckResponse_NOT_SERVING)},
+			{grpcWebFlagTrailer, "grpc-status: 0\r\nx-trail: t1\r\n"},
+		} {
+			var sb strings.Builder
+			writeEnvelope(t, &sb, frame.flags, frame.data)
+			io.WriteString(w, base64.StdEncoding.EncodeToString([]byte(sb.String())))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+	conn := newTestHTTPConn(t, hostPort(ts.URL), transportGRPCWebText)
+	stream, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING} {
+		resp, err := stream.Recv()
+		if err != nil || resp.Status != want {
+			t.Fatalf("Recv() = %v, %v, want %v", resp, err, want)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Recv() at the end = %v, want io.EOF", err)
+	}
+	if got := stream.Trailer().Get("x-trail"); len(got) != 1 {
+		t.Errorf("trailer = %v, want x-trail", stream.Trailer())
+	}
+}
+
+func TestBase64QuadReader(t *testing.T) {
+	chunks := []string{"a", "bc", "defg", "", "hijkl"}
+	var encoded strings.Builder
+	var want strings.Builder
+	for _, c := range chunks {
+		encoded.WriteString(base64.StdEncoding.EncodeToString([]byte(c)))
+		encoded.WriteString("\r\n")
+		want.WriteString(c)
+	}
+	got, err := io.ReadAll(&base64QuadReader{r: bufio.NewReader(strings.NewReader(encoded.String()))})
+	if err != nil || string(got) != want.String() {
+		t.Errorf("decoded %q, %v, want %q", got, err, want.String())
+	}
+
+	_, err = io.ReadAll(&base64QuadReader{r: bufio.NewReader(strings.NewReader("YWJj YQ"))})
+	if err == nil {
+		t.Error("decoding invalid base64 succeeded")
+	}
+	_, err = io.ReadAll(&base64QuadReader{r: bufio.NewReader(strings.NewReader("YWJjYQ"))})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("decoding a truncated quad = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestConnectEndStream(t *testing.T) {
+	tests := []struct {
+		name      string
+		endStream string
+		wantCode  codes.Code
+	}{
+		{"ok", `{"metadata":{"x-trail":["t1"]}}`, codes.OK},
+		{"error", `{"error":{"code":"resource_exhausted","message":"quota"},"metadata":{"x-trail":["t1"]}}`, codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/connect+proto")
+				writeEnvelope(t, w, 0, marshalHealth(t, healthpb.HealthCheckResponse_SERVING))
+				writeEnvelope(t, w, connectFlagEndStream, tt.endStream)
+			}))
+			defer ts.Close()
+			conn := newTestHTTPConn(t, hostPort(ts.URL), transportConnect)
+			stream, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp, err := stream.Recv(); err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+				t.Fatalf("Recv() = %v, %v, want SERVING", resp, err)
+			}
+			_, err = stream.Recv()
+			if tt.wantCode == codes.OK && err != io.EOF {
+				t.Errorf("Recv() at the end = %v, want io.EOF", err)
+			}
+			if tt.wantCode != codes.OK && status.Code(err) != tt.wantCode {
+				t.Errorf("Recv() at the end = %v, want %v", err, tt.wantCode)
+			}
+			if got := stream.Trailer().Get("x-trail"); len(got) != 1 || got[0] != "t1" {
+				t.Errorf("trailer = %v, want the end-stream metadata", stream.Trailer())
+			}
+		})
+	}
+
+	// A stream that stops without an end-stream message is broken.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/connect+proto")
+		writeEnvelope(t, w, 0, marshalHealth(t, healthpb.HealthCheckResponse_SERVING))
+	}))
+	defer ts.Close()
+	stream, err := healthpb.NewHealthClient(newTestHTTPConn(t, hostPort(ts.URL), transportConnect)).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Recv()
+	if _, err := stream.Recv(); status.Code(err) != codes.Internal {
+		t.Errorf("Recv() of a truncated stream = %v, want Internal", err)
+	}
+}
+
+func TestConnectPairedReflectionExchanges(t *testing.T) {
+	// Each reflection request must arrive as a request of its own, answered
+	// with one message and an end-stream message.
+	var requests atomic.Int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		flags, data, err := readEnvelope(r.Body)
+		if err != nil || flags != 0 {
+			t.Errorf("request %d: %v", n, err)
+		}
+		if _, _, err := readEnvelope(r.Body); err != io.EOF {
+			t.Errorf("request %d carries more than one message", n)
+		}
+		req := &reflectionpb.ServerReflectionRequest{}
+		if err := proto.Unmarshal(data, req); err != nil {
+			t.Error(err)
+		}
+		resp, _ := proto.Marshal(&reflectionpb.ServerReflectionResponse{OriginalRequest: req})
+		w.Header().Set("Content-Type", "application/connect+proto")
+		writeEnvelope(t, w, 0, string(resp))
+		writeEnvelope(t, w, connectFlagEndStream, "{}")
+	}))
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+
+	conn := newTestHTTPConn(t, hostPort(ts.URL), transportConnect)
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range []string{"a.A", "b.B"} {
+		if err := stream.Send(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol}}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := stream.Recv()
+		if err != nil || resp.GetOriginalRequest().GetFileContainingSymbol() != symbol {
+			t.Fatalf("Recv() = %v, %v, want the answer to %s", resp, err, symbol)
+		}
+	}
+	stream.CloseSend()
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Recv() after CloseSend = %v, want io.EOF", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("requests = %d, want 2", n)
+	}
+}
+
+func TestHTTPTransportUnavailable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream down", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	for _, transport := range []string{transportGRPCWeb, transportConnect} {
+		conn := newTestHTTPConn(t, hostPort(ts.URL), transport)
+		_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("%s: Check() against a 503 = %v, want Unavailable", transport, err)
+		}
+		if kind := classifyError(err, true); kind != errKindApplication {
+			t.Errorf("%s: kind = %s, want %s for an answered call", transport, kind, errKindApplication)
+		}
+	}
+
+	conn := newTestHTTPConn(t, closedAddr(t), transportGRPCWeb)
+	_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if kind := classifyError(err, false); kind != errKindTransport {
+		t.Errorf("Check() against a closed port = %v (%s), want %s", err, kind, errKindTransport)
+	}
+	if conn.GetState() != connectivity.TransientFailure {
+		t.Errorf("state = %v, want TRANSIENT_FAILURE", conn.GetState())
+	}
+	conn.Close()
+	if _, err := conn.NewStream(context.Background(), &grpc.StreamDesc{}, "/grpc.health.v1.Health/Check"); status.Code(err) != codes.Canceled {
+		t.Errorf("NewStream after Close = %v, want Canceled", err)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VariableSets is the persisted form of the variable store and the body of
+// GET /variables.
+type VariableSets struct {
+	Active string                       `json:"active,omitempty"` // set used when a request names none
+	Sets   map[string]map[string]string `json:"sets"`
+}
+
+// variableStore keeps named variable sets (dev, staging, local, ...) used to
+// fill {{var}} placeholders. If path is set, every change is saved there.
+type variableStore struct {
+	mu   sync.RWMutex
+	path string
+	data VariableSets
+}
+
+func newVariableStore(path string) *variableStore {
+	vs := &variableStore{path: path, data: VariableSets{Sets: map[string]map[string]string{}}}
+	if path == "" {
+		return vs
+	}
+	raw, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		log.Printf("WARNING: could not read variables from %s: %v", path, err)
+	default:
+		if err := json.Unmarshal(raw, &vs.data); err != nil {
+			log.Printf("WARNING: ignoring invalid variables file %s: %v", path, err)
+		}
+		if vs.data.Sets == nil {
+			vs.data.Sets = map[string]map[string]string{}
+		}
+	}
+	return vs
+}
+
+func (vs *variableStore) list() VariableSets {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	out := VariableSets{Active: vs.data.Active, Sets: make(map[string]map[string]string, len(vs.data.Sets))}
+	for name, vars := range vs.data.Sets {
+		out.Sets[name] = copyVars(vars)
+	}
+	return out
+}
+
+func (vs *variableStore) get(name string) (map[string]string, bool) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	vars, ok := vs.data.Sets[name]
+	return copyVars(vars), ok
+}
+
+func (vs *variableStore) put(name string, vars map[string]string) error {
+	if name == "" || strings.ContainsAny(name, "/ ") {
+		return fmt.Errorf("invalid variable set name %q", name)
+	}
+	for key := range vars {
+		if !variableName.MatchString(key) {
+			return fmt.Errorf("invalid variable name %q: use letters, digits, '_', '-' and '.'", key)
+		}
+	}
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.data.Sets[name] = copyVars(vars)
+	return vs.save()
+}
+
+func (vs *variableStore) remove(name string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if _, ok := vs.data.Sets[name]; !ok {
+		return fmt.Errorf("variable set %q not found", name)
+	}
+	delete(vs.data.Sets, name)
+	if vs.data.Active == name {
+		vs.data.Active = ""
+	}
+	return vs.save()
+}
+
+func (vs *variableStore) setActive(name string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if _, ok := vs.data.Sets[name]; name != "" && !ok {
+		return fmt.Errorf("variable set %q not found", name)
+	}
+	vs.data.Active = name
+	return vs.save()
+}
+
+// save writes the store to disk. Callers hold mu.
+func (vs *variableStore) save() error {
+	if vs.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(vs.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(vs.path), 0o755); err != nil {
+		return err
+	}
+	// Variables often hold credentials, so the file is private to the user.
+	return writeFileAtomic(vs.path, data, 0o600)
+}
+
+// scope returns the variables of the named set (the active set if env is
+// empty) with overrides applied on top.
+func (vs *variableStore) scope(env string, overrides map[string]string) (templateScope, error) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	if env == "" {
+		env = vs.data.Active
+	}
+	sc := templateScope{env: env, vars: map[string]string{}}
+	if env != "" {
+		vars, ok := vs.data.Sets[env]
+		if !ok {
+			return sc, fmt.Errorf("variable set %q not found", env)
+		}
+		for k, v := range vars {
+			sc.vars[k] = v
+		}
+	}
+	for k, v := range overrides {
+		sc.vars[k] = v
+	}
+	return sc, nil
+}
+
+func copyVars(vars map[string]string) map[string]string {
+	if vars == nil {
+		return nil
+	}
+	out := make(map[string]string, len(vars))
+	for k, v := range vars {
+		out[k] = v
+	}
+	return out
+}
+
+// variablesFile resolves GRPS_VARIABLES_FILE: empty selects the user config
+// directory and "off" keeps variables in memory only.
+func variablesFile(val string) string {
+	switch val {
+	case "off":
+		return ""
+	case "":
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return ""
+		}
+		return filepath.Join(dir, "servicelens", "variables.json")
+	}
+	return val
+}
+
+var (
+	placeholder  = regexp.MustCompile(`\{\{\s*(.*?)\s*\}\}`)
+	variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+)
+
+// templateScope expands {{...}} placeholders. A placeholder is either a
+// variable name or a built-in function with arguments; arguments are quoted
+// strings, numbers or variable names. Function names take precedence over
+// variables of the same name.
+type templateScope struct {
+	env  string
+	vars map[string]string
+}
+
+// templateFuncs are the built-in template functions.
+var templateFuncs = map[string]func(args []string) (string, error){
+	"uuid": func(args []string) (string, error) {
+		if len(args) != 0 {
+			return "", errors.New("uuid takes no arguments")
+		}
+		return newUUID(), nil
+	},
+	"now": func(args []string) (string, error) {
+		now := time.Now().UTC()
+		if len(args) == 0 {
+			return now.Format(time.RFC3339), nil
+		}
+		switch args[0] {
+		case "unix":
+			return strconv.FormatInt(now.Unix(), 10), nil
+		case "unixMs":
+			return strconv.FormatInt(now.UnixMilli(), 10), nil
+		}
+		return now.Format(args[0]), nil
+	},
+	"randomInt": func(args []string) (string, error) {
+		if len(args) != 2 {
+			return "", errors.New("randomInt takes a minimum and a maximum")
+		}
+		lo, err1 := strconv.ParseInt(args[0], 10, 64)
+		hi, err2 := strconv.ParseInt(args[1], 10, 64)
+		if err1 != nil || err2 != nil || hi < lo {
+			return "", fmt.Errorf("randomInt: invalid range %s..%s", args[0], args[1])
+		}
+		// hi-lo+1 overflows int64 for wide ranges, so count in big.Int.
+		span := new(big.Int).Sub(big.NewInt(hi), big.NewInt(lo))
+		n, err := rand.Int(rand.Reader, span.Add(span, big.NewInt(1)))
+		if err != nil {
+			return "", err
+		}
+		return n.Add(n, big.NewInt(lo)).String(), nil
+	},
+	"base64": func(args []string) (string, error) {
+		return base64.StdEncoding.EncodeToString([]byte(strings.Join(args, ""))), nil
+	},
+}
+
+// expand replaces every placeholder in s. It reports whether s had any.
+func (sc templateScope) expand(s string) (string, bool, error) {
+	if !strings.Contains(s, "{{") {
+		return s, false, nil
+	}
+	var firstErr error
+	out := placeholder.ReplaceAllStringFunc(s, func(m string) string {
+		val, err := sc.eval(placeholder.FindStringSubmatch(m)[1])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return val
+	})
+	if firstErr != nil {
+		return s, true, withKind(errKindPayload, firstErr)
+	}
+	return out, placeholder.MatchString(s), nil
+}
+
+func (sc templateScope) eval(expr string) (string, error) {
+	tokens, err := splitTemplateArgs(expr)
+	if err != nil {
+		return "", fmt.Errorf("{{%s}}: %w", expr, err)
+	}
+	if len(tokens) == 0 {
+		return "", errors.New("empty placeholder {{}}")
+	}
+	if fn, ok := templateFuncs[tokens[0]]; ok {
+		args := make([]string, 0, len(tokens)-1)
+		for _, tok := range tokens[1:] {
+			arg, err := sc.arg(tok)
+			if err != nil {
+				return "", fmt.Errorf("{{%s}}: %w", expr, err)
+			}
+			args = append(args, arg)
+		}
+		val, err := fn(args)
+		if err != nil {
+			return "", fmt.Errorf("{{%s}}: %w", expr, err)
+		}
+		return val, nil
+	}
+	if len(tokens) > 1 {
+		return "", fmt.Errorf("{{%s}}: unknown function %q", expr, tokens[0])
+	}
+	val, ok := sc.vars[tokens[0]]
+	if !ok {
+		return "", sc.undefined(tokens[0])
+	}
+	return val, nil
+}
+
+func (sc templateScope) arg(tok string) (string, error) {
+	if strings.HasPrefix(tok, `"`) {
+		return strconv.Unquote(tok)
+	}
+	if _, err := strconv.ParseFloat(tok, 64); err == nil {
+		return tok, nil
+	}
+	if val, ok := sc.vars[tok]; ok {
+		return val, nil
+	}
+	return "", sc.undefined(tok)
+}
+
+func (sc templateScope) undefined(name string) error {
+	if sc.env == "" {
+		return fmt.Errorf("undefined variable %q (no variable set is active)", name)
+	}
+	return fmt.Errorf("undefined variable %q in variable set %q", name, sc.env)
+}
+
+// splitTemplateArgs splits a placeholder on spaces, keeping quoted strings whole.
+func splitTemplateArgs(expr string) ([]string, error) {
+	var tokens []string
+	for expr = strings.TrimSpace(expr); expr != ""; expr = strings.TrimSpace(expr) {
+		if expr[0] == '"' {
+			end := 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, expr[:end+1])
+			expr = expr[end+1:]
+			continue
+		}
+		end := strings.IndexAny(expr, " \t")
+		if end < 0 {
+			end = len(expr)
+		}
+		tokens = append(tokens, expr[:end])
+		expr = expr[end:]
+	}
+	return tokens, nil
+}
+
+// expandValue expands the placeholders in every string of a decoded JSON value.
+func (sc templateScope) expandValue(v any) (any, bool, error) {
+	switch val := v.(type) {
+	case string:
+		return sc.expand(val)
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		changed := false
+		for k, item := range val {
+			x, ch, err := sc.expandValue(item)
+			if err != nil {
+				return nil, false, err
+			}
+			out[k], changed = x, changed || ch
+		}
+		return out, changed, nil
+	case []any:
+		out := make([]any, len(val))
+		changed := false
+		for i, item := range val {
+			x, ch, err := sc.expandValue(item)
+			if err != nil {
+				return nil, false, err
+			}
+			out[i], changed = x, changed || ch
+		}
+		return out, changed, nil
+	}
+	return v, false, nil
+}
+
+// resolveRequest expands the placeholders in the payload and metadata of an
+// invoke request. If any were found, it also returns what was sent, for the
+// response meta.
+func (s *Server) resolveRequest(in InvokeRequest) (InvokeRequest, map[string]any, error) {
+	sc, err := s.variables.scope(in.Env, in.Variables)
+	if err != nil {
+		return in, nil, withKind(errKindPayload, err)
+	}
+	payload, changed, err := sc.expandValue(map[string]any(in.Payload))
+	if err != nil {
+		return in, nil, err
+	}
+	if in.Payload != nil {
+		in.Payload = payload.(map[string]any)
+	}
+	if len(in.Metadata) > 0 {
+		md := make(map[string]string, len(in.Metadata))
+		for k, v := range in.Metadata {
+			val, ch, err := sc.expand(v)
+			if err != nil {
+				return in, nil, err
+			}
+			md[k], changed = val, changed || ch
+		}
+		in.Metadata = md
+	}
+	if !changed {
+		return in, nil, nil
+	}
+	resolved := map[string]any{"payload": in.Payload}
+	if len(in.Metadata) > 0 {
+		resolved["metadata"] = in.Metadata
+	}
+	if sc.env != "" {
+		resolved["env"] = sc.env
+	}
+	return in, resolved, nil
+}
+
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// variablesHandler serves GET (all sets) and PUT {"active": name} on /variables.
+func (s *Server) variablesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.variables.list())
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			Active *string `json:"active"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Active == nil {
+			http.Error(w, "active is required", http.StatusBadRequest)
+			return
+		}
+		if err := s.variables.setActive(strings.TrimSpace(*body.Active)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.variables.list())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// variableSetHandler serves GET, PUT (replace) and DELETE on /variables/{set}.
+func (s *Server) variableSetHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/variables/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		vars, ok := s.variables.get(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("variable set %q not found", name), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, vars)
+	case http.MethodPut, http.MethodPost:
+		var vars map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&vars); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.variables.put(name, vars); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, vars)
+	case http.MethodDelete:
+		if err := s.variables.remove(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRandomIntRange(t *testing.T) {
+	tests := []struct{ lo, hi string }{
+		{"0", "9223372036854775807"},
+		{"-9223372036854775808", "9223372036854775807"},
+		{"-9223372036854775808", "-9223372036854775808"},
+		{"-5", "5"},
+		{"7", "7"},
+	}
+	for _, tt := range tests {
+		lo, _ := strconv.ParseInt(tt.lo, 10, 64)
+		hi, _ := strconv.ParseInt(tt.hi, 10, 64)
+		for range 100 {
+			out, err := templateFuncs["randomInt"]([]string{tt.lo, tt.hi})
+			if err != nil {
+				t.Fatalf("randomInt %s %s: %v", tt.lo, tt.hi, err)
+			}
+			n, err := strconv.ParseInt(out, 10, 64)
+			if err != nil || n < lo || n > hi {
+				t.Fatalf("randomInt %s %s = %s, want a value in range", tt.lo, tt.hi, out)
+			}
+		}
+	}
+	if _, err := templateFuncs["randomInt"]([]string{"5", "1"}); err == nil {
+		t.Error("randomInt 5 1 succeeded, want an invalid range error")
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// correlationHeader carries a workflow's correlation ID to the backend.
+const correlationHeader = "x-correlation-id"
+
+// Workflow is an ordered list of unary calls. Values extracted from a step's
+// response become variables for the {{name}} placeholders of later steps.
+type Workflow struct {
+	Name            string            `json:"name,omitempty"`
+	Target          string            `json:"target,omitempty"`    // default target of the steps
+	Env             string            `json:"env,omitempty"`       // variable set; the active set if empty
+	Variables       map[string]string `json:"variables,omitempty"` // initial values, overriding the variable set
+	ContinueOnError bool              `json:"continueOnError,omitempty"`
+	Steps           []WorkflowStep    `json:"steps"`
+}
+
+// WorkflowStep is one call of a workflow. Extract maps variable names to
+// paths into the response: "$.user.id", "$.items[0].name", or
+// "$headers.<name>" and "$trailers.<name>" for response metadata.
+type WorkflowStep struct {
+	Name       string            `json:"name,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	FullMethod string            `json:"fullMethod"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Payload    map[string]any    `json:"payload,omitempty"`
+	TimeoutMs  int64             `json:"timeoutMs,omitempty"`
+	Extract    map[string]string `json:"extract,omitempty"`
+}
+
+// WorkflowResult is the response of POST /workflows/run.
+type WorkflowResult struct {
+	Name          string               `json:"name,omitempty"`
+	CorrelationID string               `json:"correlationId"`
+	OK            bool                 `json:"ok"`
+	StartedAt     time.Time            `json:"startedAt"`
+	DurationMs    float64              `json:"durationMs"`
+	Steps         []WorkflowStepResult `json:"steps"`
+	Variables     map[string]string    `json:"variables,omitempty"` // every value extracted by the steps
+}
+
+// WorkflowStepResult is the outcome of one step.
+type WorkflowStepResult struct {
+	Index      int               `json:"index"`
+	Name       string            `json:"name,omitempty"`
+	FullMethod string            `json:"fullMethod"`
+	Status     string            `json:"status"` // ok, failed or skipped
+	DurationMs float64           `json:"durationMs"`
+	Extracted  map[string]string `json:"extracted,omitempty"`
+	InvokeResponse
+}
+
+const (
+	stepOK      = "ok"
+	stepFailed  = "failed"
+	stepSkipped = "skipped"
+)
+
+// workflowsRunHandler runs a workflow posted as JSON.
+func (s *Server) workflowsRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var wf Workflow
+	if err := json.NewDecoder(r.Body).Decode(&wf); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wf.Target == "" {
+		wf.Target = targetParam(r)
+	}
+	if err := validateWorkflow(wf); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.runWorkflow(r.Context(), wf))
+}
+
+func validateWorkflow(wf Workflow) error {
+	if len(wf.Steps) == 0 {
+		return errors.New("a workflow needs at least one step")
+	}
+	for i, step := range wf.Steps {
+		if step.FullMethod == "" {
+			return fmt.Errorf("step %d: fullMethod is required", i)
+		}
+		if step.TimeoutMs < 0 {
+			return fmt.Errorf("step %d: timeoutMs must not be negative", i)
+		}
+		for name, path := range step.Extract {
+			if !variableName.MatchString(name) {
+				return fmt.Errorf("step %d: invalid variable name %q", i, name)
+			}
+			if _, err := parseResponsePath(path); err != nil {
+				return fmt.Errorf("step %d: extract %s: %w", i, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// runWorkflow runs the steps in order. After a failed step the remaining
+// steps are skipped unless ContinueOnError is set. Every call is recorded in
+// the traffic buffer under the workflow's correlation ID.
+func (s *Server) runWorkflow(ctx context.Context, wf Workflow) WorkflowResult {
+	res := WorkflowResult{
+		Name:          wf.Name,
+		CorrelationID: newCallID(),
+		OK:            true,
+		StartedAt:     time.Now().UTC(),
+		Steps:         make([]WorkflowStepResult, 0, len(wf.Steps)),
+	}
+	vars := copyVars(wf.Variables)
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	extracted := map[string]string{}
+
+	for i, step := range wf.Steps {
+		sr := WorkflowStepResult{Index: i, Name: step.Name, FullMethod: normalizeFullMethod(step.FullMethod)}
+		if !res.OK && !wf.ContinueOnError {
+			sr.Status = stepSkipped
+			res.Steps = append(res.Steps, sr)
+			continue
+		}
+		start := time.Now()
+		s.runWorkflowStep(ctx, wf, step, vars, res.CorrelationID, &sr)
+		sr.DurationMs = durationMs(time.Since(start))
+		for name, val := range sr.Extracted {
+			vars[name] = val
+			extracted[name] = val
+		}
+		if sr.Status == stepFailed {
+			res.OK = false
+		}
+		res.Steps = append(res.Steps, sr)
+	}
+	res.DurationMs = durationMs(time.Since(res.StartedAt))
+	if len(extracted) > 0 {
+		res.Variables = extracted
+	}
+	return res
+}
+
+func (s *Server) runWorkflowStep(ctx context.Context, wf Workflow, step WorkflowStep, vars map[string]string, correlationID string, sr *WorkflowStepResult) {
+	sr.Status = stepFailed
+	target := step.Target
+	if target == "" {
+		target = wf.Target
+	}
+	md := copyVars(step.Metadata)
+	if md == nil {
+		md = map[string]string{}
+	}
+	if _, ok := md[correlationHeader]; !ok {
+		md[correlationHeader] = correlationID
+	}
+	in := InvokeRequest{
+		Target:        target,
+		FullMethod:    step.FullMethod,
+		Metadata:      md,
+		Payload:       step.Payload,
+		TimeoutMs:     step.TimeoutMs,
+		Env:           wf.Env,
+		Variables:     vars,
+		CorrelationID: correlationID,
+	}
+
+	conn, t, err := s.backend(target)
+	if err != nil {
+		sr.Error, _ = newInvokeError(ctx, err, t, nil, false)
+		return
+	}
+	resp, _, _, err := s.invokeCall(ctx, conn, t, in, "workflow")
+	if err != nil {
+		sr.Error = &InvokeError{Kind: errKindPayload, Message: err.Error(), Code: codes.AlreadyExists.String()}
+		return
+	}
+	sr.InvokeResponse = resp
+	if resp.Error != nil {
+		return
+	}
+
+	for name, path := range step.Extract {
+		val, err := extractValue(resp, path)
+		if err != nil {
+			sr.Error = &InvokeError{Kind: errKindPayload, Message: fmt.Sprintf("extract %s: %v", name, err), Code: codes.FailedPrecondition.String()}
+			return
+		}
+		if sr.Extracted == nil {
+			sr.Extracted = map[string]string{}
+		}
+		sr.Extracted[name] = val
+	}
+	sr.Status = stepOK
+}
+
+// extractValue evaluates a path against a step's response. Strings are used
+// as they are; other values are encoded as JSON.
+func extractValue(resp InvokeResponse, path string) (string, error) {
+	for _, prefix := range []string{"$headers.", "$trailers."} {
+		if key, ok := strings.CutPrefix(path, prefix); ok {
+			md := resp.Headers
+			if prefix == "$trailers." {
+				md = resp.Trailers
+			}
+			vals := md[strings.ToLower(key)]
+			if len(vals) == 0 {
+				return "", fmt.Errorf("%s not found", path)
+			}
+			return vals[0], nil
+		}
+	}
+	steps, err := parseResponsePath(path)
+	if err != nil {
+		return "", err
+	}
+	var cur any = resp.Response
+	for _, seg := range steps {
+		switch node := cur.(type) {
+		case map[string]any:
+			if seg.isIndex {
+				return "", fmt.Errorf("%s: cannot index an object with [%d]", path, seg.index)
+			}
+			val, ok := node[seg.key]
+			if !ok {
+				return "", fmt.Errorf("%s: field %q not found", path, seg.key)
+			}
+			cur = val
+		case []any:
+			if !seg.isIndex {
+				return "", fmt.Errorf("%s: cannot read field %q of a list", path, seg.key)
+			}
+			i := seg.index
+			if i < 0 {
+				i += len(node)
+			}
+			if i < 0 || i >= len(node) {
+				return "", fmt.Errorf("%s: index %d out of range (length %d)", path, seg.index, len(node))
+			}
+			cur = node[i]
+		default:
+			return "", fmt.Errorf("%s: %v has no fields", path, cur)
+		}
+	}
+	if str, ok := cur.(string); ok {
+		return str, nil
+	}
+	b, err := json.Marshal(cur)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type pathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parseResponsePath parses the JSONPath subset used by Extract: "$" followed
+// by .field, ['field'] or ["field"], and [index] (negative counts from the end).
+func parseResponsePath(path string) ([]pathSegment, error) {
+	if strings.HasPrefix(path, "$headers.") || strings.HasPrefix(path, "$trailers.") {
+		return nil, nil
+	}
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, fmt.Errorf("path %q must start with $", path)
+	}
+	var segs []pathSegment
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("path %q has an empty field name", path)
+			}
+			segs = append(segs, pathSegment{key: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unclosed [", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				segs = append(segs, pathSegment{key: inner[1 : len(inner)-1]})
+				continue
+			}
+			i, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("path %q: [%s] is not an index or a quoted field", path, inner)
+			}
+			segs = append(segs, pathSegment{index: i, isIndex: true})
+		default:
+			return nil, fmt.Errorf("path %q: unexpected %q", path, rest[0])
+		}
+	}
+	return segs, nil
+}
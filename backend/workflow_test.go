@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtractValue(t *testing.T) {
+	resp := InvokeResponse{
+		Response: map[string]any{
+			"user": map[string]any{"id": "u-1", "age": float64(42), "tags": []any{"a", "b", "c"}},
+			"items": []any{
+				map[string]any{"name": "first", "price": map[string]any{"units": "10"}},
+				map[string]any{"name": "second"},
+			},
+			"empty":     []any{},
+			"odd.key":   "dotted",
+			"flag":      true,
+			"nothing":   nil,
+			"nested":    []any{[]any{"x", "y"}},
+			"countries": map[string]any{"de": "Germany"},
+		},
+		Headers:  map[string][]string{"x-request-id": {"r-1", "r-2"}},
+		Trailers: map[string][]string{"x-trail": {"t1"}},
+	}
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr string
+	}{
+		{path: "$.user.id", want: "u-1"},
+		{path: "$.user.age", want: "42"},
+		{path: "$.user.tags[0]", want: "a"},
+		{path: "$.user.tags[-1]", want: "c"},
+		{path: "$.user.tags", want: `["a","b","c"]`},
+		{path: "$.items[0].name", want: "first"},
+		{path: "$.items[0].price.units", want: "10"},
+		{path: "$.items[1]", want: `{"name":"second"}`},
+		{path: "$.nested[0][1]", want: "y"},
+		{path: "$['odd.key']", want: "dotted"},
+		{path: `$["countries"].de`, want: "Germany"},
+		{path: "$.flag", want: "true"},
+		{path: "$.nothing", want: "null"},
+		{path: "$headers.x-request-id", want: "r-1"},
+		{path: "$headers.X-Request-Id", want: "r-1"},
+		{path: "$trailers.x-trail", want: "t1"},
+
+		{path: "$.user.tags[3]", wantErr: "index 3 out of range (length 3)"},
+		{path: "$.user.tags[-4]", wantErr: "index -4 out of range (length 3)"},
+		{path: "$.empty[0]", wantErr: "index 0 out of range (length 0)"},
+		{path: "$.user.email", wantErr: `field "email" not found`},
+		{path: "$.missing.id", wantErr: `field "missing" not found`},
+		{path: "$.user[0]", wantErr: "cannot index an object with [0]"},
+		{path: "$.items.name", wantErr: `cannot read field "name" of a list`},
+		{path: "$.user.id.value", wantErr: "has no fields"},
+		{path: "$.nothing.value", wantErr: "has no fields"},
+		{path: "$headers.x-missing", wantErr: "$headers.x-missing not found"},
+		{path: "$trailers.x-request-id", wantErr: "not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := extractValue(resp, tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("extractValue(%q) = %q, %v; want error containing %q", tt.path, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("extractValue(%q) = %q, %v; want %q", tt.path, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseResponsePathErrors(t *testing.T) {
+	for _, path := range []string{"user.id", "", "$.", "$..id", "$.a[", "$.a[x]", "$.a['b]", "$a"} {
+		if segs, err := parseResponsePath(path); err == nil {
+			t.Errorf("parseResponsePath(%q) = %+v, want an error", path, segs)
+		}
+	}
+	if err := validateWorkflow(Workflow{Steps: []WorkflowStep{{FullMethod: "s/M", Extract: map[string]string{"id": "$.a[x]"}}}}); err == nil {
+		t.Errorf("validateWorkflow accepted an invalid extract path")
+	}
+}
+
+func TestRunWorkflowPropagatesVariablesAndCorrelationID(t *testing.T) {
+	addr, _, seen := startProxyBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	t.Cleanup(srv.conns.closeAll)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res := srv.runWorkflow(ctx, Workflow{
+		Name: "chain",
+		Steps: []WorkflowStep{
+			{
+				Name:       "echo",
+				FullMethod: "grpc.health.v1.Health/Check",
+				Metadata:   map[string]string{"x-custom": "svc"},
+				Payload:    map[string]any{"service": "svc"},
+				Extract:    map[string]string{"service": "$headers.x-echo", "first": "$.status", "trail": "$trailers.x-trail"},
+			},
+			{
+				Name:       "use",
+				FullMethod: "grpc.health.v1.Health/Check",
+				Metadata:   map[string]string{"x-custom": "{{trail}}"},
+				Payload:    map[string]any{"service": "{{service}}"},
+				Extract:    map[string]string{"second": "$.status"},
+			},
+			{
+				Name:       "own-id",
+				FullMethod: "grpc.health.v1.Health/Check",
+				Metadata:   map[string]string{correlationHeader: "mine"},
+				Payload:    map[string]any{"service": "svc"},
+			},
+		},
+	})
+	if !res.OK || len(res.Steps) != 3 {
+		t.Fatalf("workflow = %+v, want three ok steps", res)
+	}
+	for _, sr := range res.Steps {
+		if sr.Status != stepOK {
+			t.Fatalf("step %s = %s %+v", sr.Name, sr.Status, sr.Error)
+		}
+	}
+	want := map[string]string{"service": "svc", "first": "SERVING", "trail": "t1", "second": "SERVING"}
+	for name, val := range want {
+		if res.Variables[name] != val {
+			t.Errorf("variable %s = %q, want %q", name, res.Variables[name], val)
+		}
+	}
+
+	if res.CorrelationID == "" {
+		t.Fatal("no correlation ID")
+	}
+	wantIDs := []string{res.CorrelationID, res.CorrelationID, "mine"}
+	for i, want := range wantIDs {
+		md := <-seen
+		if got := md.Get(correlationHeader); len(got) != 1 || got[0] != want {
+			t.Errorf("step %d sent %s %v, want [%s]", i, correlationHeader, got, want)
+		}
+		if i == 1 {
+			if got := md.Get("x-custom"); len(got) != 1 || got[0] != "t1" {
+				t.Errorf("step 1 sent x-custom %v, want the extracted trailer", got)
+			}
+		}
+	}
+	n := 0
+	for _, e := range srv.traffic.snapshot() {
+		if e.CorrelationID == res.CorrelationID {
+			n++
+		}
+	}
+	if n != 3 {
+		t.Errorf("%d traffic entries carry the workflow's correlation ID, want 3", n)
+	}
+}
+
+func TestRunWorkflowExtractFailureSkipsLaterSteps(t *testing.T) {
+	addr, _, _ := startProxyBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	t.Cleanup(srv.conns.closeAll)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	steps := []WorkflowStep{
+		{FullMethod: "grpc.health.v1.Health/Check", Payload: map[string]any{"service": "svc"}, Extract: map[string]string{"id": "$.items[0]"}},
+		{FullMethod: "grpc.health.v1.Health/Check", Payload: map[string]any{"service": "svc"}},
+	}
+	res := srv.runWorkflow(ctx, Workflow{Steps: steps})
+	if res.OK || res.Steps[0].Status != stepFailed || res.Steps[1].Status != stepSkipped {
+		t.Fatalf("workflow = ok %v, steps %s %s; want failed then skipped", res.OK, res.Steps[0].Status, res.Steps[1].Status)
+	}
+	if e := res.Steps[0].Error; e == nil || e.Kind != errKindPayload || !strings.Contains(e.Message, `extract id: $.items[0]: field "items" not found`) {
+		t.Errorf("step 0 error = %+v, want the failed extraction", e)
+	}
+
+	res = srv.runWorkflow(ctx, Workflow{Steps: steps, ContinueOnError: true})
+	if res.OK || res.Steps[1].Status != stepOK {
+		t.Errorf("workflow with continueOnError = ok %v, step 1 %s; want not ok and step 1 run", res.OK, res.Steps[1].Status)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// Frame types exchanged on /invoke/ws.
+const (
+	wsStart     = "start"     // client: opens the call
+	wsCall      = "call"      // server: the call was registered under CallID
+	wsMessage   = "message"   // both: a request or response message
+	wsHalfClose = "halfClose" // client: no more request messages
+	wsCancel    = "cancel"    // client: cancels the call
+	wsHeaders   = "headers"   // server: response headers
+	wsTrailers  = "trailers"  // server: response trailers
+	wsStatus    = "status"    // server: final status, sent before closing
+	wsError     = "error"     // server: a frame could not be handled
+)
+
+// wsFrame is a single JSON frame on /invoke/ws. Which fields are set depends
+// on Type.
+type wsFrame struct {
+	Type string `json:"type"`
+
+	// start
+	Target     string            `json:"target,omitempty"`
+	FullMethod string            `json:"fullMethod,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	TimeoutMs  int64             `json:"timeoutMs,omitempty"`
+	CallID     string            `json:"callId,omitempty"`    // also set on the server's "call" frame
+	Env        string            `json:"env,omitempty"`       // variable set for {{var}} placeholders; the active set if empty
+	Variables  map[string]string `json:"variables,omitempty"` // values that override the variable set
+	// CorrelationID groups related calls in the traffic buffer.
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// message
+	Payload   map[string]any `json:"payload,omitempty"`
+	Index     *int           `json:"index,omitempty"`
+	ElapsedMs *float64       `json:"elapsedMs,omitempty"`
+
+	// headers and trailers
+	Headers  map[string][]string `json:"headers,omitempty"`
+	Trailers map[string][]string `json:"trailers,omitempty"`
+
+	// status and error
+	Kind    string         `json:"kind,omitempty"` // error class, see InvokeError.Kind
+	Code    string         `json:"code,omitempty"`
+	Message string         `json:"message,omitempty"`
+	Details []ErrorDetail  `json:"details,omitempty"`
+	Meta    map[string]any `json:"meta,omitempty"`
+}
+
+// streamSession records the ordered message log of a streaming call.
+type streamSession struct {
+	mu    sync.Mutex
+	start time.Time
+	log   []StreamLogEntry
+}
+
+func (ss *streamSession) add(direction string, msg any) float64 {
+	elapsed := durationMs(time.Since(ss.start))
+	b, _ := json.Marshal(msg)
+	ss.mu.Lock()
+	ss.log = append(ss.log, StreamLogEntry{Direction: direction, ElapsedMs: elapsed, Message: b})
+	ss.mu.Unlock()
+	return elapsed
+}
+
+func (ss *streamSession) messages() []StreamLogEntry {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return append([]StreamLogEntry(nil), ss.log...)
+}
+
+// invokeWSHandler runs client-streaming and bidirectional calls (and any other
+// method) over a WebSocket. The first frame must be "start"; the client then
+// sends "message" frames, "halfClose" when done and "cancel" to abort. The
+// server sends "headers", "message", "trailers" and a final "status" frame.
+func (s *Server) invokeWSHandler(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && !s.allowOrigin(origin) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	// Origins are checked above against the inspector's own allow list.
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		log.Printf("ERROR: websocket accept: %v", err)
+		return
+	}
+	defer c.Close(websocket.StatusInternalError, "")
+
+	// ctx is used for WebSocket I/O: nhooyr closes the connection when a read's
+	// context is canceled, so it must outlive a cancelled call.
+	ctx := r.Context()
+
+	var start wsFrame
+	if err := wsjson.Read(ctx, c, &start); err != nil {
+		return
+	}
+	if start.Type != wsStart || start.FullMethod == "" {
+		_ = wsjson.Write(ctx, c, wsFrame{Type: wsError, Message: `first frame must be {"type":"start","fullMethod":...}`})
+		c.Close(websocket.StatusPolicyViolation, "expected start frame")
+		return
+	}
+	if start.Target == "" {
+		start.Target = targetParam(r)
+	}
+
+	code, err := s.runWSCall(ctx, c, start)
+	if err != nil {
+		frame := wsFrame{Type: wsError, Message: err.Error()}
+		var ke *kindError
+		if errors.As(err, &ke) {
+			frame.Kind = ke.kind
+		}
+		_ = wsjson.Write(ctx, c, frame)
+		c.Close(websocket.StatusPolicyViolation, "invalid call")
+		return
+	}
+	c.Close(websocket.StatusNormalClosure, code)
+}
+
+// runWSCall resolves and runs the call described by start. The returned error
+// is for problems found before the call is opened; call failures are reported
+// in the status frame and their code is returned.
+func (s *Server) runWSCall(ctx context.Context, c *websocket.Conn, start wsFrame) (string, error) {
+	conn, target, err := s.backend(start.Target)
+	if err != nil {
+		return "", err
+	}
+	fullMethod := normalizeFullMethod(start.FullMethod)
+	methodDesc, snap, err := s.resolveMethod(ctx, conn, target, fullMethod)
+	if err != nil {
+		kind := classifyError(err, false)
+		return "", withKind(kind, errors.New(errorMessage(kind, err, target)))
+	}
+
+	if start.TimeoutMs < 0 {
+		return "", errors.New("timeoutMs must not be negative")
+	}
+	// Placeholders are expanded in the metadata now and in each request
+	// message as it arrives.
+	sc, err := s.variables.scope(start.Env, start.Variables)
+	if err != nil {
+		return "", withKind(errKindPayload, err)
+	}
+	reqMD := make(map[string]string, len(start.Metadata))
+	for k, v := range start.Metadata {
+		if reqMD[k], _, err = sc.expand(v); err != nil {
+			return "", err
+		}
+	}
+	callCtx, call, done, err := s.inflight.start(ctx, start.CallID, target.Name, fullMethod, "websocket", start.TimeoutMs)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	callCtx, cancel := context.WithCancel(callCtx)
+	defer cancel()
+	_ = wsjson.Write(ctx, c, wsFrame{Type: wsCall, CallID: call.ID})
+
+	md := metadata.Join(s.config().DefaultMD, buildOutgoingMetadata(reqMD))
+	if len(md) > 0 {
+		callCtx = metadata.NewOutgoingContext(callCtx, md)
+	}
+
+	session := &streamSession{start: time.Now()}
+	streamDesc := &grpc.StreamDesc{
+		ClientStreams: methodDesc.IsClientStreaming(),
+		ServerStreams: methodDesc.IsServerStreaming(),
+	}
+	var header, trailer metadata.MD
+	stream, err := conn.NewStream(callCtx, streamDesc, fullMethod, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err == nil {
+		go readWSFrames(ctx, cancel, c, stream, methodDesc.GetInputType(), streamDesc.ClientStreams, sc, session)
+		err = forwardResponses(ctx, c, stream, methodDesc.GetOutputType(), session)
+	}
+	duration := time.Since(session.start)
+
+	entry := TrafficEntry{
+		Target:        target.Name,
+		CorrelationID: start.CorrelationID,
+		Service:       parseService(fullMethod),
+		Method:        parseMethod(fullMethod),
+		Metadata:      metadataToMap(md),
+		StartedAt:     session.start,
+		Duration:      duration,
+		Messages:      session.messages(),
+	}
+	st := wsFrame{Type: wsStatus, Code: status.Code(err).String(), Meta: callMeta(call, duration)}
+	if err != nil {
+		invokeErr, _ := newInvokeError(callCtx, err, target, snap, answeredBy(header, trailer))
+		entry.Error = err.Error()
+		entry.ErrorKind = invokeErr.Kind
+		entry.ErrorDetails = invokeErr.Details
+		st.Kind = invokeErr.Kind
+		st.Code = invokeErr.Code
+		st.Message = invokeErr.Message
+		st.Details = invokeErr.Details
+	}
+	s.traffic.add(entry)
+
+	_ = wsjson.Write(ctx, c, st)
+	return st.Code, nil
+}
+
+// readWSFrames forwards the client's frames to the stream until the
+// WebSocket closes, expanding placeholders in each payload with sc. A method
+// that is not client-streaming is half-closed after its single request
+// message.
+func readWSFrames(ctx context.Context, cancel context.CancelFunc, c *websocket.Conn, stream grpc.ClientStream, reqType *desc.MessageDescriptor, clientStreams bool, sc templateScope, session *streamSession) {
+	halfClosed := false
+	for {
+		var frame wsFrame
+		if err := wsjson.Read(ctx, c, &frame); err != nil {
+			// The client went away.
+			cancel()
+			return
+		}
+		switch frame.Type {
+		case wsMessage:
+			if halfClosed {
+				_ = wsjson.Write(ctx, c, wsFrame{Type: wsError, Message: "the request stream is already half-closed"})
+				continue
+			}
+			expanded, _, err := sc.expandValue(map[string]any(frame.Payload))
+			if err != nil {
+				_ = wsjson.Write(ctx, c, wsFrame{Type: wsError, Kind: errKindPayload, Message: err.Error()})
+				continue
+			}
+			payload, _ := expanded.(map[string]any)
+			msg := dynamic.NewMessage(reqType)
+			reqJSON, _ := json.Marshal(payload)
+			if err := msg.UnmarshalJSON(reqJSON); err != nil {
+				_ = wsjson.Write(ctx, c, wsFrame{Type: wsError, Message: fmt.Sprintf("decode payload: %v", err)})
+				continue
+			}
+			session.add("send", payload)
+			// io.EOF means the server already ended the call; RecvMsg reports why.
+			if err := stream.SendMsg(msg); err != nil && !errors.Is(err, io.EOF) {
+				_ = wsjson.Write(ctx, c, wsFrame{Type: wsError, Message: err.Error()})
+			}
+			if !clientStreams {
+				halfClosed = true
+				_ = stream.CloseSend()
+			}
+		case wsHalfClose:
+			if !halfClosed {
+				halfClosed = true
+				_ = stream.CloseSend()
+			}
+		case wsCancel:
+			cancel()
+			return
+		default:
+			_ = wsjson.Write(ctx, c, wsFrame{Type: wsError, Message: fmt.Sprintf("unknown frame type %q", frame.Type)})
+		}
+	}
+}
+
+// forwardResponses sends headers, every response message and trailers to the
+// WebSocket, and returns the final error of the call.
+func forwardResponses(ctx context.Context, c *websocket.Conn, stream grpc.ClientStream, respType *desc.MessageDescriptor, session *streamSession) error {
+	if header, err := stream.Header(); err == nil {
+		_ = wsjson.Write(ctx, c, wsFrame{Type: wsHeaders, Headers: metadataToMap(header)})
+	}
+	var err error
+	for index := 0; ; index++ {
+		resp := dynamic.NewMessage(respType)
+		if err = stream.RecvMsg(resp); err != nil {
+			break
+		}
+		m, convErr := messageToMap(resp)
+		if convErr != nil {
+			err = convErr
+			break
+		}
+		i := index
+		elapsed := session.add("recv", m)
+		_ = wsjson.Write(ctx, c, wsFrame{Type: wsMessage, Payload: m, Index: &i, ElapsedMs: &elapsed})
+	}
+	_ = wsjson.Write(ctx, c, wsFrame{Type: wsTrailers, Trailers: metadataToMap(stream.Trailer())})
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
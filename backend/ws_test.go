@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestInvokeWSVariablesAndCorrelation(t *testing.T) {
+	addr, _, _ := startTestBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	defer srv.conns.closeAll()
+	if err := srv.variables.put("dev", map[string]string{"service": "nope", "team": "core"}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(srv.invokeWSHandler))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	start := wsFrame{
+		Type:          wsStart,
+		FullMethod:    "grpc.health.v1.Health/Check",
+		Metadata:      map[string]string{"x-team": "{{team}}"},
+		Env:           "dev",
+		Variables:     map[string]string{"service": "svc"},
+		CorrelationID: "corr-1",
+	}
+	if err := wsjson.Write(ctx, c, start); err != nil {
+		t.Fatal(err)
+	}
+	if err := wsjson.Write(ctx, c, wsFrame{Type: wsMessage, Payload: map[string]any{"service": "{{service}}"}}); err != nil {
+		t.Fatal(err)
+	}
+	var final wsFrame
+	for final.Type != wsStatus {
+		final = wsFrame{}
+		if err := wsjson.Read(ctx, c, &final); err != nil {
+			t.Fatal(err)
+		}
+		if final.Type == wsError {
+			t.Fatalf("error frame: %s", final.Message)
+		}
+	}
+	if final.Code != "OK" {
+		t.Fatalf("status %s: %s", final.Code, final.Message)
+	}
+
+	entries := srv.traffic.snapshot()
+	if len(entries) != 1 {
+		t.Fatalf("traffic has %d entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.CorrelationID != "corr-1" {
+		t.Errorf("CorrelationID = %q, want %q", e.CorrelationID, "corr-1")
+	}
+	if got := e.Metadata["x-team"]; len(got) != 1 || got[0] != "core" {
+		t.Errorf("x-team metadata = %v, want [core]", got)
+	}
+	var sent map[string]any
+	if len(e.Messages) == 0 || json.Unmarshal(e.Messages[0].Message, &sent) != nil || sent["service"] != "svc" {
+		t.Errorf("first logged message = %v, want the expanded payload", e.Messages)
+	}
+}
+
+func TestInvokeWSUnknownVariableSet(t *testing.T) {
+	addr, _, _ := startTestBackend(t)
+	srv := newServer(Config{BackendAddr: addr})
+	defer srv.conns.closeAll()
+	ts := httptest.NewServer(http.HandlerFunc(srv.invokeWSHandler))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	if err := wsjson.Write(ctx, c, wsFrame{Type: wsStart, FullMethod: "grpc.health.v1.Health/Check", Env: "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	var frame wsFrame
+	if err := wsjson.Read(ctx, c, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != wsError || frame.Kind != errKindPayload {
+		t.Errorf("got %+v, want a payload error frame", frame)
+	}
+}